@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ayjayt/authdoor/authfuncs/apikey"
+)
+
+var file = flag.String("file", "apikeys.json", "key store to edit")
+
+// usage prints the subcommands
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: apikey [-file apikeys.json] mint -owner NAME [-scopes a,b] [-expires 720h]\n")
+	fmt.Fprintf(os.Stderr, "       apikey [-file apikeys.json] revoke ID\n")
+	fmt.Fprintf(os.Stderr, "       apikey [-file apikeys.json] list\n")
+	os.Exit(2)
+}
+
+// fail prints err and exits
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "apikey: %v\n", err)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	store, err := apikey.OpenStore(*file)
+	if err != nil {
+		fail(err)
+	}
+	switch flag.Arg(0) {
+	case "mint":
+		mint(store, flag.Args()[1:])
+	case "revoke":
+		if flag.NArg() != 2 {
+			usage()
+		}
+		if err := store.Revoke(flag.Arg(1)); err != nil {
+			fail(err)
+		}
+		fmt.Printf("revoked %s\n", flag.Arg(1))
+	case "list":
+		for _, key := range store.List() {
+			status := "active"
+			if key.Disabled {
+				status = "disabled"
+			} else if key.Expires != nil && time.Now().After(*key.Expires) {
+				status = "expired"
+			}
+			expires := "never"
+			if key.Expires != nil {
+				expires = key.Expires.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", key.ID, key.Owner, strings.Join(key.Scopes, ","), expires, status)
+		}
+	default:
+		usage()
+	}
+}
+
+// mint parses the mint flags, creates the key and prints it once
+func mint(store *apikey.Store, args []string) {
+	flags := flag.NewFlagSet("mint", flag.ExitOnError)
+	owner := flags.String("owner", "", "who the key is for")
+	scopes := flags.String("scopes", "", "comma separated scopes")
+	expires := flags.Duration("expires", 0, "lifetime of the key, 0 never expires")
+	flags.Parse(args)
+	if *owner == "" {
+		usage()
+	}
+	var scopeList []string
+	if *scopes != "" {
+		scopeList = strings.Split(*scopes, ",")
+	}
+	var expiry *time.Time
+	if *expires != 0 {
+		t := time.Now().Add(*expires).UTC()
+		expiry = &t
+	}
+	key, stored, err := store.Mint(*owner, scopeList, expiry)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "minted %s for %s, the key won't be shown again:\n", stored.ID, stored.Owner)
+	fmt.Println(key)
+}
@@ -0,0 +1,109 @@
+/*
+Package apikey is an AuthFunc for service credentials. Keys are read from a header or query parameter and checked against a Store of salted hashes, which the apikey command mints and revokes.
+*/
+package apikey
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// DefaultHeader is where keys are read from when Config.Header is empty
+const DefaultHeader = "X-API-Key"
+
+// Config describes where keys come from and what they need
+type Config struct {
+	Store *Store
+	// Header is read first, defaults to DefaultHeader. "Authorization: Bearer" is also read if Header is "Authorization".
+	Header string
+	// QueryParam is read if the header is empty. It's off unless set since query strings end up in logs.
+	QueryParam string
+	// Scopes must all be held by the key
+	Scopes []string
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	ID     string   `json:"id"`
+	Owner  string   `json:"owner"`
+	Scopes []string `json:"scopes"`
+}
+
+// APIKey supplies an authfunc receiver and stores information to be used by that receiver
+type APIKey struct {
+	config Config
+	now    func() time.Time
+}
+
+// New returns an APIKey ready to be used as an AuthFunc
+func New(config Config) *APIKey {
+	if config.Header == "" {
+		config.Header = DefaultHeader
+	}
+	return &APIKey{config: config, now: time.Now}
+}
+
+// key finds the key in the request
+func (a *APIKey) key(r *http.Request) string {
+	key := r.Header.Get(a.config.Header)
+	if strings.EqualFold(a.config.Header, "Authorization") {
+		if len(key) < 7 || !strings.EqualFold(key[:7], "Bearer ") {
+			key = ""
+		} else {
+			key = strings.TrimSpace(key[7:])
+		}
+	}
+	if key == "" && a.config.QueryParam != "" {
+		key = r.URL.Query().Get(a.config.QueryParam)
+	}
+	return key
+}
+
+// Check is an authfunc. No key fails quietly so later instances can run, a bad key is denied with a 401 and a key without the scopes with a 403.
+func (a *APIKey) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	key := a.key(r)
+	if key == "" {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	found, err := a.config.Store.Lookup(key, a.now())
+	if err != nil {
+		defaultLogger.Info("API key rejected: " + err.Error())
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	for _, scope := range a.config.Scopes {
+		if !found.HasScope(scope) {
+			defaultLogger.Info("API key " + found.ID + " lacks scope " + scope)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+		}
+	}
+	info, err := json.Marshal(Info{ID: found.ID, Owner: found.Owner, Scopes: found.Scopes})
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: info},
+	}, nil
+}
@@ -0,0 +1,169 @@
+package apikey
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/apikey/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// newTestStore opens a store in a temporary directory
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "apikey")
+	require.NoError(t, err)
+	store, err := OpenStore(filepath.Join(dir, "keys.json"))
+	require.NoError(t, err)
+	return store, func() { os.RemoveAll(dir) }
+}
+
+// TestStore mints, looks up, expires and revokes keys
+func TestStore(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	now := time.Now()
+	key, stored, err := store.Mint("billing", []string{"read"}, nil)
+	require.NoError(t, err)
+	found, err := store.Lookup(key, now)
+	require.NoError(t, err)
+	require.Equal(t, "billing", found.Owner)
+	require.Equal(t, stored.ID, found.ID)
+
+	data, err := ioutil.ReadFile(store.file)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), key[len(KeyPrefix)+len(stored.ID)+1:])
+
+	_, err = store.Lookup(key+"x", now)
+	require.Equal(t, ErrUnknownKey, err)
+	_, err = store.Lookup("nope", now)
+	require.Equal(t, ErrMalformedKey, err)
+
+	expires := now.Add(time.Hour)
+	shortKey, _, err := store.Mint("temp", nil, &expires)
+	require.NoError(t, err)
+	_, err = store.Lookup(shortKey, now)
+	require.NoError(t, err)
+	_, err = store.Lookup(shortKey, now.Add(2*time.Hour))
+	require.Equal(t, ErrExpired, err)
+
+	require.NoError(t, store.Revoke(stored.ID))
+	_, err = store.Lookup(key, now)
+	require.Equal(t, ErrDisabled, err)
+	require.Error(t, store.Revoke("missing"))
+
+	// a second store sees the same file
+	other, err := OpenStore(store.file)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(other.List()))
+	_, err = other.Lookup(key, now)
+	require.Equal(t, ErrDisabled, err)
+}
+
+// TestWatch makes sure a key minted by another process is picked up
+func TestWatch(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	stop := store.Watch(10 * time.Millisecond)
+	defer stop()
+
+	other, err := OpenStore(store.file)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond) // so the modification time moves on coarse filesystems
+	key, _, err := other.Mint("cli", nil, nil)
+	require.NoError(t, err)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err = store.Lookup(key, time.Now()); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+}
+
+// TestCheck runs the authfunc with header, query and scope combinations
+func TestCheck(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	key, _, err := store.Mint("billing", []string{"read", "write"}, nil)
+	require.NoError(t, err)
+	readOnly, _, err := store.Mint("reports", []string{"read"}, nil)
+	require.NoError(t, err)
+	a := New(Config{Store: store, QueryParam: "api_key", Scopes: []string{"write"}})
+
+	call := func(req *http.Request) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+		recorder := httptest.NewRecorder()
+		ret, err := a.Check(recorder, req)
+		require.NoError(t, err)
+		return ret, recorder
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(DefaultHeader, key)
+	ret, _ := call(req)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, "billing", info.Owner)
+	require.Equal(t, []string{"read", "write"}, info.Scopes)
+
+	ret, _ = call(httptest.NewRequest("GET", "/?api_key="+key, nil))
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(DefaultHeader, readOnly)
+	ret, recorder := call(req)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(DefaultHeader, "ak_bad.key")
+	ret, recorder = call(req)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	ret, _ = call(httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	bearer := New(Config{Store: store, Header: "Authorization"})
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+readOnly)
+	ret, err = bearer.Check(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+}
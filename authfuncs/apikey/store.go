@@ -0,0 +1,266 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUnknownKey is returned when a key's id isn't in the store or its secret doesn't match
+	ErrUnknownKey = errors.New("unknown key")
+	// ErrMalformedKey is returned when a key isn't in the prefix_id.secret form
+	ErrMalformedKey = errors.New("malformed key")
+	// ErrExpired is returned for keys past their expiry
+	ErrExpired = errors.New("key expired")
+	// ErrDisabled is returned for revoked keys
+	ErrDisabled = errors.New("key disabled")
+)
+
+// KeyPrefix starts every key so they're easy to spot in logs and secret scanners
+const KeyPrefix = "ak_"
+
+// Key is a stored key. Only a salted hash of the secret is kept.
+type Key struct {
+	ID       string     `json:"id"`
+	Owner    string     `json:"owner"`
+	Scopes   []string   `json:"scopes,omitempty"`
+	Salt     string     `json:"salt"`
+	Hash     string     `json:"hash"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Disabled bool       `json:"disabled,omitempty"`
+}
+
+// HasScope reports whether the key was given scope
+func (k *Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hashSecret is the stored form of a secret
+func hashSecret(salt string, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitKey separates a key into its id and secret
+func splitKey(key string) (string, string, error) {
+	if !strings.HasPrefix(key, KeyPrefix) {
+		return "", "", ErrMalformedKey
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, KeyPrefix), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrMalformedKey
+	}
+	return parts[0], parts[1], nil
+}
+
+// randomString returns n random bytes, base64url encoded
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Store holds keys in a JSON file. It's safe to use from multiple goroutines, and Reload or Watch pick up changes made by the CLI.
+type Store struct {
+	file    string
+	mutex   *sync.RWMutex
+	keys    map[string]*Key
+	modTime time.Time
+}
+
+// OpenStore loads file, a missing file is an empty store
+func OpenStore(file string) (*Store, error) {
+	s := &Store{
+		file:  file,
+		mutex: new(sync.RWMutex),
+		keys:  make(map[string]*Key),
+	}
+	if err := s.Reload(); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload rereads the file. The old keys are kept if it can't be read.
+func (s *Store) Reload() error {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	list := []*Key{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.Wrap(err, s.file)
+	}
+	keys := make(map[string]*Key, len(list))
+	for _, key := range list {
+		keys[key.ID] = key
+	}
+	s.mutex.Lock()
+	s.keys = keys
+	s.modTime = info.ModTime()
+	s.mutex.Unlock()
+	defaultLogger.Info("API keys loaded from " + s.file)
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes, checking every interval. Call the returned function to stop.
+func (s *Store) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(s.file)
+				if err != nil {
+					continue
+				}
+				s.mutex.RLock()
+				changed := !info.ModTime().Equal(s.modTime)
+				s.mutex.RUnlock()
+				if changed {
+					if err := s.Reload(); err != nil {
+						defaultLogger.Error("API key reload failed: " + err.Error())
+					}
+				}
+			}
+		}
+	}()
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// save writes the keys to a temporary file and renames it over the store, so readers never see half a file. The caller holds the lock.
+func (s *Store) save() error {
+	list := make([]*Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		list = append(list, key)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), ".apikey-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if info, err := os.Stat(s.file); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Mint creates a key for owner and saves the store. The returned string is the only copy of the secret.
+func (s *Store) Mint(owner string, scopes []string, expires *time.Time) (string, *Key, error) {
+	secret := randomString(24)
+	key := &Key{
+		ID:      randomString(6),
+		Owner:   owner,
+		Scopes:  scopes,
+		Salt:    randomString(12),
+		Created: time.Now().UTC(),
+		Expires: expires,
+	}
+	key.Hash = hashSecret(key.Salt, secret)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys[key.ID] = key
+	if err := s.save(); err != nil {
+		delete(s.keys, key.ID)
+		return "", nil, err
+	}
+	return KeyPrefix + key.ID + "." + secret, key, nil
+}
+
+// Revoke disables the key with id and saves the store. Disabled keys are kept so the id isn't reused and the history stays.
+func (s *Store) Revoke(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return errors.Wrap(ErrUnknownKey, id)
+	}
+	key.Disabled = true
+	return s.save()
+}
+
+// List returns a copy of every key
+func (s *Store) List() []Key {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ret := make([]Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		ret = append(ret, *key)
+	}
+	return ret
+}
+
+// Lookup finds the key, checks its secret, expiry and disabled flag, and returns a copy
+func (s *Store) Lookup(key string, now time.Time) (Key, error) {
+	id, secret, err := splitKey(key)
+	if err != nil {
+		return Key{}, err
+	}
+	s.mutex.RLock()
+	stored, ok := s.keys[id]
+	var ret Key
+	if ok {
+		ret = *stored
+	}
+	s.mutex.RUnlock()
+	if !ok {
+		return Key{}, ErrUnknownKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(ret.Salt, secret)), []byte(ret.Hash)) != 1 {
+		return Key{}, ErrUnknownKey
+	}
+	if ret.Disabled {
+		return Key{}, ErrDisabled
+	}
+	if ret.Expires != nil && !now.Before(*ret.Expires) {
+		return Key{}, ErrExpired
+	}
+	return ret, nil
+}
@@ -0,0 +1,214 @@
+package basicpass
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// record is one line of a FileStore's log
+type record struct {
+	Op      string    `json:"op"`
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// Fingerprint is only written for set
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// FileStore keeps sessions in memory and in an append-only log file, so they survive restarts. Every change is one appended line, and the log is rewritten with only live sessions when it's opened and on Sweep. One process should use a file at a time.
+type FileStore struct {
+	file     string
+	mutex    *sync.Mutex
+	log      *os.File
+	sessions map[string]Session
+}
+
+// OpenFileStore replays file, a missing file is an empty store. A torn last line, from a crash mid-write, is dropped.
+func OpenFileStore(file string) (*FileStore, error) {
+	s := &FileStore{file: file, mutex: new(sync.Mutex), sessions: make(map[string]Session)}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		rec := record{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, errors.Wrap(err, file+" line "+strconv.Itoa(i+1))
+		}
+		s.apply(rec)
+	}
+	if err := s.compact(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// apply replays a record. The caller holds the lock.
+func (s *FileStore) apply(rec record) {
+	switch rec.Op {
+	case "set":
+		s.sessions[rec.ID] = Session{Created: rec.Created, Expires: rec.Expires, Fingerprint: rec.Fingerprint}
+	case "touch":
+		if sess, ok := s.sessions[rec.ID]; ok {
+			sess.Expires = rec.Expires
+			s.sessions[rec.ID] = sess
+		}
+	case "delete":
+		delete(s.sessions, rec.ID)
+	case "clear":
+		s.sessions = make(map[string]Session)
+	}
+}
+
+// append writes a record to the log and applies it. The caller holds the lock.
+func (s *FileStore) append(rec record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.apply(rec)
+	return nil
+}
+
+// compact drops sessions expired by now and rewrites the log through a temporary file and a rename. The caller holds the lock, or is OpenFileStore.
+func (s *FileStore) compact(now time.Time) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), ".basicpass-")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for id, sess := range s.sessions {
+		if !now.Before(sess.Expires) {
+			delete(s.sessions, id)
+			continue
+		}
+		line, err := json.Marshal(record{Op: "set", ID: id, Created: sess.Created, Expires: sess.Expires, Fingerprint: sess.Fingerprint})
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	log, err := os.OpenFile(s.file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log = log
+	return nil
+}
+
+// Get returns a copy of a session
+func (s *FileStore) Get(id string) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return &sess, nil
+}
+
+// Set stores a session
+func (s *FileStore) Set(id string, session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.append(record{Op: "set", ID: id, Created: session.Created, Expires: session.Expires, Fingerprint: session.Fingerprint})
+}
+
+// Touch moves a session's expiry
+func (s *FileStore) Touch(id string, expires time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		return ErrNoSession
+	}
+	return s.append(record{Op: "touch", ID: id, Expires: expires})
+}
+
+// Delete removes a session
+func (s *FileStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		return nil
+	}
+	return s.append(record{Op: "delete", ID: id})
+}
+
+// Sweep removes expired sessions and compacts the log
+func (s *FileStore) Sweep(now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	before := len(s.sessions)
+	if err := s.compact(now); err != nil {
+		return 0, err
+	}
+	return before - len(s.sessions), nil
+}
+
+// Count counts sessions that haven't expired
+func (s *FileStore) Count(now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := 0
+	for _, sess := range s.sessions {
+		if now.Before(sess.Expires) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// DeleteAll removes every session. It's logged as one line, the log shrinks at the next compaction.
+func (s *FileStore) DeleteAll() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	removed := len(s.sessions)
+	if err := s.append(record{Op: "clear"}); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Close closes the log
+func (s *FileStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.log.Close()
+}
@@ -1,13 +1,23 @@
 package basicpass
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/redirect"
 	"github.com/ayjayt/ilog"
-	"github.com/cornelk/hashmap"
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
 )
 
 var defaultLogger ilog.LoggerInterface
@@ -57,24 +67,259 @@ const (
 </script></body></html>`
 )
 
-// BasicPass supplies an authfunc receiver and stores information to be used by that receiver
-type BasicPass struct {
+// touchEvery is how far a session's expiry has to move before it's written back, so stores aren't written on every request
+const touchEvery = time.Minute
+
+// ErrName is returned for names that can't go in a cookie name
+var ErrName = errors.New("name may only have letters, digits, - and _")
+
+// fingerprintCost is scrypt's N. Fingerprints are kept in the store, so they're slow to make to keep the password from being guessed from them.
+var fingerprintCost = 1 << 15
+
+// fingerprint identifies a password without revealing it. It's salted with the name so instances sharing a password don't share fingerprints.
+func fingerprint(password, name string) (string, error) {
+	key, err := scrypt.Key([]byte(password), []byte("basicpass-"+name), fingerprintCost, 8, 1, 16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// Config describes a BasicPass
+type Config struct {
 	// Password is the correct password
 	Password string
-	uuid     string
-	form     []byte
-	sessions *hashmap.HashMap
+	// Name goes in the cookie and form, defaults to a random UUID. Set it to keep sessions in a persistent or shared Store working across restarts and replicas.
+	Name string
+	// Store keeps sessions, defaults to a MemoryStore
+	Store SessionStore
+	// IdleTimeout is how long a session lasts without being used, defaults to 6 hours
+	IdleTimeout time.Duration
+	// MaxLifetime is how long a session lasts from login however much it's used, defaults to 7 days
+	MaxLifetime time.Duration
+	// LogoutPath ends the session on a POST and redirects to the local path in ?next, or /. Defaults to /.basicpass-logout.
+	LogoutPath string
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	// Session is the session's id, which Revoke takes. It can't be used as a cookie.
+	Session string `json:"session"`
+}
+
+// Stats are counts for monitoring. Active comes from the store, the rest count since the BasicPass was made.
+type Stats struct {
+	Active  int   `json:"active"`
+	Created int64 `json:"created"`
+	Expired int64 `json:"expired"`
+	Swept   int64 `json:"swept"`
+	Revoked int64 `json:"revoked"`
 }
 
-// New returns a new BasicPass
+// BasicPass supplies an authfunc receiver and stores information to be used by that receiver
+type BasicPass struct {
+	// created, expired, swept and revoked are read and written with atomic, and first so they're aligned on 32 bit platforms
+	created int64
+	expired int64
+	swept   int64
+	revoked int64
+	// Password is the correct password. Change it with SetPassword, which updates it under mutex along with the fingerprint sessions are tied to.
+	Password    string
+	mutex       *sync.RWMutex
+	fingerprint string
+	logoutPath  string
+	name        string
+	form        []byte
+	store       SessionStore
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	now         func() time.Time
+}
+
+// New returns a new BasicPass with in memory sessions. NewWithConfig can't fail with a random name and the default store, so there's no error to return.
 func New(password string) BasicPass {
-	ret := BasicPass{
-		Password: password,
-		uuid:     uuid.New().String(),
-		sessions: &hashmap.HashMap{},
+	ret, _ := NewWithConfig(Config{Password: password})
+	return *ret
+}
+
+// NewWithConfig returns a new BasicPass using the store and name given
+func NewWithConfig(config Config) (*BasicPass, error) {
+	if config.Name == "" {
+		config.Name = uuid.New().String()
+	}
+	if strings.Trim(config.Name, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return nil, ErrName
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryStore()
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = 6 * time.Hour
+	}
+	if config.MaxLifetime == 0 {
+		config.MaxLifetime = 7 * 24 * time.Hour
+	}
+	if config.LogoutPath == "" {
+		config.LogoutPath = "/.basicpass-logout"
+	}
+	fp, err := fingerprint(config.Password, config.Name)
+	if err != nil {
+		return nil, err
+	}
+	ret := &BasicPass{
+		Password:    config.Password,
+		mutex:       new(sync.RWMutex),
+		fingerprint: fp,
+		logoutPath:  config.LogoutPath,
+		name:        config.Name,
+		store:       config.Store,
+		idleTimeout: config.IdleTimeout,
+		maxLifetime: config.MaxLifetime,
+		now:         time.Now,
+	}
+	ret.form = []byte(form1 + ret.name + form2 + ret.name + form3 + ret.name + form4 + script1 + ret.name + script2 + ret.name + script3)
+	return ret, nil
+}
+
+// cookieName is the name of the session cookie
+func (b *BasicPass) cookieName() string {
+	return "basicpass-" + b.name
+}
+
+// sessionID is what a cookie is stored under, a hash so the store's contents can't be used as cookies
+func sessionID(cookie string) string {
+	sum := sha256.Sum256([]byte(cookie))
+	return hex.EncodeToString(sum[:])
+}
+
+// expiry is when a session used at now should expire, the idle timeout from now but never past its max lifetime
+func (b *BasicPass) expiry(created, now time.Time) time.Time {
+	expires := now.Add(b.idleTimeout)
+	if limit := created.Add(b.maxLifetime); limit.Before(expires) {
+		return limit
+	}
+	return expires
+}
+
+// Sweep removes expired sessions from the store
+func (b *BasicPass) Sweep() (int, error) {
+	removed, err := b.store.Sweep(b.now())
+	atomic.AddInt64(&b.swept, int64(removed))
+	return removed, err
+}
+
+// StartSweeper sweeps every interval until the returned function is called. Stores like Redis that expire sessions themselves don't need it.
+func (b *BasicPass) StartSweeper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				removed, err := b.Sweep()
+				if err != nil {
+					defaultLogger.Error("session sweep failed: " + err.Error())
+					continue
+				}
+				if removed != 0 {
+					defaultLogger.Info("swept " + strconv.Itoa(removed) + " " + b.cookieName() + " sessions")
+				}
+			}
+		}
+	}()
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Revoke ends a session, returning ErrNoSession if there isn't one with id
+func (b *BasicPass) Revoke(id string) error {
+	if _, err := b.store.Get(id); err != nil {
+		return err
+	}
+	if err := b.store.Delete(id); err != nil {
+		return err
+	}
+	atomic.AddInt64(&b.revoked, 1)
+	defaultLogger.Info("revoked " + b.cookieName() + " session " + id)
+	return nil
+}
+
+// RevokeAll ends every session in the store, logging everyone out
+func (b *BasicPass) RevokeAll() (int, error) {
+	removed, err := b.store.DeleteAll()
+	atomic.AddInt64(&b.revoked, int64(removed))
+	if err != nil {
+		return removed, err
 	}
-	ret.form = []byte(form1 + ret.uuid + form2 + ret.uuid + form3 + ret.uuid + form4 + script1 + ret.uuid + script2 + ret.uuid + script3)
-	return ret
+	defaultLogger.Info("revoked all " + strconv.Itoa(removed) + " " + b.cookieName() + " sessions")
+	return removed, nil
+}
+
+// SetPassword changes the password and revokes every session. Sessions are tied to the password they logged in with, so ones in a store shared with replicas, or kept over a restart with a new Config.Password, end when they're next used even if RevokeAll doesn't reach them.
+func (b *BasicPass) SetPassword(password string) error {
+	fp, err := fingerprint(password, b.name)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.Password = password
+	b.fingerprint = fp
+	b.mutex.Unlock()
+	if _, err := b.RevokeAll(); err != nil {
+		return errors.Wrap(err, "password changed but sessions weren't all deleted")
+	}
+	return nil
+}
+
+// credentials returns the password and its fingerprint
+func (b *BasicPass) credentials() (string, string) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.Password, b.fingerprint
+}
+
+// logout deletes the request's session, clears its cookie and redirects. Only POSTs are taken, so another site can't log people out with an image.
+func (b *BasicPass) logout(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}, nil
+	}
+	if cookie, err := r.Cookie(b.cookieName()); err == nil {
+		id := sessionID(cookie.Value)
+		if _, err := b.store.Get(id); err == nil {
+			if err := b.store.Delete(id); err != nil {
+				return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+			}
+			atomic.AddInt64(&b.revoked, 1)
+			defaultLogger.Info("cookie " + b.cookieName() + " logged out")
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   b.cookieName(),
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	http.Redirect(w, r, redirect.Local(r.URL.Query().Get("next")), http.StatusSeeOther)
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}, nil
+}
+
+// Stats returns session counts
+func (b *BasicPass) Stats() (Stats, error) {
+	active, err := b.store.Count(b.now())
+	return Stats{
+		Active:  active,
+		Created: atomic.LoadInt64(&b.created),
+		Expired: atomic.LoadInt64(&b.expired),
+		Swept:   atomic.LoadInt64(&b.swept),
+		Revoked: atomic.LoadInt64(&b.revoked),
+	}, err
 }
 
 // Check is an authfunc that determines whether or a user is authenticated or helps them authenticate
@@ -89,34 +334,63 @@ func (b *BasicPass) Check(w http.ResponseWriter, r *http.Request) (authdoor.Auth
 		Resp: authdoor.Ignored,
 		Info: authdoor.InstanceReturnInfo{},
 	}
-	cookie, err := r.Cookie("basicpass-" + b.uuid)
+	if r.URL.Path == b.logoutPath {
+		return b.logout(w, r)
+	}
+	password, fp := b.credentials()
+	cookie, err := r.Cookie(b.cookieName())
 	if err == nil {
-		sessionTimeIface, ok := b.sessions.Get(cookie.Value)
-		if ok { // Found session
-			sessionTime := sessionTimeIface.(time.Time)
-			if time.Now().Before(sessionTime) {
-				b.sessions.Set(cookie.Value, time.Now().Add(time.Hour*6))
-				defaultLogger.Info("cookie basicpass-" + b.uuid + " found and success")
-				return success, nil
+		id := sessionID(cookie.Value)
+		sess, err := b.store.Get(id)
+		if err != nil && err != ErrNoSession {
+			return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+		}
+		now := b.now()
+		current := err == nil && subtle.ConstantTimeCompare([]byte(sess.Fingerprint), []byte(fp)) == 1
+		if current && now.Before(sess.Expires) && now.Before(sess.Created.Add(b.maxLifetime)) { // Found session
+			if expires := b.expiry(sess.Created, now); expires.Sub(sess.Expires) >= touchEvery {
+				if err := b.store.Touch(id, expires); err != nil {
+					defaultLogger.Error("couldn't renew session: " + err.Error())
+				}
+			}
+			defaultLogger.Info("cookie " + b.cookieName() + " found and success")
+			info, err := json.Marshal(Info{Session: id})
+			if err != nil {
+				return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+			}
+			success.Info.Info = info
+			return success, nil
+		}
+		if err == nil { // Expired or from an old password, so it's dealt with now rather than waiting for a sweep
+			if current {
+				atomic.AddInt64(&b.expired, 1)
+			} else {
+				atomic.AddInt64(&b.revoked, 1)
+			}
+			if err := b.store.Delete(id); err != nil {
+				defaultLogger.Error("couldn't delete expired session: " + err.Error())
 			}
 		}
 	}
 	if r.Method == "POST" {
 		r.ParseMultipartForm(256)
-		if r.Form["reference"][0] == b.uuid && r.Form["password"][0] == b.Password {
+		if r.PostFormValue("reference") == b.name && subtle.ConstantTimeCompare([]byte(r.PostFormValue("password")), []byte(password)) == 1 {
 			sess := uuid.New().String()
+			now := b.now()
+			if err := b.store.Set(sessionID(sess), &Session{Created: now, Expires: b.expiry(now, now), Fingerprint: fp}); err != nil {
+				return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+			}
+			atomic.AddInt64(&b.created, 1)
 			http.SetCookie(w, &http.Cookie{
-				Name:  "basicpass-" + b.uuid,
+				Name:  b.cookieName(),
 				Value: sess,
 				Path:  "/",
 			})
-
-			b.sessions.Set(sess, time.Now().Add(time.Hour*6))
 			success.Resp = authdoor.Answered
-			defaultLogger.Info("cookie basicpass-" + b.uuid + " set as success")
+			defaultLogger.Info("cookie " + b.cookieName() + " set as success")
 			return success, nil
 		} else {
-			defaultLogger.Info("cookie basicpass-" + b.uuid + " failure")
+			defaultLogger.Info("cookie " + b.cookieName() + " failure")
 			w.Write([]byte("no\n"))
 			return failure, nil
 		}
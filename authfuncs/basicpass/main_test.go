@@ -1,13 +1,32 @@
 package basicpass
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/basicpass/redistest"
 	"github.com/ayjayt/ilog"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
+// fingerprints don't need to be slow in tests
+func init() {
+	fingerprintCost = 1 << 10
+}
+
 // TsstMain runs first just to see if we should turn on verbose logging during testing
 func TestMain(t *testing.T) {
 	if testing.Verbose() {
@@ -30,3 +49,440 @@ func TestSetDefaultLogger(t *testing.T) {
 		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
 	}
 }
+
+// testStore runs the SessionStore contract against store
+func testStore(t *testing.T, store SessionStore) {
+	now := time.Now()
+	_, err := store.Get("missing")
+	require.Equal(t, ErrNoSession, err)
+	require.Equal(t, ErrNoSession, store.Touch("missing", now.Add(time.Hour)))
+	require.NoError(t, store.Delete("missing"))
+
+	require.NoError(t, store.Set("a", &Session{Created: now, Expires: now.Add(time.Hour)}))
+	require.NoError(t, store.Set("b", &Session{Created: now, Expires: now.Add(time.Hour)}))
+	sess, err := store.Get("a")
+	require.NoError(t, err)
+	require.True(t, sess.Created.Equal(now))
+	require.True(t, sess.Expires.Sub(now.Add(time.Hour)) < time.Second)
+
+	require.NoError(t, store.Touch("a", now.Add(2*time.Hour)))
+	sess, err = store.Get("a")
+	require.NoError(t, err)
+	require.True(t, sess.Created.Equal(now))
+	require.True(t, sess.Expires.Sub(now.Add(2*time.Hour)) < time.Second)
+
+	require.NoError(t, store.Delete("b"))
+	_, err = store.Get("b")
+	require.Equal(t, ErrNoSession, err)
+	n, err := store.Count(now)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	// Redis counts by its own clock
+	if _, ok := store.(*RedisStore); !ok {
+		n, err = store.Count(now.Add(3 * time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 0, n)
+	}
+	_, err = store.Sweep(now.Add(3 * time.Hour))
+	require.NoError(t, err)
+
+	require.NoError(t, store.Delete("a"))
+	require.NoError(t, store.Set("x", &Session{Created: now, Expires: now.Add(time.Hour), Fingerprint: "abc"}))
+	sess, err = store.Get("x")
+	require.NoError(t, err)
+	require.Equal(t, "abc", sess.Fingerprint)
+	require.NoError(t, store.Set("y", &Session{Created: now, Expires: now.Add(time.Hour)}))
+	removed, err := store.DeleteAll()
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	n, err = store.Count(now)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+// TestMemoryStore checks the default store
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	testStore(t, store)
+	removed, err := store.Sweep(time.Now().Add(3 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+	require.NoError(t, store.Set("c", &Session{Expires: time.Now().Add(time.Minute)}))
+	require.NoError(t, store.Set("d", &Session{Expires: time.Now().Add(time.Hour)}))
+	removed, err = store.Sweep(time.Now().Add(2 * time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	_, err = store.Get("d")
+	require.NoError(t, err)
+}
+
+// TestFileStore checks sessions survive reopening, and the log copes with a crash mid-write
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basicpass")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sessions.log")
+	store, err := OpenFileStore(file)
+	require.NoError(t, err)
+	testStore(t, store)
+
+	now := time.Now()
+	require.NoError(t, store.Set("c", &Session{Created: now, Expires: now.Add(time.Hour)}))
+	require.NoError(t, store.Touch("c", now.Add(3*time.Hour)))
+	require.NoError(t, store.Set("d", &Session{Created: now, Expires: now.Add(time.Hour)}))
+	require.NoError(t, store.Delete("d"))
+	require.NoError(t, store.Set("e", &Session{Created: now, Expires: now.Add(time.Hour)}))
+	require.NoError(t, store.Close())
+	stat, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(`{"op":"set","id":"torn","exp`))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	store, err = OpenFileStore(file)
+	require.NoError(t, err)
+	sess, err := store.Get("c")
+	require.NoError(t, err)
+	require.True(t, sess.Expires.Equal(now.Add(3*time.Hour)))
+	_, err = store.Get("e")
+	require.NoError(t, err)
+	for _, id := range []string{"b", "d", "torn"} {
+		_, err = store.Get(id)
+		require.Equal(t, ErrNoSession, err, id)
+	}
+	removed, err := store.Sweep(now.Add(150 * time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.NoError(t, store.Close())
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(data), "\n"))
+
+	// a clear is replayed, and fingerprints survive
+	store, err = OpenFileStore(file)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("f", &Session{Created: now, Expires: now.Add(time.Hour), Fingerprint: "abc"}))
+	_, err = store.DeleteAll()
+	require.NoError(t, err)
+	require.NoError(t, store.Set("g", &Session{Created: now, Expires: now.Add(time.Hour), Fingerprint: "def"}))
+	require.NoError(t, store.Close())
+	store, err = OpenFileStore(file)
+	require.NoError(t, err)
+	_, err = store.Get("c")
+	require.Equal(t, ErrNoSession, err)
+	sess, err = store.Get("g")
+	require.NoError(t, err)
+	require.Equal(t, "def", sess.Fingerprint)
+	require.NoError(t, store.Close())
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("garbage\n{}\n"), 0600))
+	_, err = OpenFileStore(file)
+	require.Error(t, err)
+}
+
+// TestRedisStore checks the Redis store against the fake server
+func TestRedisStore(t *testing.T) {
+	server := redistest.NewServer()
+	defer server.Close()
+	server.SetPassword("hunter2")
+	_, err := NewRedisStore(RedisConfig{Address: server.Addr()})
+	require.Error(t, err)
+	store, err := NewRedisStore(RedisConfig{Address: server.Addr(), Password: "hunter2", DB: 2, Prefix: "staging:"})
+	require.NoError(t, err)
+	defer store.Close()
+	testStore(t, store)
+	require.NoError(t, store.Set("z", &Session{Expires: time.Now().Add(time.Hour)}))
+	require.Equal(t, []string{"staging:z"}, server.Keys(2))
+	require.Len(t, server.Keys(0), 0)
+
+	// Redis expires sessions itself
+	require.NoError(t, store.Set("a", &Session{Expires: time.Now().Add(time.Hour)}))
+	server.Advance(3 * time.Hour)
+	_, err = store.Get("a")
+	require.Equal(t, ErrNoSession, err)
+	n, err := store.Count(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	// keys outside the prefix aren't counted, even ones matching it as a pattern
+	for _, id := range []string{"f", "g", "h"} {
+		require.NoError(t, store.Set(id, &Session{Expires: time.Now().Add(time.Hour)}))
+	}
+	starred, err := NewRedisStore(RedisConfig{Address: server.Addr(), Password: "hunter2", DB: 2, Prefix: "stag*:"})
+	require.NoError(t, err)
+	defer starred.Close()
+	require.NoError(t, starred.Set("i", &Session{Expires: time.Now().Add(time.Hour)}))
+	n, err = store.Count(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	n, err = starred.Count(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// DeleteAll gets every page, and only its own prefix
+	for i := 0; i < 1500; i++ {
+		require.NoError(t, store.Set(strconv.Itoa(i), &Session{Expires: time.Now().Add(time.Hour)}))
+	}
+	removed, err := store.DeleteAll()
+	require.NoError(t, err)
+	require.Equal(t, 1503, removed)
+	require.Equal(t, []string{"stag*:i"}, server.Keys(2))
+
+	// a dropped connection is redialed
+	connections := atomic.LoadInt64(&server.Connections)
+	store.Close()
+	require.NoError(t, store.Set("e", &Session{Expires: time.Now().Add(time.Hour)}))
+	require.True(t, atomic.LoadInt64(&server.Connections) > connections)
+}
+
+// login posts the password and returns the session cookie
+func login(t *testing.T, b *BasicPass, password string) (authdoor.AuthFuncReturn, *http.Cookie) {
+	form := url.Values{"reference": {b.name}, "password": {password}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ret, err := b.Check(w, r)
+	require.NoError(t, err)
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		return ret, nil
+	}
+	return ret, cookies[0]
+}
+
+// visit makes a request with cookie
+func visit(t *testing.T, b *BasicPass, cookie *http.Cookie) authdoor.AuthFuncReturn {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	ret, err := b.Check(w, r)
+	require.NoError(t, err)
+	return ret
+}
+
+// TestCheck logs in and checks sessions are kept in the store
+func TestCheck(t *testing.T) {
+	plain := New("secret")
+	ret := visit(t, &plain, nil)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	ret, cookie := login(t, &plain, "wrong")
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Nil(t, cookie)
+	ret, cookie = login(t, &plain, "secret")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	ret = visit(t, &plain, cookie)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	// posts missing fields are just wrong
+	for _, body := range []string{"", "reference=" + plain.name, "password=secret"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ret, err := plain.Check(w, r)
+		require.NoError(t, err)
+		require.Equal(t, authdoor.AuthFailed, ret.Auth, body)
+		require.Empty(t, w.Result().Cookies(), body)
+	}
+
+	_, err := NewWithConfig(Config{Password: "secret", Name: "bad name;"})
+	require.Equal(t, ErrName, err)
+
+	// a named instance on a shared store picks up sessions another one made, like after a restart
+	store := NewMemoryStore()
+	first, err := NewWithConfig(Config{Password: "secret", Name: "staging", Store: store})
+	require.NoError(t, err)
+	_, cookie = login(t, first, "secret")
+	require.Equal(t, "basicpass-staging", cookie.Name)
+	_, err = store.Get(cookie.Value)
+	require.Equal(t, ErrNoSession, err)
+	second, err := NewWithConfig(Config{Password: "secret", Name: "staging", Store: store})
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthGranted, visit(t, second, cookie).Auth)
+
+	// sessions are renewed as they're used, and expire when they aren't
+	start := time.Now()
+	second.now = func() time.Time { return start.Add(5 * time.Hour) }
+	require.Equal(t, authdoor.AuthGranted, visit(t, second, cookie).Auth)
+	second.now = func() time.Time { return start.Add(10 * time.Hour) }
+	require.Equal(t, authdoor.AuthGranted, visit(t, second, cookie).Auth)
+	second.now = func() time.Time { return start.Add(17 * time.Hour) }
+	require.Equal(t, authdoor.AuthFailed, visit(t, second, cookie).Auth)
+}
+
+// brokenStore fails every call
+type brokenStore struct{ *MemoryStore }
+
+// Get fails
+func (brokenStore) Get(id string) (*Session, error) {
+	return nil, errors.New("store is down")
+}
+
+// TestStoreDown checks a failing store isn't treated as no session
+func TestStoreDown(t *testing.T) {
+	b, err := NewWithConfig(Config{Password: "secret", Store: brokenStore{NewMemoryStore()}})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: b.cookieName(), Value: "x"})
+	ret, err := b.Check(w, r)
+	require.Error(t, err)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+}
+
+// TestLifetime checks sessions die after MaxLifetime however much they're used, and expired ones are cleaned up
+func TestLifetime(t *testing.T) {
+	b, err := NewWithConfig(Config{Password: "secret", IdleTimeout: time.Hour, MaxLifetime: 3 * time.Hour})
+	require.NoError(t, err)
+	start := time.Now()
+	b.now = func() time.Time { return start }
+	_, cookie := login(t, b, "secret")
+	_, other := login(t, b, "secret")
+	_, idle := login(t, b, "secret")
+	for i := 1; i < 6; i++ {
+		b.now = func() time.Time { return start.Add(time.Duration(i) * 30 * time.Minute) }
+		require.Equal(t, authdoor.AuthGranted, visit(t, b, cookie).Auth, i)
+		require.Equal(t, authdoor.AuthGranted, visit(t, b, other).Auth, i)
+	}
+	sess, err := b.store.Get(sessionID(cookie.Value))
+	require.NoError(t, err)
+	require.True(t, sess.Expires.Equal(start.Add(3*time.Hour)))
+
+	b.now = func() time.Time { return start.Add(3 * time.Hour) }
+	require.Equal(t, authdoor.AuthFailed, visit(t, b, cookie).Auth)
+	_, err = b.store.Get(sessionID(cookie.Value))
+	require.Equal(t, ErrNoSession, err)
+
+	stats, err := b.Stats()
+	require.NoError(t, err)
+	require.Equal(t, Stats{Active: 0, Created: 3, Expired: 1}, stats)
+	removed, err := b.Sweep()
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	_, err = b.store.Get(sessionID(idle.Value))
+	require.Equal(t, ErrNoSession, err)
+	stats, err = b.Stats()
+	require.NoError(t, err)
+	require.Equal(t, Stats{Active: 0, Created: 3, Expired: 1, Swept: 2}, stats)
+}
+
+// TestStartSweeper checks the sweeper runs and stops
+func TestStartSweeper(t *testing.T) {
+	b, err := NewWithConfig(Config{Password: "secret"})
+	require.NoError(t, err)
+	_, cookie := login(t, b, "secret")
+	stats, err := b.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Active)
+	b.store.Touch(sessionID(cookie.Value), time.Now())
+
+	stop := b.StartSweeper(time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&b.swept) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	stop()
+	require.Equal(t, int64(1), atomic.LoadInt64(&b.swept))
+	_, err = b.store.Get(sessionID(cookie.Value))
+	require.Equal(t, ErrNoSession, err)
+}
+
+// TestLogout checks the logout path ends the session and only redirects locally
+func TestLogout(t *testing.T) {
+	b, err := NewWithConfig(Config{Password: "secret"})
+	require.NoError(t, err)
+	_, cookie := login(t, b, "secret")
+	require.Equal(t, authdoor.AuthGranted, visit(t, b, cookie).Auth)
+
+	// a GET, like an image on another site, doesn't log out
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/.basicpass-logout", nil)
+	r.AddCookie(cookie)
+	ret, err := b.Check(w, r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Empty(t, w.Result().Cookies())
+	require.Equal(t, authdoor.AuthGranted, visit(t, b, cookie).Auth)
+
+	for next, location := range map[string]string{"": "/", "/docs?page=2": "/docs?page=2", "//evil.com": "/", "https://evil.com": "/", "/\\evil.com": "/"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/.basicpass-logout?next="+url.QueryEscape(next), nil)
+		r.AddCookie(cookie)
+		ret, err := b.Check(w, r)
+		require.NoError(t, err)
+		require.Equal(t, authdoor.AuthFailed, ret.Auth)
+		require.Equal(t, authdoor.Answered, ret.Resp)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		require.Equal(t, location, w.Header().Get("Location"), next)
+		cleared := w.Result().Cookies()
+		require.Len(t, cleared, 1)
+		require.Equal(t, cookie.Name, cleared[0].Name)
+		require.True(t, cleared[0].MaxAge < 0)
+	}
+	require.Equal(t, authdoor.AuthFailed, visit(t, b, cookie).Auth)
+	stats, err := b.Stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Revoked)
+}
+
+// TestRevoke checks sessions can be ended one at a time, all at once, and by changing the password
+func TestRevoke(t *testing.T) {
+	store := NewMemoryStore()
+	b, err := NewWithConfig(Config{Password: "secret", Name: "docs", Store: store})
+	require.NoError(t, err)
+	_, first := login(t, b, "secret")
+	_, second := login(t, b, "secret")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(first)
+	ret, err := b.Check(w, r)
+	require.NoError(t, err)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, sessionID(first.Value), info.Session)
+
+	require.NoError(t, b.Revoke(info.Session))
+	require.Equal(t, ErrNoSession, b.Revoke(info.Session))
+	require.Equal(t, authdoor.AuthFailed, visit(t, b, first).Auth)
+	require.Equal(t, authdoor.AuthGranted, visit(t, b, second).Auth)
+
+	_, first = login(t, b, "secret")
+	removed, err := b.RevokeAll()
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	require.Equal(t, authdoor.AuthFailed, visit(t, b, first).Auth)
+	require.Equal(t, authdoor.AuthFailed, visit(t, b, second).Auth)
+
+	_, first = login(t, b, "secret")
+	require.NoError(t, b.SetPassword("hunter2"))
+	require.Equal(t, authdoor.AuthFailed, visit(t, b, first).Auth)
+	ret, _ = login(t, b, "secret")
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	_, first = login(t, b, "hunter2")
+	require.Equal(t, authdoor.AuthGranted, visit(t, b, first).Auth)
+
+	// a restart with a new password ends sessions left in a persistent store
+	restarted, err := NewWithConfig(Config{Password: "correct horse", Name: "docs", Store: store})
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthFailed, visit(t, restarted, first).Auth)
+	_, err = store.Get(sessionID(first.Value))
+	require.Equal(t, ErrNoSession, err)
+	stats, err := restarted.Stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Revoked)
+	stats, err = b.Stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), stats.Revoked)
+}
@@ -0,0 +1,294 @@
+package basicpass
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor/authfuncs/internal/resp"
+)
+
+// RedisConfig says how to reach Redis, or anything speaking its protocol
+type RedisConfig struct {
+	// Address is host:port
+	Address  string
+	Password string
+	DB       int
+	// Prefix goes before every key, defaults to "basicpass:". Give each BasicPass sharing a server its own.
+	Prefix string
+	// TLSConfig, if set, connects with TLS
+	TLSConfig *tls.Config
+	// PoolSize is how many idle connections are kept, defaults to 4
+	PoolSize int
+	// Timeout bounds dialing and each command, defaults to 5 seconds
+	Timeout time.Duration
+}
+
+// redisConn is one connection and its buffers
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// RedisStore keeps sessions in Redis, so they survive restarts and are shared between replicas. Sessions are stored with a TTL, so Redis expires them itself and Sweep has nothing to do.
+type RedisStore struct {
+	config RedisConfig
+	idle   chan *redisConn
+	now    func() time.Time
+}
+
+// NewRedisStore returns a RedisStore after checking the server answers
+func NewRedisStore(config RedisConfig) (*RedisStore, error) {
+	if config.Address == "" {
+		return nil, errors.New("Address is required")
+	}
+	if config.Prefix == "" {
+		config.Prefix = "basicpass:"
+	}
+	if config.PoolSize == 0 {
+		config.PoolSize = 4
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	s := &RedisStore{config: config, idle: make(chan *redisConn, config.PoolSize), now: time.Now}
+	if _, err := s.do([]string{"PING"}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dial connects, authenticates and selects the database
+func (s *RedisStore) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: s.config.Timeout}
+	var conn net.Conn
+	var err error
+	if s.config.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.config.Address, s.config.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.config.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	var setup [][]string
+	if s.config.Password != "" {
+		setup = append(setup, []string{"AUTH", s.config.Password})
+	}
+	if s.config.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.config.DB)})
+	}
+	if len(setup) != 0 {
+		replies, err := c.pipeline(s.config.Timeout, setup)
+		if err == nil {
+			err = firstError(replies)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "redis setup")
+		}
+	}
+	return c, nil
+}
+
+// pipeline sends commands together and reads their replies
+func (c *redisConn) pipeline(timeout time.Duration, commands [][]string) ([]interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	for _, command := range commands {
+		resp.WriteCommand(c.writer, command...)
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range replies {
+		reply, err := resp.ReadReply(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// firstError returns the first error reply
+func firstError(replies []interface{}) error {
+	for _, reply := range replies {
+		if err, ok := reply.(resp.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// do runs commands on a pooled connection. A connection that fails is dropped rather than returned to the pool, since it may be halfway through a reply.
+func (s *RedisStore) do(commands ...[]string) ([]interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-s.idle:
+	default:
+		var err error
+		if c, err = s.dial(); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := c.pipeline(s.config.Timeout, commands)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	return replies, firstError(replies)
+}
+
+// key is where a session is kept
+func (s *RedisStore) key(id string) string {
+	return s.config.Prefix + id
+}
+
+// ttl is the milliseconds until expires, at least 1 so nothing is stored without a TTL
+func (s *RedisStore) ttl(expires time.Time) string {
+	ms := int64(expires.Sub(s.now()) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// Get fetches a session and its TTL together. The TTL is what counts for expiry, since Touch only moves that.
+func (s *RedisStore) Get(id string) (*Session, error) {
+	replies, err := s.do([]string{"GET", s.key(id)}, []string{"PTTL", s.key(id)})
+	if err != nil {
+		return nil, err
+	}
+	value, _ := replies[0].([]byte)
+	if value == nil {
+		return nil, ErrNoSession
+	}
+	sess := &Session{}
+	if err := json.Unmarshal(value, sess); err != nil {
+		return nil, errors.Wrap(err, "session "+id)
+	}
+	if ttl, ok := replies[1].(int64); ok && ttl >= 0 {
+		sess.Expires = s.now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	return sess, nil
+}
+
+// Set stores a session with a TTL running out at its expiry
+func (s *RedisStore) Set(id string, session *Session) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = s.do([]string{"SET", s.key(id), string(value), "PX", s.ttl(session.Expires)})
+	return err
+}
+
+// Touch moves a session's TTL
+func (s *RedisStore) Touch(id string, expires time.Time) error {
+	replies, err := s.do([]string{"PEXPIRE", s.key(id), s.ttl(expires)})
+	if err != nil {
+		return err
+	}
+	if n, _ := replies[0].(int64); n == 0 {
+		return ErrNoSession
+	}
+	return nil
+}
+
+// Delete removes a session
+func (s *RedisStore) Delete(id string) error {
+	_, err := s.do([]string{"DEL", s.key(id)})
+	return err
+}
+
+// Sweep does nothing, Redis expires sessions itself
+func (s *RedisStore) Sweep(now time.Time) (int, error) {
+	return 0, nil
+}
+
+// scan walks the prefix's keys with SCAN, which unlike KEYS doesn't block the server, calling fn with each page
+func (s *RedisStore) scan(fn func(keys []string) error) error {
+	match := globEscaper.Replace(s.config.Prefix) + "*"
+	cursor := "0"
+	for {
+		replies, err := s.do([]string{"SCAN", cursor, "MATCH", match, "COUNT", "1000"})
+		if err != nil {
+			return err
+		}
+		page, _ := replies[0].([]interface{})
+		if len(page) != 2 {
+			return resp.ErrMalformed
+		}
+		next, _ := page[0].([]byte)
+		values, _ := page[1].([]interface{})
+		keys := make([]string, 0, len(values))
+		for _, value := range values {
+			if key, ok := value.([]byte); ok {
+				keys = append(keys, string(key))
+			}
+		}
+		if len(keys) != 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// Count counts the prefix's keys. Redis expires keys by its own clock, so now is ignored, and it's a count of keys, so it's only as accurate as the prefix is unique.
+func (s *RedisStore) Count(now time.Time) (int, error) {
+	n := 0
+	err := s.scan(func(keys []string) error {
+		n += len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// DeleteAll deletes the prefix's keys a page at a time. Sessions made while it runs may survive it.
+func (s *RedisStore) DeleteAll() (int, error) {
+	removed := 0
+	err := s.scan(func(keys []string) error {
+		replies, err := s.do(append([]string{"DEL"}, keys...))
+		if err != nil {
+			return err
+		}
+		n, _ := replies[0].(int64)
+		removed += int(n)
+		return nil
+	})
+	return removed, err
+}
+
+// globEscaper escapes what's special in a Redis MATCH pattern
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Close closes the idle connections
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
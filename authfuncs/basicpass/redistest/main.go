@@ -0,0 +1,358 @@
+/*
+Package redistest provides a tiny in-process server speaking the Redis protocol for tests. It keeps strings with expiry and handles the handful of commands session stores use.
+*/
+package redistest
+
+import (
+	"bufio"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ayjayt/authdoor/authfuncs/internal/resp"
+)
+
+// entry is a stored value. A zero expires never expires.
+type entry struct {
+	value   []byte
+	expires time.Time
+	// seq orders keys for SCAN, it's given when a key is created
+	seq int
+}
+
+// Server is a fake Redis. It understands PING, AUTH, SELECT, GET, SET with EX, PX, NX and XX, DEL, EXISTS, PEXPIRE, PTTL, KEYS and SCAN.
+type Server struct {
+	// Connections and Commands count what clients did, read them with atomic
+	Connections int64
+	Commands    int64
+	listener    net.Listener
+	mutex       *sync.Mutex
+	password    string
+	// data is per database
+	data   map[int]map[string]entry
+	offset time.Duration
+	seq    int
+	conns  map[net.Conn]bool
+}
+
+// NewServer starts a server on a free port
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{
+		listener: listener,
+		mutex:    new(sync.Mutex),
+		data:     make(map[int]map[string]entry),
+		conns:    make(map[net.Conn]bool),
+	}
+	go s.serve()
+	return s
+}
+
+// SetPassword makes new connections send AUTH with password before anything else
+func (s *Server) SetPassword(password string) {
+	s.mutex.Lock()
+	s.password = password
+	s.mutex.Unlock()
+}
+
+// Addr returns the host:port to connect to
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Advance moves the server's clock forward, expiring keys as if d had passed
+func (s *Server) Advance(d time.Duration) {
+	s.mutex.Lock()
+	s.offset += d
+	s.mutex.Unlock()
+}
+
+// Keys returns the live keys in a database
+func (s *Server) Keys(db int) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var keys []string
+	for key := range s.live(db) {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Close stops listening and drops every connection
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mutex.Unlock()
+}
+
+// now is the server's clock. The caller holds the lock.
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+// live drops expired keys and returns a database. The caller holds the lock.
+func (s *Server) live(db int) map[string]entry {
+	data, ok := s.data[db]
+	if !ok {
+		data = make(map[string]entry)
+		s.data[db] = data
+	}
+	now := s.now()
+	for key, e := range data {
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			delete(data, key)
+		}
+	}
+	return data
+}
+
+// serve accepts until the listener is closed
+func (s *Server) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.Connections, 1)
+		s.mutex.Lock()
+		s.conns[c] = true
+		s.mutex.Unlock()
+		go s.handle(c)
+	}
+}
+
+// client is what the server knows about one connection
+type client struct {
+	// password is the server's when the client connected
+	password string
+	authed   bool
+	db       int
+}
+
+// handle answers one connection's commands in order
+func (s *Server) handle(c net.Conn) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.mutex.Unlock()
+		c.Close()
+	}()
+	reader, writer := bufio.NewReader(c), bufio.NewWriter(c)
+	s.mutex.Lock()
+	cl := &client{password: s.password, authed: s.password == ""}
+	s.mutex.Unlock()
+	for {
+		args, err := resp.ReadCommand(reader)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.Commands, 1)
+		s.command(cl, writer, strings.ToUpper(args[0]), args[1:])
+		// only flush once the client has nothing more buffered, so pipelined replies go out together
+		if reader.Buffered() == 0 {
+			if writer.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// command runs one command
+func (s *Server) command(cl *client, w *bufio.Writer, name string, args []string) {
+	if name == "AUTH" {
+		if len(args) == 1 && args[0] == cl.password && cl.password != "" {
+			cl.authed = true
+			resp.WriteSimple(w, "OK")
+			return
+		}
+		resp.WriteError(w, "WRONGPASS invalid username-password pair")
+		return
+	}
+	if !cl.authed {
+		resp.WriteError(w, "NOAUTH Authentication required.")
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data := s.live(cl.db)
+	switch {
+	case name == "PING":
+		resp.WriteSimple(w, "PONG")
+	case name == "SELECT" && len(args) == 1:
+		db, err := strconv.Atoi(args[0])
+		if err != nil || db < 0 || db > 15 {
+			resp.WriteError(w, "ERR DB index is out of range")
+			return
+		}
+		cl.db = db
+		resp.WriteSimple(w, "OK")
+	case name == "GET" && len(args) == 1:
+		e, ok := data[args[0]]
+		if !ok {
+			resp.WriteBulk(w, nil)
+			return
+		}
+		resp.WriteBulk(w, e.value)
+	case name == "SET" && len(args) >= 2:
+		s.set(w, data, args)
+	case (name == "DEL" || name == "EXISTS") && len(args) >= 1:
+		n := int64(0)
+		for _, key := range args {
+			if _, ok := data[key]; ok {
+				n++
+				if name == "DEL" {
+					delete(data, key)
+				}
+			}
+		}
+		resp.WriteInt(w, n)
+	case name == "PEXPIRE" && len(args) == 2:
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			resp.WriteError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		e, ok := data[args[0]]
+		if !ok {
+			resp.WriteInt(w, 0)
+			return
+		}
+		e.expires = s.now().Add(time.Duration(ms) * time.Millisecond)
+		data[args[0]] = e
+		resp.WriteInt(w, 1)
+	case name == "PTTL" && len(args) == 1:
+		e, ok := data[args[0]]
+		switch {
+		case !ok:
+			resp.WriteInt(w, -2)
+		case e.expires.IsZero():
+			resp.WriteInt(w, -1)
+		default:
+			resp.WriteInt(w, int64(e.expires.Sub(s.now())/time.Millisecond))
+		}
+	case name == "KEYS" && len(args) == 1:
+		var keys []string
+		for key := range data {
+			if ok, _ := path.Match(args[0], key); ok {
+				keys = append(keys, key)
+			}
+		}
+		resp.WriteArray(w, len(keys))
+		for _, key := range keys {
+			resp.WriteBulk(w, []byte(key))
+		}
+	case name == "SCAN" && len(args) >= 1:
+		s.scan(w, data, args)
+	default:
+		resp.WriteError(w, "ERR unknown command or wrong number of arguments for '"+strings.ToLower(name)+"'")
+	}
+}
+
+// set handles SET key value [EX seconds|PX milliseconds] [NX|XX]. The caller holds the lock.
+func (s *Server) set(w *bufio.Writer, data map[string]entry, args []string) {
+	e := entry{value: []byte(args[1])}
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(args) {
+				resp.WriteError(w, "ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				resp.WriteError(w, "ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Millisecond
+			if option == "EX" {
+				unit = time.Second
+			}
+			e.expires = s.now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			resp.WriteError(w, "ERR syntax error")
+			return
+		}
+	}
+	old, exists := data[args[0]]
+	if (nx && exists) || (xx && !exists) {
+		resp.WriteBulk(w, nil)
+		return
+	}
+	if exists {
+		e.seq = old.seq
+	} else {
+		s.seq++
+		e.seq = s.seq
+	}
+	data[args[0]] = e
+	resp.WriteSimple(w, "OK")
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count]. The cursor is the next sequence number to look at, so like Redis, keys that exist for the whole scan are returned whatever else is deleted. The caller holds the lock.
+func (s *Server) scan(w *bufio.Writer, data map[string]entry, args []string) {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		resp.WriteError(w, "ERR invalid cursor")
+		return
+	}
+	match, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			resp.WriteError(w, "ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				resp.WriteError(w, "ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			resp.WriteError(w, "ERR syntax error")
+			return
+		}
+	}
+	var keys []string
+	for key, e := range data {
+		if e.seq >= cursor {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return data[keys[i]].seq < data[keys[j]].seq })
+	next := 0
+	if len(keys) > count {
+		next = data[keys[count]].seq
+		keys = keys[:count]
+	}
+	var page []string
+	for _, key := range keys {
+		if ok, _ := path.Match(match, key); ok {
+			page = append(page, key)
+		}
+	}
+	resp.WriteArray(w, 2)
+	resp.WriteBulk(w, []byte(strconv.Itoa(next)))
+	resp.WriteArray(w, len(page))
+	for _, key := range page {
+		resp.WriteBulk(w, []byte(key))
+	}
+}
@@ -0,0 +1,124 @@
+package basicpass
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoSession is returned by stores for sessions they don't have
+var ErrNoSession = errors.New("no such session")
+
+// Session is what's stored for a logged in browser
+type Session struct {
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// Fingerprint identifies the password the session logged in with, so changing the password ends it
+	Fingerprint string `json:"fingerprint"`
+}
+
+// SessionStore keeps one BasicPass's sessions, or several sharing a Name. Ids are hashes of the cookie, so whoever can read a store can't log in with what's in it.
+type SessionStore interface {
+	// Get returns ErrNoSession for sessions that don't exist. It may return sessions past their expiry, the caller checks.
+	Get(id string) (*Session, error)
+	// Set creates or replaces a session
+	Set(id string, session *Session) error
+	// Touch moves a session's expiry, returning ErrNoSession if it's gone
+	Touch(id string, expires time.Time) error
+	// Delete removes a session. Deleting one that doesn't exist isn't an error.
+	Delete(id string) error
+	// Sweep removes sessions expired by now and returns how many it removed
+	Sweep(now time.Time) (int, error)
+	// Count returns how many sessions are live at now
+	Count(now time.Time) (int, error)
+	// DeleteAll removes every session and returns how many it removed
+	DeleteAll() (int, error)
+}
+
+// MemoryStore keeps sessions in process, so they're lost on restart and not shared between replicas
+type MemoryStore struct {
+	mutex    *sync.Mutex
+	sessions map[string]Session
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{mutex: new(sync.Mutex), sessions: make(map[string]Session)}
+}
+
+// Get returns a copy of a session
+func (m *MemoryStore) Get(id string) (*Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sess, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return &sess, nil
+}
+
+// Set stores a copy of session
+func (m *MemoryStore) Set(id string, session *Session) error {
+	m.mutex.Lock()
+	m.sessions[id] = *session
+	m.mutex.Unlock()
+	return nil
+}
+
+// Touch moves a session's expiry. It's done under the lock so a Delete can't be undone by a Touch racing it.
+func (m *MemoryStore) Touch(id string, expires time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sess, ok := m.sessions[id]
+	if !ok {
+		return ErrNoSession
+	}
+	sess.Expires = expires
+	m.sessions[id] = sess
+	return nil
+}
+
+// Delete removes a session
+func (m *MemoryStore) Delete(id string) error {
+	m.mutex.Lock()
+	delete(m.sessions, id)
+	m.mutex.Unlock()
+	return nil
+}
+
+// Sweep removes expired sessions
+func (m *MemoryStore) Sweep(now time.Time) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	removed := 0
+	for id, sess := range m.sessions {
+		if !now.Before(sess.Expires) {
+			delete(m.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Count counts sessions that haven't expired
+func (m *MemoryStore) Count(now time.Time) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	n := 0
+	for _, sess := range m.sessions {
+		if now.Before(sess.Expires) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// DeleteAll removes every session
+func (m *MemoryStore) DeleteAll() (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	removed := len(m.sessions)
+	m.sessions = make(map[string]Session)
+	return removed, nil
+}
@@ -0,0 +1,232 @@
+/*
+Package hmacsig is an AuthFunc for requests signed by machine clients, like webhooks and automation. It works like AWS SigV4 or HTTP Message Signatures (RFC 9421): the client MACs the method, path, query, chosen headers, a digest of the body, a timestamp and a nonce with its secret, and sends the result in the Authorization header.
+*/
+package hmacsig
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+var (
+	// ErrMalformed is returned for Authorization headers we can't read
+	ErrMalformed = errors.New("malformed signature header")
+	// ErrClient is returned for clients we don't know
+	ErrClient = errors.New("unknown client")
+	// ErrSignature is returned when the signature doesn't match
+	ErrSignature = errors.New("signature mismatch")
+	// ErrSkew is returned when the timestamp is too far from our clock
+	ErrSkew = errors.New("timestamp outside allowed skew")
+	// ErrReplay is returned for a nonce the client already used
+	ErrReplay = errors.New("nonce already used")
+	// ErrHeaders is returned when a required header isn't signed
+	ErrHeaders = errors.New("required header not signed")
+	// ErrBodyTooLarge is returned for bodies over Config.MaxBody
+	ErrBodyTooLarge = errors.New("body too large")
+	// ErrBusy is returned when too many nonces are being remembered to take another
+	ErrBusy = errors.New("too many nonces outstanding")
+)
+
+// maxNonces caps the nonces remembered. Only correctly signed requests add one, so reaching it means a client is flooding us.
+const maxNonces = 100000
+
+// Config lists the clients
+type Config struct {
+	// Clients maps client IDs, sent as the Credential, to their secrets
+	Clients map[string][]byte
+	// RequiredHeaders have to be signed, defaults to host. Add content-type or a webhook's event header to stop them being swapped.
+	RequiredHeaders []string
+	// Skew is how far a timestamp may be from our clock either way, defaults to 5 minutes. Nonces are remembered this long.
+	Skew time.Duration
+	// MaxBody is the most body that's read to check its digest, defaults to 1MB. The body is buffered and put back so later AuthFuncs and the base handler can still read it.
+	MaxBody int64
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	Client        string   `json:"client"`
+	SignedHeaders []string `json:"signed_headers"`
+	Timestamp     int64    `json:"timestamp"`
+}
+
+// HMACSig supplies an authfunc receiver and stores information to be used by that receiver
+type HMACSig struct {
+	config Config
+	mutex  *sync.Mutex
+	// nonces are remembered by client and nonce until their timestamp is too old to be accepted anyway
+	nonces map[string]time.Time
+	now    func() time.Time
+}
+
+// New returns an HMACSig ready to be used as an AuthFunc
+func New(config Config) (*HMACSig, error) {
+	if len(config.Clients) == 0 {
+		return nil, errors.New("at least one client is required")
+	}
+	for client, secret := range config.Clients {
+		if len(secret) < 16 {
+			return nil, errors.New("secret for " + client + " is shorter than 16 bytes")
+		}
+	}
+	if len(config.RequiredHeaders) == 0 {
+		config.RequiredHeaders = []string{"host"}
+	}
+	// signed headers are always lowercase, so "X-Event" has to be looked for as "x-event"
+	required := make([]string, 0, len(config.RequiredHeaders))
+	for _, name := range config.RequiredHeaders {
+		required = append(required, strings.ToLower(name))
+	}
+	config.RequiredHeaders = required
+	if config.Skew == 0 {
+		config.Skew = 5 * time.Minute
+	}
+	if config.MaxBody == 0 {
+		config.MaxBody = 1 << 20
+	}
+	return &HMACSig{config: config, mutex: new(sync.Mutex), nonces: make(map[string]time.Time), now: time.Now}, nil
+}
+
+// readBody buffers the body and puts it back for whoever reads it next
+func (h *HMACSig) readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	if r.ContentLength > h.config.MaxBody {
+		return nil, ErrBodyTooLarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, h.config.MaxBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > h.config.MaxBody {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+// verify checks everything about a signed request except its nonce
+func (h *HMACSig) verify(r *http.Request, p parameters) (*Info, error) {
+	signed := make(map[string]bool, len(p.signedHeaders))
+	for _, name := range p.signedHeaders {
+		signed[name] = true
+	}
+	for _, name := range h.config.RequiredHeaders {
+		if !signed[name] {
+			return nil, errors.Wrap(ErrHeaders, name)
+		}
+	}
+	timestamp, err := strconv.ParseInt(p.timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(ErrMalformed, "bad timestamp")
+	}
+	at := time.Unix(timestamp, 0)
+	if now := h.now(); at.Before(now.Add(-h.config.Skew)) || at.After(now.Add(h.config.Skew)) {
+		return nil, ErrSkew
+	}
+	secret, ok := h.config.Clients[p.client]
+	if !ok {
+		return nil, errors.Wrap(ErrClient, p.client)
+	}
+	body, err := h.readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(mac(secret, stringToSign(r, p, body))), []byte(p.signature)) != 1 {
+		return nil, ErrSignature
+	}
+	return &Info{Client: p.client, SignedHeaders: p.signedHeaders, Timestamp: timestamp}, nil
+}
+
+// useNonce records a nonce, refusing one already used
+func (h *HMACSig) useNonce(p parameters, timestamp int64) error {
+	now := h.now()
+	key := p.client + " " + p.nonce
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if forget, used := h.nonces[key]; used && now.Before(forget) {
+		return ErrReplay
+	}
+	if len(h.nonces) >= maxNonces {
+		for key, forget := range h.nonces {
+			if !now.Before(forget) {
+				delete(h.nonces, key)
+			}
+		}
+		if len(h.nonces) >= maxNonces {
+			return ErrBusy
+		}
+	}
+	h.nonces[key] = time.Unix(timestamp, 0).Add(h.config.Skew + time.Second)
+	return nil
+}
+
+// Check is an authfunc. Requests without our Authorization scheme fail quietly so later instances decide, bad signatures are answered with 401.
+func (h *HMACSig) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	p, ok, err := parseAuthorization(r.Header.Get("Authorization"))
+	if !ok {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	var info *Info
+	if err == nil {
+		info, err = h.verify(r, p)
+	}
+	if err == nil {
+		err = h.useNonce(p, info.Timestamp)
+	}
+	switch errors.Cause(err) {
+	case nil:
+	case ErrBodyTooLarge:
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	case ErrBusy:
+		defaultLogger.Error("hmacsig has too many nonces outstanding")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	default:
+		defaultLogger.Info("hmacsig refused " + p.client + ": " + err.Error())
+		w.Header().Set("WWW-Authenticate", Scheme)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: infoJSON},
+	}, nil
+}
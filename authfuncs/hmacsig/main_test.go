@@ -0,0 +1,232 @@
+package hmacsig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/hmacsig/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+// signed returns a request signed by client "hook" covering content-type
+func signed(t *testing.T, method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	require.NoError(t, Sign(r, "hook", secret, "Content-Type"))
+	return r
+}
+
+// check runs the authfunc
+func check(t *testing.T, h *HMACSig, r *http.Request) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	ret, err := h.Check(w, r)
+	require.NoError(t, err)
+	return ret, w
+}
+
+// TestCheck signs requests and checks them
+func TestCheck(t *testing.T) {
+	h, err := New(Config{Clients: map[string][]byte{"hook": secret}})
+	require.NoError(t, err)
+
+	r := signed(t, "POST", "/hooks/build?b=2&a=1&a=0", `{"ok":true}`)
+	require.True(t, strings.HasPrefix(r.Header.Get("Authorization"), Scheme+" Credential=hook, SignedHeaders=content-type;host, "))
+	ret, _ := check(t, h, r)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, "hook", info.Client)
+	require.Equal(t, []string{"content-type", "host"}, info.SignedHeaders)
+	// the body is still there for the proxy
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"ok":true}`, string(body))
+	again, err := r.GetBody()
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(again)
+	require.NoError(t, err)
+	require.Equal(t, `{"ok":true}`, string(body))
+
+	// reordering the query doesn't matter
+	r = signed(t, "GET", "/list?b=2&a=1", "")
+	r.URL.RawQuery = "a=1&b=2"
+	ret, _ = check(t, h, r)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	// no signature at all is left to later instances
+	ret, _ = check(t, h, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer abc")
+	ret, _ = check(t, h, r)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+}
+
+// TestTampering changes each signed part of a request
+func TestTampering(t *testing.T) {
+	h, err := New(Config{Clients: map[string][]byte{"hook": secret}})
+	require.NoError(t, err)
+	tamper := map[string]func(r *http.Request){
+		"method": func(r *http.Request) { r.Method = "PUT" },
+		"path":   func(r *http.Request) { r.URL.Path = "/hooks/deploy" },
+		"query":  func(r *http.Request) { r.URL.RawQuery = "a=2" },
+		"host":   func(r *http.Request) { r.Host = "other.example.com" },
+		"header": func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") },
+		"body":   func(r *http.Request) { r.Body = ioutil.NopCloser(strings.NewReader(`{"ok":false}`)) },
+		"signature": func(r *http.Request) {
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "Signature=", "Signature=0", 1))
+		},
+		"timestamp": func(r *http.Request) {
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "Timestamp=", "Timestamp=1", 1))
+		},
+		"client": func(r *http.Request) {
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "Credential=hook", "Credential=other", 1))
+		},
+		"unsigned header": func(r *http.Request) {
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "content-type;", "", 1))
+		},
+		"malformed": func(r *http.Request) {
+			r.Header.Set("Authorization", r.Header.Get("Authorization")+", Extra=1")
+		},
+	}
+	for name, change := range tamper {
+		r := signed(t, "POST", "/hooks/build?a=1", `{"ok":true}`)
+		change(r)
+		ret, w := check(t, h, r)
+		require.Equal(t, authdoor.AuthDenied, ret.Auth, name)
+		require.Equal(t, authdoor.Answered, ret.Resp, name)
+		require.Equal(t, http.StatusUnauthorized, w.Code, name)
+		require.Equal(t, Scheme, w.Header().Get("WWW-Authenticate"), name)
+	}
+
+	// a header that's only added after signing doesn't count
+	r := signed(t, "POST", "/hooks/build", "")
+	r.Header.Set("X-Event", "push")
+	ret, _ := check(t, h, r)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.NotContains(t, info.SignedHeaders, "x-event")
+}
+
+// TestReplay checks nonces and timestamps
+func TestReplay(t *testing.T) {
+	h, err := New(Config{Clients: map[string][]byte{"hook": secret}, Skew: time.Minute})
+	require.NoError(t, err)
+
+	r := signed(t, "POST", "/hooks/build", "{}")
+	header := r.Header.Get("Authorization")
+	ret, _ := check(t, h, r)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	r = httptest.NewRequest("POST", "/hooks/build", strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", header)
+	ret, _ = check(t, h, r)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	// a bad signature doesn't use up the nonce
+	r = signed(t, "POST", "/hooks/build", "{}")
+	header = r.Header.Get("Authorization")
+	r.Method = "PUT"
+	ret, _ = check(t, h, r)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	r = httptest.NewRequest("POST", "/hooks/build", strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", header)
+	ret, _ = check(t, h, r)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	for _, offset := range []time.Duration{2 * time.Minute, -2 * time.Minute} {
+		h.now = func() time.Time { return time.Now().Add(offset) }
+		ret, _ = check(t, h, signed(t, "GET", "/", ""))
+		require.Equal(t, authdoor.AuthDenied, ret.Auth, offset.String())
+	}
+	h.now = func() time.Time { return time.Now().Add(30 * time.Second) }
+	ret, _ = check(t, h, signed(t, "GET", "/", ""))
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+}
+
+// TestConfig checks required headers, body limits and clients
+func TestConfig(t *testing.T) {
+	_, err := New(Config{})
+	require.Error(t, err)
+	_, err = New(Config{Clients: map[string][]byte{"hook": []byte("short")}})
+	require.Error(t, err)
+
+	h, err := New(Config{
+		Clients:         map[string][]byte{"hook": secret, "other": []byte("fedcba9876543210fedcba9876543210")},
+		RequiredHeaders: []string{"Host", "X-Event"},
+		MaxBody:         16,
+	})
+	require.NoError(t, err)
+
+	r := signed(t, "POST", "/", "{}")
+	r.Header.Set("X-Event", "push")
+	ret, w := check(t, h, r)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+	r.Header.Set("X-Event", "push")
+	require.NoError(t, Sign(r, "hook", secret, "x-event", "X-Event"))
+	ret, _ = check(t, h, r)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	// each client has its own secret
+	r = httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+	r.Header.Set("X-Event", "push")
+	require.NoError(t, Sign(r, "other", secret, "x-event"))
+	ret, _ = check(t, h, r)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 17)))
+	r.Header.Set("X-Event", "push")
+	require.NoError(t, Sign(r, "hook", secret, "x-event"))
+	ret, w = check(t, h, r)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// a body without a length is cut off too
+	r = httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 17)))
+	r.Header.Set("X-Event", "push")
+	require.NoError(t, Sign(r, "hook", secret, "x-event"))
+	r.ContentLength = -1
+	ret, w = check(t, h, r)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
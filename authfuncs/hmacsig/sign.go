@@ -0,0 +1,182 @@
+package hmacsig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Scheme is the Authorization scheme signed requests use
+const Scheme = "AUTHDOOR-HMAC-SHA256"
+
+// parameters is what's in a signed request's Authorization header
+type parameters struct {
+	client        string
+	signedHeaders []string
+	timestamp     string
+	nonce         string
+	signature     string
+}
+
+// String renders the parameters as an Authorization header
+func (p parameters) String() string {
+	return Scheme + " Credential=" + p.client +
+		", SignedHeaders=" + strings.Join(p.signedHeaders, ";") +
+		", Timestamp=" + p.timestamp +
+		", Nonce=" + p.nonce +
+		", Signature=" + p.signature
+}
+
+// parseAuthorization reads our Authorization header. ok is false if the header isn't ours at all.
+func parseAuthorization(header string) (p parameters, ok bool, err error) {
+	if len(header) <= len(Scheme) || !strings.EqualFold(header[:len(Scheme)+1], Scheme+" ") {
+		return p, false, nil
+	}
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(header[len(Scheme)+1:], ",") {
+		equals := strings.IndexByte(field, '=')
+		if equals == -1 {
+			return p, true, errors.Wrap(ErrMalformed, "field without =")
+		}
+		name, value := strings.TrimSpace(field[:equals]), strings.TrimSpace(field[equals+1:])
+		if seen[name] || value == "" {
+			return p, true, errors.Wrap(ErrMalformed, "repeated or empty "+name)
+		}
+		seen[name] = true
+		switch name {
+		case "Credential":
+			p.client = value
+		case "SignedHeaders":
+			p.signedHeaders = strings.Split(value, ";")
+		case "Timestamp":
+			p.timestamp = value
+		case "Nonce":
+			p.nonce = value
+		case "Signature":
+			p.signature = value
+		default:
+			return p, true, errors.Wrap(ErrMalformed, "unknown field "+name)
+		}
+	}
+	if len(seen) != 5 {
+		return p, true, errors.Wrap(ErrMalformed, "missing fields")
+	}
+	if len(p.nonce) < 16 || len(p.nonce) > 128 || strings.Trim(p.nonce, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return p, true, errors.Wrap(ErrMalformed, "nonce should be 16 to 128 URL safe characters")
+	}
+	for i, name := range p.signedHeaders {
+		if name == "" || name != strings.ToLower(name) || (i > 0 && p.signedHeaders[i-1] >= name) {
+			return p, true, errors.Wrap(ErrMalformed, "SignedHeaders should be lowercase, sorted and unique")
+		}
+	}
+	return p, true, nil
+}
+
+// escape percent-encodes everything but RFC 3986 unreserved characters
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// canonicalQuery sorts the query by name and then value, so reordering it doesn't change the signature
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, escape(name)+"="+escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// headerValue returns a header's values joined the way they'd be folded, with host taken from the request line
+func headerValue(r *http.Request, name string) string {
+	if name == "host" {
+		return r.Host
+	}
+	values := r.Header[http.CanonicalHeaderKey(name)]
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(trimmed, ", ")
+}
+
+// stringToSign is what's MACed. Every part is on its own line and none can contain a newline, so parts can't run into each other.
+func stringToSign(r *http.Request, p parameters, body []byte) string {
+	digest := sha256.Sum256(body)
+	lines := []string{Scheme, r.Method, r.URL.EscapedPath(), canonicalQuery(r.URL.Query())}
+	for _, name := range p.signedHeaders {
+		lines = append(lines, name+":"+headerValue(r, name))
+	}
+	lines = append(lines, strings.Join(p.signedHeaders, ";"), p.client, p.timestamp, p.nonce, hex.EncodeToString(digest[:]))
+	return strings.Join(lines, "\n")
+}
+
+// mac returns the hex HMAC-SHA256 of s
+func mac(secret []byte, s string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Sign signs a request for a client to send, covering host and the headers given. The body is read and put back.
+func Sign(r *http.Request, client string, secret []byte, headers ...string) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if r.Host == "" && r.URL != nil {
+		r.Host = r.URL.Host
+	}
+	signed := []string{"host"}
+	for _, name := range headers {
+		name = strings.ToLower(name)
+		if name != "host" && name != "authorization" {
+			signed = append(signed, name)
+		}
+	}
+	sort.Strings(signed)
+	unique := signed[:1]
+	for _, name := range signed[1:] {
+		if name != unique[len(unique)-1] {
+			unique = append(unique, name)
+		}
+	}
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	p := parameters{
+		client:        client,
+		signedHeaders: unique,
+		timestamp:     strconv.FormatInt(time.Now().Unix(), 10),
+		nonce:         base64.RawURLEncoding.EncodeToString(nonce),
+	}
+	p.signature = mac(secret, stringToSign(r, p, body))
+	r.Header.Set("Authorization", p.String())
+	return nil
+}
@@ -0,0 +1,304 @@
+package htpasswd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInsecureHash is returned for plaintext, {SHA} and MD5 entries unless they're allowed
+	ErrInsecureHash = errors.New("insecure hash")
+	// ErrBadHash is returned for entries that can't be parsed
+	ErrBadHash = errors.New("malformed hash")
+)
+
+// scheme is a kind of htpasswd hash
+type scheme int
+
+const (
+	schemeBcrypt scheme = iota
+	schemeSHA256Crypt
+	schemeSHA512Crypt
+	schemeMD5Crypt
+	schemeSHA1
+	schemePlain
+)
+
+// secure reports whether the scheme is acceptable without AllowInsecure
+func (s scheme) secure() bool {
+	return s == schemeBcrypt || s == schemeSHA256Crypt || s == schemeSHA512Crypt
+}
+
+// detect works out a hash's scheme from its prefix. Anything unrecognized is plaintext, like Apache on Windows.
+func detect(hashed string) scheme {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		return schemeBcrypt
+	case strings.HasPrefix(hashed, "$5$"):
+		return schemeSHA256Crypt
+	case strings.HasPrefix(hashed, "$6$"):
+		return schemeSHA512Crypt
+	case strings.HasPrefix(hashed, "$apr1$"), strings.HasPrefix(hashed, "$1$"):
+		return schemeMD5Crypt
+	case strings.HasPrefix(hashed, "{SHA}"):
+		return schemeSHA1
+	}
+	return schemePlain
+}
+
+// compare checks password against hashed, which has already been through detect
+func compare(s scheme, hashed string, password string) bool {
+	var computed string
+	switch s {
+	case schemeBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	case schemeSHA256Crypt, schemeSHA512Crypt:
+		var err error
+		if computed, err = shaCrypt(password, hashed); err != nil {
+			return false
+		}
+	case schemeMD5Crypt:
+		var err error
+		if computed, err = md5Crypt(password, hashed); err != nil {
+			return false
+		}
+	case schemeSHA1:
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		computed = password
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+}
+
+// itoa64 is the crypt(3) base64 alphabet
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// b64From24 appends n characters encoding three bytes, least significant first
+func b64From24(out []byte, b2, b1, b0 byte, n int) []byte {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out = append(out, itoa64[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
+
+// sha256Order and sha512Order are the byte triples the final digest is encoded in
+var (
+	sha256Order = [][3]int{{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14}, {15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29}}
+	sha512Order = [][3]int{{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10},
+		{53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41}}
+)
+
+// shaCrypt implements Ulrich Drepper's SHA-crypt ($5$ and $6$), using the magic, rounds and salt from setting
+func shaCrypt(password string, setting string) (string, error) {
+	var newHash func() hash.Hash
+	var magic string
+	switch {
+	case strings.HasPrefix(setting, "$5$"):
+		newHash, magic = sha256.New, "$5$"
+	case strings.HasPrefix(setting, "$6$"):
+		newHash, magic = sha512.New, "$6$"
+	default:
+		return "", ErrBadHash
+	}
+	rest := setting[len(magic):]
+	rounds, customRounds := 5000, false
+	if strings.HasPrefix(rest, "rounds=") {
+		end := strings.IndexByte(rest, '$')
+		if end == -1 {
+			return "", ErrBadHash
+		}
+		n, err := strconv.Atoi(rest[len("rounds="):end])
+		if err != nil {
+			return "", ErrBadHash
+		}
+		if n < 1000 {
+			n = 1000
+		} else if n > 999999999 {
+			n = 999999999
+		}
+		rounds, customRounds, rest = n, true, rest[end+1:]
+	}
+	salt := rest
+	if end := strings.IndexByte(salt, '$'); end != -1 {
+		salt = salt[:end]
+	}
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	b := newHash()
+	b.Write(p)
+	b.Write(s)
+	b.Write(p)
+	digestB := b.Sum(nil)
+	size := len(digestB)
+
+	a := newHash()
+	a.Write(p)
+	a.Write(s)
+	for i := len(p); i > 0; i -= size {
+		if i > size {
+			a.Write(digestB)
+		} else {
+			a.Write(digestB[:i])
+		}
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(p)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	dp := newHash()
+	for i := 0; i < len(p); i++ {
+		dp.Write(p)
+	}
+	pSeq := repeatTo(dp.Sum(nil), len(p))
+
+	ds := newHash()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeatTo(ds.Sum(nil), len(s))
+
+	c := digestA
+	for i := 0; i < rounds; i++ {
+		h := newHash()
+		if i&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+		if i%7 != 0 {
+			h.Write(pSeq)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+		c = h.Sum(nil)
+	}
+
+	out := []byte(magic)
+	if customRounds {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+	out = append(out, salt...)
+	out = append(out, '$')
+	if size == sha256.Size {
+		for _, t := range sha256Order {
+			out = b64From24(out, c[t[0]], c[t[1]], c[t[2]], 4)
+		}
+		out = b64From24(out, 0, c[31], c[30], 3)
+	} else {
+		for _, t := range sha512Order {
+			out = b64From24(out, c[t[0]], c[t[1]], c[t[2]], 4)
+		}
+		out = b64From24(out, 0, 0, c[63], 2)
+	}
+	return string(out), nil
+}
+
+// repeatTo repeats digest until it's n bytes long
+func repeatTo(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if n-len(out) >= len(digest) {
+			out = append(out, digest...)
+		} else {
+			out = append(out, digest[:n-len(out)]...)
+		}
+	}
+	return out
+}
+
+// md5Crypt implements the MD5 crypt used by Apache ($apr1$) and glibc ($1$)
+func md5Crypt(password string, setting string) (string, error) {
+	magic := "$apr1$"
+	if strings.HasPrefix(setting, "$1$") {
+		magic = "$1$"
+	} else if !strings.HasPrefix(setting, magic) {
+		return "", ErrBadHash
+	}
+	salt := setting[len(magic):]
+	if end := strings.IndexByte(salt, '$'); end != -1 {
+		salt = salt[:end]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	ctx := md5.New()
+	ctx.Write(p)
+	ctx.Write([]byte(magic))
+	ctx.Write(s)
+	alt := md5.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	altSum := alt.Sum(nil)
+	for i := len(p); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(p[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(p)
+		}
+		final = h.Sum(nil)
+	}
+
+	out := []byte(magic + salt + "$")
+	for _, t := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		out = b64From24(out, final[t[0]], final[t[1]], final[t[2]], 4)
+	}
+	out = b64From24(out, 0, 0, final[11], 2)
+	return string(out), nil
+}
@@ -0,0 +1,217 @@
+/*
+Package htpasswd is an AuthFunc for HTTP Basic auth against an Apache htpasswd file. bcrypt and SHA-crypt entries are accepted, plaintext, {SHA} and MD5 only if AllowInsecure is set.
+*/
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// Config describes the htpasswd file and the challenge
+type Config struct {
+	File string
+	// Realm is sent in the WWW-Authenticate challenge, defaults to "authdoor"
+	Realm string
+	// AllowInsecure accepts plaintext, {SHA} and MD5 ($apr1$) entries, which are otherwise skipped
+	AllowInsecure bool
+}
+
+// entry is one user's hash
+type entry struct {
+	scheme scheme
+	hash   string
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	User string `json:"user"`
+}
+
+// Htpasswd supplies an authfunc receiver and stores information to be used by that receiver
+type Htpasswd struct {
+	config  Config
+	mutex   *sync.RWMutex
+	users   map[string]entry
+	modTime time.Time
+}
+
+// New loads the file and returns an Htpasswd ready to be used as an AuthFunc
+func New(config Config) (*Htpasswd, error) {
+	if config.Realm == "" {
+		config.Realm = "authdoor"
+	}
+	h := &Htpasswd{
+		config: config,
+		mutex:  new(sync.RWMutex),
+		users:  make(map[string]entry),
+	}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parse reads htpasswd lines, skipping comments, malformed lines and insecure hashes that aren't allowed
+func (h *Htpasswd) parse(data []byte) map[string]entry {
+	users := make(map[string]entry)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		colon := strings.IndexByte(text, ':')
+		if colon < 1 {
+			defaultLogger.Error(h.config.File + ":" + strconv.Itoa(line) + " is malformed")
+			continue
+		}
+		user, hashed := text[:colon], text[colon+1:]
+		s := detect(hashed)
+		if !s.secure() && !h.config.AllowInsecure {
+			defaultLogger.Error(h.config.File + ":" + strconv.Itoa(line) + " " + ErrInsecureHash.Error() + " for " + user + ", skipped")
+			continue
+		}
+		users[user] = entry{scheme: s, hash: hashed}
+	}
+	return users
+}
+
+// Reload rereads the file. The old users are kept if it can't be read.
+func (h *Htpasswd) Reload() error {
+	info, err := os.Stat(h.config.File)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(h.config.File)
+	if err != nil {
+		return err
+	}
+	users := h.parse(data)
+	h.mutex.Lock()
+	h.users = users
+	h.modTime = info.ModTime()
+	h.mutex.Unlock()
+	defaultLogger.Info("htpasswd loaded " + strconv.Itoa(len(users)) + " users from " + h.config.File)
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes, checking every interval. Call the returned function to stop.
+func (h *Htpasswd) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(h.config.File)
+				if err != nil {
+					continue
+				}
+				h.mutex.RLock()
+				changed := !info.ModTime().Equal(h.modTime)
+				h.mutex.RUnlock()
+				if changed {
+					if err := h.Reload(); err != nil {
+						defaultLogger.Error("htpasswd reload failed: " + err.Error())
+					}
+				}
+			}
+		}
+	}()
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// maxPasswordLength caps what we'll hash, sha-crypt's work grows with the square of the password's length
+const maxPasswordLength = 256
+
+var (
+	dummyOnce = new(sync.Once)
+	dummyHash []byte
+)
+
+// dummyCompare spends about as long as a real bcrypt check so unknown users can't be told apart by timing
+func dummyCompare(password string) {
+	dummyOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("authdoor"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// Verify checks a user's password
+func (h *Htpasswd) Verify(user, password string) bool {
+	if len(password) > maxPasswordLength {
+		return false
+	}
+	h.mutex.RLock()
+	e, ok := h.users[user]
+	h.mutex.RUnlock()
+	if !ok {
+		dummyCompare(password)
+		return false
+	}
+	return compare(e.scheme, e.hash, password)
+}
+
+// challenge writes a 401 asking for Basic credentials
+func (h *Htpasswd) challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.Replace(h.config.Realm, `"`, `'`, -1)+`", charset="UTF-8"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// Check is an authfunc. Missing credentials get a challenge, wrong ones are denied with a fresh challenge so the browser asks again.
+func (h *Htpasswd) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		h.challenge(w)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}, nil
+	}
+	if !h.Verify(user, password) {
+		defaultLogger.Info("htpasswd rejected " + user)
+		h.challenge(w)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	info, err := json.Marshal(Info{User: user})
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: info},
+	}, nil
+}
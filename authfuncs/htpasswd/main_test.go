@@ -0,0 +1,164 @@
+package htpasswd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/htpasswd/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// TestCrypt checks the hand written schemes against hashes made by openssl passwd
+func TestCrypt(t *testing.T) {
+	table := []struct {
+		password string
+		hash     string
+	}{
+		{"Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"This is just a test", "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"Hello world!", "$apr1$saltstri$aGfuB7Lcvs2TUeFTqUVfN0"},
+		{"", "$apr1$abc$BfqKdn9xFDWJPa3kcp/PH0"},
+		{"pw", "$1$12345678$OYWcP3UEQ50eVnrC3.L3v/"},
+		{"pw", "{SHA}GpHWL3ymc5liWkNopqtdSjuqYHM="},
+		{"pw", "pw"},
+	}
+	for _, row := range table {
+		s := detect(row.hash)
+		require.True(t, compare(s, row.hash, row.password), row.hash)
+		require.False(t, compare(s, row.hash, row.password+"x"), row.hash)
+	}
+}
+
+// writeFile writes an htpasswd file into dir
+func writeFile(t *testing.T, dir string, lines string) string {
+	file := filepath.Join(dir, "htpasswd")
+	require.NoError(t, ioutil.WriteFile(file, []byte(lines), 0600))
+	return file
+}
+
+// call runs h.Check with optional credentials
+func call(t *testing.T, h *Htpasswd, user, password string) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	recorder := httptest.NewRecorder()
+	ret, err := h.Check(recorder, req)
+	require.NoError(t, err)
+	return ret, recorder
+}
+
+// TestCheck runs the authfunc against a file with secure and insecure entries
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	file := writeFile(t, dir, "# users\naj:"+string(bcryptHash)+"\nsha:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\nplain:pw\nmd5:$apr1$saltstri$aGfuB7Lcvs2TUeFTqUVfN0\nbroken\n")
+
+	h, err := New(Config{File: file, Realm: "test"})
+	require.NoError(t, err)
+
+	ret, recorder := call(t, h, "", "")
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	require.Equal(t, `Basic realm="test", charset="UTF-8"`, recorder.Header().Get("WWW-Authenticate"))
+
+	ret, _ = call(t, h, "aj", "secret")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, "aj", info.User)
+
+	ret, _ = call(t, h, "sha", "Hello world!")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	ret, recorder = call(t, h, "aj", "wrong")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	require.NotEmpty(t, recorder.Header().Get("WWW-Authenticate"))
+
+	ret, _ = call(t, h, "nobody", "secret")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	// oversized passwords are wrong without being hashed
+	ret, _ = call(t, h, "sha", strings.Repeat("x", maxPasswordLength+1))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.False(t, h.Verify("sha", strings.Repeat("x", 1<<20)))
+
+	// insecure entries are skipped unless allowed
+	ret, _ = call(t, h, "plain", "pw")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	ret, _ = call(t, h, "md5", "Hello world!")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	insecure, err := New(Config{File: file, AllowInsecure: true})
+	require.NoError(t, err)
+	ret, _ = call(t, insecure, "plain", "pw")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	ret, _ = call(t, insecure, "md5", "Hello world!")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	_, err = New(Config{File: filepath.Join(dir, "missing")})
+	require.Error(t, err)
+}
+
+// TestWatch makes sure changes to the file are picked up
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := writeFile(t, dir, "sha:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n")
+	h, err := New(Config{File: file})
+	require.NoError(t, err)
+	require.True(t, h.Verify("sha", "Hello world!"))
+	stop := h.Watch(10 * time.Millisecond)
+	defer stop()
+
+	time.Sleep(20 * time.Millisecond) // so the modification time moves on coarse filesystems
+	writeFile(t, dir, "other:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for h.Verify("sha", "Hello world!") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.False(t, h.Verify("sha", "Hello world!"))
+	require.True(t, h.Verify("other", "Hello world!"))
+}
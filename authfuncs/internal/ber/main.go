@@ -0,0 +1,259 @@
+/*
+Package ber reads and writes the subset of ASN.1 BER that LDAP uses: definite lengths, tags under 31, and the universal types LDAP messages are built from.
+*/
+package ber
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrMalformed is returned for packets that aren't valid BER or use something we don't support
+	ErrMalformed = errors.New("malformed BER")
+	// ErrTooLarge is returned for packets over MaxSize
+	ErrTooLarge = errors.New("BER packet too large")
+)
+
+// MaxSize caps the packets Read accepts so a peer can't make us allocate without bound
+var MaxSize = 4 << 20
+
+// Classes, already shifted into place
+const (
+	ClassUniversal   = 0x00
+	ClassApplication = 0x40
+	ClassContext     = 0x80
+)
+
+// Universal tags
+const (
+	TagBoolean     = 1
+	TagInteger     = 2
+	TagOctetString = 4
+	TagNull        = 5
+	TagEnumerated  = 10
+	TagSequence    = 16
+	TagSet         = 17
+)
+
+// Packet is one BER element. Primitive packets have a Value, constructed ones have Children.
+type Packet struct {
+	Class       byte
+	Constructed bool
+	Tag         int
+	Value       []byte
+	Children    []*Packet
+}
+
+// Is reports whether the packet has class and tag
+func (p *Packet) Is(class byte, tag int) bool {
+	return p.Class == class && p.Tag == tag
+}
+
+// Int decodes a primitive integer or enumerated value
+func (p *Packet) Int() (int64, error) {
+	if p.Constructed || len(p.Value) == 0 || len(p.Value) > 8 {
+		return 0, ErrMalformed
+	}
+	n := int64(int8(p.Value[0]))
+	for _, b := range p.Value[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+// Bool decodes a primitive boolean
+func (p *Packet) Bool() (bool, error) {
+	if p.Constructed || len(p.Value) != 1 {
+		return false, ErrMalformed
+	}
+	return p.Value[0] != 0, nil
+}
+
+// String returns a primitive value as a string
+func (p *Packet) String() string {
+	return string(p.Value)
+}
+
+// Child returns the i'th child, or ErrMalformed if there isn't one
+func (p *Packet) Child(i int) (*Packet, error) {
+	if !p.Constructed || i >= len(p.Children) {
+		return nil, ErrMalformed
+	}
+	return p.Children[i], nil
+}
+
+// encodeLength writes a definite length
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// Bytes encodes the packet
+func (p *Packet) Bytes() []byte {
+	content := p.Value
+	if p.Constructed {
+		content = nil
+		for _, child := range p.Children {
+			content = append(content, child.Bytes()...)
+		}
+	}
+	identifier := p.Class | byte(p.Tag)
+	if p.Constructed {
+		identifier |= 0x20
+	}
+	out := append([]byte{identifier}, encodeLength(len(content))...)
+	return append(out, content...)
+}
+
+// Decode reads one packet from the front of data and returns what's after it
+func Decode(data []byte) (*Packet, []byte, error) {
+	return decode(data, 0)
+}
+
+// decode reads one packet at depth
+func decode(data []byte, depth int) (*Packet, []byte, error) {
+	if depth > 32 || len(data) < 2 {
+		return nil, nil, ErrMalformed
+	}
+	p := &Packet{Class: data[0] & 0xc0, Constructed: data[0]&0x20 != 0, Tag: int(data[0] & 0x1f)}
+	if p.Tag == 0x1f {
+		return nil, nil, ErrMalformed
+	}
+	length, rest, err := decodeLength(data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if length > len(rest) {
+		return nil, nil, ErrMalformed
+	}
+	content, after := rest[:length], rest[length:]
+	if !p.Constructed {
+		p.Value = content
+		return p, after, nil
+	}
+	for len(content) > 0 {
+		var child *Packet
+		child, content, err = decode(content, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.Children = append(p.Children, child)
+	}
+	return p, after, nil
+}
+
+// decodeLength reads a definite length
+func decodeLength(data []byte) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, ErrMalformed
+	}
+	if data[0] < 0x80 {
+		return int(data[0]), data[1:], nil
+	}
+	size := int(data[0] & 0x7f)
+	// 0x80 is an indefinite length, which LDAP doesn't allow
+	if size == 0 || size > 4 || len(data) < 1+size {
+		return 0, nil, ErrMalformed
+	}
+	length := 0
+	for _, b := range data[1 : 1+size] {
+		length = length<<8 | int(b)
+	}
+	if length < 0 {
+		return 0, nil, ErrMalformed
+	}
+	return length, data[1+size:], nil
+}
+
+// Read reads one whole packet from r
+func Read(r *bufio.Reader) (*Packet, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[1] >= 0x80 {
+		size := int(header[1] & 0x7f)
+		if size == 0 || size > 4 {
+			return nil, ErrMalformed
+		}
+		header = header[:2+size]
+		if _, err := io.ReadFull(r, header[2:]); err != nil {
+			return nil, err
+		}
+	}
+	length, _, err := decodeLength(header[1:])
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxSize {
+		return nil, ErrTooLarge
+	}
+	data := make([]byte, len(header)+length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[len(header):]); err != nil {
+		return nil, err
+	}
+	p, _, err := Decode(data)
+	return p, err
+}
+
+// NewSequence makes a universal sequence
+func NewSequence(children ...*Packet) *Packet {
+	return &Packet{Class: ClassUniversal, Constructed: true, Tag: TagSequence, Children: children}
+}
+
+// NewSet makes a universal set
+func NewSet(children ...*Packet) *Packet {
+	return &Packet{Class: ClassUniversal, Constructed: true, Tag: TagSet, Children: children}
+}
+
+// NewConstructed makes a constructed packet with any class and tag
+func NewConstructed(class byte, tag int, children ...*Packet) *Packet {
+	return &Packet{Class: class, Constructed: true, Tag: tag, Children: children}
+}
+
+// NewPrimitive makes a primitive packet with any class and tag
+func NewPrimitive(class byte, tag int, value []byte) *Packet {
+	return &Packet{Class: class, Tag: tag, Value: value}
+}
+
+// NewString makes an octet string
+func NewString(s string) *Packet {
+	return NewPrimitive(ClassUniversal, TagOctetString, []byte(s))
+}
+
+// encodeInt is the minimal two's complement encoding of n
+func encodeInt(n int64) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; !(n == 0 && b[0]&0x80 == 0) && !(n == -1 && b[0]&0x80 != 0); n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
+
+// NewInt makes an integer
+func NewInt(n int64) *Packet {
+	return NewPrimitive(ClassUniversal, TagInteger, encodeInt(n))
+}
+
+// NewEnum makes an enumerated value
+func NewEnum(n int64) *Packet {
+	return NewPrimitive(ClassUniversal, TagEnumerated, encodeInt(n))
+}
+
+// NewBool makes a boolean
+func NewBool(b bool) *Packet {
+	if b {
+		return NewPrimitive(ClassUniversal, TagBoolean, []byte{0xff})
+	}
+	return NewPrimitive(ClassUniversal, TagBoolean, []byte{0})
+}
@@ -0,0 +1,67 @@
+package ber
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRoundTrip encodes and decodes a packet shaped like an LDAP bind request
+func TestRoundTrip(t *testing.T) {
+	packet := NewSequence(
+		NewInt(1),
+		NewConstructed(ClassApplication, 0,
+			NewInt(3),
+			NewString("cn=admin,dc=example,dc=com"),
+			NewPrimitive(ClassContext, 0, []byte(strings.Repeat("x", 300))),
+		),
+	)
+	data := packet.Bytes()
+	decoded, rest, err := Decode(data)
+	require.NoError(t, err)
+	require.Len(t, rest, 0)
+	require.Equal(t, data, decoded.Bytes())
+	op, err := decoded.Child(1)
+	require.NoError(t, err)
+	require.True(t, op.Is(ClassApplication, 0))
+	require.Equal(t, "cn=admin,dc=example,dc=com", op.Children[1].String())
+	require.Len(t, op.Children[2].Value, 300)
+
+	read, err := Read(bufio.NewReader(bytes.NewReader(append(data, data...))))
+	require.NoError(t, err)
+	require.Equal(t, data, read.Bytes())
+}
+
+// TestInt checks integers round trip at their edges
+func TestInt(t *testing.T) {
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 40, -1 << 40} {
+		got, err := NewInt(n).Int()
+		require.NoError(t, err)
+		require.Equal(t, n, got)
+	}
+	require.Equal(t, []byte{0x02, 0x02, 0x00, 0x80}, NewInt(128).Bytes())
+	require.Equal(t, []byte{0x02, 0x01, 0xff}, NewInt(-1).Bytes())
+}
+
+// TestMalformed checks bad input is refused
+func TestMalformed(t *testing.T) {
+	bad := [][]byte{
+		{0x30},
+		{0x30, 0x80, 0x00, 0x00},       // indefinite length
+		{0x04, 0x05, 'a'},              // short
+		{0x1f, 0x01, 0x00},             // long tag
+		{0x30, 0x03, 0x04, 0x05, 0x00}, // child overruns its parent
+		bytes.Repeat([]byte{0x30, 0x02}, 40),
+	}
+	for _, data := range bad {
+		_, _, err := Decode(data)
+		require.Equal(t, ErrMalformed, err, "%x", data)
+	}
+	MaxSize = 10
+	defer func() { MaxSize = 4 << 20 }()
+	_, err := Read(bufio.NewReader(bytes.NewReader(NewString(strings.Repeat("x", 11)).Bytes())))
+	require.Equal(t, ErrTooLarge, err)
+}
@@ -0,0 +1,180 @@
+/*
+Package codeflow is the browser side of the OAuth2 authorization code flow with PKCE, shared by the oidc and oauth2 AuthFuncs: sending the user to the provider with a state cookie, checking that cookie when they come back, and the sessions made afterwards.
+*/
+package codeflow
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/redirect"
+	"github.com/ayjayt/authdoor/authfuncs/internal/seal"
+	"github.com/ayjayt/authdoor/authfuncs/internal/session"
+)
+
+var (
+	// ErrState is returned by Callback when the state cookie is missing, invalid or doesn't match the callback
+	ErrState = errors.New("state mismatch")
+	// ErrProvider is returned by Callback when the provider sent an error instead of a code
+	ErrProvider = errors.New("provider returned an error")
+)
+
+// stateLength is how long the user has at the provider
+const stateLength = 10 * time.Minute
+
+// State is kept in an encrypted cookie while the user is at the provider, so the PKCE verifier isn't readable in the browser
+type State struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n,omitempty"`
+	Verifier string `json:"v"`
+	Return   string `json:"r"`
+}
+
+// Flow is one AuthFunc's sessions and state cookie
+type Flow struct {
+	prefix        string
+	uuid          string
+	sessionLength time.Duration
+	sealer        *seal.Sealer
+	sessions      *session.Map
+}
+
+// New returns a Flow whose cookies start with prefix and whose sessions last sessionLength
+func New(prefix string, sessionLength time.Duration) *Flow {
+	return &Flow{
+		prefix:        prefix,
+		uuid:          uuid.New().String(),
+		sessionLength: sessionLength,
+		sealer:        seal.New(nil),
+		sessions:      session.New(),
+	}
+}
+
+// CookieName is the name of the session cookie
+func (f *Flow) CookieName() string {
+	return f.prefix + "-" + f.uuid
+}
+
+// stateCookieName is the name of the cookie holding the State
+func (f *Flow) stateCookieName() string {
+	return f.prefix + "-state-" + f.uuid
+}
+
+// RandomString returns n random bytes, base64url encoded
+func RandomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Session returns the info kept for the request's session, if it has one
+func (f *Flow) Session(r *http.Request) (json.RawMessage, bool) {
+	cookie, err := r.Cookie(f.CookieName())
+	if err != nil {
+		return nil, false
+	}
+	info, ok := f.sessions.Get(cookie.Value, time.Now())
+	if !ok {
+		return nil, false
+	}
+	return info.(json.RawMessage), true
+}
+
+// Login sends the browser to authURL with query plus a fresh state and PKCE challenge, and a nonce if nonce is set. The request's path is where the user lands afterwards.
+func (f *Flow) Login(w http.ResponseWriter, r *http.Request, authURL string, query url.Values, nonce bool) (authdoor.AuthFuncReturn, error) {
+	state := State{
+		State:    RandomString(16),
+		Verifier: RandomString(32),
+		Return:   r.URL.RequestURI(),
+	}
+	if nonce {
+		state.Nonce = RandomString(16)
+		query.Set("nonce", state.Nonce)
+	}
+	value, err := f.sealer.Encrypt(state, time.Now().Add(stateLength))
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     f.stateCookieName(),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(stateLength / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query.Set("response_type", "code")
+	query.Set("state", state.State)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + query.Encode()
+	} else {
+		authURL += "?" + query.Encode()
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}, nil
+}
+
+// Callback clears the state cookie and returns the State if it matches the callback and the provider didn't send an error
+func (f *Flow) Callback(w http.ResponseWriter, r *http.Request) (State, error) {
+	state := State{}
+	query := r.URL.Query()
+	http.SetCookie(w, &http.Cookie{Name: f.stateCookieName(), Value: "", Path: "/", MaxAge: -1})
+	cookie, err := r.Cookie(f.stateCookieName())
+	if err != nil {
+		return state, errors.Wrap(ErrState, "no state cookie")
+	}
+	if err := f.sealer.Decrypt(cookie.Value, &state); err != nil {
+		return state, errors.Wrap(ErrState, err.Error())
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		return state, errors.Wrap(ErrState, "callback state doesn't match cookie")
+	}
+	if providerError := query.Get("error"); providerError != "" {
+		return state, errors.Wrap(ErrProvider, providerError)
+	}
+	return state, nil
+}
+
+// Finish makes a session holding info and sends the browser back to where the login started, as long as that's on this site
+func (f *Flow) Finish(w http.ResponseWriter, r *http.Request, state State, info json.RawMessage) authdoor.AuthFuncReturn {
+	sess := uuid.New().String()
+	now := time.Now()
+	f.sessions.Set(sess, info, now.Add(f.sessionLength), now)
+	http.SetCookie(w, &http.Cookie{
+		Name:     f.CookieName(),
+		Value:    sess,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, redirect.Local(state.Return), http.StatusFound)
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Answered,
+		Info: authdoor.InstanceReturnInfo{Info: info},
+	}
+}
+
+// Answer writes status and a short message. Failed logins aren't retried automatically so we don't loop with the provider.
+func Answer(w http.ResponseWriter, auth authdoor.AuthStatus, status int) (authdoor.AuthFuncReturn, error) {
+	http.Error(w, http.StatusText(status), status)
+	return authdoor.AuthFuncReturn{Auth: auth, Resp: authdoor.Answered}, nil
+}
@@ -0,0 +1,76 @@
+package codeflow
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+)
+
+// TestFlow runs Login, Callback and Finish like a provider that approves everything
+func TestFlow(t *testing.T) {
+	f := New("test", time.Hour)
+	recorder := httptest.NewRecorder()
+	ret, err := f.Login(recorder, httptest.NewRequest("GET", "https://app.local/private?x=1", nil), "https://idp.local/auth?tenant=1", url.Values{"client_id": {"client"}}, true)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	authURL, err := url.Parse(recorder.Header().Get("Location"))
+	require.NoError(t, err)
+	query := authURL.Query()
+	require.Equal(t, "1", query.Get("tenant"))
+	require.Equal(t, "code", query.Get("response_type"))
+	require.Equal(t, "S256", query.Get("code_challenge_method"))
+	require.NotEmpty(t, query.Get("nonce"))
+	stateCookie := recorder.Result().Cookies()[0]
+
+	req := httptest.NewRequest("GET", "https://app.local/cb?code=c&state="+url.QueryEscape(query.Get("state")), nil)
+	req.AddCookie(stateCookie)
+	recorder = httptest.NewRecorder()
+	state, err := f.Callback(recorder, req)
+	require.NoError(t, err)
+	require.Equal(t, query.Get("nonce"), state.Nonce)
+	require.Equal(t, -1, recorder.Result().Cookies()[0].MaxAge)
+
+	recorder = httptest.NewRecorder()
+	ret = f.Finish(recorder, req, state, json.RawMessage(`{"sub":"aj"}`))
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, "/private?x=1", recorder.Header().Get("Location"))
+	req = httptest.NewRequest("GET", "https://app.local/private", nil)
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == f.CookieName() {
+			req.AddCookie(cookie)
+		}
+	}
+	info, ok := f.Session(req)
+	require.True(t, ok)
+	require.Equal(t, `{"sub":"aj"}`, string(info))
+
+	// a return path that isn't local goes home instead
+	recorder = httptest.NewRecorder()
+	f.Finish(recorder, req, State{Return: "//evil.com/x"}, nil)
+	require.Equal(t, "/", recorder.Header().Get("Location"))
+}
+
+// TestCallback makes sure bad state and provider errors are refused
+func TestCallback(t *testing.T) {
+	f := New("test", time.Hour)
+	_, err := f.Callback(httptest.NewRecorder(), httptest.NewRequest("GET", "/cb?state=s", nil))
+	require.Equal(t, ErrState, errors.Cause(err))
+
+	value, err := f.sealer.Encrypt(State{State: "s"}, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	for query, want := range map[string]error{"state=other": ErrState, "state=s&error=access_denied": ErrProvider, "state=s&code=c": nil} {
+		req := httptest.NewRequest("GET", "/cb?"+query, nil)
+		req.AddCookie(&http.Cookie{Name: f.stateCookieName(), Value: value})
+		_, err = f.Callback(httptest.NewRecorder(), req)
+		require.Equal(t, want, errors.Cause(err), query)
+	}
+}
@@ -0,0 +1,267 @@
+package jose
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrKeyNotFound is returned when no key in a set matches a kid
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrBadKey is returned for JWKs we can't turn into keys
+	ErrBadKey = errors.New("bad jwk")
+)
+
+// JSONWebKey is a single public key from a JWK set (RFC 7517). Private and symmetric members are ignored.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is the document served at a jwks_uri
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// decodeInt decodes a base64url big-endian integer
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, ErrBadKey
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// PublicKey returns the key as the type Verify expects
+func (k JSONWebKey) PublicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, ErrBadKey
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Wrap(ErrBadKey, "curve "+k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.Wrap(ErrBadKey, "point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.Wrap(ErrBadKey, "curve "+k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrBadKey
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.Wrap(ErrBadKey, "kty "+k.Kty)
+}
+
+// padded returns b left padded with zeros to size bytes
+func padded(b []byte, size int) []byte {
+	ret := make([]byte, size)
+	copy(ret[size-len(b):], b)
+	return ret
+}
+
+// NewJSONWebKey is the inverse of PublicKey, it's mostly used to serve test keys
+func NewJSONWebKey(kid string, key interface{}) (JSONWebKey, error) {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			Kty: "RSA",
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return JSONWebKey{
+			Kty: "EC",
+			Kid: kid,
+			Crv: pub.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(padded(pub.X.Bytes(), size)),
+			Y:   base64.RawURLEncoding.EncodeToString(padded(pub.Y.Bytes(), size)),
+		}, nil
+	case ed25519.PublicKey:
+		return JSONWebKey{Kty: "OKP", Kid: kid, Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub)}, nil
+	}
+	return JSONWebKey{}, ErrBadKey
+}
+
+// PublicKeys converts the set into a map by kid, skipping keys that aren't for signatures or that we can't parse
+func (s JSONWebKeySet) PublicKeys() map[string]interface{} {
+	ret := make(map[string]interface{}, len(s.Keys))
+	for _, jwk := range s.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		ret[jwk.Kid] = key
+	}
+	return ret
+}
+
+// RemoteKeySet fetches a JWK set from a URL and caches it. The set is refetched once it's older than the refresh interval (or the response's max-age), and when a token names a kid we haven't seen, so that key rotation is picked up without a restart.
+type RemoteKeySet struct {
+	client      *http.Client
+	url         string
+	refresh     time.Duration
+	minInterval time.Duration
+	mutex       *sync.Mutex
+	keys        map[string]interface{}
+	expires     time.Time
+	lastFetch   time.Time
+}
+
+// NewRemoteKeySet returns a RemoteKeySet for url. A nil client uses http.DefaultClient and a zero refresh defaults to an hour.
+func NewRemoteKeySet(client *http.Client, url string, refresh time.Duration) *RemoteKeySet {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if refresh == 0 {
+		refresh = time.Hour
+	}
+	return &RemoteKeySet{
+		client:      client,
+		url:         url,
+		refresh:     refresh,
+		minInterval: 10 * time.Second,
+		mutex:       new(sync.Mutex),
+	}
+}
+
+// Key returns the key for kid, fetching the set if it's stale or doesn't have kid. An empty kid matches the set's only key.
+func (s *RemoteKeySet) Key(ctx context.Context, kid string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	stale := s.keys == nil || now.After(s.expires)
+	if !stale {
+		if key, ok := lookup(s.keys, kid); ok {
+			return key, nil
+		}
+	}
+	// Unknown kids trigger a refetch, but not more often than minInterval so bad tokens can't hammer the IdP
+	if stale || now.Sub(s.lastFetch) >= s.minInterval {
+		if err := s.fetch(ctx, now); err != nil {
+			if s.keys == nil {
+				return nil, err
+			}
+			// keep serving the old set if the refresh failed, and try again later
+			s.expires = now.Add(s.minInterval)
+		}
+	}
+	if key, ok := lookup(s.keys, kid); ok {
+		return key, nil
+	}
+	return nil, errors.Wrap(ErrKeyNotFound, kid)
+}
+
+// lookup finds kid in keys
+func lookup(keys map[string]interface{}, kid string) (interface{}, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// fetch downloads the set, the mutex must be held
+func (s *RemoteKeySet) fetch(ctx context.Context, now time.Time) error {
+	s.lastFetch = now
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fetching jwks")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("fetching jwks: " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return errors.Wrap(err, "reading jwks")
+	}
+	set := JSONWebKeySet{}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return errors.Wrap(err, "parsing jwks")
+	}
+	s.keys = set.PublicKeys()
+	age := maxAge(resp.Header.Get("Cache-Control"), s.refresh)
+	if age < s.minInterval {
+		age = s.minInterval
+	}
+	s.expires = now.Add(age)
+	return nil
+}
+
+// maxAge reads max-age from a Cache-Control header, returning fallback if there isn't one or it's longer than fallback
+func maxAge(cacheControl string, fallback time.Duration) time.Duration {
+	const prefix = "max-age="
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, prefix) {
+			seconds, err := strconv.Atoi(directive[len(prefix):])
+			if err == nil && seconds >= 0 && time.Duration(seconds)*time.Second < fallback {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,282 @@
+/*
+Package jose implements the small part of JOSE (compact JWS, JWK sets and registered JWT claims) the authfuncs need to check tokens signed by someone else.
+*/
+package jose
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	// hashes used by the algorithms below
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrMalformed is returned when a token isn't a compact JWS
+	ErrMalformed = errors.New("malformed token")
+	// ErrUnsupportedAlg is returned for algorithms we don't implement, including "none"
+	ErrUnsupportedAlg = errors.New("unsupported algorithm")
+	// ErrKeyType is returned when the key doesn't fit the token's algorithm
+	ErrKeyType = errors.New("key type doesn't match algorithm")
+	// ErrSignature is returned when a signature doesn't verify
+	ErrSignature = errors.New("signature verification failed")
+	// ErrExpired is returned by Claims.ValidateTime when exp has passed
+	ErrExpired = errors.New("token is expired")
+	// ErrNotYetValid is returned by Claims.ValidateTime when nbf or iat is in the future
+	ErrNotYetValid = errors.New("token is not valid yet")
+)
+
+// Header is the protected header of a JWS
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// JWS is a parsed, not yet verified, compact JWS
+type JWS struct {
+	Header       Header
+	Payload      []byte
+	signingInput []byte
+	signature    []byte
+}
+
+// ParseCompact splits and decodes a compact JWS (header.payload.signature). It does not verify anything.
+func ParseCompact(token string) (*JWS, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(ErrMalformed, "header")
+	}
+	ret := &JWS{signingInput: []byte(parts[0] + "." + parts[1])}
+	if err := json.Unmarshal(rawHeader, &ret.Header); err != nil {
+		return nil, errors.Wrap(ErrMalformed, "header")
+	}
+	if ret.Payload, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, errors.Wrap(ErrMalformed, "payload")
+	}
+	if ret.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, errors.Wrap(ErrMalformed, "signature")
+	}
+	return ret, nil
+}
+
+// hashFor returns the hash used by an algorithm name
+func hashFor(alg string) (crypto.Hash, error) {
+	switch alg[len(alg)-3:] {
+	case "256":
+		return crypto.SHA256, nil
+	case "384":
+		return crypto.SHA384, nil
+	case "512":
+		return crypto.SHA512, nil
+	}
+	return 0, errors.Wrap(ErrUnsupportedAlg, alg)
+}
+
+// Verify checks the signature with key, which must be a []byte for HS*, *rsa.PublicKey for RS*/PS*, *ecdsa.PublicKey for ES* and ed25519.PublicKey for EdDSA.
+func (j *JWS) Verify(key interface{}) error {
+	alg := j.Header.Alg
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return ErrKeyType
+		}
+		if !ed25519.Verify(pub, j.signingInput, j.signature) {
+			return ErrSignature
+		}
+		return nil
+	}
+	if len(alg) != 5 {
+		return errors.Wrap(ErrUnsupportedAlg, alg)
+	}
+	hash, err := hashFor(alg)
+	if err != nil {
+		return err
+	}
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrKeyType
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(j.signingInput)
+		if !hmac.Equal(mac.Sum(nil), j.signature) {
+			return ErrSignature
+		}
+		return nil
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrKeyType
+		}
+		digest := hash.New()
+		digest.Write(j.signingInput)
+		if alg[:2] == "RS" {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest.Sum(nil), j.signature)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest.Sum(nil), j.signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return ErrSignature
+		}
+		return nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrKeyType
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(j.signature) != 2*size {
+			return ErrSignature
+		}
+		digest := hash.New()
+		digest.Write(j.signingInput)
+		r := new(big.Int).SetBytes(j.signature[:size])
+		s := new(big.Int).SetBytes(j.signature[size:])
+		if !ecdsa.Verify(pub, digest.Sum(nil), r, s) {
+			return ErrSignature
+		}
+		return nil
+	}
+	return errors.Wrap(ErrUnsupportedAlg, alg)
+}
+
+// Sign makes a compact JWS over payload. It's the counterpart of Verify and takes the matching private keys (or a []byte secret for HS*).
+func Sign(alg string, kid string, key interface{}, payload []byte) (string, error) {
+	rawHeader, err := json.Marshal(Header{Alg: alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(rawHeader) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	if alg == "EdDSA" {
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return "", ErrKeyType
+		}
+		signature = ed25519.Sign(priv, []byte(signingInput))
+		return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+	}
+	if len(alg) != 5 {
+		return "", errors.Wrap(ErrUnsupportedAlg, alg)
+	}
+	hash, err := hashFor(alg)
+	if err != nil {
+		return "", err
+	}
+	digest := hash.New()
+	digest.Write([]byte(signingInput))
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return "", ErrKeyType
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case "RS":
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return "", ErrKeyType
+		}
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, priv, hash, digest.Sum(nil)); err != nil {
+			return "", err
+		}
+	case "PS":
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return "", ErrKeyType
+		}
+		if signature, err = rsa.SignPSS(rand.Reader, priv, hash, digest.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+			return "", err
+		}
+	case "ES":
+		priv, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return "", ErrKeyType
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest.Sum(nil))
+		if err != nil {
+			return "", err
+		}
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[size-len(rBytes):size], rBytes)
+		copy(signature[2*size-len(sBytes):], sBytes)
+	default:
+		return "", errors.Wrap(ErrUnsupportedAlg, alg)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Audience is the "aud" claim, which may be a string or an array of strings
+type Audience []string
+
+// UnmarshalJSON accepts both forms of "aud"
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		return json.Unmarshal(b, (*[]string)(a))
+	}
+	var single string
+	if err := json.Unmarshal(b, &single); err != nil {
+		return err
+	}
+	*a = Audience{single}
+	return nil
+}
+
+// Contains reports whether aud is one of the audiences
+func (a Audience) Contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims are the registered JWT claims (RFC 7519 section 4.1) plus the OIDC nonce
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	Expiry    *int64   `json:"exp,omitempty"`
+	NotBefore *int64   `json:"nbf,omitempty"`
+	IssuedAt  *int64   `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	Nonce     string   `json:"nonce,omitempty"`
+}
+
+// ValidateTime checks exp, nbf and iat against now, allowing skew either way. Missing claims aren't errors, callers that need exp should check it's set.
+func (c *Claims) ValidateTime(now time.Time, skew time.Duration) error {
+	if c.Expiry != nil && !now.Add(-skew).Before(time.Unix(*c.Expiry, 0)) {
+		return ErrExpired
+	}
+	if c.NotBefore != nil && now.Add(skew).Before(time.Unix(*c.NotBefore, 0)) {
+		return ErrNotYetValid
+	}
+	if c.IssuedAt != nil && now.Add(skew).Before(time.Unix(*c.IssuedAt, 0)) {
+		return ErrNotYetValid
+	}
+	return nil
+}
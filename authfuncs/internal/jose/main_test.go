@@ -0,0 +1,154 @@
+package jose
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// testKeys holds one private key per algorithm family
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	edPub   ed25519.PublicKey
+	hmacKey []byte
+}
+
+// newTestKeys generates keys for the tests
+func newTestKeys(t *testing.T) testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return testKeys{rsa: rsaKey, ec: ecKey, ed: edKey, edPub: edPub, hmacKey: []byte("secret")}
+}
+
+// TestSignVerify round trips every algorithm and makes sure tampering and wrong keys fail
+func TestSignVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	table := []struct {
+		alg  string
+		priv interface{}
+		pub  interface{}
+	}{
+		{"HS256", keys.hmacKey, keys.hmacKey},
+		{"HS512", keys.hmacKey, keys.hmacKey},
+		{"RS256", keys.rsa, &keys.rsa.PublicKey},
+		{"PS256", keys.rsa, &keys.rsa.PublicKey},
+		{"ES256", keys.ec, &keys.ec.PublicKey},
+		{"EdDSA", keys.ed, keys.edPub},
+	}
+	for _, row := range table {
+		token, err := Sign(row.alg, "kid", row.priv, []byte(`{"sub":"aj"}`))
+		require.NoError(t, err, row.alg)
+		jws, err := ParseCompact(token)
+		require.NoError(t, err, row.alg)
+		require.Equal(t, row.alg, jws.Header.Alg)
+		require.Equal(t, "kid", jws.Header.Kid)
+		require.Equal(t, `{"sub":"aj"}`, string(jws.Payload))
+		require.NoError(t, jws.Verify(row.pub), row.alg)
+
+		parts := strings.Split(token, ".")
+		tampered, err := ParseCompact(parts[0] + "." + parts[1] + "x." + parts[2])
+		if err == nil {
+			require.Equal(t, ErrSignature, tampered.Verify(row.pub), row.alg)
+		}
+		require.Equal(t, ErrKeyType, jws.Verify("not a key"), row.alg)
+	}
+
+	_, err := ParseCompact("a.b")
+	require.Equal(t, ErrMalformed, err)
+	none, err := ParseCompact("eyJhbGciOiJub25lIn0.e30.")
+	require.NoError(t, err)
+	require.Equal(t, ErrUnsupportedAlg, errors.Cause(none.Verify(nil)))
+}
+
+// TestJSONWebKey round trips public keys through their JWK form
+func TestJSONWebKey(t *testing.T) {
+	keys := newTestKeys(t)
+	for _, pub := range []interface{}{&keys.rsa.PublicKey, &keys.ec.PublicKey, keys.edPub} {
+		jwk, err := NewJSONWebKey("kid", pub)
+		require.NoError(t, err)
+		raw, err := json.Marshal(jwk)
+		require.NoError(t, err)
+		parsed := JSONWebKey{}
+		require.NoError(t, json.Unmarshal(raw, &parsed))
+		key, err := parsed.PublicKey()
+		require.NoError(t, err)
+		require.Equal(t, pub, key)
+	}
+	_, err := JSONWebKey{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"}.PublicKey()
+	require.Error(t, err)
+	set := JSONWebKeySet{Keys: []JSONWebKey{{Kty: "oct"}, {Kty: "OKP", Crv: "Ed25519", Use: "enc"}}}
+	require.Equal(t, 0, len(set.PublicKeys()))
+}
+
+// TestRemoteKeySet makes sure keys are cached and that an unknown kid causes a refetch
+func TestRemoteKeySet(t *testing.T) {
+	keys := newTestKeys(t)
+	first, err := NewJSONWebKey("first", &keys.rsa.PublicKey)
+	require.NoError(t, err)
+	second, err := NewJSONWebKey("second", &keys.ec.PublicKey)
+	require.NoError(t, err)
+	served := atomic.Value{}
+	served.Store(JSONWebKeySet{Keys: []JSONWebKey{first}})
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(served.Load())
+	}))
+	defer server.Close()
+
+	set := NewRemoteKeySet(server.Client(), server.URL, time.Hour)
+	set.minInterval = 0
+	key, err := set.Key(context.Background(), "first")
+	require.NoError(t, err)
+	require.Equal(t, &keys.rsa.PublicKey, key)
+	key, err = set.Key(context.Background(), "")
+	require.NoError(t, err)
+	require.Equal(t, &keys.rsa.PublicKey, key)
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	served.Store(JSONWebKeySet{Keys: []JSONWebKey{first, second}})
+	key, err = set.Key(context.Background(), "second")
+	require.NoError(t, err)
+	require.Equal(t, &keys.ec.PublicKey, key)
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	set.minInterval = time.Hour
+	_, err = set.Key(context.Background(), "third")
+	require.Equal(t, ErrKeyNotFound, errors.Cause(err))
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches)) // rate limited
+}
+
+// TestClaims checks aud parsing and time validation
+func TestClaims(t *testing.T) {
+	claims := Claims{}
+	require.NoError(t, json.Unmarshal([]byte(`{"aud":"one","exp":1000,"nbf":500}`), &claims))
+	require.True(t, claims.Audience.Contains("one"))
+	require.NoError(t, json.Unmarshal([]byte(`{"aud":["two","three"]}`), &claims))
+	require.True(t, claims.Audience.Contains("three"))
+	require.False(t, claims.Audience.Contains("one"))
+
+	require.NoError(t, claims.ValidateTime(time.Unix(700, 0), 0))
+	require.Equal(t, ErrExpired, claims.ValidateTime(time.Unix(1000, 0), 0))
+	require.NoError(t, claims.ValidateTime(time.Unix(1000, 0), time.Minute))
+	require.Equal(t, ErrNotYetValid, claims.ValidateTime(time.Unix(400, 0), 0))
+	require.NoError(t, claims.ValidateTime(time.Unix(480, 0), time.Minute))
+}
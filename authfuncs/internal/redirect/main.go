@@ -0,0 +1,21 @@
+/*
+Package redirect checks where AuthFuncs send browsers after a login. Return paths come from the request or from values the browser hands back, so anything that isn't a path on this site is replaced, otherwise a link like https://app/%2F%2Fevil.com logs the user in and sends them to evil.com.
+*/
+package redirect
+
+import (
+	"strings"
+)
+
+// Local returns next if it's a path on this site and / if it isn't. Paths starting with // or /\ are rejected since browsers read them as another host, and so is anything with a control character, which browsers strip before reading the URL.
+func Local(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	for i := 0; i < len(next); i++ {
+		if next[i] < 0x20 || next[i] == 0x7f {
+			return "/"
+		}
+	}
+	return next
+}
@@ -0,0 +1,27 @@
+package redirect
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLocal checks paths are kept and anything that could leave the site isn't
+func TestLocal(t *testing.T) {
+	for next, want := range map[string]string{
+		"/":                  "/",
+		"/docs?page=2#top":   "/docs?page=2#top",
+		"/a//b":              "/a//b",
+		"/a\\b":              "/a\\b",
+		"":                   "/",
+		"docs":               "/",
+		"//evil.com/x":       "/",
+		"/\\evil.com":        "/",
+		"https://evil.com":   "/",
+		"/\t/evil.com":       "/",
+		"/\n/evil.com":       "/",
+		"javascript:alert()": "/",
+	} {
+		require.Equal(t, want, Local(next), next)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Package resp reads and writes RESP2, the Redis protocol: commands are arrays of bulk strings, and replies are simple strings, errors, integers, bulk strings or arrays of them.
+*/
+package resp
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrMalformed is returned for input that isn't RESP
+	ErrMalformed = errors.New("malformed RESP")
+	// ErrTooLarge is returned for bulk strings over MaxSize or arrays over MaxArray
+	ErrTooLarge = errors.New("RESP value too large")
+)
+
+// MaxSize caps bulk strings so a peer can't make us allocate without bound
+var MaxSize = 16 << 20
+
+// MaxArray caps array lengths for the same reason
+var MaxArray = 1 << 16
+
+// Error is an error reply
+type Error string
+
+// Error returns the server's message, like "ERR unknown command"
+func (e Error) Error() string {
+	return string(e)
+}
+
+// WriteCommand writes args as an array of bulk strings. None of the writers flush, so commands can be pipelined.
+func WriteCommand(w *bufio.Writer, args ...string) {
+	WriteArray(w, len(args))
+	for _, arg := range args {
+		WriteBulk(w, []byte(arg))
+	}
+}
+
+// WriteSimple writes a simple string reply, like OK
+func WriteSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+// WriteError writes an error reply
+func WriteError(w *bufio.Writer, message string) {
+	w.WriteString("-" + message + "\r\n")
+}
+
+// WriteInt writes an integer reply
+func WriteInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// WriteBulk writes a bulk string, or the null bulk string for nil
+func WriteBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// WriteArray writes an array header, the caller writes its elements
+func WriteArray(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// readLine reads up to CRLF
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", ErrMalformed
+	}
+	return line[:len(line)-2], nil
+}
+
+// ReadReply reads one reply. It returns a string for simple strings, Error for errors (as the value, not the error), int64 for integers, []byte for bulk strings with nil for null, and []interface{} for arrays with nil for null.
+func ReadReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, ErrMalformed
+		}
+		if n == -1 {
+			return []byte(nil), nil
+		}
+		if n > MaxSize {
+			return nil, ErrTooLarge
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[n] != '\r' || b[n+1] != '\n' {
+			return nil, ErrMalformed
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, ErrMalformed
+		}
+		if n == -1 {
+			return []interface{}(nil), nil
+		}
+		if n > MaxArray {
+			return nil, ErrTooLarge
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, ErrMalformed
+}
+
+// ReadCommand reads a command the way a server does. Inline commands aren't supported.
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	value, err := ReadReply(r)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := value.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, ErrMalformed
+	}
+	args := make([]string, len(values))
+	for i, v := range values {
+		b, ok := v.([]byte)
+		if !ok || b == nil {
+			return nil, ErrMalformed
+		}
+		args[i] = string(b)
+	}
+	return args, nil
+}
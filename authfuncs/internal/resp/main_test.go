@@ -0,0 +1,54 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRoundTrip writes replies and a command and reads them back
+func TestRoundTrip(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	w := bufio.NewWriter(buffer)
+	WriteCommand(w, "SET", "key", "value\r\nwith a newline", "PX", "1000")
+	WriteSimple(w, "OK")
+	WriteError(w, "ERR nope")
+	WriteInt(w, -2)
+	WriteBulk(w, nil)
+	WriteBulk(w, []byte{})
+	WriteArray(w, 2)
+	WriteInt(w, 1)
+	WriteBulk(w, []byte("x"))
+	require.NoError(t, w.Flush())
+	require.True(t, strings.HasPrefix(buffer.String(), "*5\r\n$3\r\nSET\r\n$3\r\nkey\r\n"))
+
+	r := bufio.NewReader(buffer)
+	args, err := ReadCommand(r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"SET", "key", "value\r\nwith a newline", "PX", "1000"}, args)
+	for _, want := range []interface{}{"OK", Error("ERR nope"), int64(-2), []byte(nil), []byte{}, []interface{}{int64(1), []byte("x")}} {
+		got, err := ReadReply(r)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	require.Equal(t, "ERR nope", Error("ERR nope").Error())
+}
+
+// TestMalformed checks bad input is refused
+func TestMalformed(t *testing.T) {
+	for _, input := range []string{"+OK\n", "?x\r\n", ":x\r\n", "$3\r\nabcd\r\n", "$-2\r\n", "*-2\r\n", "\r\n"} {
+		_, err := ReadReply(bufio.NewReader(strings.NewReader(input)))
+		require.Equal(t, ErrMalformed, err, input)
+	}
+	_, err := ReadReply(bufio.NewReader(strings.NewReader("$999999999\r\n")))
+	require.Equal(t, ErrTooLarge, err)
+	_, err = ReadReply(bufio.NewReader(strings.NewReader("*999999999\r\n")))
+	require.Equal(t, ErrTooLarge, err)
+	for _, input := range []string{"+PING\r\n", "*0\r\n", "*1\r\n:1\r\n", "*1\r\n$-1\r\n"} {
+		_, err := ReadCommand(bufio.NewReader(strings.NewReader(input)))
+		require.Equal(t, ErrMalformed, err, input)
+	}
+}
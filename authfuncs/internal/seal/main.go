@@ -0,0 +1,145 @@
+/*
+Package seal MACs small values so they can be handed to a browser (in a cookie or a link) and trusted when they come back. Sealed values are signed, not encrypted: don't put secrets in them. Encrypt and Decrypt are for values the browser mustn't read.
+*/
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalid is returned by Open when a value is malformed or its MAC is wrong
+	ErrInvalid = errors.New("invalid sealed value")
+	// ErrExpired is returned by Open when a value is past its expiry
+	ErrExpired = errors.New("sealed value expired")
+)
+
+// Sealer seals and opens values with one key
+type Sealer struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+// envelope is what's actually MACed
+type envelope struct {
+	Expires int64           `json:"e"`
+	Value   json.RawMessage `json:"v"`
+}
+
+// New returns a Sealer using key. A nil key gets a random one, so values only survive as long as the Sealer.
+func New(key []byte) *Sealer {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	// encryption gets its own key derived from key, so it's never used for both
+	block, err := aes.NewCipher(hmacSum(key, []byte("seal encryption key")))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &Sealer{key: key, aead: aead}
+}
+
+// hmacSum returns the HMAC-SHA256 of b under key
+func hmacSum(key, b []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// mac returns the MAC of b
+func (s *Sealer) mac(b []byte) []byte {
+	return hmacSum(s.key, b)
+}
+
+// envelop wraps v's JSON with its expiry
+func envelop(v interface{}, expires time.Time) ([]byte, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{Expires: expires.Unix(), Value: value})
+}
+
+// unwrap checks raw's expiry and decodes it into v
+func unwrap(raw []byte, v interface{}) error {
+	env := envelope{}
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return ErrInvalid
+	}
+	if time.Now().Unix() > env.Expires {
+		return ErrExpired
+	}
+	if err := json.Unmarshal(env.Value, v); err != nil {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// Seal encodes v as JSON and returns it with its expiry and MAC in a cookie- and URL-safe string
+func (s *Sealer) Seal(v interface{}, expires time.Time) (string, error) {
+	raw, err := envelop(v, expires)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw) + "." + base64.RawURLEncoding.EncodeToString(s.mac(raw)), nil
+}
+
+// Open checks sealed's MAC and expiry and decodes it into v
+func (s *Sealer) Open(sealed string, v interface{}) error {
+	parts := strings.SplitN(sealed, ".", 2)
+	if len(parts) != 2 {
+		return ErrInvalid
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalid
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sum, s.mac(raw)) {
+		return ErrInvalid
+	}
+	return unwrap(raw, v)
+}
+
+// Encrypt is Seal for secrets: v and its expiry are encrypted with AES-GCM, which also authenticates them
+func (s *Sealer) Encrypt(v interface{}, expires time.Time) (string, error) {
+	raw, err := envelop(v, expires)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, raw, nil)), nil
+}
+
+// Decrypt is Open for values made by Encrypt
+func (s *Sealer) Decrypt(sealed string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return ErrInvalid
+	}
+	raw, err := s.aead.Open(nil, data[:s.aead.NonceSize()], data[s.aead.NonceSize():], nil)
+	if err != nil {
+		return ErrInvalid
+	}
+	return unwrap(raw, v)
+}
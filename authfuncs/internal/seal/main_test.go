@@ -0,0 +1,63 @@
+package seal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSealOpen round trips a value and checks tampering, other keys and expiry
+func TestSealOpen(t *testing.T) {
+	sealer := New(nil)
+	sealed, err := sealer.Seal(map[string]string{"a": "b"}, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	ret := map[string]string{}
+	require.NoError(t, sealer.Open(sealed, &ret))
+	require.Equal(t, "b", ret["a"])
+
+	require.Equal(t, ErrInvalid, sealer.Open("x"+sealed, &ret))
+	require.Equal(t, ErrInvalid, sealer.Open(sealed[:len(sealed)-1], &ret))
+	require.Equal(t, ErrInvalid, New(nil).Open(sealed, &ret))
+	require.Equal(t, ErrInvalid, sealer.Open("nodot", &ret))
+
+	sealed, err = sealer.Seal("old", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	var old string
+	require.Equal(t, ErrExpired, sealer.Open(sealed, &old))
+
+	fixed := New([]byte("key"))
+	sealed, err = fixed.Seal(1, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	var one int
+	require.NoError(t, New([]byte("key")).Open(sealed, &one))
+	require.Equal(t, 1, one)
+}
+
+// TestEncryptDecrypt checks encrypted values round trip, can't be read or changed, and expire
+func TestEncryptDecrypt(t *testing.T) {
+	sealer := New([]byte("key"))
+	sealed, err := sealer.Encrypt(map[string]string{"verifier": "hunter2"}, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.False(t, strings.Contains(sealed, "hunter2"))
+	ret := map[string]string{}
+	require.NoError(t, New([]byte("key")).Decrypt(sealed, &ret))
+	require.Equal(t, "hunter2", ret["verifier"])
+
+	other, err := sealer.Encrypt(map[string]string{"verifier": "hunter2"}, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.NotEqual(t, sealed, other)
+
+	tampered := []byte(sealed)
+	tampered[len(tampered)/2] ^= 1
+	require.Equal(t, ErrInvalid, sealer.Decrypt(string(tampered), &ret))
+	require.Equal(t, ErrInvalid, New(nil).Decrypt(sealed, &ret))
+	require.Equal(t, ErrInvalid, sealer.Decrypt("", &ret))
+	require.Equal(t, ErrInvalid, sealer.Open(sealed, &ret))
+
+	sealed, err = sealer.Encrypt("old", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	var old string
+	require.Equal(t, ErrExpired, sealer.Decrypt(sealed, &old))
+}
@@ -0,0 +1,103 @@
+/*
+Package session is the in-memory session map AuthFuncs keep after a login. Entries expire, and expired ones are swept as the map is used, so sessions that are never presented again don't pile up for the life of the process.
+*/
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepEvery is how often Set sweeps
+const sweepEvery = time.Minute
+
+// entry is a value and when it expires
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// Map holds values by session id until they expire. Times are passed in so callers can use their own clocks.
+type Map struct {
+	mutex   *sync.Mutex
+	entries map[string]entry
+	swept   time.Time
+}
+
+// New returns an empty Map
+func New() *Map {
+	return &Map{mutex: new(sync.Mutex), entries: make(map[string]entry)}
+}
+
+// Get returns id's value if it hasn't expired by now. An expired one is deleted.
+func (m *Map) Get(id string, now time.Time) (interface{}, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, ok := m.entries[id]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(e.expires) {
+		delete(m.entries, id)
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Set stores value under id until expires, and sweeps if it hasn't in a while
+func (m *Map) Set(id string, value interface{}, expires, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if now.Sub(m.swept) >= sweepEvery || now.Before(m.swept) {
+		m.sweep(now)
+	}
+	m.entries[id] = entry{value: value, expires: expires}
+}
+
+// Add is Set unless id already has a value that hasn't expired, in which case it returns false and leaves it alone. It's for things that may only be used once.
+func (m *Map) Add(id string, value interface{}, expires, now time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if e, ok := m.entries[id]; ok && now.Before(e.expires) {
+		return false
+	}
+	if now.Sub(m.swept) >= sweepEvery || now.Before(m.swept) {
+		m.sweep(now)
+	}
+	m.entries[id] = entry{value: value, expires: expires}
+	return true
+}
+
+// Delete removes id
+func (m *Map) Delete(id string) {
+	m.mutex.Lock()
+	delete(m.entries, id)
+	m.mutex.Unlock()
+}
+
+// Sweep removes entries expired by now and returns how many it removed
+func (m *Map) Sweep(now time.Time) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.sweep(now)
+}
+
+// sweep is Sweep with the lock held
+func (m *Map) sweep(now time.Time) int {
+	removed := 0
+	for id, e := range m.entries {
+		if !now.Before(e.expires) {
+			delete(m.entries, id)
+			removed++
+		}
+	}
+	m.swept = now
+	return removed
+}
+
+// Len returns how many entries are held, expired or not
+func (m *Map) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.entries)
+}
@@ -0,0 +1,52 @@
+package session
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMap checks entries expire and that Set sweeps ones never asked for again
+func TestMap(t *testing.T) {
+	m := New()
+	now := time.Now()
+	m.Set("a", 1, now.Add(time.Hour), now)
+	value, ok := m.Get("a", now)
+	require.True(t, ok)
+	require.Equal(t, 1, value)
+	_, ok = m.Get("b", now)
+	require.False(t, ok)
+
+	_, ok = m.Get("a", now.Add(time.Hour))
+	require.False(t, ok)
+	require.Equal(t, 0, m.Len())
+
+	m.Set("a", 1, now.Add(time.Hour), now)
+	m.Delete("a")
+	_, ok = m.Get("a", now)
+	require.False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i, now.Add(time.Hour), now.Add(time.Second))
+	}
+	require.Equal(t, 100, m.Len())
+	m.Set("late", 1, now.Add(3*time.Hour), now.Add(2*time.Hour))
+	require.Equal(t, 1, m.Len())
+
+	m.Set("short", 1, now.Add(150*time.Minute), now.Add(2*time.Hour))
+	require.Equal(t, 1, m.Sweep(now.Add(150*time.Minute)))
+	require.Equal(t, 1, m.Len())
+}
+
+// TestAdd checks Add only stores ids that don't have a live value
+func TestAdd(t *testing.T) {
+	m := New()
+	now := time.Now()
+	require.True(t, m.Add("a", 1, now.Add(time.Minute), now))
+	require.False(t, m.Add("a", 2, now.Add(time.Minute), now))
+	value, _ := m.Get("a", now)
+	require.Equal(t, 1, value)
+	require.True(t, m.Add("a", 3, now.Add(2*time.Minute), now.Add(time.Minute)))
+}
@@ -0,0 +1,112 @@
+package xmldsig
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+var (
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+)
+
+// writeAttr writes ` name="value"` escaped the way canonical XML does
+func writeAttr(b *bytes.Buffer, name, value string) {
+	b.WriteString(" " + name + `="`)
+	attrEscaper.WriteString(b, value)
+	b.WriteString(`"`)
+}
+
+// writeText writes character data escaped the way canonical XML does
+func writeText(b *bytes.Buffer, text string) {
+	textEscaper.WriteString(b, text)
+}
+
+// sortedPrefixes returns a map's prefixes with the default namespace first
+func sortedPrefixes(namespaces map[string]string) []string {
+	prefixes := make([]string, 0, len(namespaces))
+	for prefix := range namespaces {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// Canonicalize returns the exclusive canonical form (without comments) of e, leaving out exclude and what's in it. inclusive is the InclusiveNamespaces PrefixList, with "#default" for the default namespace.
+func Canonicalize(e *Element, inclusive []string, exclude *Element) []byte {
+	b := new(bytes.Buffer)
+	included := make(map[string]bool)
+	for _, prefix := range inclusive {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		included[prefix] = true
+	}
+	canonicalize(b, e, map[string]string{"": ""}, included, exclude)
+	return b.Bytes()
+}
+
+// canonicalize writes e given the namespaces already rendered by its output ancestors
+func canonicalize(b *bytes.Buffer, e *Element, rendered map[string]string, included map[string]bool, exclude *Element) {
+	// the namespaces e visibly uses, plus the inclusive ones it has in scope
+	used := map[string]bool{e.Prefix: true}
+	for _, attr := range e.Attrs {
+		if attr.Prefix != "" {
+			used[attr.Prefix] = true
+		}
+	}
+	for prefix := range included {
+		if _, ok := e.lookup(prefix); ok {
+			used[prefix] = true
+		}
+	}
+	delete(used, "xml")
+	output := make(map[string]string)
+	for prefix := range used {
+		space, _ := e.lookup(prefix)
+		if prefix != "" && space == "" {
+			continue
+		}
+		if previous, ok := rendered[prefix]; !ok || previous != space {
+			output[prefix] = space
+		}
+	}
+	if len(output) > 0 {
+		inherited := rendered
+		rendered = make(map[string]string, len(inherited)+len(output))
+		for prefix, space := range inherited {
+			rendered[prefix] = space
+		}
+		for prefix, space := range output {
+			rendered[prefix] = space
+		}
+	}
+
+	b.WriteString("<" + name(e.Prefix, e.Local))
+	for _, prefix := range sortedPrefixes(output) {
+		writeAttr(b, declaration(prefix), output[prefix])
+	}
+	attrs := append([]Attr(nil), e.Attrs...)
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].Space != attrs[j].Space {
+			return attrs[i].Space < attrs[j].Space
+		}
+		return attrs[i].Local < attrs[j].Local
+	})
+	for _, attr := range attrs {
+		writeAttr(b, name(attr.Prefix, attr.Local), attr.Value)
+	}
+	b.WriteString(">")
+	for _, c := range e.Children {
+		switch child := c.(type) {
+		case *Element:
+			if child != exclude {
+				canonicalize(b, child, rendered, included, exclude)
+			}
+		case Text:
+			writeText(b, string(child))
+		}
+	}
+	b.WriteString("</" + name(e.Prefix, e.Local) + ">")
+}
@@ -0,0 +1,228 @@
+package xmldsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNoSignature is returned by Verify when the element isn't signed
+	ErrNoSignature = errors.New("no signature")
+	// ErrSignature is returned by Verify when a signature is malformed, uses something we don't accept, or doesn't check out
+	ErrSignature = errors.New("bad signature")
+)
+
+// Algorithm identifiers
+const (
+	AlgExcC14N     = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	AlgEnveloped   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	AlgRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	AlgRSASHA512   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	AlgECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	AlgSHA256      = "http://www.w3.org/2001/04/xmlenc#sha256"
+	AlgSHA512      = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+// signatureHashes are the signature methods we accept. SHA-1 isn't one of them.
+var signatureHashes = map[string]crypto.Hash{
+	AlgRSASHA256:   crypto.SHA256,
+	AlgRSASHA512:   crypto.SHA512,
+	AlgECDSASHA256: crypto.SHA256,
+}
+
+// digestHashes are the digest methods we accept
+var digestHashes = map[string]crypto.Hash{
+	AlgSHA256: crypto.SHA256,
+	AlgSHA512: crypto.SHA512,
+}
+
+// one returns the only child element with the name given, or an error
+func one(e *Element, local string) (*Element, error) {
+	found := e.Elements(NamespaceDS, local)
+	if len(found) != 1 {
+		return nil, errors.Wrap(ErrSignature, "expected one "+local)
+	}
+	return found[0], nil
+}
+
+// prefixList reads the InclusiveNamespaces PrefixList under a canonicalization method or transform
+func prefixList(method *Element) []string {
+	inclusive := method.Element(AlgExcC14N, "InclusiveNamespaces")
+	if inclusive == nil {
+		return nil
+	}
+	return strings.Fields(inclusive.Attr("PrefixList"))
+}
+
+// decodeBase64 decodes base64 that may be wrapped across lines
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// Verify checks the enveloped signature that's a direct child of e. The one reference has to point at e itself through its idAttr attribute, so what was signed is e and nothing else: callers should only trust what they read from e. KeyInfo is ignored, the signature has to check against one of certs.
+func Verify(e *Element, idAttr string, certs []*x509.Certificate) error {
+	signatures := e.Elements(NamespaceDS, "Signature")
+	if len(signatures) == 0 {
+		return ErrNoSignature
+	}
+	if len(signatures) > 1 {
+		return errors.Wrap(ErrSignature, "more than one signature")
+	}
+	signature := signatures[0]
+	signedInfo, err := one(signature, "SignedInfo")
+	if err != nil {
+		return err
+	}
+	canonicalization, err := one(signedInfo, "CanonicalizationMethod")
+	if err != nil {
+		return err
+	}
+	if canonicalization.Attr("Algorithm") != AlgExcC14N {
+		return errors.Wrap(ErrSignature, "canonicalization "+canonicalization.Attr("Algorithm"))
+	}
+	method, err := one(signedInfo, "SignatureMethod")
+	if err != nil {
+		return err
+	}
+	hash, ok := signatureHashes[method.Attr("Algorithm")]
+	if !ok {
+		return errors.Wrap(ErrSignature, "signature method "+method.Attr("Algorithm"))
+	}
+	reference, err := one(signedInfo, "Reference")
+	if err != nil {
+		return err
+	}
+	id := e.Attr(idAttr)
+	if id == "" || reference.Attr("URI") != "#"+id {
+		return errors.Wrap(ErrSignature, "reference isn't to the signed element")
+	}
+	transforms, err := one(reference, "Transforms")
+	if err != nil {
+		return err
+	}
+	var inclusive []string
+	enveloped, exclusive := false, false
+	for _, transform := range transforms.Elements(NamespaceDS, "Transform") {
+		switch transform.Attr("Algorithm") {
+		case AlgEnveloped:
+			enveloped = true
+		case AlgExcC14N:
+			exclusive = true
+			inclusive = prefixList(transform)
+		default:
+			return errors.Wrap(ErrSignature, "transform "+transform.Attr("Algorithm"))
+		}
+	}
+	if !enveloped || !exclusive {
+		return errors.Wrap(ErrSignature, "expected enveloped and exclusive canonicalization transforms")
+	}
+	digestMethod, err := one(reference, "DigestMethod")
+	if err != nil {
+		return err
+	}
+	digestHash, ok := digestHashes[digestMethod.Attr("Algorithm")]
+	if !ok {
+		return errors.Wrap(ErrSignature, "digest method "+digestMethod.Attr("Algorithm"))
+	}
+	digestValue, err := one(reference, "DigestValue")
+	if err != nil {
+		return err
+	}
+	want, err := decodeBase64(digestValue.Text())
+	if err != nil {
+		return errors.Wrap(ErrSignature, "digest isn't base64")
+	}
+	h := digestHash.New()
+	h.Write(Canonicalize(e, inclusive, signature))
+	if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+		return errors.Wrap(ErrSignature, "digest doesn't match")
+	}
+	signatureValue, err := one(signature, "SignatureValue")
+	if err != nil {
+		return err
+	}
+	sig, err := decodeBase64(signatureValue.Text())
+	if err != nil {
+		return errors.Wrap(ErrSignature, "signature isn't base64")
+	}
+	h = hash.New()
+	h.Write(Canonicalize(signedInfo, prefixList(canonicalization), nil))
+	hashed := h.Sum(nil)
+	for _, cert := range certs {
+		if verifyWith(cert.PublicKey, hash, hashed, sig) {
+			return nil
+		}
+	}
+	return errors.Wrap(ErrSignature, "no certificate verifies it")
+}
+
+// verifyWith checks a signature value. ECDSA signatures are r and s side by side, not ASN.1.
+func verifyWith(key crypto.PublicKey, hash crypto.Hash, hashed, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, hash, hashed, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, hashed, r, s)
+	}
+	return false
+}
+
+// dsElement returns an element in the signature namespace, which Sign declares once on Signature
+func dsElement(local string) *Element {
+	return &Element{Prefix: "ds", Local: local, Space: NamespaceDS}
+}
+
+// algorithm returns a method element with an Algorithm attribute
+func algorithm(local, alg string) *Element {
+	return dsElement(local).SetAttr("Algorithm", alg)
+}
+
+// Sign returns an enveloped RSA-SHA256 signature over e, referencing it through its idAttr attribute. The caller inserts it into e wherever its schema wants, the signature doesn't cover where it goes.
+func Sign(e *Element, idAttr string, key *rsa.PrivateKey, cert *x509.Certificate) (*Element, error) {
+	id := e.Attr(idAttr)
+	if id == "" {
+		return nil, errors.New("element has no " + idAttr)
+	}
+	digest := crypto.SHA256.New()
+	digest.Write(Canonicalize(e, nil, nil))
+	signedInfo := dsElement("SignedInfo").Add(
+		algorithm("CanonicalizationMethod", AlgExcC14N),
+		algorithm("SignatureMethod", AlgRSASHA256),
+		dsElement("Reference").SetAttr("URI", "#"+id).Add(
+			dsElement("Transforms").Add(
+				algorithm("Transform", AlgEnveloped),
+				algorithm("Transform", AlgExcC14N),
+			),
+			algorithm("DigestMethod", AlgSHA256),
+			dsElement("DigestValue").Add(Text(base64.StdEncoding.EncodeToString(digest.Sum(nil)))),
+		),
+	)
+	signature := NewElement("ds", NamespaceDS, "Signature").Add(signedInfo)
+	hashed := crypto.SHA256.New()
+	hashed.Write(Canonicalize(signedInfo, nil, nil))
+	value, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	signature.Add(dsElement("SignatureValue").Add(Text(base64.StdEncoding.EncodeToString(value))))
+	if cert != nil {
+		signature.Add(dsElement("KeyInfo").Add(dsElement("X509Data").Add(
+			dsElement("X509Certificate").Add(Text(base64.StdEncoding.EncodeToString(cert.Raw))),
+		)))
+	}
+	return signature, nil
+}
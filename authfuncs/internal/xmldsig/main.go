@@ -0,0 +1,311 @@
+/*
+Package xmldsig is a small XML tree with exclusive canonicalization and enveloped XML signatures, enough to check and make the signatures SAML uses. It refuses DTDs, so entity tricks don't get in.
+*/
+package xmldsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrMalformed is returned for documents we won't parse
+var ErrMalformed = errors.New("malformed XML")
+
+// MaxDepth caps element nesting
+const MaxDepth = 64
+
+// Namespaces
+const (
+	NamespaceXML = "http://www.w3.org/XML/1998/namespace"
+	NamespaceDS  = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// Node is an *Element or Text
+type Node interface{}
+
+// Text is character data, unescaped
+type Text string
+
+// Attr is an attribute. Space is the namespace it resolves to, empty for unprefixed attributes.
+type Attr struct {
+	Prefix string
+	Local  string
+	Space  string
+	Value  string
+}
+
+// Element is an element and everything in it
+type Element struct {
+	Prefix string
+	Local  string
+	Space  string
+	Attrs  []Attr
+	// Namespaces are the declarations on this element, "" is the default namespace
+	Namespaces map[string]string
+	Children   []Node
+	Parent     *Element
+}
+
+// NewElement returns an element in space, declaring prefix for it
+func NewElement(prefix, space, local string) *Element {
+	return &Element{Prefix: prefix, Local: local, Space: space, Namespaces: map[string]string{prefix: space}}
+}
+
+// SetAttr sets an unprefixed attribute
+func (e *Element) SetAttr(local, value string) *Element {
+	for i := range e.Attrs {
+		if e.Attrs[i].Space == "" && e.Attrs[i].Local == local {
+			e.Attrs[i].Value = value
+			return e
+		}
+	}
+	e.Attrs = append(e.Attrs, Attr{Local: local, Value: value})
+	return e
+}
+
+// Attr returns an unprefixed attribute's value
+func (e *Element) Attr(local string) string {
+	for _, attr := range e.Attrs {
+		if attr.Space == "" && attr.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Insert puts child at index i, or at the end if i is out of range
+func (e *Element) Insert(i int, child Node) {
+	if c, ok := child.(*Element); ok {
+		c.Parent = e
+	}
+	if i < 0 || i > len(e.Children) {
+		i = len(e.Children)
+	}
+	e.Children = append(e.Children, nil)
+	copy(e.Children[i+1:], e.Children[i:])
+	e.Children[i] = child
+}
+
+// Add appends children and returns e
+func (e *Element) Add(children ...Node) *Element {
+	for _, child := range children {
+		e.Insert(-1, child)
+	}
+	return e
+}
+
+// Remove takes child out of e
+func (e *Element) Remove(child *Element) {
+	for i, c := range e.Children {
+		if c == Node(child) {
+			e.Children = append(e.Children[:i], e.Children[i+1:]...)
+			child.Parent = nil
+			return
+		}
+	}
+}
+
+// Elements returns the child elements with the namespace and local name given
+func (e *Element) Elements(space, local string) []*Element {
+	var found []*Element
+	for _, c := range e.Children {
+		if child, ok := c.(*Element); ok && child.Space == space && child.Local == local {
+			found = append(found, child)
+		}
+	}
+	return found
+}
+
+// Element returns the first child element with the namespace and local name given, or nil
+func (e *Element) Element(space, local string) *Element {
+	found := e.Elements(space, local)
+	if len(found) == 0 {
+		return nil
+	}
+	return found[0]
+}
+
+// Text returns the element's own character data, trimmed
+func (e *Element) Text() string {
+	var b strings.Builder
+	for _, c := range e.Children {
+		if text, ok := c.(Text); ok {
+			b.WriteString(string(text))
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// lookup returns the namespace prefix is bound to where e is
+func (e *Element) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return NamespaceXML, true
+	}
+	for at := e; at != nil; at = at.Parent {
+		if space, ok := at.Namespaces[prefix]; ok {
+			return space, true
+		}
+	}
+	if prefix == "" {
+		return "", true
+	}
+	return "", false
+}
+
+// Walk calls fn on e and every element under it, in document order
+func (e *Element) Walk(fn func(*Element)) {
+	fn(e)
+	for _, c := range e.Children {
+		if child, ok := c.(*Element); ok {
+			child.Walk(fn)
+		}
+	}
+}
+
+// Parse reads a document and returns its root element. Comments and processing instructions are dropped, DTDs are refused.
+func Parse(data []byte) (*Element, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var root, current *Element
+	depth := 0
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(ErrMalformed, err.Error())
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if root != nil && current == nil {
+				return nil, errors.Wrap(ErrMalformed, "more than one root")
+			}
+			depth++
+			if depth > MaxDepth {
+				return nil, errors.Wrap(ErrMalformed, "too deep")
+			}
+			e, err := newParsed(t, current)
+			if err != nil {
+				return nil, err
+			}
+			if current == nil {
+				root = e
+			} else {
+				current.Add(e)
+			}
+			current = e
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.Prefix || t.Name.Local != current.Local {
+				return nil, errors.Wrap(ErrMalformed, "mismatched end tag")
+			}
+			depth--
+			current = current.Parent
+		case xml.CharData:
+			if current != nil {
+				if n := len(current.Children); n > 0 {
+					if text, ok := current.Children[n-1].(Text); ok {
+						current.Children[n-1] = text + Text(t)
+						continue
+					}
+				}
+				current.Add(Text(t))
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.Wrap(ErrMalformed, "text outside the root")
+			}
+		case xml.Directive:
+			return nil, errors.Wrap(ErrMalformed, "DTDs aren't allowed")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.Wrap(ErrMalformed, "unfinished document")
+	}
+	return root, nil
+}
+
+// newParsed builds an element from a raw start tag, resolving its prefixes
+func newParsed(t xml.StartElement, parent *Element) (*Element, error) {
+	e := &Element{Prefix: t.Name.Space, Local: t.Name.Local, Namespaces: make(map[string]string), Parent: parent}
+	for _, attr := range t.Attr {
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			e.Namespaces[""] = attr.Value
+		case attr.Name.Space == "xmlns":
+			if attr.Value == "" || attr.Name.Local == "xml" || attr.Name.Local == "xmlns" {
+				return nil, errors.Wrap(ErrMalformed, "bad namespace declaration")
+			}
+			e.Namespaces[attr.Name.Local] = attr.Value
+		}
+	}
+	space, ok := e.lookup(e.Prefix)
+	if !ok {
+		return nil, errors.Wrap(ErrMalformed, "unbound prefix "+e.Prefix)
+	}
+	e.Space = space
+	for _, attr := range t.Attr {
+		if attr.Name.Local == "xmlns" && attr.Name.Space == "" || attr.Name.Space == "xmlns" {
+			continue
+		}
+		a := Attr{Prefix: attr.Name.Space, Local: attr.Name.Local, Value: attr.Value}
+		if a.Prefix != "" {
+			if a.Space, ok = e.lookup(a.Prefix); !ok {
+				return nil, errors.Wrap(ErrMalformed, "unbound prefix "+a.Prefix)
+			}
+		}
+		for _, other := range e.Attrs {
+			if other.Space == a.Space && other.Local == a.Local {
+				return nil, errors.Wrap(ErrMalformed, "repeated attribute "+a.Local)
+			}
+		}
+		e.Attrs = append(e.Attrs, a)
+	}
+	return e, nil
+}
+
+// name returns prefix:local, or local without a prefix
+func name(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+// declaration returns the attribute name that declares prefix
+func declaration(prefix string) string {
+	if prefix == "" {
+		return "xmlns"
+	}
+	return "xmlns:" + prefix
+}
+
+// Bytes writes the element out as a document, keeping its namespace declarations where they are
+func (e *Element) Bytes() []byte {
+	b := new(bytes.Buffer)
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	e.write(b)
+	return b.Bytes()
+}
+
+// write writes e and its children
+func (e *Element) write(b *bytes.Buffer) {
+	b.WriteString("<" + name(e.Prefix, e.Local))
+	for _, prefix := range sortedPrefixes(e.Namespaces) {
+		writeAttr(b, declaration(prefix), e.Namespaces[prefix])
+	}
+	for _, attr := range e.Attrs {
+		writeAttr(b, name(attr.Prefix, attr.Local), attr.Value)
+	}
+	b.WriteString(">")
+	for _, c := range e.Children {
+		switch child := c.(type) {
+		case *Element:
+			child.write(b)
+		case Text:
+			writeText(b, string(child))
+		}
+	}
+	b.WriteString("</" + name(e.Prefix, e.Local) + ">")
+}
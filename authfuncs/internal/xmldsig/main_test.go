@@ -0,0 +1,101 @@
+package xmldsig
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCanonicalize checks exclusive canonicalization against the example in its spec and some escaping and ordering
+func TestCanonicalize(t *testing.T) {
+	root, err := Parse([]byte(`<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org"><n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"/></n1:elem2></n0:local>`))
+	require.NoError(t, err)
+	elem2 := root.Element("http://example.net", "elem2")
+	require.Equal(t, `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"></n3:stuff></n1:elem2>`, string(Canonicalize(elem2, nil, nil)))
+	require.Equal(t, `<n1:elem2 xmlns:n1="http://example.net" xmlns:n3="ftp://example.org" xml:lang="en"><n3:stuff></n3:stuff></n1:elem2>`, string(Canonicalize(elem2, []string{"n3"}, nil)))
+
+	root, err = Parse([]byte("<?xml version=\"1.0\"?>\n<!-- hi --><a xmlns=\"urn:a\" xmlns:b=\"urn:b\" xmlns:unused=\"urn:u\" z=\"1\" b:y=\"2\" a=\"3&#10;\"><c xmlns=\"\"/><b:d><![CDATA[&<>]]>\"</b:d></a>"))
+	require.NoError(t, err)
+	require.Equal(t, `<a xmlns="urn:a" xmlns:b="urn:b" a="3&#xA;" z="1" b:y="2"><c xmlns=""></c><b:d>&amp;&lt;&gt;"</b:d></a>`, string(Canonicalize(root, nil, nil)))
+	require.Equal(t, `<b:d xmlns:b="urn:b">&amp;&lt;&gt;"</b:d>`, string(Canonicalize(root.Element("urn:b", "d"), nil, nil)))
+
+	for _, bad := range []string{
+		`<!DOCTYPE a [<!ENTITY x "y">]><a>&x;</a>`,
+		`<a><b></a></b>`,
+		`<a/><b/>`,
+		`<x:a/>`,
+		`<a b="1" b="2"/>`,
+		`<a>`,
+		strings.Repeat("<a>", 70) + strings.Repeat("</a>", 70),
+	} {
+		_, err := Parse([]byte(bad))
+		require.Error(t, err, bad)
+	}
+}
+
+// keyPair makes a key and a self-signed certificate for it
+func keyPair(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return key, cert
+}
+
+// TestSignVerify signs an element whose prefix is declared on its parent and checks it after a round trip
+func TestSignVerify(t *testing.T) {
+	key, cert := keyPair(t)
+	_, other := keyPair(t)
+	document := func() (*Element, *Element) {
+		root, err := Parse([]byte(`<p:Outer xmlns:p="urn:p" ID="outer"><p:Inner ID="inner" Name="x"><p:Value>one &amp; two</p:Value></p:Inner></p:Outer>`))
+		require.NoError(t, err)
+		inner := root.Element("urn:p", "Inner")
+		signature, err := Sign(inner, "ID", key, cert)
+		require.NoError(t, err)
+		inner.Insert(0, signature)
+		root, err = Parse(root.Bytes())
+		require.NoError(t, err)
+		return root, root.Element("urn:p", "Inner")
+	}
+
+	root, inner := document()
+	require.NoError(t, Verify(inner, "ID", []*x509.Certificate{other, cert}))
+	require.Equal(t, ErrNoSignature, Verify(root, "ID", []*x509.Certificate{cert}))
+	require.Error(t, Verify(inner, "ID", []*x509.Certificate{other}))
+
+	// changing what's signed
+	_, inner = document()
+	inner.Element("urn:p", "Value").Children[0] = Text("one & three")
+	require.Error(t, Verify(inner, "ID", []*x509.Certificate{cert}))
+	_, inner = document()
+	inner.SetAttr("Name", "y")
+	require.Error(t, Verify(inner, "ID", []*x509.Certificate{cert}))
+
+	// the signature moved onto an element with a different ID
+	root, inner = document()
+	signature := inner.Element(NamespaceDS, "Signature")
+	inner.Remove(signature)
+	root.Insert(0, signature)
+	require.Error(t, Verify(root, "ID", []*x509.Certificate{cert}))
+
+	// SHA-1 isn't accepted even when the signature is otherwise fine
+	_, inner = document()
+	signedInfo := inner.Element(NamespaceDS, "Signature").Element(NamespaceDS, "SignedInfo")
+	signedInfo.Element(NamespaceDS, "SignatureMethod").SetAttr("Algorithm", "http://www.w3.org/2000/09/xmldsig#rsa-sha1")
+	require.Error(t, Verify(inner, "ID", []*x509.Certificate{cert}))
+}
@@ -0,0 +1,238 @@
+/*
+Package ipfilter is an AuthFunc that grants or denies by client address. Rules are CIDRs in a prefix trie where the longest match wins, so "allow 10.0.0.0/8" and "deny 10.6.6.0/24" do what you'd expect.
+*/
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+var (
+	// ErrBadRule is returned for rule lines that aren't "allow CIDR" or "deny CIDR"
+	ErrBadRule = errors.New("bad rule")
+	// ErrBadHeader is returned by NewResolver for a header other than X-Forwarded-For, Forwarded or X-Real-IP
+	ErrBadHeader = errors.New("unsupported forwarding header")
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// Action is what a matching rule does
+type Action bool
+
+const (
+	// Deny answers 403
+	Deny Action = false
+	// Allow grants
+	Allow Action = true
+)
+
+// Config lists the rules and proxies
+type Config struct {
+	Allow []string
+	Deny  []string
+	// File has one rule per line, "allow 10.0.0.0/8" or "deny 192.0.2.1", and # comments. Its rules are added to Allow and Deny.
+	File string
+	// TrustedProxies may set TrustedHeader
+	TrustedProxies []string
+	// TrustedHeader is the one header the proxies set: XForwardedFor (the default), Forwarded or XRealIP. Nothing else is read, so a client can't get around the rules by sending another one.
+	TrustedHeader string
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	IP      string `json:"ip"`
+	Network string `json:"network"`
+}
+
+// IPFilter supplies an authfunc receiver and stores information to be used by that receiver
+type IPFilter struct {
+	config   Config
+	resolver *Resolver
+	mutex    *sync.RWMutex
+	rules    *Trie
+	modTime  time.Time
+}
+
+// New builds the rules and returns an IPFilter ready to be used as an AuthFunc
+func New(config Config) (*IPFilter, error) {
+	resolver, err := NewResolver(config.TrustedProxies, config.TrustedHeader)
+	if err != nil {
+		return nil, err
+	}
+	f := &IPFilter{
+		config:   config,
+		resolver: resolver,
+		mutex:    new(sync.RWMutex),
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// addRule inserts s into rules
+func addRule(rules *Trie, s string, action Action) error {
+	network, err := ParseNetwork(s)
+	if err != nil {
+		return errors.Wrap(ErrBadRule, s)
+	}
+	rules.Insert(network, action)
+	return nil
+}
+
+// parseFile reads rules from data into rules
+func parseFile(rules *Trie, name string, data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if hash := strings.IndexByte(text, '#'); hash != -1 {
+			text = strings.TrimSpace(text[:hash])
+		}
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return errors.Wrap(ErrBadRule, name+":"+strconv.Itoa(line))
+		}
+		var action Action
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			action = Allow
+		case "deny":
+			action = Deny
+		default:
+			return errors.Wrap(ErrBadRule, name+":"+strconv.Itoa(line))
+		}
+		if err := addRule(rules, fields[1], action); err != nil {
+			return errors.Wrap(err, name+":"+strconv.Itoa(line))
+		}
+	}
+	return nil
+}
+
+// Reload rebuilds the rules from the config and the file. The old rules are kept if there's an error.
+func (f *IPFilter) Reload() error {
+	rules := NewTrie()
+	for _, s := range f.config.Allow {
+		if err := addRule(rules, s, Allow); err != nil {
+			return err
+		}
+	}
+	for _, s := range f.config.Deny {
+		if err := addRule(rules, s, Deny); err != nil {
+			return err
+		}
+	}
+	var modTime time.Time
+	if f.config.File != "" {
+		info, err := os.Stat(f.config.File)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(f.config.File)
+		if err != nil {
+			return err
+		}
+		if err := parseFile(rules, f.config.File, data); err != nil {
+			return err
+		}
+		modTime = info.ModTime()
+	}
+	f.mutex.Lock()
+	f.rules = rules
+	f.modTime = modTime
+	f.mutex.Unlock()
+	defaultLogger.Info("ipfilter loaded " + strconv.Itoa(rules.Len()) + " rules")
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes, checking every interval. Call the returned function to stop.
+func (f *IPFilter) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(f.config.File)
+				if err != nil {
+					continue
+				}
+				f.mutex.RLock()
+				changed := !info.ModTime().Equal(f.modTime)
+				f.mutex.RUnlock()
+				if changed {
+					if err := f.Reload(); err != nil {
+						defaultLogger.Error("ipfilter reload failed: " + err.Error())
+					}
+				}
+			}
+		}
+	}()
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Check is an authfunc. An allowed address is granted, a denied one answered with 403, and one matching nothing fails quietly so later instances decide.
+func (f *IPFilter) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	ip := f.resolver.ClientIP(r)
+	if ip == nil {
+		defaultLogger.Error("ipfilter couldn't parse RemoteAddr " + r.RemoteAddr)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	f.mutex.RLock()
+	rules := f.rules
+	f.mutex.RUnlock()
+	value, network, ok := rules.Lookup(ip)
+	if !ok {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	if value.(Action) == Deny {
+		defaultLogger.Info("ipfilter denied " + ip.String() + " by " + network.String())
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	info, err := json.Marshal(Info{IP: ip.String(), Network: network.String()})
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: info},
+	}, nil
+}
@@ -0,0 +1,182 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/ipfilter/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// TestTrie checks longest prefix matching for both families
+func TestTrie(t *testing.T) {
+	trie := NewTrie()
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3", "2001:db8::/32", "0.0.0.0/0"} {
+		network, err := ParseNetwork(s)
+		require.NoError(t, err)
+		trie.Insert(network, s)
+	}
+	require.Equal(t, 5, trie.Len())
+	table := map[string]string{
+		"10.9.9.9":        "10.0.0.0/8",
+		"10.1.9.9":        "10.1.0.0/16",
+		"10.1.2.3":        "10.1.2.3",
+		"192.0.2.1":       "0.0.0.0/0",
+		"::ffff:10.1.2.3": "10.1.2.3",
+		"2001:db8::1":     "2001:db8::/32",
+	}
+	for ip, want := range table {
+		value, _, ok := trie.Lookup(net.ParseIP(ip))
+		require.True(t, ok, ip)
+		require.Equal(t, want, value, ip)
+	}
+	require.False(t, trie.Contains(net.ParseIP("2001:db9::1")))
+	_, err := ParseNetwork("10.0.0.0/33")
+	require.Error(t, err)
+}
+
+// TestClientIP makes sure forwarding headers are only believed from trusted proxies, and only the configured one
+func TestClientIP(t *testing.T) {
+	resolvers := make(map[string]*Resolver)
+	for _, header := range []string{"", Forwarded, XRealIP} {
+		res, err := NewResolver([]string{"10.0.0.0/8", "::1"}, header)
+		require.NoError(t, err)
+		resolvers[header] = res
+	}
+	_, err := NewResolver(nil, "X-Client-IP")
+	require.Equal(t, ErrBadHeader, errors.Cause(err))
+	table := []struct {
+		header  string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "192.0.2.1"},
+		{"", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 2.2.2.2, 10.0.0.2"}, "2.2.2.2"},
+		{"", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{Forwarded, "[::1]:1234", map[string]string{"Forwarded": `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{XRealIP, "10.0.0.1:1234", map[string]string{"X-Real-IP": "192.0.2.9"}, "192.0.2.9"},
+		{"", "10.0.0.1:1234", nil, "10.0.0.1"},
+		// a client sending a header the proxy doesn't set can't use it to pick its address
+		{"", "10.0.0.5:1234", map[string]string{"X-Forwarded-For": "203.0.113.9", "Forwarded": "for=192.168.1.1"}, "203.0.113.9"},
+		{"", "10.0.0.5:1234", map[string]string{"Forwarded": "for=192.168.1.1", "X-Real-IP": "192.168.1.1"}, "10.0.0.5"},
+		{Forwarded, "10.0.0.5:1234", map[string]string{"X-Forwarded-For": "192.168.1.1"}, "10.0.0.5"},
+		{XRealIP, "10.0.0.5:1234", map[string]string{"X-Forwarded-For": "192.168.1.1"}, "10.0.0.5"},
+	}
+	for _, row := range table {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = row.remote
+		for k, v := range row.headers {
+			req.Header.Set(k, v)
+		}
+		require.Equal(t, row.want, resolvers[row.header].ClientIP(req).String(), row.remote)
+	}
+}
+
+// call runs f.Check from remote
+func call(t *testing.T, f *IPFilter, remote string) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remote
+	recorder := httptest.NewRecorder()
+	ret, err := f.Check(recorder, req)
+	require.NoError(t, err)
+	return ret, recorder
+}
+
+// TestCheck checks allow, deny and no match, and reloading from a file
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rules")
+	require.NoError(t, ioutil.WriteFile(file, []byte("# office\nallow 192.0.2.0/24\ndeny 192.0.2.66 # printer\n"), 0600))
+
+	f, err := New(Config{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.6.6.0/24"}, File: file})
+	require.NoError(t, err)
+
+	ret, _ := call(t, f, "10.1.1.1:1")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, Info{IP: "10.1.1.1", Network: "10.0.0.0/8"}, info)
+
+	ret, recorder := call(t, f, "10.6.6.6:1")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	ret, _ = call(t, f, "192.0.2.1:1")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	ret, _ = call(t, f, "192.0.2.66:1")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	ret, _ = call(t, f, "198.51.100.1:1")
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	stop := f.Watch(10 * time.Millisecond)
+	defer stop()
+	time.Sleep(20 * time.Millisecond) // so the modification time moves on coarse filesystems
+	require.NoError(t, ioutil.WriteFile(file, []byte("deny 192.0.2.0/24\n"), 0600))
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if ret, _ = call(t, f, "192.0.2.1:1"); ret.Auth == authdoor.AuthDenied {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("permit 192.0.2.0/24\n"), 0600))
+	require.Equal(t, ErrBadRule, errors.Cause(f.Reload()))
+	ret, _ = call(t, f, "192.0.2.1:1")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth) // old rules kept
+}
+
+// BenchmarkLookup looks up addresses in a trie of 10000 networks
+func BenchmarkLookup(b *testing.B) {
+	trie := NewTrie()
+	for i := 0; i < 10000; i++ {
+		trie.Insert(&net.IPNet{IP: net.IPv4(byte(i>>8), byte(i), 0, 0).To4(), Mask: net.CIDRMask(16, 32)}, Allow)
+	}
+	ip := net.ParseIP("39.15.1.1")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Lookup(ip)
+	}
+}
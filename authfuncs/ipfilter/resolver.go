@@ -0,0 +1,109 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The forwarding headers a Resolver can read. Only one is ever read: a proxy that sets one usually passes the others through from the client untouched.
+const (
+	XForwardedFor = "X-Forwarded-For"
+	Forwarded     = "Forwarded"
+	XRealIP       = "X-Real-IP"
+)
+
+// Resolver finds the client's address. The forwarding header is only believed when it was added by a trusted proxy, otherwise anyone could claim any address.
+type Resolver struct {
+	trusted *Trie
+	header  string
+}
+
+// NewResolver returns a Resolver trusting proxies in the given networks (CIDRs or bare addresses) to set header, which is XForwardedFor if empty. No networks means headers are never used.
+func NewResolver(trustedProxies []string, header string) (*Resolver, error) {
+	header = http.CanonicalHeaderKey(header)
+	switch header {
+	case "":
+		header = XForwardedFor
+	case XForwardedFor, Forwarded, http.CanonicalHeaderKey(XRealIP):
+	default:
+		return nil, errors.Wrap(ErrBadHeader, header)
+	}
+	trusted := NewTrie()
+	for _, s := range trustedProxies {
+		network, err := ParseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		trusted.Insert(network, true)
+	}
+	return &Resolver{trusted: trusted, header: header}, nil
+}
+
+// parseHost parses an address that might have a port, brackets or quotes
+func parseHost(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// forwardedFor returns the for= values of a Forwarded header (RFC 7239) in order
+func forwardedFor(values []string) []string {
+	var ret []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					ret = append(ret, pair[4:])
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// hops returns the addresses the resolver's header claims, client first. Other headers are ignored, even when it's missing.
+func (res *Resolver) hops(r *http.Request) []string {
+	values := r.Header[res.header]
+	switch res.header {
+	case Forwarded:
+		return forwardedFor(values)
+	case XForwardedFor:
+		var ret []string
+		for _, value := range values {
+			ret = append(ret, strings.Split(value, ",")...)
+		}
+		return ret
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	// X-Real-IP is a single address, a proxy overwrites rather than appends
+	return values[len(values)-1:]
+}
+
+// ClientIP returns the client's address. Starting at the connection's peer, it walks the resolver's header right to left while the hop is a trusted proxy, and returns the first address that isn't. nil means RemoteAddr couldn't be parsed.
+func (res *Resolver) ClientIP(r *http.Request) net.IP {
+	ip := parseHost(r.RemoteAddr)
+	if ip == nil || !res.trusted.Contains(ip) {
+		return ip
+	}
+	claimed := res.hops(r)
+	for i := len(claimed) - 1; i >= 0; i-- {
+		hop := parseHost(claimed[i])
+		if hop == nil {
+			// garbage in the chain, the last trusted proxy is all we can be sure of
+			return ip
+		}
+		ip = hop
+		if !res.trusted.Contains(ip) {
+			return ip
+		}
+	}
+	return ip
+}
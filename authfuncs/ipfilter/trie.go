@@ -0,0 +1,111 @@
+package ipfilter
+
+import (
+	"net"
+)
+
+// trieNode is one bit of a prefix
+type trieNode struct {
+	children [2]*trieNode
+	network  *net.IPNet
+	value    interface{}
+}
+
+// Trie is a binary prefix trie over IPv4 and IPv6 networks. Lookup is the longest matching prefix and costs at most 32 or 128 steps however many networks are stored.
+type Trie struct {
+	v4  *trieNode
+	v6  *trieNode
+	len int
+}
+
+// NewTrie returns an empty Trie
+func NewTrie() *Trie {
+	return &Trie{v4: new(trieNode), v6: new(trieNode)}
+}
+
+// root picks the tree and the byte form of ip
+func (t *Trie) root(ip net.IP) (*trieNode, net.IP) {
+	if v4 := ip.To4(); v4 != nil {
+		return t.v4, v4
+	}
+	return t.v6, ip.To16()
+}
+
+// bit returns bit i of ip, most significant first
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// Insert stores value for network, replacing any value already stored for exactly that network
+func (t *Trie) Insert(network *net.IPNet, value interface{}) {
+	node, ip := t.root(network.IP)
+	ones, bits := network.Mask.Size()
+	if ip == nil || len(ip)*8 != bits {
+		// a v4 network given in 16 byte form has a 128 bit mask
+		if v4 := network.IP.To4(); v4 != nil && bits == 128 && ones >= 96 {
+			ones -= 96
+		} else {
+			return
+		}
+	}
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = new(trieNode)
+		}
+		node = node.children[b]
+	}
+	if node.network == nil {
+		t.len++
+	}
+	node.network = network
+	node.value = value
+}
+
+// Lookup returns the value and network of the longest prefix containing ip
+func (t *Trie) Lookup(ip net.IP) (interface{}, *net.IPNet, bool) {
+	node, ip := t.root(ip)
+	if ip == nil {
+		return nil, nil, false
+	}
+	var found *trieNode
+	for i := 0; node != nil; i++ {
+		if node.network != nil {
+			found = node
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[bit(ip, i)]
+	}
+	if found == nil {
+		return nil, nil, false
+	}
+	return found.value, found.network, true
+}
+
+// Contains reports whether any stored network contains ip
+func (t *Trie) Contains(ip net.IP) bool {
+	_, _, ok := t.Lookup(ip)
+	return ok
+}
+
+// Len is the number of networks stored
+func (t *Trie) Len() int {
+	return t.len
+}
+
+// ParseNetwork accepts a CIDR or a bare address, which is a /32 or /128
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "CIDR address", Text: s}
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
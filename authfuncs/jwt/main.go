@@ -0,0 +1,234 @@
+/*
+Package jwt is an AuthFunc for machine clients that send "Authorization: Bearer <jwt>". Keys come from PEM files, a shared secret, or a JWKS URL.
+*/
+package jwt
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/jose"
+	"github.com/ayjayt/ilog"
+)
+
+var (
+	// ErrNoKeys is returned by New when no key source is configured
+	ErrNoKeys = errors.New("no keys configured")
+	// ErrBadPEM is returned when a key file doesn't contain a public key we can use
+	ErrBadPEM = errors.New("couldn't parse public key")
+	// ErrAlgorithm is returned when a token's alg isn't allowed
+	ErrAlgorithm = errors.New("algorithm not allowed")
+	// ErrClaims is returned when iss, aud or a required exp doesn't check out
+	ErrClaims = errors.New("invalid claims")
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// DefaultAlgorithms are accepted when Config.Algorithms is empty
+var DefaultAlgorithms = []string{"HS256", "RS256", "ES256", "EdDSA"}
+
+// Config describes where keys come from and what the claims must say
+type Config struct {
+	// Algorithms allowed in the token header, defaults to DefaultAlgorithms
+	Algorithms []string
+	// Secret is the HMAC key for HS* tokens
+	Secret []byte
+	// PublicKeyFiles are PEM files (PKIX public keys or certificates), every key is tried
+	PublicKeyFiles []string
+	// JWKSURL is fetched, cached and refetched when a token names a kid we haven't seen
+	JWKSURL string
+	// JWKSRefresh is how often the JWKS is refetched without a cache header, defaults to an hour
+	JWKSRefresh time.Duration
+	// HTTPClient fetches the JWKS, defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Issuer, if set, must match iss
+	Issuer string
+	// Audience, if set, must be in aud
+	Audience string
+	// ClockSkew is allowed on exp, nbf and iat, defaults to a minute
+	ClockSkew time.Duration
+	// RequireExpiry rejects tokens without exp
+	RequireExpiry bool
+}
+
+// JWT supplies an authfunc receiver and stores information to be used by that receiver
+type JWT struct {
+	config     Config
+	algorithms map[string]bool
+	staticKeys []interface{}
+	remote     *jose.RemoteKeySet
+	now        func() time.Time
+}
+
+// New loads the static keys and returns a JWT ready to be used as an AuthFunc
+func New(config Config) (*JWT, error) {
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = DefaultAlgorithms
+	}
+	if config.ClockSkew == 0 {
+		config.ClockSkew = time.Minute
+	}
+	j := &JWT{
+		config:     config,
+		algorithms: make(map[string]bool),
+		now:        time.Now,
+	}
+	for _, alg := range config.Algorithms {
+		j.algorithms[alg] = true
+	}
+	for _, file := range config.PublicKeyFiles {
+		keys, err := LoadPEM(file)
+		if err != nil {
+			return nil, err
+		}
+		j.staticKeys = append(j.staticKeys, keys...)
+	}
+	if config.JWKSURL != "" {
+		j.remote = jose.NewRemoteKeySet(config.HTTPClient, config.JWKSURL, config.JWKSRefresh)
+	}
+	if len(config.Secret) == 0 && len(j.staticKeys) == 0 && j.remote == nil {
+		return nil, ErrNoKeys
+	}
+	defaultLogger.Info("JWT validator created with " + strings.Join(config.Algorithms, ","))
+	return j, nil
+}
+
+// LoadPEM reads every public key and certificate in a PEM file
+func LoadPEM(file string) ([]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []interface{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(ErrBadPEM, file+": "+err.Error())
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(ErrBadPEM, file+": "+err.Error())
+			}
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.Wrap(ErrBadPEM, file)
+	}
+	return keys, nil
+}
+
+// bearer returns the token from the Authorization header, if there is one
+func bearer(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// Check is an authfunc. No bearer token fails quietly so later instances can run, a bad token is denied with a 401.
+func (j *JWT) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	token := bearer(r)
+	if token == "" {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	payload, err := j.Validate(r.Context(), token)
+	if err != nil {
+		defaultLogger.Info("JWT rejected: " + err.Error())
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: payload},
+	}, nil
+}
+
+// Validate checks the token's signature and claims and returns its payload
+func (j *JWT) Validate(ctx context.Context, token string) (json.RawMessage, error) {
+	jws, err := jose.ParseCompact(token)
+	if err != nil {
+		return nil, err
+	}
+	if !j.algorithms[jws.Header.Alg] {
+		return nil, errors.Wrap(ErrAlgorithm, jws.Header.Alg)
+	}
+	if err := j.verify(ctx, jws); err != nil {
+		return nil, err
+	}
+	claims := jose.Claims{}
+	if err := json.Unmarshal(jws.Payload, &claims); err != nil {
+		return nil, errors.Wrap(ErrClaims, err.Error())
+	}
+	if err := claims.ValidateTime(j.now(), j.config.ClockSkew); err != nil {
+		return nil, err
+	}
+	if j.config.RequireExpiry && claims.Expiry == nil {
+		return nil, errors.Wrap(ErrClaims, "no exp")
+	}
+	if j.config.Issuer != "" && claims.Issuer != j.config.Issuer {
+		return nil, errors.Wrap(ErrClaims, "iss "+claims.Issuer)
+	}
+	if j.config.Audience != "" && !claims.Audience.Contains(j.config.Audience) {
+		return nil, errors.Wrap(ErrClaims, "aud")
+	}
+	return json.RawMessage(jws.Payload), nil
+}
+
+// verify checks the signature with the secret for HS*, otherwise with the static keys and then the JWKS
+func (j *JWT) verify(ctx context.Context, jws *jose.JWS) error {
+	if strings.HasPrefix(jws.Header.Alg, "HS") {
+		if len(j.config.Secret) == 0 {
+			return errors.Wrap(ErrAlgorithm, "no secret for "+jws.Header.Alg)
+		}
+		return jws.Verify(j.config.Secret)
+	}
+	err := error(jose.ErrSignature)
+	for _, key := range j.staticKeys {
+		// keys of the wrong type give ErrKeyType, keep looking
+		if err = jws.Verify(key); err == nil {
+			return nil
+		}
+	}
+	if j.remote != nil {
+		key, err := j.remote.Key(ctx, jws.Header.Kid)
+		if err != nil {
+			return err
+		}
+		return jws.Verify(key)
+	}
+	return err
+}
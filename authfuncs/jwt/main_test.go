@@ -0,0 +1,206 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/jose"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/jwt/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// sign makes a token with claims
+func sign(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	token, err := jose.Sign(alg, kid, key, payload)
+	require.NoError(t, err)
+	return token
+}
+
+// check runs j.Check with token as the bearer
+func check(t *testing.T, j *JWT, token string) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	ret, err := j.Check(recorder, req)
+	require.NoError(t, err)
+	return ret, recorder
+}
+
+// writePEM writes pub to a temporary PEM file
+func writePEM(t *testing.T, dir string, pub interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	file, err := ioutil.TempFile(dir, "*.pem")
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, pem.Encode(file, &pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return file.Name()
+}
+
+// TestStaticKeys validates tokens of every default algorithm against PEM files and a secret
+func TestStaticKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	j, err := New(Config{
+		Secret:         []byte("secret"),
+		PublicKeyFiles: []string{writePEM(t, dir, &rsaKey.PublicKey), writePEM(t, dir, &ecKey.PublicKey), writePEM(t, dir, edPub)},
+		Issuer:         "https://issuer",
+		Audience:       "authdoor",
+	})
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{"iss": "https://issuer", "aud": "authdoor", "sub": "robot", "exp": time.Now().Add(time.Hour).Unix()}
+	for alg, key := range map[string]interface{}{"HS256": []byte("secret"), "RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey} {
+		ret, _ := check(t, j, sign(t, alg, "", key, claims))
+		require.Equal(t, authdoor.AuthGranted, ret.Auth, alg)
+		require.Equal(t, authdoor.Ignored, ret.Resp)
+		got := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(ret.Info.Info, &got))
+		require.Equal(t, "robot", got["sub"])
+	}
+
+	// not allowed by default
+	ret, recorder := check(t, j, sign(t, "HS512", "", []byte("secret"), claims))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	require.Contains(t, recorder.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	ret, _ = check(t, j, sign(t, "HS256", "", []byte("wrong"), claims))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	ret, _ = check(t, j, "")
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	_, err = New(Config{PublicKeyFiles: []string{filepath.Join(dir, "missing.pem")}})
+	require.Error(t, err)
+	_, err = New(Config{})
+	require.Equal(t, ErrNoKeys, err)
+}
+
+// TestClaims checks iss, aud, exp and nbf with skew
+func TestClaims(t *testing.T) {
+	j, err := New(Config{Secret: []byte("secret"), Issuer: "iss", Audience: "aud", ClockSkew: time.Minute, RequireExpiry: true})
+	require.NoError(t, err)
+	now := time.Now()
+	j.now = func() time.Time { return now }
+	ctx := context.Background()
+	base := func() map[string]interface{} {
+		return map[string]interface{}{"iss": "iss", "aud": []string{"other", "aud"}, "exp": now.Add(time.Minute).Unix()}
+	}
+	_, err = j.Validate(ctx, sign(t, "HS256", "", []byte("secret"), base()))
+	require.NoError(t, err)
+
+	claims := base()
+	claims["exp"] = now.Add(-30 * time.Second).Unix()
+	_, err = j.Validate(ctx, sign(t, "HS256", "", []byte("secret"), claims))
+	require.NoError(t, err) // within skew
+	claims["exp"] = now.Add(-2 * time.Minute).Unix()
+	_, err = j.Validate(ctx, sign(t, "HS256", "", []byte("secret"), claims))
+	require.Equal(t, jose.ErrExpired, err)
+
+	claims = base()
+	claims["nbf"] = now.Add(2 * time.Minute).Unix()
+	_, err = j.Validate(ctx, sign(t, "HS256", "", []byte("secret"), claims))
+	require.Equal(t, jose.ErrNotYetValid, err)
+
+	for field, value := range map[string]interface{}{"iss": "other", "aud": "other", "exp": nil} {
+		claims = base()
+		if value == nil {
+			delete(claims, field)
+		} else {
+			claims[field] = value
+		}
+		_, err = j.Validate(ctx, sign(t, "HS256", "", []byte("secret"), claims))
+		require.Equal(t, ErrClaims, errors.Cause(err), field)
+	}
+}
+
+// TestJWKS fetches keys from a JWKS endpoint and picks them by kid. Rotation is covered by jose's RemoteKeySet tests.
+func TestJWKS(t *testing.T) {
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	second, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	firstJWK, err := jose.NewJSONWebKey("first", &first.PublicKey)
+	require.NoError(t, err)
+	secondJWK, err := jose.NewJSONWebKey("second", &second.PublicKey)
+	require.NoError(t, err)
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{firstJWK, secondJWK}})
+	}))
+	defer server.Close()
+
+	j, err := New(Config{JWKSURL: server.URL, HTTPClient: server.Client()})
+	require.NoError(t, err)
+	claims := map[string]interface{}{"sub": "robot"}
+	ret, _ := check(t, j, sign(t, "RS256", "first", first, claims))
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	// HS256 with the public key as the secret mustn't work
+	ret, _ = check(t, j, sign(t, "HS256", "first", x509.MarshalPKCS1PublicKey(&first.PublicKey), claims))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	ret, _ = check(t, j, sign(t, "ES256", "second", second, claims))
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	ret, _ = check(t, j, sign(t, "ES256", "first", second, claims))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
@@ -0,0 +1,271 @@
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor/authfuncs/internal/ber"
+)
+
+var (
+	// ErrInvalidCredentials is returned when a bind is refused with invalidCredentials
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrProtocol is returned for responses that don't make sense, the connection isn't reused after one
+	ErrProtocol = errors.New("unexpected LDAP response")
+)
+
+// Protocol operation tags (RFC 4511 section 4.2 onwards)
+const (
+	opBindRequest      = 0
+	opBindResponse     = 1
+	opUnbindRequest    = 2
+	opSearchRequest    = 3
+	opSearchEntry      = 4
+	opSearchDone       = 5
+	opSearchReference  = 19
+	opExtendedRequest  = 23
+	opExtendedResponse = 24
+)
+
+const (
+	resultSuccess      = 0
+	resultInvalidCreds = 49
+	resultBusy         = 51
+	resultUnavailable  = 52
+	scopeWholeSubtree  = 2
+	derefAliasesNever  = 0
+	startTLSOID        = "1.3.6.1.4.1.1466.20037"
+	// searchSizeLimit is the most entries a search asks for, searchTimeLimit the seconds it gives the server
+	searchSizeLimit = 100
+	searchTimeLimit = 10
+)
+
+// ResultError is a non-success result from the server
+type ResultError struct {
+	Code    int64
+	Message string
+}
+
+// Error describes the result
+func (e *ResultError) Error() string {
+	return "ldap result " + strconv.FormatInt(e.Code, 10) + ": " + e.Message
+}
+
+// entry is a search result
+type entry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// first returns the first value of an attribute, matching its name without regard to case
+func (e *entry) first(name string) string {
+	values := e.values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// values returns an attribute's values, matching its name without regard to case
+func (e *entry) values(name string) []string {
+	for attribute, values := range e.attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// conn is one connection to a server, used for one operation at a time
+type conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	id      int64
+	// broken is set after a network or protocol error so the pool throws the connection away
+	broken bool
+	idle   time.Time
+}
+
+// newConn wraps an established connection
+func newConn(c net.Conn, timeout time.Duration) *conn {
+	return &conn{Conn: c, reader: bufio.NewReader(c), timeout: timeout}
+}
+
+// roundTrip sends op and returns the responses up to and including the one tagged last
+func (c *conn) roundTrip(op *ber.Packet, last int) ([]*ber.Packet, error) {
+	c.id++
+	c.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.Write(ber.NewSequence(ber.NewInt(c.id), op).Bytes()); err != nil {
+		c.broken = true
+		return nil, err
+	}
+	var responses []*ber.Packet
+	for {
+		message, err := ber.Read(c.reader)
+		if err != nil {
+			c.broken = true
+			return nil, err
+		}
+		id, errID := message.Child(0)
+		response, errOp := message.Child(1)
+		if errID != nil || errOp != nil {
+			c.broken = true
+			return nil, ErrProtocol
+		}
+		if n, err := id.Int(); err != nil || n != c.id || response.Class != ber.ClassApplication {
+			c.broken = true
+			return nil, ErrProtocol
+		}
+		responses = append(responses, response)
+		if response.Tag == last {
+			return responses, nil
+		}
+		if len(responses) > searchSizeLimit {
+			c.broken = true
+			return nil, ErrProtocol
+		}
+	}
+}
+
+// checkResult reads the LDAPResult at the start of a response
+func (c *conn) checkResult(response *ber.Packet) error {
+	code, errCode := response.Child(0)
+	message, errMessage := response.Child(2)
+	if errCode != nil || errMessage != nil {
+		c.broken = true
+		return ErrProtocol
+	}
+	n, err := code.Int()
+	if err != nil {
+		c.broken = true
+		return ErrProtocol
+	}
+	switch n {
+	case resultSuccess:
+		return nil
+	case resultInvalidCreds:
+		return ErrInvalidCredentials
+	case resultBusy, resultUnavailable:
+		// treated like a network error so the pool tries the next server
+		c.broken = true
+	}
+	return &ResultError{Code: n, Message: message.String()}
+}
+
+// bind does a simple bind. An empty password is an anonymous bind that servers report as a success, so callers checking a user's password must refuse empty ones first.
+func (c *conn) bind(dn, password string) error {
+	responses, err := c.roundTrip(ber.NewConstructed(ber.ClassApplication, opBindRequest,
+		ber.NewInt(3),
+		ber.NewString(dn),
+		ber.NewPrimitive(ber.ClassContext, 0, []byte(password)),
+	), opBindResponse)
+	if err != nil {
+		return err
+	}
+	return c.checkResult(responses[len(responses)-1])
+}
+
+// startTLS upgrades the connection (RFC 4511 section 4.14)
+func (c *conn) startTLS(config *tls.Config) error {
+	responses, err := c.roundTrip(ber.NewConstructed(ber.ClassApplication, opExtendedRequest,
+		ber.NewPrimitive(ber.ClassContext, 0, []byte(startTLSOID)),
+	), opExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err := c.checkResult(responses[len(responses)-1]); err != nil {
+		c.broken = true
+		return errors.Wrap(err, "StartTLS refused")
+	}
+	tlsConn := tls.Client(c.Conn, config)
+	tlsConn.SetDeadline(time.Now().Add(c.timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		c.broken = true
+		return err
+	}
+	c.Conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// search runs a search and returns its entries
+func (c *conn) search(base string, scope int64, filter string, attributes []string) ([]entry, error) {
+	compiled, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	requested := ber.NewSequence()
+	for _, attribute := range attributes {
+		requested.Children = append(requested.Children, ber.NewString(attribute))
+	}
+	responses, err := c.roundTrip(ber.NewConstructed(ber.ClassApplication, opSearchRequest,
+		ber.NewString(base),
+		ber.NewEnum(scope),
+		ber.NewEnum(derefAliasesNever),
+		ber.NewInt(searchSizeLimit),
+		ber.NewInt(searchTimeLimit),
+		ber.NewBool(false),
+		compiled,
+		requested,
+	), opSearchDone)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkResult(responses[len(responses)-1]); err != nil {
+		return nil, err
+	}
+	var entries []entry
+	for _, response := range responses[:len(responses)-1] {
+		if response.Tag == opSearchReference {
+			// referrals to other servers aren't followed
+			continue
+		}
+		if response.Tag != opSearchEntry {
+			c.broken = true
+			return nil, ErrProtocol
+		}
+		e, err := parseEntry(response)
+		if err != nil {
+			c.broken = true
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// parseEntry reads a SearchResultEntry
+func parseEntry(response *ber.Packet) (entry, error) {
+	dn, errDN := response.Child(0)
+	list, errList := response.Child(1)
+	if errDN != nil || errList != nil {
+		return entry{}, ErrProtocol
+	}
+	e := entry{dn: dn.String(), attributes: make(map[string][]string)}
+	for _, attribute := range list.Children {
+		name, errName := attribute.Child(0)
+		values, errValues := attribute.Child(1)
+		if errName != nil || errValues != nil {
+			return entry{}, ErrProtocol
+		}
+		for _, value := range values.Children {
+			e.attributes[name.String()] = append(e.attributes[name.String()], value.String())
+		}
+	}
+	return e, nil
+}
+
+// close unbinds politely and closes the connection
+func (c *conn) close() {
+	c.id++
+	c.SetDeadline(time.Now().Add(time.Second))
+	c.Write(ber.NewSequence(ber.NewInt(c.id), ber.NewPrimitive(ber.ClassApplication, opUnbindRequest, nil)).Bytes())
+	c.Conn.Close()
+}
@@ -0,0 +1,180 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor/authfuncs/internal/ber"
+)
+
+// ErrFilter is returned for filters that don't parse
+var ErrFilter = errors.New("bad filter")
+
+// Filter choice tags (RFC 4511 section 4.5.1)
+const (
+	filterAnd            = 0
+	filterOr             = 1
+	filterNot            = 2
+	filterEqualityMatch  = 3
+	filterSubstrings     = 4
+	filterGreaterOrEqual = 5
+	filterLessOrEqual    = 6
+	filterPresent        = 7
+	filterApproxMatch    = 8
+)
+
+// EscapeFilter escapes a value for use in a filter string (RFC 4515 section 3), which anything a user typed has to go through
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			b.WriteString("\\" + hex.EncodeToString([]byte{c}))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeValue turns \XX escapes back into bytes
+func unescapeValue(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", ErrFilter
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", ErrFilter
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// compileFilter turns a filter string like (&(objectClass=person)(uid=aj)) into its BER form
+func compileFilter(filter string) (*ber.Packet, error) {
+	packet, rest, err := parseFilter(strings.TrimSpace(filter), 0)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, ErrFilter
+	}
+	return packet, nil
+}
+
+// parseFilter parses one parenthesized filter and returns what's after it
+func parseFilter(s string, depth int) (*ber.Packet, string, error) {
+	if depth > 32 || len(s) < 3 || s[0] != '(' {
+		return nil, "", ErrFilter
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|':
+		tag := filterAnd
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		s = s[1:]
+		set := ber.NewConstructed(ber.ClassContext, tag)
+		for len(s) > 0 && s[0] == '(' {
+			child, rest, err := parseFilter(s, depth+1)
+			if err != nil {
+				return nil, "", err
+			}
+			set.Children = append(set.Children, child)
+			s = rest
+		}
+		if len(set.Children) == 0 || len(s) == 0 || s[0] != ')' {
+			return nil, "", ErrFilter
+		}
+		return set, s[1:], nil
+	case '!':
+		child, rest, err := parseFilter(s[1:], depth+1)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", ErrFilter
+		}
+		return ber.NewConstructed(ber.ClassContext, filterNot, child), rest[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end == -1 {
+		return nil, "", ErrFilter
+	}
+	item, rest := s[:end], s[end+1:]
+	packet, err := parseItem(item)
+	return packet, rest, err
+}
+
+// parseItem parses the inside of a simple filter like uid=aj
+func parseItem(item string) (*ber.Packet, error) {
+	equals := strings.IndexByte(item, '=')
+	if equals < 1 || strings.ContainsAny(item, "(") {
+		return nil, ErrFilter
+	}
+	attribute, value := item[:equals], item[equals+1:]
+	tag := filterEqualityMatch
+	switch attribute[len(attribute)-1] {
+	case '~':
+		tag = filterApproxMatch
+	case '>':
+		tag = filterGreaterOrEqual
+	case '<':
+		tag = filterLessOrEqual
+	}
+	if tag != filterEqualityMatch {
+		attribute = attribute[:len(attribute)-1]
+	}
+	if attribute == "" || strings.ContainsAny(attribute, " *\\") {
+		return nil, ErrFilter
+	}
+	if tag == filterEqualityMatch && value == "*" {
+		return ber.NewPrimitive(ber.ClassContext, filterPresent, []byte(attribute)), nil
+	}
+	if tag == filterEqualityMatch && strings.Contains(value, "*") {
+		return parseSubstrings(attribute, value)
+	}
+	unescaped, err := unescapeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return ber.NewConstructed(ber.ClassContext, tag, ber.NewString(attribute), ber.NewString(unescaped)), nil
+}
+
+// parseSubstrings parses a value with wildcards like a*b*c
+func parseSubstrings(attribute, value string) (*ber.Packet, error) {
+	parts := strings.Split(value, "*")
+	substrings := ber.NewSequence()
+	for i, part := range parts {
+		if part == "" {
+			if i != 0 && i != len(parts)-1 {
+				// ** has nothing between the stars
+				return nil, ErrFilter
+			}
+			continue
+		}
+		unescaped, err := unescapeValue(part)
+		if err != nil {
+			return nil, err
+		}
+		tag := 1
+		if i == 0 {
+			tag = 0
+		} else if i == len(parts)-1 {
+			tag = 2
+		}
+		substrings.Children = append(substrings.Children, ber.NewPrimitive(ber.ClassContext, tag, []byte(unescaped)))
+	}
+	return ber.NewConstructed(ber.ClassContext, filterSubstrings, ber.NewString(attribute), substrings), nil
+}
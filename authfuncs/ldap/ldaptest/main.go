@@ -0,0 +1,436 @@
+/*
+Package ldaptest provides a tiny in-process LDAP server for tests. It handles simple binds, searches, StartTLS and unbinds over plain TCP or LDAPS, with a self-signed certificate for 127.0.0.1.
+*/
+package ldaptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ayjayt/authdoor/authfuncs/internal/ber"
+)
+
+// Result codes the server sends (RFC 4511 appendix A)
+const (
+	resultSuccess           = 0
+	resultProtocolError     = 2
+	resultNoSuchObject      = 32
+	resultInvalidCreds      = 49
+	resultInsufficientRight = 50
+	resultUnavailable       = 52
+	resultUnwilling         = 53
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Entry is one object in the directory. Attribute names are matched without regard to case.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Server is a fake directory. Add to Entries and Passwords before connecting, they're read under a lock so tests can change them between logins.
+type Server struct {
+	Entries []Entry
+	// Passwords are checked on bind, keyed by DN
+	Passwords map[string]string
+	// AllowAnonymous lets searches run without binding
+	AllowAnonymous bool
+	// Unavailable answers every operation with unavailable, to test failover
+	Unavailable bool
+	// Certificates trusts the server's certificate
+	Certificates *x509.CertPool
+	// Connections and Binds count what clients did, read them with atomic
+	Connections int64
+	Binds       int64
+	ldaps       bool
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	mutex       *sync.Mutex
+	conns       map[net.Conn]bool
+}
+
+// NewServer starts a plain server which also offers StartTLS
+func NewServer() *Server {
+	return start(false)
+}
+
+// NewTLSServer starts an LDAPS server
+func NewTLSServer() *Server {
+	return start(true)
+}
+
+// start listens on a free port and serves in the background
+func start(ldaps bool) *Server {
+	certificate, pool := selfSigned()
+	s := &Server{
+		Passwords:    make(map[string]string),
+		Certificates: pool,
+		ldaps:        ldaps,
+		tlsConfig:    &tls.Config{Certificates: []tls.Certificate{certificate}},
+		mutex:        new(sync.Mutex),
+		conns:        make(map[net.Conn]bool),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	if ldaps {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listener = listener
+	go s.serve()
+	return s
+}
+
+// selfSigned makes a certificate for 127.0.0.1 and a pool trusting it
+func selfSigned() (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldaptest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// URL returns ldap:// or ldaps:// with the server's address
+func (s *Server) URL() string {
+	if s.ldaps {
+		return "ldaps://" + s.listener.Addr().String()
+	}
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// AddUser adds a person entry with a uid, password and any other attributes
+func (s *Server) AddUser(dn, uid, password string, attributes map[string][]string) {
+	if attributes == nil {
+		attributes = make(map[string][]string)
+	}
+	attributes["objectClass"] = []string{"top", "person", "inetOrgPerson"}
+	attributes["uid"] = []string{uid}
+	s.mutex.Lock()
+	s.Entries = append(s.Entries, Entry{DN: dn, Attributes: attributes})
+	s.Passwords[dn] = password
+	s.mutex.Unlock()
+}
+
+// Close stops listening and drops every connection
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mutex.Unlock()
+}
+
+// serve accepts until the listener is closed
+func (s *Server) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.Connections, 1)
+		s.mutex.Lock()
+		s.conns[c] = true
+		s.mutex.Unlock()
+		go s.handle(c)
+	}
+}
+
+// session is what the server knows about one connection
+type session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	authed bool
+}
+
+// handle answers one connection's requests in order
+func (s *Server) handle(c net.Conn) {
+	sess := &session{conn: c, reader: bufio.NewReader(c)}
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, sess.conn)
+		s.mutex.Unlock()
+		sess.conn.Close()
+	}()
+	for {
+		message, err := ber.Read(sess.reader)
+		if err != nil || len(message.Children) < 2 {
+			return
+		}
+		id, err := message.Children[0].Int()
+		if err != nil {
+			return
+		}
+		op := message.Children[1]
+		if op.Class != ber.ClassApplication {
+			return
+		}
+		s.mutex.Lock()
+		unavailable := s.Unavailable
+		s.mutex.Unlock()
+		switch op.Tag {
+		case 2:
+			return
+		case 0:
+			if unavailable {
+				s.reply(sess, id, 1, resultUnavailable, "")
+				continue
+			}
+			s.bind(sess, id, op)
+		case 3:
+			if unavailable {
+				s.reply(sess, id, 5, resultUnavailable, "")
+				continue
+			}
+			s.search(sess, id, op)
+		case 23:
+			if !s.startTLS(sess, id, op) {
+				return
+			}
+		default:
+			s.reply(sess, id, op.Tag+1, resultUnwilling, "unsupported operation")
+		}
+	}
+}
+
+// reply sends an LDAPResult under the given response tag
+func (s *Server) reply(sess *session, id int64, tag int, code int64, message string) {
+	sess.conn.Write(ber.NewSequence(ber.NewInt(id), ber.NewConstructed(ber.ClassApplication, tag,
+		ber.NewEnum(code),
+		ber.NewString(""),
+		ber.NewString(message),
+	)).Bytes())
+}
+
+// bind checks a simple bind. Like real servers, a DN with an empty password is an unauthenticated bind that succeeds.
+func (s *Server) bind(sess *session, id int64, op *ber.Packet) {
+	atomic.AddInt64(&s.Binds, 1)
+	if len(op.Children) < 3 || !op.Children[2].Is(ber.ClassContext, 0) {
+		s.reply(sess, id, 1, resultProtocolError, "only simple binds")
+		return
+	}
+	dn, password := op.Children[1].String(), op.Children[2].String()
+	sess.authed = false
+	if password == "" {
+		s.reply(sess, id, 1, resultSuccess, "")
+		return
+	}
+	s.mutex.Lock()
+	want, ok := s.Passwords[dn]
+	s.mutex.Unlock()
+	if !ok || want != password {
+		s.reply(sess, id, 1, resultInvalidCreds, "")
+		return
+	}
+	sess.authed = true
+	s.reply(sess, id, 1, resultSuccess, "")
+}
+
+// search sends the entries under the base that match the filter
+func (s *Server) search(sess *session, id int64, op *ber.Packet) {
+	if len(op.Children) < 8 {
+		s.reply(sess, id, 5, resultProtocolError, "")
+		return
+	}
+	s.mutex.Lock()
+	entries := append([]Entry(nil), s.Entries...)
+	allowAnonymous := s.AllowAnonymous
+	s.mutex.Unlock()
+	if !sess.authed && !allowAnonymous {
+		s.reply(sess, id, 5, resultInsufficientRight, "anonymous searches aren't allowed")
+		return
+	}
+	base := strings.ToLower(op.Children[0].String())
+	var wanted []string
+	for _, attribute := range op.Children[7].Children {
+		wanted = append(wanted, attribute.String())
+	}
+	found := false
+	for _, e := range entries {
+		dn := strings.ToLower(e.DN)
+		if dn == base {
+			found = true
+		}
+		if dn != base && !strings.HasSuffix(dn, ","+base) {
+			continue
+		}
+		found = true
+		if !matches(e, op.Children[6]) {
+			continue
+		}
+		sess.conn.Write(ber.NewSequence(ber.NewInt(id), ber.NewConstructed(ber.ClassApplication, 4,
+			ber.NewString(e.DN),
+			attributeList(e, wanted),
+		)).Bytes())
+	}
+	if !found {
+		s.reply(sess, id, 5, resultNoSuchObject, "")
+		return
+	}
+	s.reply(sess, id, 5, resultSuccess, "")
+}
+
+// attributeList returns the requested attributes of an entry, or all of them if none were asked for
+func attributeList(e Entry, wanted []string) *ber.Packet {
+	list := ber.NewSequence()
+	for name, values := range e.Attributes {
+		if len(wanted) > 0 && !containsFold(wanted, name) {
+			continue
+		}
+		set := ber.NewSet()
+		for _, value := range values {
+			set.Children = append(set.Children, ber.NewString(value))
+		}
+		list.Children = append(list.Children, ber.NewSequence(ber.NewString(name), set))
+	}
+	return list
+}
+
+// containsFold reports whether list has s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// values returns an entry's attribute values, ignoring the name's case
+func values(e Entry, name string) []string {
+	for attribute, values := range e.Attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// matches evaluates a BER filter against an entry, comparing values without regard to case
+func matches(e Entry, filter *ber.Packet) bool {
+	if filter.Class != ber.ClassContext {
+		return false
+	}
+	switch filter.Tag {
+	case 0:
+		for _, child := range filter.Children {
+			if !matches(e, child) {
+				return false
+			}
+		}
+		return true
+	case 1:
+		for _, child := range filter.Children {
+			if matches(e, child) {
+				return true
+			}
+		}
+		return false
+	case 2:
+		return len(filter.Children) == 1 && !matches(e, filter.Children[0])
+	case 7:
+		return len(values(e, filter.String())) > 0
+	case 4:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		for _, value := range values(e, filter.Children[0].String()) {
+			if substringsMatch(strings.ToLower(value), filter.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	case 3, 5, 6, 8:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		want := strings.ToLower(filter.Children[1].String())
+		for _, value := range values(e, filter.Children[0].String()) {
+			value = strings.ToLower(value)
+			if (filter.Tag == 5 && value >= want) || (filter.Tag == 6 && value <= want) || value == want {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// substringsMatch checks initial, any and final parts in order
+func substringsMatch(value string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		want := strings.ToLower(part.String())
+		switch part.Tag {
+		case 0:
+			if !strings.HasPrefix(value, want) {
+				return false
+			}
+			value = value[len(want):]
+		case 1:
+			i := strings.Index(value, want)
+			if i == -1 {
+				return false
+			}
+			value = value[i+len(want):]
+		case 2:
+			if !strings.HasSuffix(value, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// startTLS answers the extended request and does the handshake, returning false if the connection should close
+func (s *Server) startTLS(sess *session, id int64, op *ber.Packet) bool {
+	if s.ldaps || len(op.Children) < 1 || op.Children[0].String() != startTLSOID {
+		s.reply(sess, id, 24, resultUnwilling, "")
+		return true
+	}
+	s.reply(sess, id, 24, resultSuccess, "")
+	tlsConn := tls.Server(sess.conn, s.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return false
+	}
+	s.mutex.Lock()
+	delete(s.conns, sess.conn)
+	s.conns[tlsConn] = true
+	s.mutex.Unlock()
+	sess.conn = tlsConn
+	sess.reader = bufio.NewReader(tlsConn)
+	return true
+}
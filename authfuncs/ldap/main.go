@@ -0,0 +1,384 @@
+/*
+Package ldap is an AuthFunc that checks passwords against an LDAP directory. It searches for the user with a service account, binds as them to check the password, and looks up their groups. Credentials come from Basic auth or a login form.
+*/
+package ldap
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/redirect"
+	"github.com/ayjayt/authdoor/authfuncs/internal/session"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// ErrNotInGroup is returned when a user's password is right but they aren't in any of Config.RequiredGroups
+var ErrNotInGroup = errors.New("not in a required group")
+
+// Config describes the directory
+type Config struct {
+	// Servers are tried in order, like ldaps://ldap1.example.com and ldap://ldap2.example.com:389
+	Servers []string
+	// StartTLS upgrades ldap:// connections, TLSConfig is used for it and ldaps://
+	StartTLS  bool
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the service account searches run as, empty searches anonymously
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are searched for
+	BaseDN string
+	// UserFilter finds a user, {user} is replaced with what they typed, escaped. Defaults to (uid={user}).
+	UserFilter string
+	// UserAttribute is returned as the uid, defaults to uid
+	UserAttribute string
+	// GroupAttribute lists a user's groups on their entry, like memberOf
+	GroupAttribute string
+	// GroupBaseDN turns on searching for groups with GroupFilter, where {dn} and {user} are the user's DN and uid.
+	// GroupFilter defaults to (|(member={dn})(uniqueMember={dn})(memberUid={user})), GroupNameAttribute to cn.
+	GroupBaseDN        string
+	GroupFilter        string
+	GroupNameAttribute string
+	// RequiredGroups, if set, denies users who aren't in one of them
+	RequiredGroups []string
+	// PoolSize is how many idle connections are kept per server, defaults to 4
+	PoolSize int
+	// Timeout is for each dial and operation, defaults to 10 seconds. IdleTimeout drops pooled connections, defaults to a minute.
+	Timeout     time.Duration
+	IdleTimeout time.Duration
+	// DisableForm answers with a Basic challenge instead of the login form
+	DisableForm bool
+	// Realm is sent in Basic challenges
+	Realm string
+	// SessionLength is for logins through the form, defaults to 6 hours like basicpass
+	SessionLength time.Duration
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	DN     string   `json:"dn"`
+	UID    string   `json:"uid"`
+	Groups []string `json:"groups"`
+}
+
+// LDAP supplies an authfunc receiver and stores information to be used by that receiver
+type LDAP struct {
+	config Config
+	uuid   string
+	pool   *pool
+	// sessions holds the Info of form logins by session id
+	sessions *session.Map
+	now      func() time.Time
+}
+
+// New returns an LDAP ready to be used as an AuthFunc
+func New(config Config) (*LDAP, error) {
+	if len(config.Servers) == 0 || config.BaseDN == "" {
+		return nil, errors.New("Servers and BaseDN are required")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid={user})"
+	}
+	if config.UserAttribute == "" {
+		config.UserAttribute = "uid"
+	}
+	if config.GroupFilter == "" {
+		config.GroupFilter = "(|(member={dn})(uniqueMember={dn})(memberUid={user}))"
+	}
+	if config.GroupNameAttribute == "" {
+		config.GroupNameAttribute = "cn"
+	}
+	if config.PoolSize == 0 {
+		config.PoolSize = 4
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = time.Minute
+	}
+	if config.Realm == "" {
+		config.Realm = "authdoor"
+	}
+	if config.SessionLength == 0 {
+		config.SessionLength = 6 * time.Hour
+	}
+	// the filters are checked now so a typo shows up at startup
+	for _, filter := range []string{config.UserFilter, config.GroupFilter} {
+		if _, err := compileFilter(strings.NewReplacer("{user}", "x", "{dn}", "x").Replace(filter)); err != nil {
+			return nil, errors.Wrap(err, filter)
+		}
+	}
+	p := &pool{
+		startTLS:    config.StartTLS,
+		tlsConfig:   config.TLSConfig,
+		timeout:     config.Timeout,
+		idleTimeout: config.IdleTimeout,
+	}
+	for _, raw := range config.Servers {
+		s, err := parseServer(raw, config.PoolSize)
+		if err != nil {
+			return nil, err
+		}
+		p.servers = append(p.servers, s)
+	}
+	return &LDAP{
+		config:   config,
+		uuid:     uuid.New().String(),
+		pool:     p,
+		sessions: session.New(),
+		now:      time.Now,
+	}, nil
+}
+
+// Close closes pooled connections
+func (l *LDAP) Close() {
+	l.pool.close()
+}
+
+// rdnValue returns the value of a DN's first component, so cn=admins,ou=groups,dc=example,dc=com is admins
+func rdnValue(dn string) string {
+	end := len(dn)
+	for i := 0; i < len(dn); i++ {
+		if dn[i] == '\\' {
+			i++
+			continue
+		}
+		if dn[i] == ',' || dn[i] == '+' {
+			end = i
+			break
+		}
+	}
+	rdn := dn[:end]
+	if equals := strings.IndexByte(rdn, '='); equals != -1 {
+		return strings.TrimSpace(rdn[equals+1:])
+	}
+	return rdn
+}
+
+// serviceBind binds as the service account, or anonymously, so a pooled connection doesn't search as whoever used it last
+func (l *LDAP) serviceBind(c *conn) error {
+	if err := c.bind(l.config.BindDN, l.config.BindPassword); err != nil {
+		return errors.Wrap(err, "service bind")
+	}
+	return nil
+}
+
+// Authenticate checks a user's password and returns their DN, uid and groups
+func (l *LDAP) Authenticate(user, password string) (*Info, error) {
+	if user == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	var info *Info
+	err := l.pool.do(func(c *conn) error {
+		if err := l.serviceBind(c); err != nil {
+			return err
+		}
+		filter := strings.Replace(l.config.UserFilter, "{user}", EscapeFilter(user), -1)
+		attributes := []string{l.config.UserAttribute}
+		if l.config.GroupAttribute != "" {
+			attributes = append(attributes, l.config.GroupAttribute)
+		}
+		entries, err := c.search(l.config.BaseDN, scopeWholeSubtree, filter, attributes)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 1 {
+			if len(entries) > 1 {
+				defaultLogger.Error("ldap filter " + filter + " matched more than one entry")
+			}
+			return ErrInvalidCredentials
+		}
+		found := entries[0]
+		if err := c.bind(found.dn, password); err != nil {
+			return err
+		}
+		info = &Info{DN: found.dn, UID: found.first(l.config.UserAttribute), Groups: []string{}}
+		if info.UID == "" {
+			info.UID = user
+		}
+		if l.config.GroupAttribute != "" {
+			for _, group := range found.values(l.config.GroupAttribute) {
+				info.Groups = append(info.Groups, rdnValue(group))
+			}
+		}
+		if l.config.GroupBaseDN == "" {
+			return nil
+		}
+		// users often can't read groups, so the search goes back to the service account
+		if err := l.serviceBind(c); err != nil {
+			return err
+		}
+		groupFilter := strings.NewReplacer("{dn}", EscapeFilter(found.dn), "{user}", EscapeFilter(info.UID)).Replace(l.config.GroupFilter)
+		groups, err := c.search(l.config.GroupBaseDN, scopeWholeSubtree, groupFilter, []string{l.config.GroupNameAttribute})
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			name := group.first(l.config.GroupNameAttribute)
+			if name == "" {
+				name = rdnValue(group.dn)
+			}
+			info.Groups = append(info.Groups, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(l.config.RequiredGroups) > 0 && !inAny(info.Groups, l.config.RequiredGroups) {
+		return info, ErrNotInGroup
+	}
+	return info, nil
+}
+
+// inAny reports whether any of groups is in required, ignoring case like directories do
+func inAny(groups, required []string) bool {
+	for _, group := range groups {
+		for _, r := range required {
+			if strings.EqualFold(group, r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// granted is the return for a user
+func granted(info *Info) (authdoor.AuthFuncReturn, error) {
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: infoJSON},
+	}, nil
+}
+
+// answered is returned with every page. A form login grants on the request we redirect to, granting here would hand the POST to the base handler.
+var answered = authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}
+
+// denied is returned for wrong passwords and users outside RequiredGroups
+var denied = authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}
+
+// Check is an authfunc. Basic credentials are checked on every request, form logins get a session.
+func (l *LDAP) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if user, password, ok := r.BasicAuth(); ok {
+		info, err := l.Authenticate(user, password)
+		if err != nil {
+			return l.refuse(w, r, user, err, l.challenge)
+		}
+		return granted(info)
+	}
+	if info, ok := l.currentSession(r); ok {
+		return granted(info)
+	}
+	if l.config.DisableForm {
+		l.challenge(w, "")
+		return answered, nil
+	}
+	if r.Method == "POST" && r.PostFormValue("ldap-reference") == l.uuid {
+		user := r.PostFormValue("ldap-user")
+		info, err := l.Authenticate(user, r.PostFormValue("ldap-password"))
+		if err != nil {
+			return l.refuse(w, r, user, err, l.form)
+		}
+		l.startSession(w, r, info)
+		defaultLogger.Info("ldap logged in " + info.DN)
+		http.Redirect(w, r, redirect.Local(r.URL.RequestURI()), http.StatusSeeOther)
+		return answered, nil
+	}
+	l.form(w, "")
+	return answered, nil
+}
+
+// refuse answers a failed login with show. Directory outages are returned as errors rather than blamed on the user.
+func (l *LDAP) refuse(w http.ResponseWriter, r *http.Request, user string, err error, show func(http.ResponseWriter, string)) (authdoor.AuthFuncReturn, error) {
+	switch errors.Cause(err) {
+	case ErrInvalidCredentials:
+		defaultLogger.Info("ldap rejected " + user)
+		show(w, "Wrong user name or password.")
+		return denied, nil
+	case ErrNotInGroup:
+		defaultLogger.Info("ldap refused " + user + " who isn't in a required group")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return denied, nil
+	}
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+}
+
+// challenge writes a 401 asking for Basic credentials
+func (l *LDAP) challenge(w http.ResponseWriter, _ string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.Replace(l.config.Realm, `"`, `'`, -1)+`", charset="UTF-8"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// form writes the login form with a 401
+func (l *LDAP) form(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	formPage.Execute(w, struct{ Reference, Error string }{l.uuid, message})
+}
+
+// currentSession returns the request's login, if it has one
+func (l *LDAP) currentSession(r *http.Request) (*Info, bool) {
+	cookie, err := r.Cookie("ldap-" + l.uuid)
+	if err != nil {
+		return nil, false
+	}
+	info, ok := l.sessions.Get(cookie.Value, l.now())
+	if !ok {
+		return nil, false
+	}
+	return info.(*Info), true
+}
+
+// startSession sets the session cookie
+func (l *LDAP) startSession(w http.ResponseWriter, r *http.Request, info *Info) {
+	sess := uuid.New().String()
+	now := l.now()
+	l.sessions.Set(sess, info, now.Add(l.config.SessionLength), now)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "ldap-" + l.uuid,
+		Value:    sess,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+var formPage = template.Must(template.New("form").Parse(`<html><body>
+	<form method="POST">
+		{{if .Error}}<p>{{.Error}}</p>{{end}}
+		<input name="ldap-user" autocomplete="username" autofocus />
+		<input name="ldap-password" type="password" autocomplete="current-password" />
+		<input name="ldap-reference" type="hidden" value="{{.Reference}}" />
+		<button type="submit">Log in</button>
+	</form>
+</body></html>
+`))
@@ -0,0 +1,397 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/ber"
+	"github.com/ayjayt/authdoor/authfuncs/ldap/ldaptest"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/ldap/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+const (
+	readerDN = "cn=reader,dc=example,dc=com"
+	ajDN     = "uid=aj,ou=people,dc=example,dc=com"
+)
+
+// directory starts a fake server with a service account, a user in two groups, and a user in none
+func directory(server *ldaptest.Server) *ldaptest.Server {
+	server.Passwords[readerDN] = "reader-password"
+	server.AddUser(ajDN, "aj", "aj-password", map[string][]string{
+		"memberOf": {"cn=admins,ou=groups,dc=example,dc=com"},
+	})
+	server.AddUser("uid=bo,ou=people,dc=example,dc=com", "bo", "bo-password", nil)
+	server.Entries = append(server.Entries, ldaptest.Entry{
+		DN: "cn=staff,ou=groups,dc=example,dc=com",
+		Attributes: map[string][]string{
+			"objectClass": {"groupOfNames"},
+			"cn":          {"staff"},
+			"member":      {ajDN},
+		},
+	})
+	return server
+}
+
+// config is a Config for the servers given
+func config(servers ...*ldaptest.Server) Config {
+	c := Config{
+		BindDN:       readerDN,
+		BindPassword: "reader-password",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		Timeout:      2 * time.Second,
+	}
+	for _, server := range servers {
+		c.Servers = append(c.Servers, server.URL())
+	}
+	return c
+}
+
+// TestFilter checks filters compile and user input is escaped
+func TestFilter(t *testing.T) {
+	good := []string{
+		"(uid=aj)",
+		"(&(objectClass=person)(|(uid=aj)(mail=aj@example.com)))",
+		"(!(uid=aj))",
+		"(cn=*)",
+		"(cn=a*b*c)",
+		"(cn=*b*)",
+		"(uidNumber>=1000)",
+		"(cn~=aj)",
+		`(cn=\28x\29)`,
+	}
+	for _, filter := range good {
+		_, err := compileFilter(filter)
+		require.NoError(t, err, filter)
+	}
+	bad := []string{"", "uid=aj", "(uid=aj", "(uid=aj))", "(&)", "(=aj)", "(cn=a**b)", `(cn=\2)`, `(cn=\zz)`, strings.Repeat("(!", 40) + "(a=b)" + strings.Repeat(")", 40)}
+	for _, filter := range bad {
+		_, err := compileFilter(filter)
+		require.Equal(t, ErrFilter, err, filter)
+	}
+	require.Equal(t, `\2a\29\28uid=\5c\00`, EscapeFilter("*)(uid=\\\x00"))
+	packet, err := compileFilter("(uid=" + EscapeFilter("a*") + ")")
+	require.NoError(t, err)
+	require.True(t, packet.Is(ber.ClassContext, filterEqualityMatch))
+	require.Equal(t, "a*", packet.Children[1].String())
+	require.Equal(t, "admins", rdnValue("cn=admins,ou=groups,dc=example,dc=com"))
+	require.Equal(t, `a\,b`, rdnValue(`cn=a\,b,dc=example`))
+}
+
+// TestAuthenticate checks search-then-bind and both ways of finding groups
+func TestAuthenticate(t *testing.T) {
+	server := directory(ldaptest.NewServer())
+	defer server.Close()
+	c := config(server)
+	c.GroupAttribute = "memberOf"
+	c.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	l, err := New(c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	info, err := l.Authenticate("aj", "aj-password")
+	require.NoError(t, err)
+	require.Equal(t, &Info{DN: ajDN, UID: "aj", Groups: []string{"admins", "staff"}}, info)
+
+	info, err = l.Authenticate("bo", "bo-password")
+	require.NoError(t, err)
+	require.Equal(t, []string{}, info.Groups)
+
+	for _, user := range [][2]string{{"aj", "wrong"}, {"nobody", "aj-password"}, {"*", "aj-password"}, {"aj", ""}, {"", "x"}} {
+		_, err = l.Authenticate(user[0], user[1])
+		require.Equal(t, ErrInvalidCredentials, errors.Cause(err), user[0])
+	}
+	// the empty password is refused before it gets to the server, which would call it a success
+	require.NoError(t, l.pool.do(func(c *conn) error { return c.bind(ajDN, "") }))
+
+	c.RequiredGroups = []string{"Staff"}
+	l, err = New(c)
+	require.NoError(t, err)
+	_, err = l.Authenticate("aj", "aj-password")
+	require.NoError(t, err)
+	_, err = l.Authenticate("bo", "bo-password")
+	require.Equal(t, ErrNotInGroup, err)
+
+	c.BindPassword = "wrong"
+	l, err = New(c)
+	require.NoError(t, err)
+	_, err = l.Authenticate("aj", "aj-password")
+	require.Equal(t, ErrInvalidCredentials, errors.Cause(err))
+
+	c.UserFilter = "(uid={user}"
+	_, err = New(c)
+	require.Error(t, err)
+}
+
+// TestPool checks connections are reused, rebound as the service account, and replaced when they die
+func TestPool(t *testing.T) {
+	server := directory(ldaptest.NewServer())
+	defer server.Close()
+	l, err := New(config(server))
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		_, err := l.Authenticate("aj", "aj-password")
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), atomic.LoadInt64(&server.Connections))
+	// a service bind, then the user's bind, each time
+	require.Equal(t, int64(6), atomic.LoadInt64(&server.Binds))
+
+	// the server hangs up on the pooled connection, which is retried on a fresh one without failing over
+	idle := <-l.pool.servers[0].idle
+	idle.Conn.Close()
+	l.pool.servers[0].idle <- idle
+	_, err = l.Authenticate("aj", "aj-password")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), atomic.LoadInt64(&server.Connections))
+	require.False(t, l.pool.servers[0].isDown(time.Now()))
+}
+
+// TestPoolConcurrent has connections taken out of the pool and broken as soon as they're put back, like another request finding them dead, for -race
+func TestPoolConcurrent(t *testing.T) {
+	server := directory(ldaptest.NewServer())
+	defer server.Close()
+	l, err := New(config(server))
+	require.NoError(t, err)
+	defer l.Close()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case c := <-l.pool.servers[0].idle:
+				c.broken = true
+				c.Conn.Close()
+			}
+		}
+	}()
+	errs := make(chan error, 80)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, err := l.Authenticate("aj", "aj-password")
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-stopped
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+// TestFailover checks unreachable and unavailable servers are skipped
+func TestFailover(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := "ldap://" + listener.Addr().String()
+	listener.Close()
+	unavailable := directory(ldaptest.NewServer())
+	defer unavailable.Close()
+	unavailable.Unavailable = true
+	server := directory(ldaptest.NewServer())
+	defer server.Close()
+
+	c := config(unavailable, server)
+	c.Servers = append([]string{dead}, c.Servers...)
+	l, err := New(c)
+	require.NoError(t, err)
+	defer l.Close()
+	info, err := l.Authenticate("aj", "aj-password")
+	require.NoError(t, err)
+	require.Equal(t, ajDN, info.DN)
+	require.True(t, l.pool.servers[0].isDown(time.Now()))
+	require.True(t, l.pool.servers[1].isDown(time.Now()))
+
+	// the down servers aren't tried again for a while
+	before := atomic.LoadInt64(&unavailable.Connections)
+	_, err = l.Authenticate("aj", "aj-password")
+	require.NoError(t, err)
+	require.Equal(t, before, atomic.LoadInt64(&unavailable.Connections))
+
+	server.Close()
+	_, err = l.Authenticate("aj", "aj-password")
+	require.Equal(t, ErrNoServers, errors.Cause(err))
+}
+
+// TestTLS checks StartTLS and LDAPS, and that the certificate is verified
+func TestTLS(t *testing.T) {
+	plain := directory(ldaptest.NewServer())
+	defer plain.Close()
+	ldaps := directory(ldaptest.NewTLSServer())
+	defer ldaps.Close()
+
+	c := config(plain)
+	c.StartTLS = true
+	c.TLSConfig = &tls.Config{RootCAs: plain.Certificates}
+	l, err := New(c)
+	require.NoError(t, err)
+	_, err = l.Authenticate("aj", "aj-password")
+	require.NoError(t, err)
+	l.Close()
+
+	c = config(ldaps)
+	c.TLSConfig = &tls.Config{RootCAs: ldaps.Certificates}
+	l, err = New(c)
+	require.NoError(t, err)
+	_, err = l.Authenticate("aj", "aj-password")
+	require.NoError(t, err)
+	l.Close()
+
+	c.TLSConfig = nil
+	l, err = New(c)
+	require.NoError(t, err)
+	_, err = l.Authenticate("aj", "aj-password")
+	require.Equal(t, ErrNoServers, errors.Cause(err))
+}
+
+// TestCheck goes through Basic credentials and the login form
+func TestCheck(t *testing.T) {
+	server := directory(ldaptest.NewServer())
+	defer server.Close()
+	c := config(server)
+	c.GroupAttribute = "memberOf"
+	l, err := New(c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/page", nil)
+	r.SetBasicAuth("aj", "aj-password")
+	ret, err := l.Check(w, r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	require.Equal(t, `{"dn":"`+ajDN+`","uid":"aj","groups":["admins"]}`, string(ret.Info.Info))
+
+	w = httptest.NewRecorder()
+	r.SetBasicAuth("aj", "wrong")
+	ret, err = l.Check(w, r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/page", nil)
+	ret, err = l.Check(w, r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), l.uuid)
+
+	post := func(path, user, password string) *httptest.ResponseRecorder {
+		form := url.Values{"ldap-user": {user}, "ldap-password": {password}, "ldap-reference": {l.uuid}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "https://app.local"+path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ret, err := l.Check(w, r)
+		require.NoError(t, err)
+		require.Equal(t, authdoor.Answered, ret.Resp)
+		return w
+	}
+	w = post("/page?x=1", "aj", "wrong")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), "Wrong user name or password")
+	// a login at a path another host could be read from doesn't send the user there
+	w = post("//evil.com/x", "aj", "aj-password")
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/", w.Header().Get("Location"))
+	w = post("/page?x=1", "aj", "aj-password")
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/page?x=1", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.True(t, cookies[0].HttpOnly)
+
+	r = httptest.NewRequest("GET", "/page", nil)
+	r.AddCookie(cookies[0])
+	ret, err = l.Check(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	var info Info
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, "aj", info.UID)
+
+	l.now = func() time.Time { return time.Now().Add(7 * time.Hour) }
+	ret, err = l.Check(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+
+	// an outage is an error, not a wrong password
+	l.now = time.Now
+	server.Close()
+	l.Close()
+	r = httptest.NewRequest("GET", "/page", nil)
+	r.SetBasicAuth("aj", "aj-password")
+	ret, err = l.Check(httptest.NewRecorder(), r)
+	require.Error(t, err)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	c.DisableForm = true
+	c.RequiredGroups = []string{"staff"}
+	server = directory(ldaptest.NewServer())
+	defer server.Close()
+	c.Servers = []string{server.URL()}
+	l, err = New(c)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	ret, err = l.Check(w, httptest.NewRequest("GET", "/page", nil))
+	require.NoError(t, err)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Contains(t, w.Header().Get("WWW-Authenticate"), `realm="authdoor"`)
+	w = httptest.NewRecorder()
+	r.SetBasicAuth("aj", "aj-password")
+	ret, err = l.Check(w, r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,202 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoServers is returned when no server could be reached
+var ErrNoServers = errors.New("no LDAP server reachable")
+
+// downFor is how long a server that failed is skipped, unless every server is down
+const downFor = 30 * time.Second
+
+// server is one configured server and its idle connections
+type server struct {
+	address   string
+	ldaps     bool
+	host      string
+	idle      chan *conn
+	mutex     *sync.Mutex
+	downUntil time.Time
+}
+
+// parseServer reads an ldap:// or ldaps:// URL, filling in the default port
+func parseServer(raw string, poolSize int) (*server, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	s := &server{host: u.Hostname(), idle: make(chan *conn, poolSize), mutex: new(sync.Mutex)}
+	port := u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		s.ldaps = true
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return nil, errors.New("server " + raw + " isn't ldap:// or ldaps://")
+	}
+	if s.host == "" {
+		return nil, errors.New("server " + raw + " has no host")
+	}
+	s.address = net.JoinHostPort(s.host, port)
+	return s, nil
+}
+
+// isDown reports whether the server failed recently
+func (s *server) isDown(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return now.Before(s.downUntil)
+}
+
+// markDown skips the server for a while
+func (s *server) markDown(now time.Time) {
+	s.mutex.Lock()
+	s.downUntil = now.Add(downFor)
+	s.mutex.Unlock()
+}
+
+// pool hands out connections to the configured servers in order, failing over when one can't be reached
+type pool struct {
+	servers     []*server
+	startTLS    bool
+	tlsConfig   *tls.Config
+	timeout     time.Duration
+	idleTimeout time.Duration
+}
+
+// tlsFor returns the TLS config for a server, checking its name by default
+func (p *pool) tlsFor(s *server) *tls.Config {
+	config := &tls.Config{}
+	if p.tlsConfig != nil {
+		config = p.tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = s.host
+	}
+	return config
+}
+
+// dial opens a new connection, with TLS if the server or config asks for it
+func (p *pool) dial(s *server) (*conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	if s.ldaps {
+		c, err := tls.DialWithDialer(dialer, "tcp", s.address, p.tlsFor(s))
+		if err != nil {
+			return nil, err
+		}
+		return newConn(c, p.timeout), nil
+	}
+	raw, err := dialer.Dial("tcp", s.address)
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(raw, p.timeout)
+	if p.startTLS {
+		if err := c.startTLS(p.tlsFor(s)); err != nil {
+			c.Conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// get returns an idle connection if there's a fresh one, or dials
+func (p *pool) get(s *server) (*conn, bool, error) {
+	for {
+		select {
+		case c := <-s.idle:
+			if time.Since(c.idle) > p.idleTimeout {
+				c.close()
+				continue
+			}
+			return c, true, nil
+		default:
+			c, err := p.dial(s)
+			return c, false, err
+		}
+	}
+}
+
+// put returns a connection to the pool, or closes it if it's broken or the pool is full
+func (p *pool) put(s *server, c *conn) {
+	if c.broken {
+		c.Conn.Close()
+		return
+	}
+	c.idle = time.Now()
+	select {
+	case s.idle <- c:
+	default:
+		c.close()
+	}
+}
+
+// do runs fn on a connection to the first server that works. A pooled connection that turns out to be dead is retried on a new one before moving on to the next server. Errors from the directory itself, like wrong passwords, are returned without failing over.
+func (p *pool) do(fn func(c *conn) error) error {
+	now := time.Now()
+	servers := make([]*server, 0, len(p.servers))
+	for _, s := range p.servers {
+		if !s.isDown(now) {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		servers = p.servers
+	}
+	var last error = ErrNoServers
+	for _, s := range servers {
+		for attempt := 0; attempt < 2; attempt++ {
+			c, pooled, err := p.get(s)
+			if err != nil {
+				last = err
+				break
+			}
+			err = fn(c)
+			// once it's back in the pool c belongs to whoever takes it next, so broken is read first
+			broken := c.broken
+			p.put(s, c)
+			if !broken {
+				return err
+			}
+			last = err
+			if !pooled {
+				break
+			}
+		}
+		defaultLogger.Error("ldap server " + s.address + " failed, trying the next: " + last.Error())
+		s.markDown(time.Now())
+	}
+	return errors.Wrap(ErrNoServers, last.Error())
+}
+
+// close closes every idle connection
+func (p *pool) close() {
+	for _, s := range p.servers {
+		s.drain()
+	}
+}
+
+// drain closes the server's idle connections
+func (s *server) drain() {
+	for {
+		select {
+		case c := <-s.idle:
+			c.close()
+		default:
+			return
+		}
+	}
+}
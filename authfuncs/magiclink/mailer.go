@@ -0,0 +1,77 @@
+package magiclink
+
+import (
+	"bytes"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// ErrHeader is returned for messages with line breaks in their headers
+var ErrHeader = errors.New("line break in header")
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(message Message) error
+}
+
+// SMTPMailer sends through an SMTP server with net/smtp, which uses STARTTLS when the server offers it
+type SMTPMailer struct {
+	// Addr is host:port
+	Addr string
+	From string
+	// Auth is optional, like smtp.PlainAuth
+	Auth smtp.Auth
+}
+
+// Send sends message
+func (m *SMTPMailer) Send(message Message) error {
+	for _, header := range []string{m.From, message.To, message.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return ErrHeader
+		}
+	}
+	domain := m.From[strings.LastIndex(m.From, "@")+1:]
+	msg := new(bytes.Buffer)
+	msg.WriteString("From: " + m.From + "\r\n")
+	msg.WriteString("To: " + message.To + "\r\n")
+	msg.WriteString("Subject: " + message.Subject + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Message-ID: <" + uuid.New().String() + "@" + domain + ">\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(strings.Replace(message.Body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{message.To}, msg.Bytes())
+}
+
+// MemoryMailer keeps messages instead of sending them, for tests and development
+type MemoryMailer struct {
+	mutex    sync.Mutex
+	messages []Message
+}
+
+// Send keeps message
+func (m *MemoryMailer) Send(message Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// Messages returns what's been sent so far
+func (m *MemoryMailer) Messages() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Message{}, m.messages...)
+}
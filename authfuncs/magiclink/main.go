@@ -0,0 +1,308 @@
+/*
+Package magiclink is a passwordless AuthFunc. People enter their email address and get a link; following it logs them in. Links are sealed, expire, and work once.
+*/
+package magiclink
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/redirect"
+	"github.com/ayjayt/authdoor/authfuncs/internal/seal"
+	"github.com/ayjayt/authdoor/authfuncs/internal/session"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// Config describes who can log in and how links are sent
+type Config struct {
+	Mailer Mailer
+	// URL is the site's base URL, like https://docs.example.com, which links are built on. It isn't taken from the request so a forged Host can't redirect links.
+	URL string
+	// Path is where links point, defaults to /.magiclink
+	Path string
+	// Key signs links, nil makes a random one so links only work until a restart
+	Key []byte
+	// AllowedDomains and AllowedAddresses restrict who gets a link. One of them is required.
+	AllowedDomains   []string
+	AllowedAddresses []string
+	// LinkExpiry defaults to 15 minutes
+	LinkExpiry time.Duration
+	// SessionLength defaults to 6 hours like basicpass
+	SessionLength time.Duration
+	// Subject defaults to "Your login link"
+	Subject string
+	// ResendInterval is how long an address waits between links, defaults to a minute
+	ResendInterval time.Duration
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	Email string `json:"email"`
+}
+
+// link is what's sealed into a link
+type link struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Next  string `json:"next"`
+}
+
+// MagicLink supplies an authfunc receiver and stores information to be used by that receiver
+type MagicLink struct {
+	config Config
+	uuid   string
+	sealer *seal.Sealer
+	// sessions holds the emails of followed links by session id
+	sessions *session.Map
+	// used are link ids already followed, kept until the links would have expired anyway
+	used *session.Map
+	// sent are addresses mailed a link within ResendInterval
+	sent *session.Map
+	now  func() time.Time
+}
+
+// New returns a MagicLink ready to be used as an AuthFunc
+func New(config Config) (*MagicLink, error) {
+	if config.Mailer == nil || config.URL == "" {
+		return nil, errors.New("Mailer and URL are required")
+	}
+	if len(config.AllowedDomains) == 0 && len(config.AllowedAddresses) == 0 {
+		return nil, errors.New("AllowedDomains or AllowedAddresses is required")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Path == "" {
+		config.Path = "/.magiclink"
+	}
+	if config.LinkExpiry == 0 {
+		config.LinkExpiry = 15 * time.Minute
+	}
+	if config.SessionLength == 0 {
+		config.SessionLength = 6 * time.Hour
+	}
+	if config.Subject == "" {
+		config.Subject = "Your login link"
+	}
+	if config.ResendInterval == 0 {
+		config.ResendInterval = time.Minute
+	}
+	return &MagicLink{
+		config:   config,
+		uuid:     uuid.New().String(),
+		sealer:   seal.New(config.Key),
+		sessions: session.New(),
+		used:     session.New(),
+		sent:     session.New(),
+		now:      time.Now,
+	}, nil
+}
+
+// cookieName is the name of the session cookie
+func (m *MagicLink) cookieName() string {
+	return "magiclink-" + m.uuid
+}
+
+// allowed reports whether address may log in. Domains match exactly, so subdomains have to be listed.
+func (m *MagicLink) allowed(address string) bool {
+	for _, allowed := range m.config.AllowedAddresses {
+		if strings.EqualFold(address, allowed) {
+			return true
+		}
+	}
+	domain := address[strings.LastIndex(address, "@")+1:]
+	for _, allowed := range m.config.AllowedDomains {
+		if strings.EqualFold(domain, strings.TrimPrefix(allowed, "@")) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddress takes a bare address and lower cases it, so the same person always gets the same session info
+func parseAddress(input string) (string, bool) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(input))
+	if err != nil || parsed.Name != "" || strings.Count(parsed.Address, "@") != 1 {
+		return "", false
+	}
+	return strings.ToLower(parsed.Address), true
+}
+
+// answered is returned for every page. A followed link grants on the request we redirect to, granting here would hand the POST to the base handler.
+var answered = authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}
+
+// Check is an authfunc. It follows links, grants requests with a session, takes email addresses, and shows everyone else the form.
+func (m *MagicLink) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if r.URL.Path == m.config.Path {
+		return m.follow(w, r)
+	}
+	if email, ok := m.currentSession(r); ok {
+		info, err := json.Marshal(Info{Email: email})
+		if err != nil {
+			return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+		}
+		return authdoor.AuthFuncReturn{
+			Auth: authdoor.AuthGranted,
+			Resp: authdoor.Ignored,
+			Info: authdoor.InstanceReturnInfo{Info: info},
+		}, nil
+	}
+	if r.Method == "POST" && r.PostFormValue("magiclink-reference") == m.uuid {
+		return m.send(w, r)
+	}
+	return m.render(w, http.StatusUnauthorized, formPage, pageData{Reference: m.uuid})
+}
+
+// currentSession returns the request's email, if it has a session
+func (m *MagicLink) currentSession(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(m.cookieName())
+	if err != nil {
+		return "", false
+	}
+	email, ok := m.sessions.Get(cookie.Value, m.now())
+	if !ok {
+		return "", false
+	}
+	return email.(string), true
+}
+
+// send mails a link to an allowed address, at most once per ResendInterval so the form can't flood an inbox. Everyone sees the same page so it can't be used to find out who's allowed.
+func (m *MagicLink) send(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	email, ok := parseAddress(r.PostFormValue("magiclink-email"))
+	if !ok {
+		return m.render(w, http.StatusBadRequest, formPage, pageData{Reference: m.uuid, Error: "That doesn't look like an email address."})
+	}
+	if !m.allowed(email) {
+		defaultLogger.Info("magiclink refused to send to " + email)
+		return m.render(w, http.StatusOK, sentPage, pageData{})
+	}
+	now := m.now()
+	if !m.sent.Add(email, true, now.Add(m.config.ResendInterval), now) {
+		defaultLogger.Info("magiclink already sent a link to " + email + " within " + m.config.ResendInterval.String())
+		return m.render(w, http.StatusOK, sentPage, pageData{})
+	}
+	next := r.URL.RequestURI()
+	token, err := m.sealer.Seal(link{ID: uuid.New().String(), Email: email, Next: next}, now.Add(m.config.LinkExpiry))
+	if err != nil {
+		m.sent.Delete(email)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	body := "Follow this link to log in to " + m.config.URL + ":\n\n" +
+		m.config.URL + m.config.Path + "?token=" + token + "\n\n" +
+		"It works once and expires in " + m.config.LinkExpiry.String() + ". If you didn't ask for it you can ignore this email.\n"
+	if err := m.config.Mailer.Send(Message{To: email, Subject: m.config.Subject, Body: body}); err != nil {
+		// nothing was sent, so they can try again straight away
+		m.sent.Delete(email)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, errors.Wrap(err, "couldn't send link")
+	}
+	defaultLogger.Info("magiclink sent a link to " + email)
+	return m.render(w, http.StatusOK, sentPage, pageData{})
+}
+
+// follow checks a link. A GET only shows a button, since mail scanners fetch links and would use them up; the POST it makes logs in.
+func (m *MagicLink) follow(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	token := r.FormValue("token")
+	l := link{}
+	if err := m.sealer.Open(token, &l); err != nil || m.isUsed(l.ID) {
+		m.render(w, http.StatusUnauthorized, formPage, pageData{Reference: m.uuid, Error: "That link is invalid, used or expired. Enter your email to get a new one."})
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	if r.Method != "POST" {
+		return m.render(w, http.StatusOK, followPage, pageData{Token: token, Email: l.Email})
+	}
+	if !m.use(l.ID) {
+		m.render(w, http.StatusUnauthorized, formPage, pageData{Reference: m.uuid, Error: "That link was already used. Enter your email to get a new one."})
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	sess := uuid.New().String()
+	now := m.now()
+	m.sessions.Set(sess, l.Email, now.Add(m.config.SessionLength), now)
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.cookieName(),
+		Value:    sess,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(m.config.URL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	defaultLogger.Info("magiclink logged in " + l.Email)
+	http.Redirect(w, r, redirect.Local(l.Next), http.StatusSeeOther)
+	return answered, nil
+}
+
+// isUsed reports whether a link was already followed
+func (m *MagicLink) isUsed(id string) bool {
+	_, used := m.used.Get(id, m.now())
+	return used
+}
+
+// use marks a link followed, returning false if it already was
+func (m *MagicLink) use(id string) bool {
+	now := m.now()
+	return m.used.Add(id, true, now.Add(m.config.LinkExpiry), now)
+}
+
+// pageData fills the templates
+type pageData struct {
+	Reference string
+	Error     string
+	Token     string
+	Email     string
+}
+
+// render writes a page
+func (m *MagicLink) render(w http.ResponseWriter, status int, page *template.Template, data pageData) (authdoor.AuthFuncReturn, error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	if err := page.Execute(w, data); err != nil {
+		return answered, err
+	}
+	return answered, nil
+}
+
+var (
+	formPage = template.Must(template.New("form").Parse(`<html><body>
+	<form method="POST">
+		<p>Enter your email address and we'll send you a link to log in.</p>
+		{{if .Error}}<p>{{.Error}}</p>{{end}}
+		<input name="magiclink-email" type="email" autocomplete="email" autofocus />
+		<input name="magiclink-reference" type="hidden" value="{{.Reference}}" />
+		<button type="submit">Send link</button>
+	</form>
+</body></html>
+`))
+	sentPage = template.Must(template.New("sent").Parse(`<html><body>
+	<p>If that address is allowed in, a link is on its way. You can close this page.</p>
+</body></html>
+`))
+	followPage = template.Must(template.New("follow").Parse(`<html><body>
+	<form method="POST">
+		<p>Log in as {{.Email}}?</p>
+		<input name="token" type="hidden" value="{{.Token}}" />
+		<button type="submit">Log in</button>
+	</form>
+</body></html>
+`))
+)
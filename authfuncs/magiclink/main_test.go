@@ -0,0 +1,215 @@
+package magiclink
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/magiclink/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// call runs Check, POSTing form if it isn't nil
+func call(t *testing.T, m *MagicLink, target string, form url.Values, cookies ...*http.Cookie) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", target, nil)
+	if form != nil {
+		req = httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	ret, err := m.Check(recorder, req)
+	require.NoError(t, err)
+	return ret, recorder
+}
+
+var linkRegexp = regexp.MustCompile(`https://docs\.example\.com(/\.magiclink\?token=\S+)`)
+
+// TestFlow asks for a link, follows it, and checks it only works once
+func TestFlow(t *testing.T) {
+	mailer := &MemoryMailer{}
+	m, err := New(Config{Mailer: mailer, URL: "https://docs.example.com/", AllowedDomains: []string{"example.com"}, AllowedAddresses: []string{"guest@partner.test"}})
+	require.NoError(t, err)
+
+	ret, recorder := call(t, m, "/docs/page?x=1", nil)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// nobody learns who's allowed, but only allowed addresses get mail
+	ask := func(email string) *httptest.ResponseRecorder {
+		_, recorder := call(t, m, "/docs/page?x=1", url.Values{"magiclink-email": {email}, "magiclink-reference": {m.uuid}})
+		return recorder
+	}
+	require.Equal(t, http.StatusOK, ask("mallory@evil.test").Code)
+	require.Equal(t, http.StatusOK, ask("someone@sub.example.com").Code)
+	require.Len(t, mailer.Messages(), 0)
+	require.Equal(t, http.StatusBadRequest, ask("Mallory <mallory@example.com>").Code)
+	require.Equal(t, http.StatusOK, ask("Guest@Partner.test").Code)
+	require.Equal(t, http.StatusOK, ask(" AJ@example.com ").Code)
+	messages := mailer.Messages()
+	require.Len(t, messages, 2)
+	require.Equal(t, "guest@partner.test", messages[0].To)
+	require.Equal(t, "aj@example.com", messages[1].To)
+
+	// asking again within ResendInterval looks the same but sends nothing
+	require.Equal(t, http.StatusOK, ask("aj@example.com").Code)
+	require.Len(t, mailer.Messages(), 2)
+
+	// opening the link doesn't use it up, the button does
+	match := linkRegexp.FindStringSubmatch(messages[1].Body)
+	require.NotNil(t, match)
+	_, recorder = call(t, m, match[1], nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Contains(t, recorder.Body.String(), "aj@example.com")
+	token, err := url.Parse(match[1])
+	require.NoError(t, err)
+	ret, recorder = call(t, m, "/.magiclink", url.Values{"token": {token.Query().Get("token")}})
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, http.StatusSeeOther, recorder.Code)
+	require.Equal(t, "/docs/page?x=1", recorder.Header().Get("Location"))
+	cookies := recorder.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	ret, _ = call(t, m, "/docs/page", nil, cookies...)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, `{"email":"aj@example.com"}`, string(ret.Info.Info))
+
+	// a second use fails, with or without the button
+	ret, _ = call(t, m, match[1], nil)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	ret, recorder = call(t, m, "/.magiclink", url.Values{"token": {token.Query().Get("token")}})
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// as do tampered links
+	ret, _ = call(t, m, "/.magiclink", url.Values{"token": {token.Query().Get("token") + "x"}})
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	// sessions expire
+	m.now = func() time.Time { return time.Now().Add(7 * time.Hour) }
+	ret, _ = call(t, m, "/docs/page", nil, cookies...)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+
+	// and by then a new link can be sent
+	require.Equal(t, http.StatusOK, ask("aj@example.com").Code)
+	require.Len(t, mailer.Messages(), 3)
+}
+
+// TestExpiredLink checks links stop working after LinkExpiry
+func TestExpiredLink(t *testing.T) {
+	mailer := &MemoryMailer{}
+	m, err := New(Config{Mailer: mailer, URL: "https://docs.example.com", AllowedDomains: []string{"example.com"}, LinkExpiry: time.Minute})
+	require.NoError(t, err)
+	m.now = func() time.Time { return time.Now().Add(-2 * time.Minute) }
+	call(t, m, "/", url.Values{"magiclink-email": {"aj@example.com"}, "magiclink-reference": {m.uuid}})
+	m.now = time.Now
+	match := linkRegexp.FindStringSubmatch(mailer.Messages()[0].Body)
+	require.NotNil(t, match)
+	ret, recorder := call(t, m, match[1], nil)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+// TestNew checks a restriction is required
+func TestNew(t *testing.T) {
+	_, err := New(Config{Mailer: &MemoryMailer{}, URL: "https://docs.example.com"})
+	require.Error(t, err)
+}
+
+// fakeSMTP accepts one message and returns what it got
+func fakeSMTP(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	received := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 fake ESMTP\r\n")
+		transcript := new(strings.Builder)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				fmt.Fprint(conn, "250 fake\r\n")
+			case command == "DATA":
+				fmt.Fprint(conn, "354 go ahead\r\n")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				fmt.Fprint(conn, "250 queued\r\n")
+			case command == "QUIT":
+				fmt.Fprint(conn, "221 bye\r\n")
+				received <- transcript.String()
+				return
+			default:
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+// TestSMTPMailer sends through a fake server
+func TestSMTPMailer(t *testing.T) {
+	addr, received := fakeSMTP(t)
+	mailer := &SMTPMailer{Addr: addr, From: "login@example.com"}
+	require.NoError(t, mailer.Send(Message{To: "aj@example.com", Subject: "Your login link", Body: "line one\nline two\n"}))
+	transcript := <-received
+	require.Contains(t, transcript, "MAIL FROM:<login@example.com>")
+	require.Contains(t, transcript, "RCPT TO:<aj@example.com>")
+	require.Contains(t, transcript, "Subject: Your login link\r\n")
+	require.Contains(t, transcript, "line one\r\nline two\r\n")
+
+	require.Equal(t, ErrHeader, mailer.Send(Message{To: "aj@example.com", Subject: "hi\r\nBcc: everyone@example.com"}))
+}
@@ -0,0 +1,258 @@
+/*
+Package mtls is an AuthFunc for client certificates. The peer's chain is verified against its own CA pool, so the listener can accept any certificate while different lists trust different CAs, and then matched against rules over the subject and SANs.
+*/
+package mtls
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+var (
+	// ErrNoCA is returned by New when there's no CA to verify against
+	ErrNoCA = errors.New("no CA configured")
+	// ErrRevoked is returned when the client certificate is on the CRL
+	ErrRevoked = errors.New("certificate revoked")
+	// ErrCRL is returned when the CRL can't be used: it's unparsable, expired, or not signed by the certificate's issuer
+	ErrCRL = errors.New("bad CRL")
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// Rule matches a certificate if every non-empty field has a value matching the certificate. Values are path.Match patterns, so "spiffe://example.org/ns/*/sa/web" works and "*" doesn't cross a "/".
+type Rule struct {
+	CommonNames         []string
+	OrganizationalUnits []string
+	DNSNames            []string
+	URIs                []string
+}
+
+// Config describes which CAs to trust and who to let in
+type Config struct {
+	// CAFile is a PEM bundle of trusted roots, used if CAPool is nil
+	CAFile string
+	CAPool *x509.CertPool
+	// CRLFile, if set, is a PEM or DER CRL checked against the leaf. An expired CRL fails closed.
+	CRLFile string
+	// Rules are ORed, no rules grants any verified certificate
+	Rules []Rule
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	Subject             string   `json:"subject"`
+	CommonName          string   `json:"common_name"`
+	OrganizationalUnits []string `json:"organizational_units,omitempty"`
+	DNSNames            []string `json:"dns_names,omitempty"`
+	URIs                []string `json:"uris,omitempty"`
+	Serial              string   `json:"serial"`
+	Issuer              string   `json:"issuer"`
+}
+
+// MTLS supplies an authfunc receiver and stores information to be used by that receiver
+type MTLS struct {
+	config Config
+	pool   *x509.CertPool
+	mutex  *sync.RWMutex
+	crl    *pkix.CertificateList
+	now    func() time.Time
+}
+
+// New loads the CA pool and CRL and returns an MTLS ready to be used as an AuthFunc
+func New(config Config) (*MTLS, error) {
+	m := &MTLS{
+		config: config,
+		pool:   config.CAPool,
+		mutex:  new(sync.RWMutex),
+		now:    time.Now,
+	}
+	if m.pool == nil {
+		if config.CAFile == "" {
+			return nil, ErrNoCA
+		}
+		data, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		m.pool = x509.NewCertPool()
+		if !m.pool.AppendCertsFromPEM(data) {
+			return nil, errors.Wrap(ErrNoCA, config.CAFile)
+		}
+	}
+	if config.CRLFile != "" {
+		if err := m.ReloadCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ReloadCRL rereads the CRL file. The old CRL is kept if it can't be read.
+func (m *MTLS) ReloadCRL() error {
+	data, err := ioutil.ReadFile(m.config.CRLFile)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseDERCRL(data)
+	if err != nil {
+		return errors.Wrap(ErrCRL, err.Error())
+	}
+	m.mutex.Lock()
+	m.crl = crl
+	m.mutex.Unlock()
+	defaultLogger.Info("CRL loaded from " + m.config.CRLFile)
+	return nil
+}
+
+// Verify checks the chain and the CRL and returns the leaf
+func (m *MTLS) Verify(peers []*x509.Certificate) (*x509.Certificate, error) {
+	leaf := peers[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range peers[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         m.pool,
+		Intermediates: intermediates,
+		CurrentTime:   m.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	crl := m.crl
+	m.mutex.RUnlock()
+	if crl == nil {
+		return leaf, nil
+	}
+	if crl.HasExpired(m.now()) {
+		return nil, errors.Wrap(ErrCRL, "expired")
+	}
+	issuer := chains[0][0] // a leaf trusted directly is its own issuer
+	if len(chains[0]) > 1 {
+		issuer = chains[0][1]
+	}
+	if err := issuer.CheckCRLSignature(crl); err != nil {
+		return nil, errors.Wrap(ErrCRL, "not signed by "+issuer.Subject.String())
+	}
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return nil, errors.Wrap(ErrRevoked, leaf.SerialNumber.String())
+		}
+	}
+	return leaf, nil
+}
+
+// anyMatch reports whether any value matches any pattern
+func anyMatch(patterns []string, values []string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Match reports whether the rule matches cert
+func (r Rule) Match(cert *x509.Certificate) bool {
+	if len(r.CommonNames) != 0 && !anyMatch(r.CommonNames, []string{cert.Subject.CommonName}) {
+		return false
+	}
+	if len(r.OrganizationalUnits) != 0 && !anyMatch(r.OrganizationalUnits, cert.Subject.OrganizationalUnit) {
+		return false
+	}
+	if len(r.DNSNames) != 0 && !anyMatch(r.DNSNames, cert.DNSNames) {
+		return false
+	}
+	if len(r.URIs) != 0 && !anyMatch(r.URIs, uriStrings(cert)) {
+		return false
+	}
+	return true
+}
+
+// uriStrings returns the URI SANs as strings
+func uriStrings(cert *x509.Certificate) []string {
+	ret := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		ret = append(ret, uri.String())
+	}
+	return ret
+}
+
+// allowed reports whether any rule matches, or there are no rules
+func (m *MTLS) allowed(cert *x509.Certificate) bool {
+	if len(m.config.Rules) == 0 {
+		return true
+	}
+	for _, rule := range m.config.Rules {
+		if rule.Match(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check is an authfunc. Connections without a client certificate fail quietly so later instances can run, a certificate that doesn't verify or match a rule is denied with a 403.
+func (m *MTLS) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	leaf, err := m.Verify(r.TLS.PeerCertificates)
+	if err != nil {
+		defaultLogger.Info("client certificate rejected: " + err.Error())
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	if !m.allowed(leaf) {
+		defaultLogger.Info("client certificate " + leaf.Subject.String() + " matched no rule")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	info, err := json.Marshal(Info{
+		Subject:             leaf.Subject.String(),
+		CommonName:          leaf.Subject.CommonName,
+		OrganizationalUnits: leaf.Subject.OrganizationalUnit,
+		DNSNames:            leaf.DNSNames,
+		URIs:                uriStrings(leaf),
+		Serial:              leaf.SerialNumber.String(),
+		Issuer:              leaf.Issuer.String(),
+	})
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: info},
+	}, nil
+}
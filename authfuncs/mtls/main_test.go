@@ -0,0 +1,187 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/mtls/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// testCA is a CA that can issue client certificates and CRLs
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA makes a self signed CA
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue makes a client certificate
+func (ca *testCA) issue(t *testing.T, serial int64, cn string, ou string, uri string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	spiffe, err := url.Parse(uri)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: []string{ou}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn + ".svc.local"},
+		URIs:         []*url.URL{spiffe},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+// call runs m.Check with cert as the peer
+func call(t *testing.T, m *MTLS, cert *x509.Certificate) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", "https://app.local/", nil)
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	recorder := httptest.NewRecorder()
+	ret, err := m.Check(recorder, req)
+	require.NoError(t, err)
+	return ret, recorder
+}
+
+// TestRules checks verification against the pool and the rule matching
+func TestRules(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	m, err := New(Config{CAPool: pool, Rules: []Rule{
+		{URIs: []string{"spiffe://example.org/ns/prod/sa/*"}},
+		{CommonNames: []string{"admin"}, OrganizationalUnits: []string{"ops"}},
+	}})
+	require.NoError(t, err)
+
+	ret, _ := call(t, m, ca.issue(t, 2, "web", "eng", "spiffe://example.org/ns/prod/sa/web"))
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, "web", info.CommonName)
+	require.Equal(t, []string{"spiffe://example.org/ns/prod/sa/web"}, info.URIs)
+	require.Equal(t, []string{"web.svc.local"}, info.DNSNames)
+
+	ret, _ = call(t, m, ca.issue(t, 3, "admin", "ops", "spiffe://example.org/ns/dev/sa/admin"))
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	ret, recorder := call(t, m, ca.issue(t, 4, "admin", "eng", "spiffe://example.org/ns/prod/sa/deep/path"))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	other := newTestCA(t, "other")
+	ret, _ = call(t, m, other.issue(t, 2, "web", "eng", "spiffe://example.org/ns/prod/sa/web"))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	ret, _ = call(t, m, nil)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	_, err = New(Config{})
+	require.Equal(t, ErrNoCA, err)
+}
+
+// TestCRL checks revocation from files on disk
+func TestCRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, "ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+	revoked := []pkix.RevokedCertificate{{SerialNumber: big.NewInt(5), RevocationTime: time.Now()}}
+	crl, err := ca.cert.CreateCRL(rand.Reader, ca.key, revoked, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	crlFile := filepath.Join(dir, "crl.pem")
+	require.NoError(t, ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0600))
+
+	m, err := New(Config{CAFile: caFile, CRLFile: crlFile})
+	require.NoError(t, err)
+	good := ca.issue(t, 6, "web", "eng", "spiffe://example.org/web")
+	ret, _ := call(t, m, good)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	_, err = m.Verify([]*x509.Certificate{ca.issue(t, 5, "web", "eng", "spiffe://example.org/web")})
+	require.Equal(t, ErrRevoked, errors.Cause(err))
+
+	// a CRL signed by someone else, or expired, fails closed
+	other := newTestCA(t, "other")
+	forged, err := other.cert.CreateCRL(rand.Reader, other.key, nil, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(crlFile, forged, 0600))
+	require.NoError(t, m.ReloadCRL())
+	_, err = m.Verify([]*x509.Certificate{good})
+	require.Equal(t, ErrCRL, errors.Cause(err))
+
+	m.now = func() time.Time { return time.Now().Add(90 * time.Minute) }
+	_, err = m.Verify([]*x509.Certificate{good})
+	require.Error(t, err)
+}
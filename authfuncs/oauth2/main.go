@@ -0,0 +1,359 @@
+/*
+Package oauth2 is an AuthFunc for OAuth2 logins where the user's identity comes from the provider's REST API (GitHub, GitLab, Google and anything else that implements Provider) rather than from an ID token.
+*/
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/codeflow"
+	"github.com/ayjayt/ilog"
+)
+
+var (
+	// ErrTokenExchange is returned when the token endpoint doesn't give us an access token
+	ErrTokenExchange = errors.New("token exchange failed")
+	// ErrProfile is returned by providers when the profile can't be fetched
+	ErrProfile = errors.New("couldn't fetch profile")
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// Token is the token endpoint's response
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// Profile is the identity a Provider maps its user API onto. It's what the AuthFunc returns as info.
+type Profile struct {
+	Provider      string `json:"provider"`
+	ID            string `json:"id"`
+	Login         string `json:"login,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+	// Domain is a hosted domain asserted by the provider (Google's "hd"), it's checked as well as the email's domain
+	Domain string `json:"domain,omitempty"`
+	// Orgs are organizations or groups the user belongs to
+	Orgs []string `json:"orgs,omitempty"`
+	// Teams are "org/team" slugs
+	Teams []string `json:"teams,omitempty"`
+}
+
+// Provider is implemented for each OAuth2 provider. GitHub, GitLab and Google are included.
+type Provider interface {
+	// Name is used in logs and Profile.Provider
+	Name() string
+	// AuthURL is the authorization endpoint
+	AuthURL() string
+	// TokenURL is the token endpoint
+	TokenURL() string
+	// Scopes are what the provider needs to fill in a Profile
+	Scopes() []string
+	// FetchProfile maps the provider's user API onto a Profile, client already adds the access token
+	FetchProfile(ctx context.Context, client *http.Client) (*Profile, error)
+}
+
+// Restrictions limit who may log in. Each non-empty list must be satisfied by at least one of its values, empty lists don't restrict anything.
+type Restrictions struct {
+	// Users are allowed logins
+	Users []string
+	// Orgs are organizations or groups, the user must be in one
+	Orgs []string
+	// Teams are "org/team" slugs, the user must be in one
+	Teams []string
+	// Domains are allowed email (verified only) or hosted domains
+	Domains []string
+}
+
+// Config describes the OAuth2 client
+type Config struct {
+	Provider     Provider
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback registered with the provider. Check serves its path.
+	RedirectURL string
+	// ExtraScopes are requested on top of the provider's
+	ExtraScopes  []string
+	Restrictions Restrictions
+	// HTTPClient is used to talk to the provider, defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// SessionLength is how long a login lasts, defaults to 6 hours like basicpass
+	SessionLength time.Duration
+}
+
+// OAuth2 supplies an authfunc receiver and stores information to be used by that receiver
+type OAuth2 struct {
+	config       Config
+	callbackPath string
+	// flow holds the state cookie and profiles by session id
+	flow *codeflow.Flow
+}
+
+// New returns an OAuth2 ready to be used as an AuthFunc
+func New(config Config) (*OAuth2, error) {
+	if config.Provider == nil {
+		return nil, errors.New("a Provider is required")
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.SessionLength == 0 {
+		config.SessionLength = time.Hour * 6
+	}
+	redirect, err := url.Parse(config.RedirectURL)
+	if err != nil || !redirect.IsAbs() {
+		return nil, errors.New("RedirectURL must be absolute")
+	}
+	defaultLogger.Info("Creating OAuth2 login for " + config.Provider.Name())
+	return &OAuth2{
+		config:       config,
+		callbackPath: redirect.EscapedPath(),
+		flow:         codeflow.New("oauth2", config.SessionLength),
+	}, nil
+}
+
+// cookieName is the name of the session cookie
+func (o *OAuth2) cookieName() string {
+	return o.flow.CookieName()
+}
+
+// Check is an authfunc that grants users with a session, handles the provider's callback, and sends everyone else to the provider
+func (o *OAuth2) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if r.URL.EscapedPath() == o.callbackPath {
+		return o.callback(w, r)
+	}
+	if profile, ok := o.flow.Session(r); ok {
+		return authdoor.AuthFuncReturn{
+			Auth: authdoor.AuthGranted,
+			Resp: authdoor.Ignored,
+			Info: authdoor.InstanceReturnInfo{Info: profile},
+		}, nil
+	}
+	scopes := append(append([]string{}, o.config.Provider.Scopes()...), o.config.ExtraScopes...)
+	return o.flow.Login(w, r, o.config.Provider.AuthURL(), url.Values{
+		"client_id":    {o.config.ClientID},
+		"redirect_uri": {o.config.RedirectURL},
+		"scope":        {strings.Join(scopes, " ")},
+	}, false)
+}
+
+// callback finishes the login: checks state, exchanges the code, fetches and checks the profile, and creates a session
+func (o *OAuth2) callback(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	state, err := o.flow.Callback(w, r)
+	if err != nil {
+		defaultLogger.Info("OAuth2 callback failed: " + err.Error())
+		if errors.Cause(err) == codeflow.ErrProvider {
+			return codeflow.Answer(w, authdoor.AuthFailed, http.StatusUnauthorized)
+		}
+		return codeflow.Answer(w, authdoor.AuthFailed, http.StatusBadRequest)
+	}
+	token, err := o.exchange(r.Context(), r.URL.Query().Get("code"), state.Verifier)
+	if err != nil {
+		defaultLogger.Error("OAuth2 token exchange failed: " + err.Error())
+		return codeflow.Answer(w, authdoor.AuthFailed, http.StatusBadGateway)
+	}
+	profile, err := o.config.Provider.FetchProfile(r.Context(), bearerClient(o.config.HTTPClient, token))
+	if err != nil {
+		defaultLogger.Error("OAuth2 profile fetch failed: " + err.Error())
+		return codeflow.Answer(w, authdoor.AuthFailed, http.StatusBadGateway)
+	}
+	profile.Provider = o.config.Provider.Name()
+	if !o.config.Restrictions.Allow(profile) {
+		defaultLogger.Info("OAuth2 user " + profile.Login + " isn't allowed")
+		return codeflow.Answer(w, authdoor.AuthDenied, http.StatusForbidden)
+	}
+	info, err := json.Marshal(profile)
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	defaultLogger.Info("cookie " + o.cookieName() + " set as success")
+	return o.flow.Finish(w, r, state, info), nil
+}
+
+// exchange trades the code for an access token
+func (o *OAuth2) exchange(ctx context.Context, code, verifier string) (*Token, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {o.config.ClientID},
+		"client_secret": {o.config.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.config.Provider.TokenURL(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json") // GitHub answers form encoded otherwise
+	resp, err := o.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(ErrTokenExchange, err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, errors.Wrap(ErrTokenExchange, err.Error())
+	}
+	token := struct {
+		Token
+		Error string `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, errors.Wrap(ErrTokenExchange, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return nil, errors.Wrap(ErrTokenExchange, resp.Status+" "+token.Error)
+	}
+	return &token.Token, nil
+}
+
+// bearerTransport adds the access token to every request
+type bearerTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+// RoundTrip sets Authorization on a copy of the request
+func (b *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+b.token)
+	return b.base.RoundTrip(r)
+}
+
+// bearerClient returns a copy of client that authenticates with token
+func bearerClient(client *http.Client, token *Token) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ret := *client
+	ret.Transport = &bearerTransport{base: base, token: token.AccessToken}
+	return &ret
+}
+
+// Allow reports whether profile satisfies the restrictions
+func (r Restrictions) Allow(profile *Profile) bool {
+	if len(r.Users) != 0 && !anyMatch(r.Users, []string{profile.Login}) {
+		return false
+	}
+	if len(r.Orgs) != 0 && !anyMatch(r.Orgs, profile.Orgs) {
+		return false
+	}
+	if len(r.Teams) != 0 && !anyMatch(r.Teams, profile.Teams) {
+		return false
+	}
+	if len(r.Domains) != 0 {
+		domains := []string{}
+		if profile.Domain != "" {
+			domains = append(domains, profile.Domain)
+		}
+		if at := strings.LastIndex(profile.Email, "@"); at != -1 && profile.EmailVerified {
+			domains = append(domains, profile.Email[at+1:])
+		}
+		if !anyMatch(r.Domains, domains) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyMatch reports whether any of have is in allowed, ignoring case
+func anyMatch(allowed []string, have []string) bool {
+	for _, a := range allowed {
+		for _, h := range have {
+			if h != "" && strings.EqualFold(a, h) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxPages caps how many pages of a list are read, so a provider can't keep us paging forever
+const maxPages = 50
+
+// getJSON fetches url with client and decodes the response into v
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	_, err := getPage(ctx, client, url, v)
+	return err
+}
+
+// getPage is getJSON for one page of a list, returning the next page's URL or "" if it's the last
+func getPage(ctx context.Context, client *http.Client, target string, v interface{}) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(ErrProfile, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Wrap(ErrProfile, target+": "+resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return "", errors.Wrap(ErrProfile, err.Error())
+	}
+	return nextPage(req.URL, resp.Header)
+}
+
+// nextPage finds the next page from a Link rel="next" header (GitHub) or X-Next-Page (GitLab). It has to be on the same host, since the access token goes with it.
+func nextPage(current *url.URL, header http.Header) (string, error) {
+	next := ""
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if strings.Replace(strings.TrimSpace(param), " ", "", -1) == `rel="next"` {
+				next = strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	if page := header.Get("X-Next-Page"); next == "" && page != "" {
+		u := *current
+		q := u.Query()
+		q.Set("page", page)
+		u.RawQuery = q.Encode()
+		next = u.String()
+	}
+	if next == "" {
+		return "", nil
+	}
+	u, err := current.Parse(next)
+	if err != nil || u.Scheme != current.Scheme || u.Host != current.Host {
+		return "", errors.Wrap(ErrProfile, "next page "+next+" isn't on "+current.Host)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,322 @@
+package oauth2
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/oauth2/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// fakeProvider is an httptest server that acts as both GitHub and Google. It approves every authorization and checks PKCE.
+type fakeProvider struct {
+	server     *httptest.Server
+	challenges map[string]string
+	// apis maps API paths to JSON responses
+	apis map[string]interface{}
+}
+
+// newFakeProvider starts a fakeProvider
+func newFakeProvider() *fakeProvider {
+	f := &fakeProvider{challenges: make(map[string]string), apis: make(map[string]interface{})}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// serve handles the OAuth endpoints and the canned APIs
+func (f *fakeProvider) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/login/oauth/authorize", "/google/auth":
+		q := r.URL.Query()
+		if q.Get("client_id") != "client" || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		f.challenges["code"] = q.Get("code_challenge")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=code&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	case "/login/oauth/access_token", "/google/token":
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("client_secret") != "secret" || base64.RawURLEncoding.EncodeToString(verifier[:]) != f.challenges[r.PostFormValue("code")] {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"token","token_type":"bearer"}`))
+	default:
+		response, ok := f.apis[r.URL.Path]
+		if !ok || r.Header.Get("Authorization") != "Bearer token" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// githubUser sets the fake GitHub API responses
+func (f *fakeProvider) githubUser(login string, orgs []string, teams []string) {
+	f.apis["/user"] = map[string]interface{}{"id": 7, "login": login, "name": "AJ"}
+	f.apis["/user/emails"] = []map[string]interface{}{{"email": login + "@ajpikul.com", "primary": true, "verified": true}}
+	orgList := []map[string]interface{}{}
+	for _, org := range orgs {
+		orgList = append(orgList, map[string]interface{}{"login": org})
+	}
+	f.apis["/user/orgs"] = orgList
+	teamList := []map[string]interface{}{}
+	for _, team := range teams {
+		teamList = append(teamList, map[string]interface{}{"slug": team, "organization": map[string]string{"login": orgs[0]}})
+	}
+	f.apis["/user/teams"] = teamList
+}
+
+// newTestOAuth2 returns an OAuth2 against the fake provider
+func newTestOAuth2(t *testing.T, f *fakeProvider, provider Provider, restrictions Restrictions) *OAuth2 {
+	o, err := New(Config{
+		Provider:     provider,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.local/oauth2/callback",
+		Restrictions: restrictions,
+		HTTPClient:   f.server.Client(),
+	})
+	require.NoError(t, err)
+	return o
+}
+
+// check runs o.Check on req and returns the recorder
+func check(t *testing.T, o *OAuth2, req *http.Request) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	ret, err := o.Check(recorder, req)
+	require.NoError(t, err)
+	return ret, recorder
+}
+
+// login runs the flow for /private up to and including the callback
+func login(t *testing.T, o *OAuth2, f *fakeProvider) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	return loginFrom(t, o, f, "/private")
+}
+
+// loginFrom runs the flow starting at path up to and including the callback
+func loginFrom(t *testing.T, o *OAuth2, f *fakeProvider, path string) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	ret, recorder := check(t, o, httptest.NewRequest("GET", "https://app.local"+path, nil))
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusFound, recorder.Code)
+	stateCookie := recorder.Result().Cookies()[0]
+
+	client := f.server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(recorder.Header().Get("Location"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	req := httptest.NewRequest("GET", resp.Header.Get("Location"), nil)
+	req.AddCookie(stateCookie)
+	return check(t, o, req)
+}
+
+// sessionCookie finds the session cookie in a callback response
+func sessionCookie(o *OAuth2, recorder *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == o.cookieName() {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// TestGitHubFlow logs in through the fake GitHub and uses the session
+func TestGitHubFlow(t *testing.T) {
+	f := newFakeProvider()
+	defer f.server.Close()
+	f.githubUser("aj", []string{"ayjayt"}, []string{"core"})
+	o := newTestOAuth2(t, f, GitHub{BaseURL: f.server.URL, APIURL: f.server.URL}, Restrictions{Teams: []string{"ayjayt/core"}})
+
+	ret, recorder := login(t, o, f)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, "/private", recorder.Header().Get("Location"))
+	cookie := sessionCookie(o, recorder)
+	require.NotNil(t, cookie)
+
+	req := httptest.NewRequest("GET", "https://app.local/private", nil)
+	req.AddCookie(cookie)
+	ret, _ = check(t, o, req)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	profile := Profile{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &profile))
+	require.Equal(t, "github", profile.Provider)
+	require.Equal(t, "7", profile.ID)
+	require.Equal(t, "aj@ajpikul.com", profile.Email)
+	require.Equal(t, []string{"ayjayt"}, profile.Orgs)
+}
+
+// TestOpenRedirect makes sure a login started at a path another host could be read from doesn't send the user there
+func TestOpenRedirect(t *testing.T) {
+	f := newFakeProvider()
+	defer f.server.Close()
+	f.githubUser("aj", []string{"ayjayt"}, nil)
+	o := newTestOAuth2(t, f, GitHub{BaseURL: f.server.URL, APIURL: f.server.URL}, Restrictions{})
+
+	ret, recorder := loginFrom(t, o, f, "//evil.com/x")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, "/", recorder.Header().Get("Location"))
+}
+
+// TestRestrictedUser makes sure a user outside the restrictions is denied without a session
+func TestRestrictedUser(t *testing.T) {
+	f := newFakeProvider()
+	defer f.server.Close()
+	f.githubUser("mallory", []string{"elsewhere"}, []string{"core"})
+	o := newTestOAuth2(t, f, GitHub{BaseURL: f.server.URL, APIURL: f.server.URL}, Restrictions{Orgs: []string{"ayjayt"}})
+
+	ret, recorder := login(t, o, f)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+	require.Nil(t, sessionCookie(o, recorder))
+}
+
+// TestGoogleDomain checks the hosted domain restriction with the Google provider
+func TestGoogleDomain(t *testing.T) {
+	f := newFakeProvider()
+	defer f.server.Close()
+	google := Google{
+		AuthEndpoint:     f.server.URL + "/google/auth",
+		TokenEndpoint:    f.server.URL + "/google/token",
+		UserInfoEndpoint: f.server.URL + "/google/userinfo",
+	}
+	o := newTestOAuth2(t, f, google, Restrictions{Domains: []string{"ajpikul.com"}})
+
+	f.apis["/google/userinfo"] = map[string]interface{}{"sub": "1", "email": "aj@ajpikul.com", "email_verified": true, "hd": "ajpikul.com"}
+	ret, _ := login(t, o, f)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	f.apis["/google/userinfo"] = map[string]interface{}{"sub": "2", "email": "aj@ajpikul.com", "email_verified": false}
+	ret, _ = login(t, o, f)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+}
+
+// TestRestrictions checks that categories are ANDed and values ORed
+func TestRestrictions(t *testing.T) {
+	profile := &Profile{Login: "aj", Orgs: []string{"ayjayt"}, Teams: []string{"ayjayt/core"}, Email: "aj@ajpikul.com", EmailVerified: true}
+	require.True(t, Restrictions{}.Allow(profile))
+	require.True(t, Restrictions{Users: []string{"bob", "AJ"}}.Allow(profile))
+	require.True(t, Restrictions{Orgs: []string{"ayjayt"}, Domains: []string{"ajpikul.com"}}.Allow(profile))
+	require.False(t, Restrictions{Orgs: []string{"ayjayt"}, Domains: []string{"example.com"}}.Allow(profile))
+	require.False(t, Restrictions{Teams: []string{"ayjayt/other"}}.Allow(profile))
+}
+
+// TestBadCallback makes sure a bad code or state is refused
+func TestBadCallback(t *testing.T) {
+	f := newFakeProvider()
+	defer f.server.Close()
+	o := newTestOAuth2(t, f, GitHub{BaseURL: f.server.URL, APIURL: f.server.URL}, Restrictions{})
+
+	ret, recorder := check(t, o, httptest.NewRequest("GET", "https://app.local/oauth2/callback?code=x&state=y", nil))
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	_, err := o.exchange(httptest.NewRequest("GET", "/", nil).Context(), "unknown", "verifier")
+	require.Equal(t, ErrTokenExchange, errors.Cause(err))
+}
+
+// TestPagination reads every page of GitHub's orgs and teams and GitLab's groups, and won't follow a next page to another host
+func TestPagination(t *testing.T) {
+	names := func(prefix string, from, to int) []map[string]interface{} {
+		list := []map[string]interface{}{}
+		for i := from; i < to; i++ {
+			name := prefix + strconv.Itoa(i)
+			list = append(list, map[string]interface{}{"login": name, "slug": name, "organization": map[string]string{"login": "ayjayt"}, "full_path": name})
+		}
+		return list
+	}
+	elsewhere := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		switch r.URL.Path {
+		case "/user":
+			w.Write([]byte(`{"id":7,"login":"aj"}`))
+			return
+		case "/user/emails":
+			w.Write([]byte(`[]`))
+			return
+		case "/user/orgs", "/user/teams":
+			if page < 3 {
+				next := "http://" + r.Host + r.URL.Path + "?per_page=100&page=" + strconv.Itoa(page+1)
+				if elsewhere != "" {
+					next = elsewhere
+				}
+				w.Header().Set("Link", `<`+next+`>; rel="next", <http://`+r.Host+r.URL.Path+`?page=3>; rel="last"`)
+			}
+		case "/api/v4/user":
+			w.Write([]byte(`{"id":7,"username":"aj"}`))
+			return
+		case "/api/v4/groups":
+			if r.URL.Query().Get("min_access_level") != "10" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if page < 3 {
+				w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+			}
+		}
+		json.NewEncoder(w).Encode(names(r.URL.Path+"-", (page-1)*100, page*100-50*(page/3)))
+	}))
+	defer server.Close()
+	ctx := httptest.NewRequest("GET", "/", nil).Context()
+
+	profile, err := GitHub{APIURL: server.URL}.FetchProfile(ctx, server.Client())
+	require.NoError(t, err)
+	require.Len(t, profile.Orgs, 250)
+	require.Equal(t, "/user/orgs-249", profile.Orgs[249])
+	require.Len(t, profile.Teams, 250)
+	require.Equal(t, "ayjayt//user/teams-0", profile.Teams[0])
+
+	profile, err = GitLab{BaseURL: server.URL}.FetchProfile(ctx, server.Client())
+	require.NoError(t, err)
+	require.Len(t, profile.Orgs, 250)
+	require.Equal(t, "/api/v4/groups-100", profile.Orgs[100])
+
+	elsewhere = "https://evil.example.com/user/orgs?page=2"
+	_, err = GitHub{APIURL: server.URL}.FetchProfile(ctx, server.Client())
+	require.Equal(t, ErrProfile, errors.Cause(err))
+}
@@ -0,0 +1,241 @@
+package oauth2
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GitHub is a Provider for github.com or GitHub Enterprise. Orgs and Teams are filled in, which needs the read:org scope.
+type GitHub struct {
+	// BaseURL is where the OAuth endpoints live, defaults to https://github.com
+	BaseURL string
+	// APIURL is the REST API, defaults to https://api.github.com (Enterprise uses BaseURL + "/api/v3")
+	APIURL string
+}
+
+// Name returns "github"
+func (g GitHub) Name() string {
+	return "github"
+}
+
+// base returns BaseURL or its default
+func (g GitHub) base() string {
+	if g.BaseURL == "" {
+		return "https://github.com"
+	}
+	return strings.TrimSuffix(g.BaseURL, "/")
+}
+
+// api returns APIURL or its default
+func (g GitHub) api() string {
+	if g.APIURL == "" {
+		return "https://api.github.com"
+	}
+	return strings.TrimSuffix(g.APIURL, "/")
+}
+
+// AuthURL is the authorization endpoint
+func (g GitHub) AuthURL() string {
+	return g.base() + "/login/oauth/authorize"
+}
+
+// TokenURL is the token endpoint
+func (g GitHub) TokenURL() string {
+	return g.base() + "/login/oauth/access_token"
+}
+
+// Scopes are read:user, user:email and read:org
+func (g GitHub) Scopes() []string {
+	return []string{"read:user", "user:email", "read:org"}
+}
+
+// FetchProfile reads /user, /user/emails, and every page of /user/orgs and /user/teams
+func (g GitHub) FetchProfile(ctx context.Context, client *http.Client) (*Profile, error) {
+	user := struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}{}
+	if err := getJSON(ctx, client, g.api()+"/user", &user); err != nil {
+		return nil, err
+	}
+	profile := &Profile{ID: strconv.FormatInt(user.ID, 10), Login: user.Login, Name: user.Name}
+
+	emails := []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}{}
+	if err := getJSON(ctx, client, g.api()+"/user/emails", &emails); err != nil {
+		return nil, err
+	}
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email = email.Email
+			profile.EmailVerified = email.Verified
+		}
+	}
+
+	next := g.api() + "/user/orgs?per_page=100"
+	for page := 0; next != "" && page < maxPages; page++ {
+		orgs := []struct {
+			Login string `json:"login"`
+		}{}
+		var err error
+		if next, err = getPage(ctx, client, next, &orgs); err != nil {
+			return nil, err
+		}
+		for _, org := range orgs {
+			profile.Orgs = append(profile.Orgs, org.Login)
+		}
+	}
+
+	next = g.api() + "/user/teams?per_page=100"
+	for page := 0; next != "" && page < maxPages; page++ {
+		teams := []struct {
+			Slug         string `json:"slug"`
+			Organization struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}{}
+		var err error
+		if next, err = getPage(ctx, client, next, &teams); err != nil {
+			return nil, err
+		}
+		for _, team := range teams {
+			profile.Teams = append(profile.Teams, team.Organization.Login+"/"+team.Slug)
+		}
+	}
+	return profile, nil
+}
+
+// GitLab is a Provider for gitlab.com or a self-hosted GitLab. Groups become Orgs.
+type GitLab struct {
+	// BaseURL defaults to https://gitlab.com
+	BaseURL string
+}
+
+// Name returns "gitlab"
+func (g GitLab) Name() string {
+	return "gitlab"
+}
+
+// base returns BaseURL or its default
+func (g GitLab) base() string {
+	if g.BaseURL == "" {
+		return "https://gitlab.com"
+	}
+	return strings.TrimSuffix(g.BaseURL, "/")
+}
+
+// AuthURL is the authorization endpoint
+func (g GitLab) AuthURL() string {
+	return g.base() + "/oauth/authorize"
+}
+
+// TokenURL is the token endpoint
+func (g GitLab) TokenURL() string {
+	return g.base() + "/oauth/token"
+}
+
+// Scopes is read_api, which covers the user and their groups
+func (g GitLab) Scopes() []string {
+	return []string{"read_api"}
+}
+
+// FetchProfile reads /api/v4/user and every page of /api/v4/groups
+func (g GitLab) FetchProfile(ctx context.Context, client *http.Client) (*Profile, error) {
+	user := struct {
+		ID          int64  `json:"id"`
+		Username    string `json:"username"`
+		Name        string `json:"name"`
+		Email       string `json:"email"`
+		ConfirmedAt string `json:"confirmed_at"`
+	}{}
+	if err := getJSON(ctx, client, g.base()+"/api/v4/user", &user); err != nil {
+		return nil, err
+	}
+	profile := &Profile{
+		ID:            strconv.FormatInt(user.ID, 10),
+		Login:         user.Username,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.ConfirmedAt != "",
+	}
+	next := g.base() + "/api/v4/groups?min_access_level=10&per_page=100"
+	for page := 0; next != "" && page < maxPages; page++ {
+		groups := []struct {
+			FullPath string `json:"full_path"`
+		}{}
+		var err error
+		if next, err = getPage(ctx, client, next, &groups); err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			profile.Orgs = append(profile.Orgs, group.FullPath)
+		}
+	}
+	return profile, nil
+}
+
+// Google is a Provider for Google accounts. Workspace accounts have Domain set from "hd".
+type Google struct {
+	// AuthEndpoint, TokenEndpoint and UserInfoEndpoint override Google's, for tests
+	AuthEndpoint     string
+	TokenEndpoint    string
+	UserInfoEndpoint string
+}
+
+// Name returns "google"
+func (g Google) Name() string {
+	return "google"
+}
+
+// AuthURL is the authorization endpoint
+func (g Google) AuthURL() string {
+	if g.AuthEndpoint != "" {
+		return g.AuthEndpoint
+	}
+	return "https://accounts.google.com/o/oauth2/v2/auth"
+}
+
+// TokenURL is the token endpoint
+func (g Google) TokenURL() string {
+	if g.TokenEndpoint != "" {
+		return g.TokenEndpoint
+	}
+	return "https://oauth2.googleapis.com/token"
+}
+
+// Scopes are openid, email and profile
+func (g Google) Scopes() []string {
+	return []string{"openid", "email", "profile"}
+}
+
+// FetchProfile reads the userinfo endpoint
+func (g Google) FetchProfile(ctx context.Context, client *http.Client) (*Profile, error) {
+	endpoint := g.UserInfoEndpoint
+	if endpoint == "" {
+		endpoint = "https://openidconnect.googleapis.com/v1/userinfo"
+	}
+	user := struct {
+		Sub           string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		HostedDomain  string `json:"hd"`
+	}{}
+	if err := getJSON(ctx, client, endpoint, &user); err != nil {
+		return nil, err
+	}
+	return &Profile{
+		ID:            user.Sub,
+		Login:         user.Email,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Domain:        user.HostedDomain,
+	}, nil
+}
@@ -0,0 +1,292 @@
+/*
+Package oidc is an OpenID Connect relying party AuthFunc. It runs the authorization code flow with PKCE, checks ID tokens against the provider's discovered JWKS, and keeps an in-memory session so the provider is only visited once per session.
+*/
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/codeflow"
+	"github.com/ayjayt/authdoor/authfuncs/internal/jose"
+	"github.com/ayjayt/ilog"
+)
+
+var (
+	// ErrDiscovery is returned by New when the provider metadata can't be used
+	ErrDiscovery = errors.New("provider discovery failed")
+	// ErrState is returned when the callback's state doesn't match the state cookie
+	ErrState = codeflow.ErrState
+	// ErrTokenExchange is returned when the token endpoint doesn't give us an ID token
+	ErrTokenExchange = errors.New("token exchange failed")
+	// ErrIDToken is returned when an ID token fails validation
+	ErrIDToken = errors.New("invalid id token")
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// allowedAlgs are the ID token algorithms we accept. Symmetric and "none" are never accepted.
+var allowedAlgs = map[string]bool{"RS256": true, "RS384": true, "RS512": true, "PS256": true, "ES256": true, "ES384": true, "EdDSA": true}
+
+// Config describes the provider and how we're registered with it
+type Config struct {
+	// Issuer is the provider's issuer URL, discovery is done at Issuer + "/.well-known/openid-configuration"
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback registered with the provider. Check serves its path.
+	RedirectURL string
+	// Scopes requested, "openid" is always included
+	Scopes []string
+	// HTTPClient is used to talk to the provider, defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// SessionLength is how long a login lasts, defaults to 6 hours like basicpass
+	SessionLength time.Duration
+	// ClockSkew is tolerated when checking ID token times, defaults to a minute
+	ClockSkew time.Duration
+}
+
+// providerMetadata is the part of the discovery document we use
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDC supplies an authfunc receiver and stores information to be used by that receiver
+type OIDC struct {
+	config       Config
+	provider     providerMetadata
+	keys         *jose.RemoteKeySet
+	callbackPath string
+	// flow holds the state cookie and ID token claims by session id
+	flow *codeflow.Flow
+}
+
+// New does discovery against the issuer and returns an OIDC ready to be used as an AuthFunc
+func New(config Config) (*OIDC, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.SessionLength == 0 {
+		config.SessionLength = time.Hour * 6
+	}
+	if config.ClockSkew == 0 {
+		config.ClockSkew = time.Minute
+	}
+	if !hasScope(config.Scopes, "openid") {
+		config.Scopes = append([]string{"openid"}, config.Scopes...)
+	}
+	callback, err := url.Parse(config.RedirectURL)
+	if err != nil || !callback.IsAbs() {
+		return nil, errors.New("RedirectURL must be absolute")
+	}
+	defaultLogger.Info("Discovering OIDC provider " + config.Issuer)
+	provider, err := discover(config.HTTPClient, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	ret := &OIDC{
+		config:       config,
+		provider:     provider,
+		keys:         jose.NewRemoteKeySet(config.HTTPClient, provider.JWKSURI, 0),
+		callbackPath: callback.EscapedPath(),
+		flow:         codeflow.New("oidc", config.SessionLength),
+	}
+	return ret, nil
+}
+
+// hasScope reports whether scope is in scopes
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// discover fetches and checks the provider metadata
+func discover(client *http.Client, issuer string) (providerMetadata, error) {
+	ret := providerMetadata{}
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return ret, errors.Wrap(ErrDiscovery, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ret, errors.Wrap(ErrDiscovery, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&ret); err != nil {
+		return ret, errors.Wrap(ErrDiscovery, err.Error())
+	}
+	if ret.Issuer != issuer {
+		return ret, errors.Wrap(ErrDiscovery, "issuer "+ret.Issuer+" doesn't match "+issuer)
+	}
+	if ret.AuthorizationEndpoint == "" || ret.TokenEndpoint == "" || ret.JWKSURI == "" {
+		return ret, errors.Wrap(ErrDiscovery, "missing endpoints")
+	}
+	return ret, nil
+}
+
+// cookieName is the name of the session cookie
+func (o *OIDC) cookieName() string {
+	return o.flow.CookieName()
+}
+
+// Check is an authfunc that grants users with a session, handles the provider's callback, and sends everyone else to the provider
+func (o *OIDC) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if r.URL.EscapedPath() == o.callbackPath {
+		return o.callback(w, r)
+	}
+	if claims, ok := o.flow.Session(r); ok {
+		return authdoor.AuthFuncReturn{
+			Auth: authdoor.AuthGranted,
+			Resp: authdoor.Ignored,
+			Info: authdoor.InstanceReturnInfo{Info: claims},
+		}, nil
+	}
+	return o.flow.Login(w, r, o.provider.AuthorizationEndpoint, url.Values{
+		"client_id":    {o.config.ClientID},
+		"redirect_uri": {o.config.RedirectURL},
+		"scope":        {strings.Join(o.config.Scopes, " ")},
+	}, true)
+}
+
+// callback finishes the login: checks state, exchanges the code, validates the ID token and creates a session
+func (o *OIDC) callback(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	state, err := o.flow.Callback(w, r)
+	if err != nil {
+		defaultLogger.Info("OIDC callback failed: " + err.Error())
+		if errors.Cause(err) == codeflow.ErrProvider {
+			return codeflow.Answer(w, authdoor.AuthFailed, http.StatusUnauthorized)
+		}
+		return codeflow.Answer(w, authdoor.AuthFailed, http.StatusBadRequest)
+	}
+	idToken, err := o.exchange(r.Context(), r.URL.Query().Get("code"), state.Verifier)
+	if err != nil {
+		defaultLogger.Error("OIDC token exchange failed: " + err.Error())
+		return codeflow.Answer(w, authdoor.AuthFailed, http.StatusBadGateway)
+	}
+	claims, err := o.validate(r.Context(), idToken, state.Nonce)
+	if err != nil {
+		defaultLogger.Info("OIDC id token rejected: " + err.Error())
+		return codeflow.Answer(w, authdoor.AuthFailed, http.StatusUnauthorized)
+	}
+	defaultLogger.Info("cookie " + o.cookieName() + " set as success")
+	return o.flow.Finish(w, r, state, claims), nil
+}
+
+// exchange trades the code for an ID token at the token endpoint
+func (o *OIDC) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if o.config.ClientSecret == "" {
+		form.Set("client_id", o.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	}
+	resp, err := o.config.HTTPClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(ErrTokenExchange, err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", errors.Wrap(ErrTokenExchange, err.Error())
+	}
+	token := struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", errors.Wrap(ErrTokenExchange, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return "", errors.Wrap(ErrTokenExchange, resp.Status+" "+token.Error)
+	}
+	return token.IDToken, nil
+}
+
+// validate checks the ID token's signature and claims and returns its payload
+func (o *OIDC) validate(ctx context.Context, idToken, nonce string) (json.RawMessage, error) {
+	jws, err := jose.ParseCompact(idToken)
+	if err != nil {
+		return nil, errors.Wrap(ErrIDToken, err.Error())
+	}
+	if !allowedAlgs[jws.Header.Alg] {
+		return nil, errors.Wrap(ErrIDToken, "alg "+jws.Header.Alg)
+	}
+	key, err := o.keys.Key(ctx, jws.Header.Kid)
+	if err != nil {
+		return nil, errors.Wrap(ErrIDToken, err.Error())
+	}
+	if err := jws.Verify(key); err != nil {
+		return nil, errors.Wrap(ErrIDToken, err.Error())
+	}
+	claims := struct {
+		jose.Claims
+		AuthorizedParty string `json:"azp"`
+	}{}
+	if err := json.Unmarshal(jws.Payload, &claims); err != nil {
+		return nil, errors.Wrap(ErrIDToken, err.Error())
+	}
+	if claims.Issuer != o.provider.Issuer {
+		return nil, errors.Wrap(ErrIDToken, "issuer")
+	}
+	if !claims.Audience.Contains(o.config.ClientID) {
+		return nil, errors.Wrap(ErrIDToken, "audience")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != o.config.ClientID {
+		return nil, errors.Wrap(ErrIDToken, "azp")
+	}
+	if claims.Expiry == nil || claims.Subject == "" {
+		return nil, errors.Wrap(ErrIDToken, "missing exp or sub")
+	}
+	if err := claims.ValidateTime(time.Now(), o.config.ClockSkew); err != nil {
+		return nil, errors.Wrap(ErrIDToken, err.Error())
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.Wrap(ErrIDToken, "nonce")
+	}
+	compacted := new(bytes.Buffer)
+	if err := json.Compact(compacted, jws.Payload); err != nil {
+		return nil, errors.Wrap(ErrIDToken, err.Error())
+	}
+	return compacted.Bytes(), nil
+}
@@ -0,0 +1,209 @@
+package oidc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/oidc/oidctest"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/oidc/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// newTestOIDC starts a fake IdP and an OIDC configured against it
+func newTestOIDC(t *testing.T) (*OIDC, *oidctest.IdP) {
+	idp := oidctest.NewIdP("client", "secret")
+	o, err := New(Config{
+		Issuer:       idp.Issuer(),
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.local/oidc/callback",
+		Scopes:       []string{"email"},
+		HTTPClient:   idp.Server.Client(),
+	})
+	require.NoError(t, err)
+	return o, idp
+}
+
+// check runs o.Check on req and returns the recorder
+func check(t *testing.T, o *OIDC, req *http.Request) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	ret, err := o.Check(recorder, req)
+	require.NoError(t, err)
+	return ret, recorder
+}
+
+// followIdP visits the IdP's authorization endpoint like a browser and returns the callback URL it redirects to
+func followIdP(t *testing.T, idp *oidctest.IdP, location string) *url.URL {
+	client := idp.Server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(location)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	return callback
+}
+
+// login runs the whole flow for /private and returns the session cookie
+func login(t *testing.T, o *OIDC, idp *oidctest.IdP) (*http.Cookie, authdoor.AuthFuncReturn) {
+	return loginFrom(t, o, idp, "/private?x=1", "/private?x=1")
+}
+
+// loginFrom runs the whole flow starting at path, checks it ends up at returnTo, and returns the session cookie
+func loginFrom(t *testing.T, o *OIDC, idp *oidctest.IdP, path, returnTo string) (*http.Cookie, authdoor.AuthFuncReturn) {
+	ret, recorder := check(t, o, httptest.NewRequest("GET", "https://app.local"+path, nil))
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusFound, recorder.Code)
+	location := recorder.Header().Get("Location")
+	authURL, err := url.Parse(location)
+	require.NoError(t, err)
+	require.Equal(t, "openid email", authURL.Query().Get("scope"))
+	stateCookie := recorder.Result().Cookies()[0]
+	raw, _ := base64.RawURLEncoding.DecodeString(strings.SplitN(stateCookie.Value, ".", 2)[0])
+	require.False(t, bytes.Contains(raw, []byte(`"v":`)), "the PKCE verifier is readable")
+
+	callback := followIdP(t, idp, location)
+	require.Equal(t, "/oidc/callback", callback.Path)
+	req := httptest.NewRequest("GET", callback.String(), nil)
+	req.AddCookie(stateCookie)
+	ret, recorder = check(t, o, req)
+	require.Equal(t, http.StatusFound, recorder.Code)
+	require.Equal(t, returnTo, recorder.Header().Get("Location"))
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == o.cookieName() {
+			return cookie, ret
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil, ret
+}
+
+// TestLoginFlow runs the full code flow against the fake IdP
+func TestLoginFlow(t *testing.T) {
+	o, idp := newTestOIDC(t)
+	defer idp.Close()
+	idp.Subject = "aj"
+	idp.Claims["email"] = "aj@ajpikul.com"
+
+	sessionCookie, ret := login(t, o, idp)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+
+	req := httptest.NewRequest("GET", "https://app.local/private", nil)
+	req.AddCookie(sessionCookie)
+	ret, _ = check(t, o, req)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	claims := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &claims))
+	require.Equal(t, "aj", claims["sub"])
+	require.Equal(t, "aj@ajpikul.com", claims["email"])
+}
+
+// TestOpenRedirect makes sure a login started at a path another host could be read from doesn't send the user there
+func TestOpenRedirect(t *testing.T) {
+	o, idp := newTestOIDC(t)
+	defer idp.Close()
+	_, ret := loginFrom(t, o, idp, "//evil.com/x", "/")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+}
+
+// TestCallbackState makes sure the callback rejects missing, forged and mismatched state
+func TestCallbackState(t *testing.T) {
+	o, idp := newTestOIDC(t)
+	defer idp.Close()
+
+	_, recorder := check(t, o, httptest.NewRequest("GET", "https://app.local/", nil))
+	stateCookie := recorder.Result().Cookies()[0]
+	callback := followIdP(t, idp, recorder.Header().Get("Location"))
+
+	ret, recorder := check(t, o, httptest.NewRequest("GET", callback.String(), nil))
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+
+	forged := *stateCookie
+	forged.Value = forged.Value[:len(forged.Value)-2] + "AA"
+	req := httptest.NewRequest("GET", callback.String(), nil)
+	req.AddCookie(&forged)
+	_, recorder = check(t, o, req)
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	query := callback.Query()
+	query.Set("state", "other")
+	callback.RawQuery = query.Encode()
+	req = httptest.NewRequest("GET", callback.String(), nil)
+	req.AddCookie(stateCookie)
+	_, recorder = check(t, o, req)
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+// TestValidate checks ID token validation against tokens minted by the IdP's key
+func TestValidate(t *testing.T) {
+	o, idp := newTestOIDC(t)
+	defer idp.Close()
+	idp.Subject = "aj"
+	_, ret := login(t, o, idp)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	// a token signed by a different key under a kid we've already fetched is rejected
+	other := oidctest.NewIdP("client", "secret")
+	defer other.Close()
+	idp.Key = other.Key
+	_, recorder := check(t, o, httptest.NewRequest("GET", "https://app.local/", nil))
+	stateCookie := recorder.Result().Cookies()[0]
+	req := httptest.NewRequest("GET", followIdP(t, idp, recorder.Header().Get("Location")).String(), nil)
+	req.AddCookie(stateCookie)
+	ret, recorder = check(t, o, req)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	_, err := o.validate(httptest.NewRequest("GET", "/", nil).Context(), "not.a.token", "")
+	require.Equal(t, ErrIDToken, errors.Cause(err))
+}
+
+// TestDiscoveryMismatch makes sure New refuses a provider claiming a different issuer
+func TestDiscoveryMismatch(t *testing.T) {
+	idp := oidctest.NewIdP("client", "secret")
+	defer idp.Close()
+	_, err := New(Config{Issuer: idp.Issuer() + "/other", ClientID: "client", RedirectURL: "https://app.local/cb", HTTPClient: idp.Server.Client()})
+	require.Equal(t, ErrDiscovery, errors.Cause(err))
+	_, err = New(Config{Issuer: idp.Issuer(), ClientID: "client", RedirectURL: "/relative"})
+	require.Error(t, err)
+}
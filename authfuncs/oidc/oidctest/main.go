@@ -0,0 +1,205 @@
+/*
+Package oidctest provides a tiny in-process OpenID Connect provider for tests. It serves discovery, JWKS, an authorization endpoint that approves every request immediately, and a token endpoint that checks PKCE and issues RS256 ID tokens.
+*/
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ayjayt/authdoor/authfuncs/internal/jose"
+)
+
+// pendingCode is what the IdP remembers between the authorization and token endpoints
+type pendingCode struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+// IdP is a fake OpenID provider. Change Subject, Claims or Key between logins to test different users and key rotation.
+type IdP struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string
+	// Subject is the "sub" of the next ID token
+	Subject string
+	// Claims are added to the next ID token
+	Claims map[string]interface{}
+	// Key signs ID tokens and is served from the jwks endpoint under KeyID
+	Key   *rsa.PrivateKey
+	KeyID string
+	// Lifetime of issued ID tokens
+	Lifetime time.Duration
+	mutex    *sync.Mutex
+	codes    map[string]pendingCode
+}
+
+// NewIdP starts a fake provider which accepts the client credentials given
+func NewIdP(clientID, clientSecret string) *IdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	idp := &IdP{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Subject:      "user",
+		Claims:       make(map[string]interface{}),
+		Key:          key,
+		KeyID:        uuid.New().String(),
+		Lifetime:     time.Hour,
+		mutex:        new(sync.Mutex),
+		codes:        make(map[string]pendingCode),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/jwks", idp.jwks)
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+// Issuer returns the issuer URL, which is also the discovery base
+func (i *IdP) Issuer() string {
+	return i.Server.URL
+}
+
+// Close shuts down the server
+func (i *IdP) Close() {
+	i.Server.Close()
+}
+
+// discovery serves the provider metadata
+func (i *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                i.Issuer(),
+		"authorization_endpoint":                i.Issuer() + "/authorize",
+		"token_endpoint":                        i.Issuer() + "/token",
+		"jwks_uri":                              i.Issuer() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// jwks serves the current public key
+func (i *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	i.mutex.Lock()
+	jwk, err := jose.NewJSONWebKey(i.KeyID, &i.Key.PublicKey)
+	i.mutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk}})
+}
+
+// authorize approves the request and redirects straight back with a code
+func (i *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != i.ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	code := uuid.New().String()
+	i.mutex.Lock()
+	i.codes[code] = pendingCode{
+		clientID:    q.Get("client_id"),
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+	}
+	i.mutex.Unlock()
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", q.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token after checking the client and the PKCE verifier
+func (i *IdP) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "invalid_request")
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != i.ClientID || clientSecret != i.ClientSecret {
+		tokenError(w, "invalid_client")
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	code := r.PostForm.Get("code")
+	pending, ok := i.codes[code]
+	delete(i.codes, code) // codes are single use
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || pending.clientID != clientID || pending.redirectURI != r.PostForm.Get("redirect_uri") || base64.RawURLEncoding.EncodeToString(verifier[:]) != pending.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	now := time.Now()
+	claims := map[string]interface{}{}
+	for k, v := range i.Claims {
+		claims[k] = v
+	}
+	claims["iss"] = i.Issuer()
+	claims["sub"] = i.Subject
+	claims["aud"] = i.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(i.Lifetime).Unix()
+	if pending.nonce != "" {
+		claims["nonce"] = pending.nonce
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		tokenError(w, "server_error")
+		return
+	}
+	idToken, err := jose.Sign("RS256", i.KeyID, i.Key, payload)
+	if err != nil {
+		tokenError(w, "server_error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": uuid.New().String(),
+		"token_type":   "Bearer",
+		"expires_in":   int(i.Lifetime.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// tokenError writes an OAuth2 error response
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package peercred
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred reads SO_PEERCRED, which the kernel set when the peer connected
+func peerCred(conn *net.UnixConn) (Cred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return Cred{}, err
+	}
+	var ucred *syscall.Ucred
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return Cred{}, err
+	}
+	if sockErr != nil {
+		return Cred{}, sockErr
+	}
+	return Cred{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid}, nil
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package peercred
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+)
+
+// TestSocket connects over a real socket and checks the kernel's credentials come through
+func TestSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercred")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authdoor.sock")
+	listener, err := Listen(path, 0600)
+	require.NoError(t, err)
+
+	p, err := New(Config{Allow: Rule{UIDs: []uint32{uint32(os.Getuid())}}})
+	require.NoError(t, err)
+	server := &http.Server{
+		ConnContext: ConnContext,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ret, err := p.Check(w, r)
+			require.NoError(t, err)
+			if ret.Auth == authdoor.AuthGranted {
+				w.Write(ret.Info.Info)
+			}
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://authdoor/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(body, &info))
+	require.Equal(t, uint32(os.Getuid()), info.UID)
+	require.Equal(t, uint32(os.Getgid()), info.GID)
+	require.Equal(t, int32(os.Getpid()), info.PID)
+}
@@ -0,0 +1,264 @@
+/*
+Package peercred is an AuthFunc for local tools talking to authdoor over a unix domain socket. The kernel tells us the uid, gid and pid of the process on the other end of each connection (SO_PEERCRED), so local admin access can be granted by user or group without passwords. It only works on linux.
+*/
+package peercred
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+var (
+	// ErrUnsupported is returned on platforms where we can't read peer credentials
+	ErrUnsupported = errors.New("peer credentials unsupported on this platform")
+	// ErrNotSocket is returned by Listen when something other than a socket is at the path
+	ErrNotSocket = errors.New("path exists and isn't a socket")
+)
+
+// Cred is who's on the other end of a connection, as the kernel saw it when they connected
+type Cred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// contextKey is unexported so only this package can set the cred in a context
+type contextKey struct{}
+
+// ConnContext is for http.Server's ConnContext. It reads the peer credentials of unix socket connections once, when they're accepted, and leaves other connections alone.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := peerCred(conn)
+	if err != nil {
+		defaultLogger.Error("couldn't read peer credentials: " + err.Error())
+		return ctx
+	}
+	return NewContext(ctx, cred)
+}
+
+// NewContext returns a copy of ctx carrying cred
+func NewContext(ctx context.Context, cred Cred) context.Context {
+	return context.WithValue(ctx, contextKey{}, cred)
+}
+
+// FromContext returns the Cred stored by ConnContext, if there is one
+func FromContext(ctx context.Context) (Cred, bool) {
+	cred, ok := ctx.Value(contextKey{}).(Cred)
+	return cred, ok
+}
+
+// Listen listens on a unix socket at path with mode, removing a stale socket left there. Serve it with an http.Server whose ConnContext is ConnContext.
+func Listen(path string, mode os.FileMode) (net.Listener, error) {
+	if stat, err := os.Lstat(path); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Wrap(ErrNotSocket, path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Rule matches a peer whose uid or gid is listed. Users and Groups are names looked up by New.
+type Rule struct {
+	UIDs   []uint32
+	GIDs   []uint32
+	Users  []string
+	Groups []string
+}
+
+// Config lists the rules. A peer matching Deny is answered with 403, one matching Allow is granted, and anyone else fails quietly so later instances decide.
+type Config struct {
+	Allow Rule
+	Deny  Rule
+	// SupplementaryGroups also matches GIDs against the groups the peer's user is a member of, not just its primary gid
+	SupplementaryGroups bool
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	UID  uint32 `json:"uid"`
+	GID  uint32 `json:"gid"`
+	PID  int32  `json:"pid"`
+	User string `json:"user,omitempty"`
+}
+
+// ids are a rule with names resolved
+type ids struct {
+	uids map[uint32]bool
+	gids map[uint32]bool
+}
+
+// PeerCred supplies an authfunc receiver and stores information to be used by that receiver
+type PeerCred struct {
+	config Config
+	allow  ids
+	deny   ids
+	// groupIDs returns the supplementary groups of a uid, swapped out in tests
+	groupIDs func(uid uint32) ([]uint32, error)
+}
+
+// parseID parses a numeric id from os/user
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// resolve looks up the names in a rule
+func resolve(rule Rule) (ids, error) {
+	ret := ids{uids: make(map[uint32]bool), gids: make(map[uint32]bool)}
+	for _, uid := range rule.UIDs {
+		ret.uids[uid] = true
+	}
+	for _, gid := range rule.GIDs {
+		ret.gids[gid] = true
+	}
+	for _, name := range rule.Users {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return ret, err
+		}
+		uid, err := parseID(u.Uid)
+		if err != nil {
+			return ret, errors.Wrap(err, name)
+		}
+		ret.uids[uid] = true
+	}
+	for _, name := range rule.Groups {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return ret, err
+		}
+		gid, err := parseID(g.Gid)
+		if err != nil {
+			return ret, errors.Wrap(err, name)
+		}
+		ret.gids[gid] = true
+	}
+	return ret, nil
+}
+
+// groupIDs looks up the groups a uid is a member of
+func groupIDs(uid uint32) ([]uint32, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, err
+	}
+	names, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]uint32, 0, len(names))
+	for _, name := range names {
+		if gid, err := parseID(name); err == nil {
+			ret = append(ret, gid)
+		}
+	}
+	return ret, nil
+}
+
+// New resolves the rules and returns a PeerCred ready to be used as an AuthFunc
+func New(config Config) (*PeerCred, error) {
+	allow, err := resolve(config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := resolve(config.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerCred{config: config, allow: allow, deny: deny, groupIDs: groupIDs}, nil
+}
+
+// match reports whether the peer's uid or any of its gids is in rule
+func (rule ids) match(cred Cred, gids []uint32) bool {
+	if rule.uids[cred.UID] || rule.gids[cred.GID] {
+		return true
+	}
+	for _, gid := range gids {
+		if rule.gids[gid] {
+			return true
+		}
+	}
+	return false
+}
+
+// Check is an authfunc. Requests that didn't come over a unix socket served with ConnContext fail quietly, as do peers matching no rule.
+func (p *PeerCred) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	cred, ok := FromContext(r.Context())
+	if !ok {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	uid := strconv.FormatUint(uint64(cred.UID), 10)
+	var gids []uint32
+	if p.config.SupplementaryGroups && (len(p.allow.gids) != 0 || len(p.deny.gids) != 0) {
+		var err error
+		if gids, err = p.groupIDs(cred.UID); err != nil {
+			// without its groups we can't tell whether a deny rule applies, so it's denied
+			if len(p.deny.gids) != 0 {
+				defaultLogger.Error("peercred denied uid " + uid + " whose groups couldn't be looked up: " + err.Error())
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+			}
+			// with only allow rules it just has no supplementary groups
+			defaultLogger.Info("couldn't look up groups of uid " + uid + ": " + err.Error())
+		}
+	}
+	if p.deny.match(cred, gids) {
+		defaultLogger.Info("peercred denied uid " + uid)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	if !p.allow.match(cred, gids) {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	info := Info{UID: cred.UID, GID: cred.GID, PID: cred.PID}
+	if u, err := user.LookupId(uid); err == nil {
+		info.User = u.Username
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: infoJSON},
+	}, nil
+}
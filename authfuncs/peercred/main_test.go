@@ -0,0 +1,154 @@
+package peercred
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/peercred/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// check runs the authfunc as if cred had connected
+func check(t *testing.T, p *PeerCred, cred *Cred) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	if cred != nil {
+		r = r.WithContext(NewContext(context.Background(), *cred))
+	}
+	ret, err := p.Check(w, r)
+	require.NoError(t, err)
+	return ret, w
+}
+
+// TestCheck checks the rules
+func TestCheck(t *testing.T) {
+	p, err := New(Config{
+		Allow:               Rule{UIDs: []uint32{1000}, GIDs: []uint32{10}},
+		Deny:                Rule{UIDs: []uint32{1001}, GIDs: []uint32{99}},
+		SupplementaryGroups: true,
+	})
+	require.NoError(t, err)
+	groups := map[uint32][]uint32{1000: {}, 1001: {}, 1002: {10}, 1003: {99}, 2000: {}}
+	p.groupIDs = func(uid uint32) ([]uint32, error) {
+		if gids, ok := groups[uid]; ok {
+			return gids, nil
+		}
+		return nil, errors.New("no such user")
+	}
+
+	ret, _ := check(t, p, nil)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	ret, _ = check(t, p, &Cred{UID: 1000, GID: 1000, PID: 42})
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, Info{UID: 1000, GID: 1000, PID: 42, User: info.User}, info)
+
+	granted := []Cred{{UID: 2000, GID: 10}, {UID: 1002, GID: 1002}}
+	for _, cred := range granted {
+		ret, _ = check(t, p, &cred)
+		require.Equal(t, authdoor.AuthGranted, ret.Auth, cred)
+	}
+	// deny wins, whether it's by uid, primary group or supplementary group
+	denied := []Cred{{UID: 1001, GID: 10}, {UID: 1000, GID: 99}, {UID: 1003, GID: 10}}
+	for _, cred := range denied {
+		ret, w := check(t, p, &cred)
+		require.Equal(t, authdoor.AuthDenied, ret.Auth, cred)
+		require.Equal(t, authdoor.Answered, ret.Resp, cred)
+		require.Equal(t, http.StatusForbidden, w.Code, cred)
+	}
+	ret, _ = check(t, p, &Cred{UID: 2000, GID: 2000})
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	// a uid whose groups can't be looked up might be in a denied one, so it's denied
+	ret, w := check(t, p, &Cred{UID: 3000, GID: 10})
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	// unless there are no denied groups, then it just has no supplementary groups
+	allowOnly, err := New(Config{Allow: Rule{GIDs: []uint32{10}}, Deny: Rule{UIDs: []uint32{1001}}, SupplementaryGroups: true})
+	require.NoError(t, err)
+	allowOnly.groupIDs = p.groupIDs
+	ret, _ = check(t, allowOnly, &Cred{UID: 3000, GID: 10})
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	// supplementary groups are only looked up when asked for
+	p.config.SupplementaryGroups = false
+	ret, _ = check(t, p, &Cred{UID: 1002, GID: 1002})
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+}
+
+// TestNew checks names are resolved
+func TestNew(t *testing.T) {
+	p, err := New(Config{Allow: Rule{Users: []string{"root"}, Groups: []string{"root"}}})
+	if err != nil {
+		t.Skip("no root user to look up: " + err.Error())
+	}
+	require.True(t, p.allow.uids[0])
+	require.True(t, p.allow.gids[0])
+	_, err = New(Config{Deny: Rule{Users: []string{"no-such-user-here"}}})
+	require.Error(t, err)
+	_, err = New(Config{Allow: Rule{Groups: []string{"no-such-group-here"}}})
+	require.Error(t, err)
+}
+
+// TestListen checks stale sockets are replaced and other files aren't
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercred")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authdoor.sock")
+
+	listener, err := Listen(path, 0660)
+	require.NoError(t, err)
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0660), stat.Mode().Perm())
+	// a crashed process leaves its socket behind
+	listener.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	require.NoError(t, listener.Close())
+	listener, err = Listen(path, 0600)
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	_, err = Listen(file, 0600)
+	require.Equal(t, ErrNotSocket, errors.Cause(err))
+}
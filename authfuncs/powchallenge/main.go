@@ -0,0 +1,266 @@
+/*
+Package powchallenge is an AuthFunc that makes browsers do a little proof of work before they get through, to slow down scrapers. Without a clearance cookie a request gets a page whose JavaScript finds a number that makes a SHA-256 hash start with enough zero bits. The solution is checked here and a short lived signed clearance cookie is set.
+
+It never grants: cleared requests fail quietly so the instances after it decide, which is why it goes before expensive AuthFuncs in a list.
+*/
+package powchallenge
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/redirect"
+	"github.com/ayjayt/authdoor/authfuncs/internal/seal"
+	"github.com/ayjayt/authdoor/authfuncs/internal/session"
+	"github.com/ayjayt/authdoor/authfuncs/ipfilter"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// ErrDifficulty is returned for difficulties outside 1 to MaxDifficulty
+var ErrDifficulty = errors.New("difficulty out of range")
+
+// MaxDifficulty is the most zero bits that can be asked for. Every bit doubles the work, and 24 already takes a phone several seconds.
+const MaxDifficulty = 32
+
+// Config sets how hard the challenge is and how long clearance lasts
+type Config struct {
+	// Key signs challenges and clearance cookies, nil makes a random one so clearance only lasts until a restart. Share it between replicas.
+	Key []byte
+	// Difficulty is how many leading zero bits the hash needs, defaults to 16. SetDifficulty changes it while running.
+	Difficulty int
+	// ChallengeExpiry is how long a challenge can be solved for, defaults to 5 minutes
+	ChallengeExpiry time.Duration
+	// ClearanceLength is how long a solved challenge lets requests through, defaults to 1 hour
+	ClearanceLength time.Duration
+	// DisableIPBinding lets clearance be used from any address. By default it only works from the address that solved the challenge, so one solution can't be shared by a fleet.
+	DisableIPBinding bool
+	// Resolver finds the client address, nil uses RemoteAddr
+	Resolver *ipfilter.Resolver
+}
+
+// challenge is sealed into the page
+type challenge struct {
+	ID         string `json:"id"`
+	IP         string `json:"ip,omitempty"`
+	Difficulty int    `json:"difficulty"`
+	Next       string `json:"next"`
+}
+
+// clearance is sealed into the cookie
+type clearance struct {
+	IP string `json:"ip,omitempty"`
+}
+
+// PoWChallenge supplies an authfunc receiver and stores information to be used by that receiver
+type PoWChallenge struct {
+	config     Config
+	difficulty int32
+	// challenges and clearances are sealed under different keys so a challenge can't pass for clearance
+	challenges *seal.Sealer
+	clearances *seal.Sealer
+	cookieName string
+	// solved are challenge ids already used, kept until the challenges would have expired anyway
+	solved *session.Map
+	now    func() time.Time
+}
+
+// New returns a PoWChallenge ready to be used as an AuthFunc
+func New(config Config) (*PoWChallenge, error) {
+	if config.Difficulty == 0 {
+		config.Difficulty = 16
+	}
+	if config.Difficulty < 1 || config.Difficulty > MaxDifficulty {
+		return nil, ErrDifficulty
+	}
+	if config.ChallengeExpiry == 0 {
+		config.ChallengeExpiry = 5 * time.Minute
+	}
+	if config.ClearanceLength == 0 {
+		config.ClearanceLength = time.Hour
+	}
+	if config.Resolver == nil {
+		resolver, err := ipfilter.NewResolver(nil, "")
+		if err != nil {
+			return nil, err
+		}
+		config.Resolver = resolver
+	}
+	// the cookie is named after the key, so replicas sharing a key share cookies and instances with different keys don't trip over each other
+	name := uuid.New().String()
+	if config.Key != nil {
+		sum := sha256.Sum256(config.Key)
+		name = hex.EncodeToString(sum[:8])
+	}
+	key := config.Key
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &PoWChallenge{
+		config:     config,
+		difficulty: int32(config.Difficulty),
+		challenges: seal.New(derive(key, "challenge")),
+		clearances: seal.New(derive(key, "clearance")),
+		cookieName: "powchallenge-" + name,
+		solved:     session.New(),
+		now:        time.Now,
+	}, nil
+}
+
+// derive returns the key for one use of Key
+func derive(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// SetDifficulty changes the difficulty of new challenges, to turn it up while under attack. Pages already handed out keep theirs.
+func (p *PoWChallenge) SetDifficulty(difficulty int) error {
+	if difficulty < 1 || difficulty > MaxDifficulty {
+		return ErrDifficulty
+	}
+	atomic.StoreInt32(&p.difficulty, int32(difficulty))
+	defaultLogger.Info("powchallenge difficulty set to " + strconv.Itoa(difficulty))
+	return nil
+}
+
+// Difficulty returns the difficulty of new challenges
+func (p *PoWChallenge) Difficulty() int {
+	return int(atomic.LoadInt32(&p.difficulty))
+}
+
+// clientIP is the address challenges and clearance are bound to, empty if binding is off
+func (p *PoWChallenge) clientIP(r *http.Request) string {
+	if p.config.DisableIPBinding {
+		return ""
+	}
+	if ip := p.config.Resolver.ClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// leadingZeros counts the leading zero bits of sha256(token + ":" + solution)
+func leadingZeros(token, solution string) int {
+	sum := sha256.Sum256([]byte(token + ":" + solution))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// cleared reports whether the request has valid clearance
+func (p *PoWChallenge) cleared(r *http.Request) bool {
+	cookie, err := r.Cookie(p.cookieName)
+	if err != nil {
+		return false
+	}
+	c := clearance{}
+	if err := p.clearances.Open(cookie.Value, &c); err != nil {
+		return false
+	}
+	return c.IP == p.clientIP(r)
+}
+
+// answered is returned for every page. Clearance lets the request we redirect to through, letting this one through would hand the POST to the base handler.
+var answered = authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}
+
+// Check is an authfunc. Cleared requests fail quietly so later instances decide, solutions are checked, and everyone else gets a challenge.
+func (p *PoWChallenge) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if p.cleared(r) {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	if r.Method == "POST" && r.PostFormValue("powchallenge-reference") == p.cookieName {
+		return p.solve(w, r)
+	}
+	return p.challenge(w, r, http.StatusForbidden)
+}
+
+// challenge renders a new challenge for the request
+func (p *PoWChallenge) challenge(w http.ResponseWriter, r *http.Request, status int) (authdoor.AuthFuncReturn, error) {
+	c := challenge{ID: uuid.New().String(), IP: p.clientIP(r), Difficulty: p.Difficulty(), Next: r.URL.RequestURI()}
+	token, err := p.challenges.Seal(c, p.now().Add(p.config.ChallengeExpiry))
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := challengePage.Execute(w, pageData{Reference: p.cookieName, Challenge: token, Difficulty: c.Difficulty}); err != nil {
+		return answered, err
+	}
+	return answered, nil
+}
+
+// solve checks a solution, sets clearance and sends the browser back where it was going. A wrong or stale solution just gets a new challenge.
+func (p *PoWChallenge) solve(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	token, solution := r.PostFormValue("powchallenge-challenge"), r.PostFormValue("powchallenge-solution")
+	c := challenge{}
+	if err := p.challenges.Open(token, &c); err != nil || c.IP != p.clientIP(r) {
+		return p.challenge(w, r, http.StatusForbidden)
+	}
+	if len(solution) == 0 || len(solution) > 20 || strings.Trim(solution, "0123456789") != "" || leadingZeros(token, solution) < c.Difficulty {
+		defaultLogger.Info("powchallenge got a wrong solution from " + r.RemoteAddr)
+		return p.challenge(w, r, http.StatusForbidden)
+	}
+	if err := p.use(c.ID); err != nil {
+		defaultLogger.Info("powchallenge refused " + r.RemoteAddr + ": " + err.Error())
+		return p.challenge(w, r, http.StatusForbidden)
+	}
+	cookie, err := p.clearances.Seal(clearance{IP: c.IP}, p.now().Add(p.config.ClearanceLength))
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.cookieName,
+		Value:    cookie,
+		Path:     "/",
+		MaxAge:   int(p.config.ClearanceLength / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, redirect.Local(c.Next), http.StatusSeeOther)
+	return answered, nil
+}
+
+// use marks a challenge solved, so one solution can't be traded in for clearance over and over
+func (p *PoWChallenge) use(id string) error {
+	now := p.now()
+	if !p.solved.Add(id, true, now.Add(p.config.ChallengeExpiry), now) {
+		return errors.New("challenge already solved")
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package powchallenge
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/powchallenge/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+var challengeField = regexp.MustCompile(`name="powchallenge-challenge" type="hidden" value="([^"]*)"`)
+
+// get requests target, with a cookie if there is one
+func get(t *testing.T, p *PoWChallenge, target string, cookie *http.Cookie) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", target, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	ret, err := p.Check(w, r)
+	require.NoError(t, err)
+	return ret, w
+}
+
+// post submits a solution from the page's address
+func post(t *testing.T, p *PoWChallenge, token, solution, remoteAddr string) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	form := url.Values{"powchallenge-reference": {p.cookieName}, "powchallenge-challenge": {token}, "powchallenge-solution": {solution}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/preview/1", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if remoteAddr != "" {
+		r.RemoteAddr = remoteAddr
+	}
+	ret, err := p.Check(w, r)
+	require.NoError(t, err)
+	return ret, w
+}
+
+// solve does what the page's JavaScript does
+func solve(token string, difficulty int) string {
+	for n := 0; ; n++ {
+		if leadingZeros(token, strconv.Itoa(n)) >= difficulty {
+			return strconv.Itoa(n)
+		}
+	}
+}
+
+// challengeToken pulls the challenge out of a page
+func challengeToken(t *testing.T, w *httptest.ResponseRecorder) string {
+	match := challengeField.FindStringSubmatch(w.Body.String())
+	require.NotNil(t, match, w.Body.String())
+	return html.UnescapeString(match[1])
+}
+
+// TestChallenge solves a challenge and uses the clearance
+func TestChallenge(t *testing.T) {
+	p, err := New(Config{Difficulty: 8})
+	require.NoError(t, err)
+
+	ret, w := get(t, p, "/preview/1?page=2", nil)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.True(t, regexp.MustCompile(`difficulty = \s*8\s*;`).MatchString(w.Body.String()))
+	token := challengeToken(t, w)
+	solution := solve(token, 8)
+
+	ret, w = post(t, p, token, solution, "")
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/preview/1?page=2", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.True(t, cookies[0].HttpOnly)
+
+	// cleared requests are left to later instances
+	ret, _ = get(t, p, "/preview/2", cookies[0])
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	// a solution is only good once
+	ret, w = post(t, p, token, solution, "")
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Empty(t, w.Result().Cookies())
+
+	// clearance is bound to the address that solved it
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/preview/2", nil)
+	r.RemoteAddr = "198.51.100.7:1234"
+	r.AddCookie(cookies[0])
+	ret, err = p.Check(w, r)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	// stale challenges can't be solved
+	p.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	_, w = get(t, p, "/", nil)
+	token = challengeToken(t, w)
+	p.now = time.Now
+	_, w = post(t, p, token, solve(token, 8), "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	// and clearance stops working after ClearanceLength
+	_, w = get(t, p, "/", nil)
+	token = challengeToken(t, w)
+	p.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	_, w = post(t, p, token, solve(token, 8), "")
+	p.now = time.Now
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	_, w = get(t, p, "/", w.Result().Cookies()[0])
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// TestWrongSolutions checks bad submissions just get a new challenge
+func TestWrongSolutions(t *testing.T) {
+	p, err := New(Config{Difficulty: 12})
+	require.NoError(t, err)
+	_, w := get(t, p, "/", nil)
+	token := challengeToken(t, w)
+	solution := solve(token, 12)
+	wrong := 0
+	for leadingZeros(token, strconv.Itoa(wrong)) >= 12 {
+		wrong++
+	}
+
+	other, err := New(Config{Difficulty: 12})
+	require.NoError(t, err)
+	_, w = get(t, other, "/", nil)
+	otherToken := challengeToken(t, w)
+
+	for _, tc := range []struct{ token, solution, remoteAddr string }{
+		{token, strconv.Itoa(wrong), ""},
+		{token, "", ""},
+		{token, " " + solution, ""},
+		{token, "-" + solution, ""},
+		{otherToken, solve(otherToken, 12), ""},
+		{token + "x", solution, ""},
+		{token, solution, "198.51.100.7:1234"},
+	} {
+		ret, w := post(t, p, tc.token, tc.solution, tc.remoteAddr)
+		require.Equal(t, authdoor.AuthFailed, ret.Auth, tc)
+		require.Equal(t, authdoor.Answered, ret.Resp, tc)
+		require.Equal(t, http.StatusForbidden, w.Code, tc)
+		require.Empty(t, w.Result().Cookies(), tc)
+	}
+	ret, w := post(t, p, token, solution, "")
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+}
+
+// TestChallengeIsNotClearance checks the page's challenge token can't be used as the clearance cookie
+func TestChallengeIsNotClearance(t *testing.T) {
+	p, err := New(Config{Difficulty: 8, Key: []byte("0123456789abcdef")})
+	require.NoError(t, err)
+	_, w := get(t, p, "/", nil)
+	token := challengeToken(t, w)
+
+	ret, w := get(t, p, "/", &http.Cookie{Name: p.cookieName, Value: token})
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// TestDifficulty checks difficulty can be changed and challenges keep theirs
+func TestDifficulty(t *testing.T) {
+	_, err := New(Config{Difficulty: MaxDifficulty + 1})
+	require.Equal(t, ErrDifficulty, err)
+	p, err := New(Config{Difficulty: 4, DisableIPBinding: true, Key: []byte("0123456789abcdef")})
+	require.NoError(t, err)
+	_, w := get(t, p, "/", nil)
+	easy := challengeToken(t, w)
+
+	require.Equal(t, ErrDifficulty, p.SetDifficulty(0))
+	require.NoError(t, p.SetDifficulty(10))
+	require.Equal(t, 10, p.Difficulty())
+	_, w = get(t, p, "/", nil)
+	require.True(t, regexp.MustCompile(`difficulty = \s*10\s*;`).MatchString(w.Body.String()))
+	hard := challengeToken(t, w)
+	easySolution := solve(hard, 4)
+	if leadingZeros(hard, easySolution) < 10 {
+		_, w = post(t, p, hard, easySolution, "")
+		require.Equal(t, http.StatusForbidden, w.Code)
+	}
+
+	// without IP binding clearance works from anywhere, and replicas with the same key share it
+	_, w = post(t, p, easy, solve(easy, 4), "198.51.100.7:1234")
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	cookie := w.Result().Cookies()[0]
+	replica, err := New(Config{DisableIPBinding: true, Key: []byte("0123456789abcdef")})
+	require.NoError(t, err)
+	ret, _ := get(t, replica, "/", cookie)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+}
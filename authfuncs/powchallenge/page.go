@@ -0,0 +1,98 @@
+package powchallenge
+
+import (
+	"html/template"
+)
+
+// pageData fills the challenge page
+type pageData struct {
+	Reference  string
+	Challenge  string
+	Difficulty int
+}
+
+// challengePage solves the challenge with a small SHA-256 in plain JavaScript. crypto.subtle isn't used since it's missing on plain http and its promises make every hash slow.
+var challengePage = template.Must(template.New("challenge").Parse(`<html><body>
+	<form id="powchallenge" method="POST">
+		<p id="powchallenge-status">Checking your browser, this takes a moment...</p>
+		<noscript><p>Please turn on JavaScript to continue.</p></noscript>
+		<input name="powchallenge-reference" type="hidden" value="{{.Reference}}" />
+		<input name="powchallenge-challenge" type="hidden" value="{{.Challenge}}" />
+		<input name="powchallenge-solution" type="hidden" value="" />
+	</form>
+	<script>
+	(function () {
+		var challenge = {{.Challenge}}, difficulty = {{.Difficulty}};
+		var K = [
+			0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+			0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+			0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+			0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+			0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+			0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+			0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+			0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+		];
+		var W = new Array(64);
+		// sha256 of an ASCII string, as eight 32 bit words
+		function sha256(s) {
+			var bytes = [], i, j;
+			for (i = 0; i < s.length; i++) {
+				bytes.push(s.charCodeAt(i) & 0xff);
+			}
+			var length = bytes.length * 8;
+			bytes.push(0x80);
+			while (bytes.length % 64 != 56) {
+				bytes.push(0);
+			}
+			bytes.push(0, 0, 0, 0, length >>> 24 & 0xff, length >>> 16 & 0xff, length >>> 8 & 0xff, length & 0xff);
+			var H = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+			for (j = 0; j < bytes.length; j += 64) {
+				for (i = 0; i < 16; i++) {
+					W[i] = bytes[j + 4 * i] << 24 | bytes[j + 4 * i + 1] << 16 | bytes[j + 4 * i + 2] << 8 | bytes[j + 4 * i + 3];
+				}
+				for (i = 16; i < 64; i++) {
+					var x = W[i - 15], y = W[i - 2];
+					var s0 = (x >>> 7 | x << 25) ^ (x >>> 18 | x << 14) ^ x >>> 3;
+					var s1 = (y >>> 17 | y << 15) ^ (y >>> 19 | y << 13) ^ y >>> 10;
+					W[i] = W[i - 16] + s0 + W[i - 7] + s1 | 0;
+				}
+				var a = H[0], b = H[1], c = H[2], d = H[3], e = H[4], f = H[5], g = H[6], h = H[7];
+				for (i = 0; i < 64; i++) {
+					var t1 = h + ((e >>> 6 | e << 26) ^ (e >>> 11 | e << 21) ^ (e >>> 25 | e << 7)) + (e & f ^ ~e & g) + K[i] + W[i] | 0;
+					var t2 = ((a >>> 2 | a << 30) ^ (a >>> 13 | a << 19) ^ (a >>> 22 | a << 10)) + (a & b ^ a & c ^ b & c) | 0;
+					h = g; g = f; f = e; e = d + t1 | 0; d = c; c = b; b = a; a = t1 + t2 | 0;
+				}
+				H[0] = H[0] + a | 0; H[1] = H[1] + b | 0; H[2] = H[2] + c | 0; H[3] = H[3] + d | 0;
+				H[4] = H[4] + e | 0; H[5] = H[5] + f | 0; H[6] = H[6] + g | 0; H[7] = H[7] + h | 0;
+			}
+			return H;
+		}
+		// leadingZeros counts the zero bits at the start of a hash
+		function leadingZeros(H) {
+			var zeros = 0;
+			for (var i = 0; i < H.length; i++) {
+				if (H[i] != 0) {
+					return zeros + Math.clz32(H[i]);
+				}
+				zeros += 32;
+			}
+			return zeros;
+		}
+		var form = document.getElementById("powchallenge"), n = 0;
+		// work in slices so the page stays responsive
+		function work() {
+			for (var stop = n + 5000; n < stop; n++) {
+				if (leadingZeros(sha256(challenge + ":" + n)) >= difficulty) {
+					form.elements["powchallenge-solution"].value = String(n);
+					form.submit();
+					return;
+				}
+			}
+			setTimeout(work, 0);
+		}
+		work();
+	})();
+	</script>
+</body></html>
+`))
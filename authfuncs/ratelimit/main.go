@@ -0,0 +1,345 @@
+/*
+Package ratelimit is an AuthFunc meant to run first in a list. It never grants: requests under the limit fail quietly and move on to the next instance, requests over it are answered with 429. Wrapping later instances with Observe lets it lock out keys that keep getting denied.
+*/
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/ipfilter"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// KeyFunc picks what a request is limited by. Returning false skips limiting for the request.
+type KeyFunc func(r *http.Request) (string, bool)
+
+// ByIP limits by client address. A nil resolver uses RemoteAddr, pass an ipfilter.Resolver to honor trusted proxies.
+func ByIP(resolver *ipfilter.Resolver) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		if resolver != nil {
+			if ip := resolver.ClientIP(r); ip != nil {
+				return ip.String(), true
+			}
+			return "", false
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr, r.RemoteAddr != ""
+		}
+		return host, true
+	}
+}
+
+// ByFormField limits by a form field, like a username, on requests that have it. The form is parsed the same way later instances will parse it, so they still see it.
+func ByFormField(field string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		if r.Method != "POST" {
+			return "", false
+		}
+		r.ParseMultipartForm(1 << 20)
+		value := r.FormValue(field)
+		return strings.ToLower(value), value != ""
+	}
+}
+
+// ByHeader limits by a request header
+func ByHeader(name string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		value := r.Header.Get(name)
+		return value, value != ""
+	}
+}
+
+// Combine joins keys, so ByIP and ByFormField together limit each user from each address. Every key must be present.
+func Combine(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			part, ok := key(r)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, "\x00"), true
+	}
+}
+
+// Config sets the limits
+type Config struct {
+	// Key defaults to ByIP(nil)
+	Key KeyFunc
+	// Rate is tokens per second added to each key's bucket, 0 turns off rate limiting and leaves only lockouts
+	Rate float64
+	// Burst is the bucket size, defaults to 1
+	Burst int
+	// LockoutThreshold is how many failures within FailureWindow lock a key out, 0 turns off lockouts
+	LockoutThreshold int
+	// FailureWindow defaults to 15 minutes
+	FailureWindow time.Duration
+	// LockoutBase is the first lockout, doubled for each one after until LockoutMax. Defaults to a minute and an hour.
+	LockoutBase time.Duration
+	LockoutMax  time.Duration
+	// IsFailure decides which outcomes observed by Observe count towards a lockout, defaults to AuthDenied
+	IsFailure func(authdoor.AuthFuncReturn) bool
+	// MaxKeys caps how many keys are remembered, defaults to 100000. A new key past it pushes out one that isn't locked out.
+	MaxKeys int
+}
+
+// entry is the state kept per key
+type entry struct {
+	tokens      float64
+	last        time.Time
+	failures    []time.Time
+	lockouts    uint
+	lockedUntil time.Time
+}
+
+// sweepBatch is how many entries each call looks at for ones to forget, so the map is swept a little at a time instead of all at once under the lock
+const sweepBatch = 8
+
+// Limiter supplies an authfunc receiver and stores information to be used by that receiver
+type Limiter struct {
+	config  Config
+	mutex   *sync.Mutex
+	entries map[string]*entry
+	now     func() time.Time
+}
+
+// New returns a Limiter ready to be used as an AuthFunc
+func New(config Config) *Limiter {
+	if config.Key == nil {
+		config.Key = ByIP(nil)
+	}
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	if config.FailureWindow == 0 {
+		config.FailureWindow = 15 * time.Minute
+	}
+	if config.LockoutBase == 0 {
+		config.LockoutBase = time.Minute
+	}
+	if config.LockoutMax == 0 {
+		config.LockoutMax = time.Hour
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = func(ret authdoor.AuthFuncReturn) bool {
+			return ret.Auth == authdoor.AuthDenied
+		}
+	}
+	if config.MaxKeys == 0 {
+		config.MaxKeys = 100000
+	}
+	return &Limiter{
+		config:  config,
+		mutex:   new(sync.Mutex),
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+// get returns the entry for key, creating it with a full bucket. At MaxKeys a key that isn't locked out is forgotten to make room, and if they all are the new key isn't remembered. The caller holds the lock.
+func (l *Limiter) get(key string, now time.Time) *entry {
+	e, ok := l.entries[key]
+	if ok {
+		return e
+	}
+	e = &entry{tokens: float64(l.config.Burst), last: now}
+	if len(l.entries) >= l.config.MaxKeys && !l.evict(now) {
+		defaultLogger.Error("ratelimit has MaxKeys keys locked out, not limiting a new one")
+		return e
+	}
+	l.entries[key] = e
+	return e
+}
+
+// evict forgets one key that isn't locked out, preferring one that would be swept anyway. The caller holds the lock.
+func (l *Limiter) evict(now time.Time) bool {
+	victim, checked := "", 0
+	for key, e := range l.entries {
+		if checked == 64 {
+			break
+		}
+		checked++
+		if l.forgettable(e, now) {
+			victim = key
+			break
+		}
+		if victim == "" && !now.Before(e.lockedUntil) {
+			victim = key
+		}
+	}
+	if victim == "" {
+		return false
+	}
+	delete(l.entries, victim)
+	return true
+}
+
+// forgettable reports whether forgetting e changes nothing: its bucket is full and it's not locked out. One with failures or lockouts is kept until they're too old to count.
+func (l *Limiter) forgettable(e *entry, now time.Time) bool {
+	if now.Before(e.lockedUntil) {
+		return false
+	}
+	if l.config.Rate != 0 && e.tokens+now.Sub(e.last).Seconds()*l.config.Rate < float64(l.config.Burst) {
+		return false
+	}
+	if e.lockouts == 0 {
+		for _, failure := range e.failures {
+			if now.Sub(failure) < l.config.FailureWindow {
+				return false
+			}
+		}
+		return true
+	}
+	idle := l.config.FailureWindow
+	if l.config.LockoutMax > idle {
+		idle = l.config.LockoutMax
+	}
+	return now.Sub(e.last) > idle && now.Sub(e.lockedUntil) > idle
+}
+
+// sweep forgets forgettable keys among a few of the entries. The caller holds the lock.
+func (l *Limiter) sweep(now time.Time) {
+	checked := 0
+	for key, e := range l.entries {
+		if checked == sweepBatch {
+			return
+		}
+		checked++
+		if l.forgettable(e, now) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// Allow takes a token for key. If it can't, it returns how long until it could.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.sweep(now)
+	if l.config.Rate == 0 {
+		// only lockouts to check, so keys that aren't locked out don't need an entry
+		if e, ok := l.entries[key]; ok && now.Before(e.lockedUntil) {
+			return false, e.lockedUntil.Sub(now)
+		}
+		return true, 0
+	}
+	e := l.get(key, now)
+	if now.Before(e.lockedUntil) {
+		return false, e.lockedUntil.Sub(now)
+	}
+	e.tokens = math.Min(float64(l.config.Burst), e.tokens+now.Sub(e.last).Seconds()*l.config.Rate)
+	e.last = now
+	if e.tokens < 1 {
+		return false, time.Duration((1 - e.tokens) / l.config.Rate * float64(time.Second))
+	}
+	e.tokens--
+	return true, 0
+}
+
+// Failure records a failed attempt for key and locks it out once there have been LockoutThreshold within FailureWindow
+func (l *Limiter) Failure(key string) {
+	if l.config.LockoutThreshold == 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.sweep(now)
+	e := l.get(key, now)
+	recent := e.failures[:0]
+	for _, failure := range e.failures {
+		if now.Sub(failure) < l.config.FailureWindow {
+			recent = append(recent, failure)
+		}
+	}
+	e.failures = append(recent, now)
+	if len(e.failures) < l.config.LockoutThreshold {
+		return
+	}
+	lockout := l.config.LockoutBase
+	for i := uint(0); i < e.lockouts && lockout < l.config.LockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > l.config.LockoutMax {
+		lockout = l.config.LockoutMax
+	}
+	e.lockouts++
+	e.lockedUntil = now.Add(lockout)
+	e.failures = e.failures[:0]
+	defaultLogger.Info("ratelimit locked out a key for " + lockout.String())
+}
+
+// Success forgets key's failures and lockout history
+func (l *Limiter) Success(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if e, ok := l.entries[key]; ok {
+		e.failures = nil
+		e.lockouts = 0
+	}
+}
+
+// tooMany answers 429 with Retry-After in whole seconds, rounded up
+func tooMany(w http.ResponseWriter, wait time.Duration) (authdoor.AuthFuncReturn, error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+}
+
+// Check is an authfunc. It answers 429 for keys over the limit or locked out, and otherwise fails quietly so the next instance runs.
+func (l *Limiter) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	key, ok := l.config.Key(r)
+	if !ok {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	if allowed, wait := l.Allow(key); !allowed {
+		defaultLogger.Info("ratelimit refused a request, retry in " + wait.String())
+		return tooMany(w, wait)
+	}
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+}
+
+// Observe wraps a later instance's authfunc so its failures count towards lockouts and its grants clear them. Use it on the instances in the same list as the Limiter.
+func (l *Limiter) Observe(fn authdoor.AuthFunc) authdoor.AuthFunc {
+	return func(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+		ret, err := fn(w, r)
+		if err != nil {
+			return ret, err
+		}
+		key, ok := l.config.Key(r)
+		if !ok {
+			return ret, err
+		}
+		if ret.Auth == authdoor.AuthGranted {
+			l.Success(key)
+		} else if l.config.IsFailure(ret) {
+			l.Failure(key)
+		}
+		return ret, err
+	}
+}
@@ -0,0 +1,202 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/ratelimit/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct {
+	now time.Time
+}
+
+// Now returns the fake time
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// call runs fn from remote
+func call(t *testing.T, fn authdoor.AuthFunc, req *http.Request) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	ret, err := fn(recorder, req)
+	require.NoError(t, err)
+	return ret, recorder
+}
+
+// fromIP makes a GET from ip
+func fromIP(ip string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = ip + ":1234"
+	return req
+}
+
+// TestTokenBucket checks burst, refill and Retry-After
+func TestTokenBucket(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := New(Config{Rate: 0.5, Burst: 2})
+	l.now = clock.Now
+
+	for i := 0; i < 2; i++ {
+		ret, _ := call(t, l.Check, fromIP("192.0.2.1"))
+		require.Equal(t, authdoor.AuthFailed, ret.Auth)
+		require.Equal(t, authdoor.Ignored, ret.Resp)
+	}
+	ret, recorder := call(t, l.Check, fromIP("192.0.2.1"))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Equal(t, "2", recorder.Header().Get("Retry-After"))
+
+	// other keys have their own bucket
+	ret, _ = call(t, l.Check, fromIP("192.0.2.2"))
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	clock.now = clock.now.Add(2 * time.Second)
+	ret, _ = call(t, l.Check, fromIP("192.0.2.1"))
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	ret, _ = call(t, l.Check, fromIP("192.0.2.1"))
+	require.Equal(t, authdoor.Answered, ret.Resp)
+}
+
+// TestLockout runs a limiter ahead of a password check in a list and checks lockouts escalate
+func TestLockout(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := New(Config{Key: ByFormField("user"), LockoutThreshold: 3, LockoutBase: time.Minute, LockoutMax: 3 * time.Minute})
+	l.now = clock.Now
+	password := func(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+		if r.FormValue("password") == "right" {
+			return authdoor.AuthFuncReturn{Auth: authdoor.AuthGranted, Resp: authdoor.Ignored}, nil
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	limiter, checker := authdoor.AuthFuncInstance{}, authdoor.AuthFuncInstance{}
+	limiter.Init("ratelimit", l.Check, -10, nil)
+	checker.Init("password", l.Observe(password), 0, nil)
+	list := authdoor.AuthFuncList{}
+	require.NoError(t, list.Init(checker, limiter))
+
+	login := func(user, pass string) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+		form := url.Values{"user": {user}, "password": {pass}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		ret, err := list.CallAll(recorder, req)
+		require.NoError(t, err)
+		return ret, recorder
+	}
+
+	lockFor := func(want time.Duration) {
+		for i := 0; i < 3; i++ {
+			_, recorder := login("aj", "wrong")
+			require.Equal(t, http.StatusUnauthorized, recorder.Code)
+		}
+		ret, recorder := login("AJ", "right")
+		require.Equal(t, authdoor.AuthDenied, ret.Auth)
+		require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		require.Equal(t, fmt.Sprint(int(want.Seconds())), recorder.Header().Get("Retry-After"))
+		clock.now = clock.now.Add(want)
+	}
+	lockFor(time.Minute)
+	lockFor(2 * time.Minute)
+	lockFor(3 * time.Minute) // capped
+
+	// another user isn't affected, and a success resets the escalation
+	ret, _ := login("bob", "right")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	ret, _ = login("aj", "right")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	lockFor(time.Minute)
+}
+
+// TestSweep makes sure idle keys are forgotten
+func TestSweep(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := New(Config{Rate: 1, Burst: 1, FailureWindow: time.Minute, LockoutMax: time.Minute})
+	l.now = clock.Now
+	call(t, l.Check, fromIP("192.0.2.1"))
+	require.Equal(t, 1, len(l.entries))
+	clock.now = clock.now.Add(5 * time.Minute)
+	call(t, l.Check, fromIP("192.0.2.2"))
+	require.Equal(t, 1, len(l.entries))
+
+	// a key without failures goes as soon as its bucket is full again, one with them stays until they're old
+	l = New(Config{Rate: 1, Burst: 1, LockoutThreshold: 5, FailureWindow: time.Minute, LockoutMax: time.Minute})
+	l.now = clock.Now
+	l.Failure("192.0.2.3")
+	call(t, l.Check, fromIP("192.0.2.4"))
+	require.Len(t, l.entries, 2)
+	require.Contains(t, l.entries, "192.0.2.3")
+	require.Contains(t, l.entries, "192.0.2.4")
+	clock.now = clock.now.Add(30 * time.Second)
+	l.Allow("192.0.2.5")
+	require.Contains(t, l.entries, "192.0.2.3")
+	require.NotContains(t, l.entries, "192.0.2.4")
+
+	// with only lockouts, keys that aren't locked out aren't kept at all
+	lockouts := New(Config{LockoutThreshold: 3})
+	for i := 0; i < 100; i++ {
+		call(t, lockouts.Check, fromIP("192.0.2."+strconv.Itoa(i)))
+	}
+	require.Empty(t, lockouts.entries)
+}
+
+// TestMaxKeys checks new keys past MaxKeys push out ones that aren't locked out
+func TestMaxKeys(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := New(Config{Rate: 0.001, Burst: 1, LockoutThreshold: 1, MaxKeys: 3})
+	l.now = clock.Now
+	l.Failure("locked")
+	for i := 0; i < 10; i++ {
+		ret, _ := call(t, l.Check, fromIP("192.0.2."+strconv.Itoa(i)))
+		require.Equal(t, authdoor.Ignored, ret.Resp)
+		if i > 0 {
+			require.Len(t, l.entries, 3)
+		}
+		require.Contains(t, l.entries, "locked")
+	}
+	allowed, _ := l.Allow("locked")
+	require.False(t, allowed)
+
+	// with every key locked out, new ones aren't remembered
+	l.Failure("locked too")
+	l.Failure("locked three")
+	require.Len(t, l.entries, 3)
+	l.Failure("locked four")
+	require.Len(t, l.entries, 3)
+	require.NotContains(t, l.entries, "locked four")
+}
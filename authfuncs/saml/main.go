@@ -0,0 +1,280 @@
+/*
+Package saml is a SAML 2.0 service provider AuthFunc. It sends users to the IdP with an AuthnRequest over the HTTP-Redirect binding, takes the IdP's signed response over the HTTP-POST binding at its assertion consumer service, and keeps an in-memory session so the IdP is only visited once per session. It also serves its own metadata to give to the IdP.
+*/
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/redirect"
+	"github.com/ayjayt/authdoor/authfuncs/internal/seal"
+	"github.com/ayjayt/authdoor/authfuncs/internal/session"
+	"github.com/ayjayt/authdoor/authfuncs/internal/xmldsig"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// maxResponseSize caps the POSTed response
+const maxResponseSize = 1 << 20
+
+// Config describes us and the IdP
+type Config struct {
+	// URL is the site's base URL, like https://docs.example.com. Our endpoints are built on it, not on the request's Host.
+	URL string
+	// Path is where the assertion consumer service (Path + "acs") and metadata (Path + "metadata") are served, defaults to /.saml/
+	Path string
+	// EntityID is our entity ID, defaults to the metadata URL
+	EntityID string
+	IdP      IdP
+	// Key and Certificate, if set, sign AuthnRequests and are published in the metadata
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+	// NameIDFormat is asked for in AuthnRequests, like urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress
+	NameIDFormat string
+	// Attributes maps attribute Names or FriendlyNames to the keys they're returned under. Nil returns every attribute under its Name.
+	Attributes map[string]string
+	// LoginTimeout is how long the IdP has to answer, defaults to 10 minutes
+	LoginTimeout time.Duration
+	// ClockSkew is tolerated when checking assertion times, defaults to a minute
+	ClockSkew time.Duration
+	// SessionLength defaults to 6 hours like basicpass, or less if the IdP says so
+	SessionLength time.Duration
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	NameID       string              `json:"name_id"`
+	NameIDFormat string              `json:"name_id_format,omitempty"`
+	Issuer       string              `json:"issuer"`
+	SessionIndex string              `json:"session_index,omitempty"`
+	Attributes   map[string][]string `json:"attributes"`
+}
+
+// relayState is sealed into the RelayState sent with an AuthnRequest, so nothing is kept for logins that are never finished
+type relayState struct {
+	ID       string `json:"i"`
+	ReturnTo string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+// SAML supplies an authfunc receiver and stores information to be used by that receiver
+type SAML struct {
+	config       Config
+	uuid         string
+	acsURL       string
+	acsPath      string
+	metadataPath string
+	sealer       *seal.Sealer
+	// sessions holds the Info JSON of finished logins by session id
+	sessions *session.Map
+	// answered are AuthnRequest IDs that got a response, kept until the requests time out anyway
+	answered *session.Map
+	// used are assertion IDs already consumed, kept until the assertions expire anyway
+	used *session.Map
+	now  func() time.Time
+}
+
+// New returns a SAML ready to be used as an AuthFunc
+func New(config Config) (*SAML, error) {
+	base, err := url.Parse(config.URL)
+	if err != nil || !base.IsAbs() {
+		return nil, errors.New("URL must be absolute")
+	}
+	if config.IdP.EntityID == "" || config.IdP.SSOURL == "" || len(config.IdP.Certificates) == 0 {
+		return nil, errors.New("IdP needs an EntityID, SSOURL and Certificates")
+	}
+	if (config.Key == nil) != (config.Certificate == nil) {
+		return nil, errors.New("Key and Certificate go together")
+	}
+	if config.Path == "" {
+		config.Path = "/.saml/"
+	}
+	if !strings.HasSuffix(config.Path, "/") {
+		config.Path += "/"
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		config.Path = "/" + config.Path
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	if config.EntityID == "" {
+		config.EntityID = base.String() + config.Path + "metadata"
+	}
+	if config.LoginTimeout == 0 {
+		config.LoginTimeout = 10 * time.Minute
+	}
+	if config.ClockSkew == 0 {
+		config.ClockSkew = time.Minute
+	}
+	if config.SessionLength == 0 {
+		config.SessionLength = 6 * time.Hour
+	}
+	return &SAML{
+		config:       config,
+		uuid:         uuid.New().String(),
+		acsURL:       base.String() + config.Path + "acs",
+		acsPath:      base.Path + config.Path + "acs",
+		metadataPath: base.Path + config.Path + "metadata",
+		sealer:       seal.New(nil),
+		sessions:     session.New(),
+		answered:     session.New(),
+		used:         session.New(),
+		now:          time.Now,
+	}, nil
+}
+
+// randomString returns n random bytes, hex encoded
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// cookieName is the name of the session cookie
+func (s *SAML) cookieName() string {
+	return "saml-" + s.uuid
+}
+
+// answered is returned with pages and redirects. The ACS grants on the request it redirects to, granting on the POST would hand it to the base handler.
+var answered = authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}
+
+// Check is an authfunc. It serves our metadata and ACS, grants requests with a session, and sends everyone else to the IdP.
+func (s *SAML) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	switch r.URL.Path {
+	case s.metadataPath:
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.Write(s.metadata())
+		return answered, nil
+	case s.acsPath:
+		return s.acs(w, r)
+	}
+	if cookie, err := r.Cookie(s.cookieName()); err == nil {
+		if info, ok := s.sessions.Get(cookie.Value, s.now()); ok {
+			return authdoor.AuthFuncReturn{
+				Auth: authdoor.AuthGranted,
+				Resp: authdoor.Ignored,
+				Info: authdoor.InstanceReturnInfo{Info: info.(json.RawMessage)},
+			}, nil
+		}
+	}
+	return s.login(w, r)
+}
+
+// login redirects to the IdP with a new AuthnRequest, its ID and where the user was going are sealed into the RelayState
+func (s *SAML) login(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	now := s.now()
+	expires := now.Add(s.config.LoginTimeout)
+	state := relayState{ID: "_" + randomString(20), ReturnTo: r.URL.RequestURI(), Expires: expires.Unix()}
+	sealed, err := s.sealer.Seal(state, expires)
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	target, err := s.redirectURL(state.ID, sealed, now)
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+	return answered, nil
+}
+
+// redirectURL builds the HTTP-Redirect binding URL for an AuthnRequest, signing it if we have a key
+func (s *SAML) redirectURL(id, relayState string, now time.Time) (string, error) {
+	request := xmldsig.NewElement("samlp", nsProtocol, "AuthnRequest").
+		SetAttr("ID", id).
+		SetAttr("Version", "2.0").
+		SetAttr("IssueInstant", now.UTC().Format(timeFormat)).
+		SetAttr("Destination", s.config.IdP.SSOURL).
+		SetAttr("AssertionConsumerServiceURL", s.acsURL).
+		SetAttr("ProtocolBinding", bindingPOST)
+	request.Namespaces["saml"] = nsAssertion
+	request.Add(element("saml", nsAssertion, "Issuer").Add(xmldsig.Text(s.config.EntityID)))
+	if s.config.NameIDFormat != "" {
+		request.Add(element("samlp", nsProtocol, "NameIDPolicy").SetAttr("Format", s.config.NameIDFormat).SetAttr("AllowCreate", "true"))
+	}
+	deflated := new(bytes.Buffer)
+	writer, err := flate.NewWriter(deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	writer.Write(request.Bytes())
+	writer.Close()
+	// the signature covers the query exactly as sent, so it's built by hand in the order the binding gives
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes())) +
+		"&RelayState=" + url.QueryEscape(relayState)
+	if s.config.Key != nil {
+		query += "&SigAlg=" + url.QueryEscape(xmldsig.AlgRSASHA256)
+		hashed := sha256.Sum256([]byte(query))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, s.config.Key, crypto.SHA256, hashed[:])
+		if err != nil {
+			return "", err
+		}
+		query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+	}
+	if strings.Contains(s.config.IdP.SSOURL, "?") {
+		return s.config.IdP.SSOURL + "&" + query, nil
+	}
+	return s.config.IdP.SSOURL + "?" + query, nil
+}
+
+// acs takes the IdP's response, starts a session and sends the user back where they were going
+func (s *SAML) acs(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return answered, nil
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxResponseSize)
+	info, expires, returnTo, err := s.consume(r.PostFormValue("SAMLResponse"), r.PostFormValue("RelayState"))
+	if err != nil {
+		defaultLogger.Info("SAML response rejected: " + err.Error())
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	sess := uuid.New().String()
+	s.sessions.Set(sess, json.RawMessage(infoJSON), expires, s.now())
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    sess,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	defaultLogger.Info("SAML logged in " + info.NameID)
+	http.Redirect(w, r, redirect.Local(returnTo), http.StatusSeeOther)
+	return answered, nil
+}
@@ -0,0 +1,360 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/xmldsig"
+	"github.com/ayjayt/authdoor/authfuncs/saml/samltest"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/saml/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// newSP returns an SP trusting a fresh IdP, configured through the IdP's metadata
+func newSP(t *testing.T, config Config) (*SAML, *samltest.IdP) {
+	idp := samltest.NewIdP()
+	metadata, err := ParseIdPMetadata(idp.Metadata())
+	require.NoError(t, err)
+	config.URL = "https://sp.example.com"
+	config.IdP = metadata
+	s, err := New(config)
+	require.NoError(t, err)
+	return s, idp
+}
+
+// begin starts a login for path and returns the AuthnRequest the IdP gets
+func begin(t *testing.T, s *SAML, idp *samltest.IdP, path string) *samltest.Request {
+	w := httptest.NewRecorder()
+	ret, err := s.Check(w, httptest.NewRequest("GET", path, nil))
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusFound, w.Code)
+	require.True(t, strings.HasPrefix(w.Header().Get("Location"), idp.SSOURL+"?"))
+	request, err := idp.ParseRequest(w.Header().Get("Location"))
+	require.NoError(t, err)
+	return request
+}
+
+// post sends a response to the ACS
+func post(t *testing.T, s *SAML, response, relayState string) (*httptest.ResponseRecorder, authdoor.AuthFuncReturn) {
+	form := url.Values{"SAMLResponse": {response}, "RelayState": {relayState}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/.saml/acs", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ret, err := s.Check(w, r)
+	require.NoError(t, err)
+	return w, ret
+}
+
+// TestMetadata checks both sides' metadata
+func TestMetadata(t *testing.T) {
+	idp := samltest.NewIdP()
+	metadata, err := ParseIdPMetadata(idp.Metadata())
+	require.NoError(t, err)
+	require.Equal(t, idp.EntityID, metadata.EntityID)
+	require.Equal(t, idp.SSOURL, metadata.SSOURL)
+	require.Len(t, metadata.Certificates, 1)
+	require.True(t, metadata.Certificates[0].Equal(idp.Certificate))
+	for _, bad := range []string{`<a/>`, `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"/>`, `<!DOCTYPE x><x/>`} {
+		_, err := ParseIdPMetadata([]byte(bad))
+		require.Equal(t, ErrMetadata, errors.Cause(err), bad)
+	}
+
+	s, _ := newSP(t, Config{NameIDFormat: "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"})
+	require.Equal(t, "https://sp.example.com/.saml/metadata", s.config.EntityID)
+	w := httptest.NewRecorder()
+	ret, err := s.Check(w, httptest.NewRequest("GET", "/.saml/metadata", nil))
+	require.NoError(t, err)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	root, err := xmldsig.Parse(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, s.config.EntityID, root.Attr("entityID"))
+	acs := root.Element(nsMetadata, "SPSSODescriptor").Element(nsMetadata, "AssertionConsumerService")
+	require.Equal(t, "https://sp.example.com/.saml/acs", acs.Attr("Location"))
+	require.Equal(t, bindingPOST, acs.Attr("Binding"))
+}
+
+// TestLogin goes through a whole login and checks the response can't be used twice
+func TestLogin(t *testing.T) {
+	s, idp := newSP(t, Config{Attributes: map[string]string{"urn:oid:0.9.2342.19200300.100.1.3": "mail", "groups": "groups"}})
+	request := begin(t, s, idp, "/private?x=1")
+	require.Equal(t, s.config.EntityID, request.Issuer)
+	require.Equal(t, "https://sp.example.com/.saml/acs", request.ACSURL)
+	require.Empty(t, request.SigAlg)
+
+	response := idp.Respond(request, "aj@example.com", map[string][]string{
+		"urn:oid:0.9.2342.19200300.100.1.3": {"aj@example.com"},
+		"groups":                            {"admins", "staff"},
+		"ignored":                           {"x"},
+	})
+	w, ret := post(t, s, response, request.RelayState)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/private?x=1", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	r := httptest.NewRequest("GET", "/private", nil)
+	r.AddCookie(cookies[0])
+	ret, err := s.Check(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := string(ret.Info.Info)
+	require.Contains(t, info, `"name_id":"aj@example.com"`)
+	require.Contains(t, info, `"issuer":"`+idp.EntityID+`"`)
+	require.Contains(t, info, `"attributes":{"groups":["admins","staff"],"mail":["aj@example.com"]}`)
+
+	w, ret = post(t, s, response, request.RelayState)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	_, _, _, err = s.consume(response, request.RelayState)
+	require.Equal(t, ErrReplay, err)
+
+	s.now = func() time.Time { return time.Now().Add(7 * time.Hour) }
+	ret, err = s.Check(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+}
+
+// TestOpenRedirect makes sure a login started at a path another host could be read from doesn't send the user there, and that logins nobody finishes leave nothing behind
+func TestOpenRedirect(t *testing.T) {
+	s, idp := newSP(t, Config{})
+	for i := 0; i < 100; i++ {
+		begin(t, s, idp, "/")
+	}
+	request := begin(t, s, idp, "https://sp.example.com//evil.com/x")
+	require.Equal(t, 0, s.answered.Len())
+	w, _ := post(t, s, idp.Respond(request, "aj", nil), request.RelayState)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/", w.Header().Get("Location"))
+	require.Equal(t, 1, s.answered.Len())
+}
+
+// TestSignedRequest checks AuthnRequests are signed over the query when we have a key
+func TestSignedRequest(t *testing.T) {
+	spIdP := samltest.NewIdP()
+	s, idp := newSP(t, Config{Key: spIdP.Key, Certificate: spIdP.Certificate})
+	request := begin(t, s, idp, "/")
+	require.Equal(t, xmldsig.AlgRSASHA256, request.SigAlg)
+	hashed := sha256.Sum256([]byte(request.Signed))
+	require.NoError(t, rsa.VerifyPKCS1v15(&spIdP.Key.PublicKey, crypto.SHA256, hashed[:], request.Signature))
+	require.True(t, strings.HasPrefix(request.Signed, "SAMLRequest="))
+	require.Contains(t, string(s.metadata()), base64.StdEncoding.EncodeToString(spIdP.Certificate.Raw))
+	require.Contains(t, string(s.metadata()), `AuthnRequestsSigned="true"`)
+}
+
+// TestRejected checks what a response has to get right
+func TestRejected(t *testing.T) {
+	s, idp := newSP(t, Config{})
+	other := samltest.NewIdP()
+	other.EntityID = idp.EntityID
+	saml := func(local string) *xmldsig.Element {
+		return &xmldsig.Element{Prefix: "saml", Local: local, Space: nsAssertion}
+	}
+
+	tests := []struct {
+		name string
+		// build returns the encoded response, and the relay state to send with it
+		build func(request *samltest.Request) (string, string)
+		want  error
+	}{
+		{"signed response", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			idp.Sign(response)
+			return samltest.Encode(response), request.RelayState
+		}, nil},
+		{"signed both", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			idp.Sign(samltest.Assertion(response))
+			idp.Sign(response)
+			return samltest.Encode(response), request.RelayState
+		}, nil},
+		{"unsigned", func(request *samltest.Request) (string, string) {
+			return samltest.Encode(idp.Response(samltest.LoginFor(request, "aj"))), request.RelayState
+		}, ErrResponse},
+		{"other key", func(request *samltest.Request) (string, string) {
+			return other.Respond(request, "aj", nil), request.RelayState
+		}, ErrResponse},
+		{"changed after signing", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			idp.Sign(samltest.Assertion(response))
+			samltest.Assertion(response).Element(nsAssertion, "Subject").Element(nsAssertion, "NameID").Children[0] = xmldsig.Text("admin")
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"wrapped", func(request *samltest.Request) (string, string) {
+			// the signed assertion is hidden in Extensions and a forged one put where it was
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			signed := samltest.Assertion(response)
+			idp.Sign(signed)
+			response.Remove(signed)
+			forged := samltest.Assertion(idp.Response(samltest.LoginFor(request, "admin")))
+			forged.Parent.Remove(forged)
+			response.Add(forged)
+			response.Insert(1, (&xmldsig.Element{Prefix: "samlp", Local: "Extensions", Space: nsProtocol}).Add(signed))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"wrapped with the same ID", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			signed := samltest.Assertion(response)
+			idp.Sign(signed)
+			forged := samltest.Assertion(idp.Response(samltest.LoginFor(request, "admin")))
+			forged.Parent.Remove(forged)
+			forged.SetAttr("ID", signed.Attr("ID"))
+			forged.Insert(1, signed.Element(xmldsig.NamespaceDS, "Signature"))
+			response.Insert(1, (&xmldsig.Element{Prefix: "samlp", Local: "Extensions", Space: nsProtocol}).Add(forged))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"two assertions", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			idp.Sign(samltest.Assertion(response))
+			extra := samltest.Assertion(idp.Response(samltest.LoginFor(request, "admin")))
+			idp.Sign(extra)
+			extra.Parent.Remove(extra)
+			response.Add(extra)
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"audience", func(request *samltest.Request) (string, string) {
+			login := samltest.LoginFor(request, "aj")
+			login.Audience = "https://other.example.com"
+			response := idp.Response(login)
+			idp.Sign(samltest.Assertion(response))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"recipient", func(request *samltest.Request) (string, string) {
+			login := samltest.LoginFor(request, "aj")
+			login.Recipient = "https://other.example.com/acs"
+			response := idp.Response(login)
+			idp.Sign(samltest.Assertion(response))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"expired", func(request *samltest.Request) (string, string) {
+			login := samltest.LoginFor(request, "aj")
+			login.Now = time.Now().Add(-10 * time.Minute)
+			response := idp.Response(login)
+			idp.Sign(samltest.Assertion(response))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"not yet valid", func(request *samltest.Request) (string, string) {
+			login := samltest.LoginFor(request, "aj")
+			login.Now = time.Now().Add(3 * time.Minute)
+			response := idp.Response(login)
+			idp.Sign(samltest.Assertion(response))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"issuer", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			samltest.Assertion(response).Element(nsAssertion, "Issuer").Children[0] = xmldsig.Text("https://evil.example.com")
+			idp.Sign(samltest.Assertion(response))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"status", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			idp.Sign(samltest.Assertion(response))
+			response.Element(nsProtocol, "Status").Element(nsProtocol, "StatusCode").SetAttr("Value", "urn:oasis:names:tc:SAML:2.0:status:Requester")
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"no audience restriction", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			conditions := samltest.Assertion(response).Element(nsAssertion, "Conditions")
+			conditions.Remove(conditions.Element(nsAssertion, "AudienceRestriction"))
+			idp.Sign(samltest.Assertion(response))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"not a bearer", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			subject := samltest.Assertion(response).Element(nsAssertion, "Subject")
+			subject.Element(nsAssertion, "SubjectConfirmation").SetAttr("Method", "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key")
+			idp.Sign(samltest.Assertion(response))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"other request", func(request *samltest.Request) (string, string) {
+			login := samltest.LoginFor(request, "aj")
+			login.InResponseTo = "_unknown"
+			response := idp.Response(login)
+			idp.Sign(samltest.Assertion(response))
+			return samltest.Encode(response), request.RelayState
+		}, ErrUnsolicited},
+		{"relay state", func(request *samltest.Request) (string, string) {
+			return idp.Respond(request, "aj", nil), "other"
+		}, ErrUnsolicited},
+		{"encrypted", func(request *samltest.Request) (string, string) {
+			response := idp.Response(samltest.LoginFor(request, "aj"))
+			response.Add(saml("EncryptedAssertion"))
+			idp.Sign(samltest.Assertion(response))
+			return samltest.Encode(response), request.RelayState
+		}, ErrResponse},
+		{"doctype", func(request *samltest.Request) (string, string) {
+			return base64.StdEncoding.EncodeToString([]byte(`<!DOCTYPE x [<!ENTITY a "b">]><x/>`)), request.RelayState
+		}, ErrResponse},
+		{"not base64", func(request *samltest.Request) (string, string) {
+			return "%%%", request.RelayState
+		}, ErrResponse},
+	}
+	for _, test := range tests {
+		request := begin(t, s, idp, "/")
+		response, relayState := test.build(request)
+		info, _, returnTo, err := s.consume(response, relayState)
+		if test.want == nil {
+			require.NoError(t, err, test.name)
+			require.Equal(t, "aj", info.NameID, test.name)
+			require.Equal(t, "/", returnTo)
+			continue
+		}
+		require.Equal(t, test.want, errors.Cause(err), test.name)
+	}
+
+	// a request is only answered once, even by a different assertion
+	request := begin(t, s, idp, "/")
+	_, _, _, err := s.consume(idp.Respond(request, "aj", nil), request.RelayState)
+	require.NoError(t, err)
+	_, _, _, err = s.consume(idp.Respond(request, "aj", nil), request.RelayState)
+	require.Equal(t, ErrUnsolicited, err)
+
+	// and not after it times out
+	request = begin(t, s, idp, "/")
+	s.now = func() time.Time { return time.Now().Add(11 * time.Minute) }
+	login := samltest.LoginFor(request, "aj")
+	login.Now = s.now()
+	response := idp.Response(login)
+	idp.Sign(samltest.Assertion(response))
+	_, _, _, err = s.consume(samltest.Encode(response), request.RelayState)
+	require.Equal(t, ErrUnsolicited, err)
+}
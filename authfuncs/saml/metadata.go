@@ -0,0 +1,127 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor/authfuncs/internal/xmldsig"
+)
+
+// ErrMetadata is returned by ParseIdPMetadata for metadata we can't use
+var ErrMetadata = errors.New("unusable IdP metadata")
+
+// SAML namespaces and identifiers
+const (
+	nsProtocol      = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion     = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsMetadata      = "urn:oasis:names:tc:SAML:2.0:metadata"
+	bindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	statusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	methodBearer    = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// IdP is what we need to know about the identity provider
+type IdP struct {
+	EntityID string
+	// SSOURL is its HTTP-Redirect single sign-on endpoint
+	SSOURL string
+	// Certificates are the ones it signs with, any of them is accepted
+	Certificates []*x509.Certificate
+}
+
+// ParseIdPMetadata reads an EntityDescriptor with an IDPSSODescriptor. The metadata's own signature isn't checked, get it from somewhere you trust.
+func ParseIdPMetadata(data []byte) (IdP, error) {
+	idp := IdP{}
+	root, err := xmldsig.Parse(data)
+	if err != nil {
+		return idp, errors.Wrap(ErrMetadata, err.Error())
+	}
+	if root.Space != nsMetadata || root.Local != "EntityDescriptor" {
+		return idp, errors.Wrap(ErrMetadata, "root isn't an EntityDescriptor")
+	}
+	idp.EntityID = root.Attr("entityID")
+	descriptor := root.Element(nsMetadata, "IDPSSODescriptor")
+	if idp.EntityID == "" || descriptor == nil {
+		return idp, errors.Wrap(ErrMetadata, "no entityID or IDPSSODescriptor")
+	}
+	for _, service := range descriptor.Elements(nsMetadata, "SingleSignOnService") {
+		if service.Attr("Binding") == bindingRedirect {
+			idp.SSOURL = service.Attr("Location")
+			break
+		}
+	}
+	for _, keyDescriptor := range descriptor.Elements(nsMetadata, "KeyDescriptor") {
+		if use := keyDescriptor.Attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		keyInfo := keyDescriptor.Element(xmldsig.NamespaceDS, "KeyInfo")
+		if keyInfo == nil {
+			continue
+		}
+		for _, data := range keyInfo.Elements(xmldsig.NamespaceDS, "X509Data") {
+			for _, encoded := range data.Elements(xmldsig.NamespaceDS, "X509Certificate") {
+				der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded.Text()), ""))
+				if err != nil {
+					return idp, errors.Wrap(ErrMetadata, "certificate isn't base64")
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return idp, errors.Wrap(ErrMetadata, err.Error())
+				}
+				idp.Certificates = append(idp.Certificates, cert)
+			}
+		}
+	}
+	if idp.SSOURL == "" || len(idp.Certificates) == 0 {
+		return idp, errors.Wrap(ErrMetadata, "no HTTP-Redirect SingleSignOnService or signing certificate")
+	}
+	return idp, nil
+}
+
+// element returns an element whose prefix is declared by an ancestor
+func element(prefix, space, local string) *xmldsig.Element {
+	return &xmldsig.Element{Prefix: prefix, Local: local, Space: space}
+}
+
+// metadata returns our EntityDescriptor
+func (s *SAML) metadata() []byte {
+	descriptor := element("md", nsMetadata, "SPSSODescriptor").
+		SetAttr("AuthnRequestsSigned", boolString(s.config.Key != nil)).
+		SetAttr("WantAssertionsSigned", "true").
+		SetAttr("protocolSupportEnumeration", nsProtocol)
+	if s.config.Certificate != nil {
+		descriptor.Add(element("md", nsMetadata, "KeyDescriptor").SetAttr("use", "signing").Add(
+			xmldsig.NewElement("ds", xmldsig.NamespaceDS, "KeyInfo").Add(
+				element("ds", xmldsig.NamespaceDS, "X509Data").Add(
+					element("ds", xmldsig.NamespaceDS, "X509Certificate").Add(
+						xmldsig.Text(base64.StdEncoding.EncodeToString(s.config.Certificate.Raw)),
+					),
+				),
+			),
+		))
+	}
+	if s.config.NameIDFormat != "" {
+		descriptor.Add(element("md", nsMetadata, "NameIDFormat").Add(xmldsig.Text(s.config.NameIDFormat)))
+	}
+	descriptor.Add(element("md", nsMetadata, "AssertionConsumerService").
+		SetAttr("Binding", bindingPOST).
+		SetAttr("Location", s.acsURL).
+		SetAttr("index", "0").
+		SetAttr("isDefault", "true"))
+	return xmldsig.NewElement("md", nsMetadata, "EntityDescriptor").
+		SetAttr("entityID", s.config.EntityID).
+		Add(descriptor).
+		Bytes()
+}
+
+// boolString is an xs:boolean
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
@@ -0,0 +1,266 @@
+package saml
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor/authfuncs/internal/xmldsig"
+)
+
+var (
+	// ErrResponse is returned for responses that fail validation
+	ErrResponse = errors.New("invalid SAML response")
+	// ErrUnsolicited is returned for responses to requests we didn't make, or already got an answer to
+	ErrUnsolicited = errors.New("SAML response to no pending request")
+	// ErrReplay is returned for assertions already consumed
+	ErrReplay = errors.New("SAML assertion already used")
+)
+
+// timeFormat is xs:dateTime in UTC, how SAML wants times written
+const timeFormat = "2006-01-02T15:04:05Z"
+
+// invalid wraps ErrResponse with what was wrong
+func invalid(reason string) error {
+	return errors.Wrap(ErrResponse, reason)
+}
+
+// parseTime reads an optional xs:dateTime attribute
+func parseTime(e *xmldsig.Element, attr string) (time.Time, bool, error) {
+	value := e.Attr(attr)
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false, invalid("bad " + attr)
+	}
+	return t, true, nil
+}
+
+// uniqueIDs refuses documents where two elements share an ID, so a reference can only mean one thing
+func uniqueIDs(root *xmldsig.Element) error {
+	seen := make(map[string]bool)
+	var err error
+	root.Walk(func(e *xmldsig.Element) {
+		if id := e.Attr("ID"); id != "" {
+			if seen[id] {
+				err = invalid("repeated ID " + id)
+			}
+			seen[id] = true
+		}
+	})
+	return err
+}
+
+// text returns the text of the named child element, or "" if there isn't one
+func text(e *xmldsig.Element, space, local string) string {
+	child := e.Element(space, local)
+	if child == nil {
+		return ""
+	}
+	return child.Text()
+}
+
+// consume validates a base64 encoded response and returns who logged in, when their session ends, and where they were going. Everything it reads about the user comes from the signed element, unsigned wrappers around it are only checked, never trusted.
+func (s *SAML) consume(encoded, sealedState string) (*Info, time.Time, string, error) {
+	now := s.now()
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil || len(data) == 0 {
+		return nil, now, "", invalid("SAMLResponse isn't base64")
+	}
+	root, err := xmldsig.Parse(data)
+	if err != nil {
+		return nil, now, "", errors.Wrap(ErrResponse, err.Error())
+	}
+	if root.Space != nsProtocol || root.Local != "Response" || root.Attr("Version") != "2.0" {
+		return nil, now, "", invalid("not a SAML 2.0 Response")
+	}
+	if err := uniqueIDs(root); err != nil {
+		return nil, now, "", err
+	}
+	responseSigned := false
+	switch err := xmldsig.Verify(root, "ID", s.config.IdP.Certificates); err {
+	case nil:
+		responseSigned = true
+	case xmldsig.ErrNoSignature:
+	default:
+		return nil, now, "", errors.Wrap(ErrResponse, err.Error())
+	}
+	if destination := root.Attr("Destination"); destination != "" && destination != s.acsURL {
+		return nil, now, "", invalid("Destination " + destination)
+	}
+	if issuer := text(root, nsAssertion, "Issuer"); issuer != "" && issuer != s.config.IdP.EntityID {
+		return nil, now, "", invalid("Issuer " + issuer)
+	}
+	status := root.Element(nsProtocol, "Status")
+	if status == nil || status.Element(nsProtocol, "StatusCode") == nil {
+		return nil, now, "", invalid("no Status")
+	}
+	if code := status.Element(nsProtocol, "StatusCode").Attr("Value"); code != statusSuccess {
+		return nil, now, "", invalid("status " + code)
+	}
+	if len(root.Elements(nsAssertion, "EncryptedAssertion")) > 0 {
+		return nil, now, "", invalid("encrypted assertions aren't supported")
+	}
+	assertions := root.Elements(nsAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return nil, now, "", invalid("expected one Assertion")
+	}
+	assertion := assertions[0]
+	switch err := xmldsig.Verify(assertion, "ID", s.config.IdP.Certificates); err {
+	case nil:
+	case xmldsig.ErrNoSignature:
+		if !responseSigned {
+			return nil, now, "", invalid("neither the Response nor the Assertion is signed")
+		}
+	default:
+		return nil, now, "", errors.Wrap(ErrResponse, err.Error())
+	}
+
+	if assertion.Attr("Version") != "2.0" || assertion.Attr("ID") == "" {
+		return nil, now, "", invalid("assertion version or ID")
+	}
+	if issuer := text(assertion, nsAssertion, "Issuer"); issuer != s.config.IdP.EntityID {
+		return nil, now, "", invalid("assertion Issuer " + issuer)
+	}
+	requestID, confirmedUntil, err := s.checkSubject(assertion, now)
+	if err != nil {
+		return nil, now, "", err
+	}
+	if inResponseTo := root.Attr("InResponseTo"); inResponseTo != "" && inResponseTo != requestID {
+		return nil, now, "", invalid("InResponseTo doesn't match the assertion")
+	}
+	if err := s.checkConditions(assertion, now); err != nil {
+		return nil, now, "", err
+	}
+
+	subject := assertion.Element(nsAssertion, "Subject")
+	nameID := subject.Element(nsAssertion, "NameID")
+	info := &Info{
+		NameID:       nameID.Text(),
+		NameIDFormat: nameID.Attr("Format"),
+		Issuer:       s.config.IdP.EntityID,
+		Attributes:   s.attributes(assertion),
+	}
+	expires := now.Add(s.config.SessionLength)
+	if statement := assertion.Element(nsAssertion, "AuthnStatement"); statement != nil {
+		info.SessionIndex = statement.Attr("SessionIndex")
+		sessionEnd, ok, err := parseTime(statement, "SessionNotOnOrAfter")
+		if err != nil {
+			return nil, now, "", err
+		}
+		if ok && sessionEnd.Before(expires) {
+			expires = sessionEnd
+		}
+	}
+
+	state := relayState{}
+	if err := s.sealer.Open(sealedState, &state); err != nil || state.ID != requestID || !now.Before(time.Unix(state.Expires, 0)) {
+		return nil, now, "", ErrUnsolicited
+	}
+	if !s.used.Add(assertion.Attr("ID"), true, confirmedUntil.Add(s.config.ClockSkew), now) {
+		return nil, now, "", ErrReplay
+	}
+	if !s.answered.Add(requestID, true, time.Unix(state.Expires, 0), now) {
+		return nil, now, "", ErrUnsolicited
+	}
+	return info, expires, state.ReturnTo, nil
+}
+
+// checkSubject finds a bearer confirmation meant for us and returns the request it answers and how long it's good for
+func (s *SAML) checkSubject(assertion *xmldsig.Element, now time.Time) (string, time.Time, error) {
+	subject := assertion.Element(nsAssertion, "Subject")
+	if subject == nil || text(subject, nsAssertion, "NameID") == "" {
+		return "", now, invalid("no NameID")
+	}
+	for _, confirmation := range subject.Elements(nsAssertion, "SubjectConfirmation") {
+		data := confirmation.Element(nsAssertion, "SubjectConfirmationData")
+		if confirmation.Attr("Method") != methodBearer || data == nil {
+			continue
+		}
+		if data.Attr("Recipient") != s.acsURL || data.Attr("InResponseTo") == "" {
+			continue
+		}
+		notOnOrAfter, ok, err := parseTime(data, "NotOnOrAfter")
+		if err != nil {
+			return "", now, err
+		}
+		if !ok || !now.Before(notOnOrAfter.Add(s.config.ClockSkew)) {
+			continue
+		}
+		notBefore, ok, err := parseTime(data, "NotBefore")
+		if err != nil {
+			return "", now, err
+		}
+		if ok && now.Add(s.config.ClockSkew).Before(notBefore) {
+			continue
+		}
+		return data.Attr("InResponseTo"), notOnOrAfter, nil
+	}
+	return "", now, invalid("no current bearer SubjectConfirmation for us")
+}
+
+// checkConditions checks the assertion's time window and that every AudienceRestriction includes us
+func (s *SAML) checkConditions(assertion *xmldsig.Element, now time.Time) error {
+	conditions := assertion.Element(nsAssertion, "Conditions")
+	if conditions == nil {
+		return invalid("no Conditions")
+	}
+	notBefore, ok, err := parseTime(conditions, "NotBefore")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(s.config.ClockSkew).Before(notBefore) {
+		return invalid("assertion not valid yet")
+	}
+	notOnOrAfter, ok, err := parseTime(conditions, "NotOnOrAfter")
+	if err != nil {
+		return err
+	}
+	if ok && !now.Before(notOnOrAfter.Add(s.config.ClockSkew)) {
+		return invalid("assertion expired")
+	}
+	restrictions := conditions.Elements(nsAssertion, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return invalid("no AudienceRestriction")
+	}
+	for _, restriction := range restrictions {
+		found := false
+		for _, audience := range restriction.Elements(nsAssertion, "Audience") {
+			if audience.Text() == s.config.EntityID {
+				found = true
+			}
+		}
+		if !found {
+			return invalid("audience isn't us")
+		}
+	}
+	return nil
+}
+
+// attributes collects the assertion's attributes under the keys Config.Attributes gives
+func (s *SAML) attributes(assertion *xmldsig.Element) map[string][]string {
+	attributes := make(map[string][]string)
+	for _, statement := range assertion.Elements(nsAssertion, "AttributeStatement") {
+		for _, attribute := range statement.Elements(nsAssertion, "Attribute") {
+			key := attribute.Attr("Name")
+			if s.config.Attributes != nil {
+				mapped, ok := s.config.Attributes[key]
+				if !ok {
+					mapped, ok = s.config.Attributes[attribute.Attr("FriendlyName")]
+				}
+				if !ok {
+					continue
+				}
+				key = mapped
+			}
+			for _, value := range attribute.Elements(nsAssertion, "AttributeValue") {
+				attributes[key] = append(attributes[key], value.Text())
+			}
+		}
+	}
+	return attributes
+}
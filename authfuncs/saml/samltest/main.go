@@ -0,0 +1,277 @@
+/*
+Package samltest provides a tiny SAML identity provider for tests. It reads AuthnRequests from redirect URLs and builds responses that tests can sign, leave unsigned or tamper with before encoding them for the POST binding.
+*/
+package samltest
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor/authfuncs/internal/xmldsig"
+)
+
+// SAML namespaces and identifiers
+const (
+	NamespaceProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	NamespaceAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsMetadata         = "urn:oasis:names:tc:SAML:2.0:metadata"
+	bindingRedirect    = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	timeFormat         = "2006-01-02T15:04:05Z"
+)
+
+// IdP is a fake identity provider with its own key pair
+type IdP struct {
+	EntityID    string
+	SSOURL      string
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// NewIdP makes an IdP with a fresh key and self-signed certificate
+func NewIdP() *IdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "samltest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return &IdP{
+		EntityID:    "https://idp.example.com/metadata",
+		SSOURL:      "https://idp.example.com/sso",
+		Key:         key,
+		Certificate: cert,
+	}
+}
+
+// element returns an element whose prefix is declared by an ancestor
+func element(prefix, space, local string) *xmldsig.Element {
+	return &xmldsig.Element{Prefix: prefix, Local: local, Space: space}
+}
+
+// Metadata returns the IdP's metadata
+func (i *IdP) Metadata() []byte {
+	return xmldsig.NewElement("md", nsMetadata, "EntityDescriptor").SetAttr("entityID", i.EntityID).Add(
+		element("md", nsMetadata, "IDPSSODescriptor").SetAttr("protocolSupportEnumeration", NamespaceProtocol).Add(
+			element("md", nsMetadata, "KeyDescriptor").SetAttr("use", "signing").Add(
+				xmldsig.NewElement("ds", xmldsig.NamespaceDS, "KeyInfo").Add(
+					element("ds", xmldsig.NamespaceDS, "X509Data").Add(
+						element("ds", xmldsig.NamespaceDS, "X509Certificate").Add(
+							xmldsig.Text(base64.StdEncoding.EncodeToString(i.Certificate.Raw)),
+						),
+					),
+				),
+			),
+			element("md", nsMetadata, "SingleSignOnService").SetAttr("Binding", bindingRedirect).SetAttr("Location", i.SSOURL),
+		),
+	).Bytes()
+}
+
+// Request is what the IdP read from an AuthnRequest redirect
+type Request struct {
+	ID         string
+	Issuer     string
+	ACSURL     string
+	RelayState string
+	// SigAlg and Signature are set if the redirect was signed, Signed is the query string they cover
+	SigAlg    string
+	Signature []byte
+	Signed    string
+}
+
+// ParseRequest reads the AuthnRequest out of a redirect to the IdP
+func (i *IdP) ParseRequest(location string) (*Request, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	deflated, err := base64.StdEncoding.DecodeString(query.Get("SAMLRequest"))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil {
+		return nil, err
+	}
+	root, err := xmldsig.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if root.Space != NamespaceProtocol || root.Local != "AuthnRequest" {
+		return nil, errors.New("not an AuthnRequest")
+	}
+	request := &Request{
+		ID:         root.Attr("ID"),
+		ACSURL:     root.Attr("AssertionConsumerServiceURL"),
+		RelayState: query.Get("RelayState"),
+		SigAlg:     query.Get("SigAlg"),
+	}
+	if issuer := root.Element(NamespaceAssertion, "Issuer"); issuer != nil {
+		request.Issuer = issuer.Text()
+	}
+	if request.SigAlg != "" {
+		if request.Signature, err = base64.StdEncoding.DecodeString(query.Get("Signature")); err != nil {
+			return nil, err
+		}
+		raw := u.RawQuery
+		end := strings.Index(raw, "&Signature=")
+		if end == -1 {
+			return nil, errors.New("Signature isn't last")
+		}
+		request.Signed = raw[:end]
+	}
+	return request, nil
+}
+
+// Login describes the response to build
+type Login struct {
+	// InResponseTo, Recipient and Audience usually come from the Request
+	InResponseTo string
+	Recipient    string
+	Audience     string
+	NameID       string
+	Attributes   map[string][]string
+	// Now is when the response is issued, defaults to time.Now(). Lifetime defaults to 5 minutes.
+	Now      time.Time
+	Lifetime time.Duration
+}
+
+// LoginFor returns a Login answering request for nameID
+func LoginFor(request *Request, nameID string) Login {
+	return Login{
+		InResponseTo: request.ID,
+		Recipient:    request.ACSURL,
+		Audience:     request.Issuer,
+		NameID:       nameID,
+	}
+}
+
+// randomID returns a fresh xs:ID
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "_" + hex.EncodeToString(b)
+}
+
+// Response builds an unsigned Response with one Assertion
+func (i *IdP) Response(login Login) *xmldsig.Element {
+	if login.Now.IsZero() {
+		login.Now = time.Now()
+	}
+	if login.Lifetime == 0 {
+		login.Lifetime = 5 * time.Minute
+	}
+	now := login.Now.UTC().Format(timeFormat)
+	expires := login.Now.Add(login.Lifetime).UTC().Format(timeFormat)
+	saml := func(local string) *xmldsig.Element {
+		return element("saml", NamespaceAssertion, local)
+	}
+	attributes := saml("AttributeStatement")
+	names := make([]string, 0, len(login.Attributes))
+	for name := range login.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attribute := saml("Attribute").SetAttr("Name", name)
+		for _, value := range login.Attributes[name] {
+			attribute.Add(saml("AttributeValue").Add(xmldsig.Text(value)))
+		}
+		attributes.Add(attribute)
+	}
+	assertion := saml("Assertion").
+		SetAttr("ID", randomID()).
+		SetAttr("Version", "2.0").
+		SetAttr("IssueInstant", now).
+		Add(
+			saml("Issuer").Add(xmldsig.Text(i.EntityID)),
+			saml("Subject").Add(
+				saml("NameID").SetAttr("Format", "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress").Add(xmldsig.Text(login.NameID)),
+				saml("SubjectConfirmation").SetAttr("Method", "urn:oasis:names:tc:SAML:2.0:cm:bearer").Add(
+					saml("SubjectConfirmationData").
+						SetAttr("InResponseTo", login.InResponseTo).
+						SetAttr("NotOnOrAfter", expires).
+						SetAttr("Recipient", login.Recipient),
+				),
+			),
+			saml("Conditions").SetAttr("NotBefore", now).SetAttr("NotOnOrAfter", expires).Add(
+				saml("AudienceRestriction").Add(saml("Audience").Add(xmldsig.Text(login.Audience))),
+			),
+			saml("AuthnStatement").SetAttr("AuthnInstant", now).SetAttr("SessionIndex", randomID()).Add(
+				saml("AuthnContext").Add(saml("AuthnContextClassRef").Add(
+					xmldsig.Text("urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"),
+				)),
+			),
+			attributes,
+		)
+	response := xmldsig.NewElement("samlp", NamespaceProtocol, "Response").
+		SetAttr("ID", randomID()).
+		SetAttr("Version", "2.0").
+		SetAttr("IssueInstant", now).
+		SetAttr("Destination", login.Recipient).
+		SetAttr("InResponseTo", login.InResponseTo)
+	response.Namespaces["saml"] = NamespaceAssertion
+	return response.Add(
+		saml("Issuer").Add(xmldsig.Text(i.EntityID)),
+		element("samlp", NamespaceProtocol, "Status").Add(
+			element("samlp", NamespaceProtocol, "StatusCode").SetAttr("Value", "urn:oasis:names:tc:SAML:2.0:status:Success"),
+		),
+		assertion,
+	)
+}
+
+// Assertion returns the response's assertion
+func Assertion(response *xmldsig.Element) *xmldsig.Element {
+	return response.Element(NamespaceAssertion, "Assertion")
+}
+
+// Sign signs e, a Response or Assertion, putting the signature after its Issuer like the schema wants
+func (i *IdP) Sign(e *xmldsig.Element) {
+	signature, err := xmldsig.Sign(e, "ID", i.Key, i.Certificate)
+	if err != nil {
+		panic(err)
+	}
+	e.Insert(1, signature)
+}
+
+// Encode returns the response the way the POST binding sends it
+func Encode(response *xmldsig.Element) string {
+	return base64.StdEncoding.EncodeToString(response.Bytes())
+}
+
+// Respond is a response to request for nameID with a signed assertion, encoded for the POST binding
+func (i *IdP) Respond(request *Request, nameID string, attributes map[string][]string) string {
+	login := LoginFor(request, nameID)
+	login.Attributes = attributes
+	response := i.Response(login)
+	i.Sign(Assertion(response))
+	return Encode(response)
+}
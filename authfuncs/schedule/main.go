@@ -0,0 +1,228 @@
+/*
+Package schedule is an AuthFunc limiting access to windows of time, like business hours for contractors or weekdays for a staging site. On its own it answers 403 outside the windows and lets requests through to later instances inside them. Wrapping an identity AuthFunc, it reads who was granted from their info and holds each identity to its own windows.
+*/
+package schedule
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+var (
+	// ErrBadRule is returned by New for rules or windows that can't be parsed
+	ErrBadRule = errors.New("bad schedule rule")
+	// ErrNoIdentity is returned by New when there's a Primary but no Identity to read its info with
+	ErrNoIdentity = errors.New("identity is required with a primary")
+)
+
+// Action is what happens to identities matching no rule
+type Action int
+
+const (
+	// Deny keeps them out, it's the default
+	Deny Action = iota
+	// Allow lets them through
+	Allow
+)
+
+// Rule holds identities to windows of time
+type Rule struct {
+	// Identities are path.Match patterns, like "*@contractors.example.com". Empty matches everyone, including requests with no identity.
+	Identities []string
+	// Allow, if set, only lets the identities in inside one of these windows
+	Allow []Window
+	// Deny keeps the identities out inside any of these windows, even ones Allow lets in
+	Deny []Window
+}
+
+// Config lists the rules
+type Config struct {
+	// Primary, if set, is the identity AuthFunc whose grants are checked against the rules. Without it every request is checked as having no identity.
+	Primary authdoor.AuthFunc
+	// Identity picks the identity out of the primary's info, like Fields("email"). It's required with a Primary: pick the field your Rules' patterns are written against.
+	Identity func(info json.RawMessage) (string, bool)
+	// Rules are tried in order and the first one matching the identity decides
+	Rules []Rule
+	// Default is what happens to identities matching no rule, Deny unless set
+	Default Action
+	// Location is the time zone for windows without their own, defaults to UTC
+	Location *time.Location
+	// Now is the clock, defaults to time.Now
+	Now func() time.Time
+}
+
+// Info is returned as the instance's info when a primary's grant is passed on
+type Info struct {
+	Identity string          `json:"identity"`
+	Primary  json.RawMessage `json:"primary,omitempty"`
+}
+
+// rule is a parsed Rule
+type rule struct {
+	identities []string
+	allow      []*window
+	deny       []*window
+}
+
+// Schedule supplies an authfunc receiver and stores information to be used by that receiver
+type Schedule struct {
+	config Config
+	rules  []rule
+}
+
+// New parses the rules and returns a Schedule ready to be used as an AuthFunc
+func New(config Config) (*Schedule, error) {
+	if len(config.Rules) == 0 {
+		return nil, errors.Wrap(ErrBadRule, "no rules")
+	}
+	if config.Primary != nil && config.Identity == nil {
+		return nil, ErrNoIdentity
+	}
+	if config.Location == nil {
+		config.Location = time.UTC
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	s := &Schedule{config: config}
+	for _, r := range config.Rules {
+		for _, pattern := range r.Identities {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrap(ErrBadRule, "identity pattern "+pattern)
+			}
+		}
+		parsed := rule{identities: r.Identities}
+		for _, w := range r.Allow {
+			pw, err := parseWindow(w, config.Location)
+			if err != nil {
+				return nil, err
+			}
+			parsed.allow = append(parsed.allow, pw)
+		}
+		for _, w := range r.Deny {
+			pw, err := parseWindow(w, config.Location)
+			if err != nil {
+				return nil, err
+			}
+			parsed.deny = append(parsed.deny, pw)
+		}
+		s.rules = append(s.rules, parsed)
+	}
+	return s, nil
+}
+
+// Fields returns a Config.Identity reading the first non-empty string field of names from the primary's info
+func Fields(names ...string) func(info json.RawMessage) (string, bool) {
+	return func(info json.RawMessage) (string, bool) {
+		fields := map[string]interface{}{}
+		if json.Unmarshal(info, &fields) != nil {
+			return "", false
+		}
+		for _, name := range names {
+			if value, ok := fields[name].(string); ok && value != "" {
+				return value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// matches reports whether the rule applies to identity
+func (r rule) matches(identity string) bool {
+	if len(r.identities) == 0 {
+		return true
+	}
+	for _, pattern := range r.identities {
+		if ok, _ := path.Match(pattern, identity); ok && identity != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedAt reports whether the rule lets its identities in at t
+func (r rule) allowedAt(t time.Time) bool {
+	for _, w := range r.deny {
+		if w.contains(t) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, w := range r.allow {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether identity may come in at t. Use "" for no identity.
+func (s *Schedule) Allowed(identity string, t time.Time) bool {
+	for _, r := range s.rules {
+		if r.matches(identity) {
+			return r.allowedAt(t)
+		}
+	}
+	return s.config.Default == Allow
+}
+
+// refuse answers 403, unless the primary already answered
+func refuse(w http.ResponseWriter, answered bool) (authdoor.AuthFuncReturn, error) {
+	if !answered {
+		http.Error(w, "Access isn't allowed at this time.", http.StatusForbidden)
+	}
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+}
+
+// Check is an authfunc. Without a primary, requests outside the windows are answered with 403 and the rest fail quietly so later instances decide. With one, its grants are passed on only inside the identity's windows, and everything else it returns is passed on as is.
+func (s *Schedule) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	now := s.config.Now()
+	if s.config.Primary == nil {
+		if !s.Allowed("", now) {
+			defaultLogger.Info("schedule refused a request at " + now.Format(time.RFC3339))
+			return refuse(w, false)
+		}
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	ret, err := s.config.Primary(w, r)
+	if err != nil || ret.Auth != authdoor.AuthGranted {
+		return ret, err
+	}
+	identity, _ := s.config.Identity(ret.Info.Info)
+	if !s.Allowed(identity, now) {
+		defaultLogger.Info("schedule refused " + identity + " at " + now.Format(time.RFC3339))
+		return refuse(w, ret.IsAnswered())
+	}
+	info, err := json.Marshal(Info{Identity: identity, Primary: ret.Info.Info})
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: ret.Resp,
+		Info: authdoor.InstanceReturnInfo{Info: info},
+	}, nil
+}
@@ -0,0 +1,247 @@
+package schedule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/schedule/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// at parses a time in loc
+func at(t *testing.T, value string, loc *time.Location) time.Time {
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+	require.NoError(t, err)
+	return parsed
+}
+
+// TestCron checks cron expressions
+func TestCron(t *testing.T) {
+	c, err := parseCron("*/15 9-17 * * mon-fri")
+	require.NoError(t, err)
+	// 2024-01-01 was a Monday
+	require.True(t, c.match(at(t, "2024-01-01 09:00", time.UTC)))
+	require.True(t, c.match(at(t, "2024-01-05 17:45", time.UTC)))
+	require.False(t, c.match(at(t, "2024-01-01 09:01", time.UTC)))
+	require.False(t, c.match(at(t, "2024-01-01 18:00", time.UTC)))
+	require.False(t, c.match(at(t, "2024-01-06 10:00", time.UTC)))
+
+	// both day fields restricted ORs them, like cron
+	c, err = parseCron("* * 1,15 * 7")
+	require.NoError(t, err)
+	require.True(t, c.match(at(t, "2024-01-15 12:00", time.UTC)))
+	require.True(t, c.match(at(t, "2024-01-07 12:00", time.UTC)))
+	require.False(t, c.match(at(t, "2024-01-08 12:00", time.UTC)))
+
+	c, err = parseCron("0 0 5/10 Dec *")
+	require.NoError(t, err)
+	require.True(t, c.match(at(t, "2024-12-25 00:00", time.UTC)))
+	require.False(t, c.match(at(t, "2024-12-20 00:00", time.UTC)))
+	require.False(t, c.match(at(t, "2024-11-25 00:00", time.UTC)))
+
+	for _, bad := range []string{"* * * *", "60 * * * *", "* * 0 * *", "* * * 13 *", "* 5-1 * * *", "*/0 * * * *", "* * * * funday"} {
+		_, err := parseCron(bad)
+		require.Equal(t, ErrBadRule, errors.Cause(err), bad)
+	}
+}
+
+// TestWindow checks weekly windows, including ones past midnight and in other time zones
+func TestWindow(t *testing.T) {
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	w, err := parseWindow(Window{Days: weekdays, From: "09:00", To: "17:30"}, time.UTC)
+	require.NoError(t, err)
+	require.True(t, w.contains(at(t, "2024-01-01 09:00", time.UTC)))
+	require.True(t, w.contains(at(t, "2024-01-01 17:29", time.UTC)))
+	require.False(t, w.contains(at(t, "2024-01-01 17:30", time.UTC)))
+	require.False(t, w.contains(at(t, "2024-01-06 12:00", time.UTC)))
+
+	// Friday night to Saturday morning belongs to Friday
+	w, err = parseWindow(Window{Days: []time.Weekday{time.Friday}, From: "22:00", To: "02:00"}, time.UTC)
+	require.NoError(t, err)
+	require.True(t, w.contains(at(t, "2024-01-05 23:00", time.UTC)))
+	require.True(t, w.contains(at(t, "2024-01-06 01:59", time.UTC)))
+	require.False(t, w.contains(at(t, "2024-01-05 01:00", time.UTC)))
+	require.False(t, w.contains(at(t, "2024-01-06 22:30", time.UTC)))
+
+	w, err = parseWindow(Window{Days: []time.Weekday{time.Saturday, time.Sunday}}, time.UTC)
+	require.NoError(t, err)
+	require.True(t, w.contains(at(t, "2024-01-06 00:00", time.UTC)))
+	require.True(t, w.contains(at(t, "2024-01-07 23:59", time.UTC)))
+	require.False(t, w.contains(at(t, "2024-01-08 00:00", time.UTC)))
+
+	// the window's own zone wins, so 09:00 in UTC+9 is midnight UTC
+	tokyo := time.FixedZone("JST", 9*60*60)
+	w, err = parseWindow(Window{From: "09:00", To: "24:00", Location: tokyo}, time.UTC)
+	require.NoError(t, err)
+	require.True(t, w.contains(at(t, "2024-01-01 00:00", time.UTC)))
+	require.False(t, w.contains(at(t, "2023-12-31 23:59", time.UTC)))
+
+	for _, bad := range []Window{
+		{From: "09:00"},
+		{From: "9", To: "17:00"},
+		{From: "09:00", To: "09:00"},
+		{From: "24:00", To: "01:00"},
+		{From: "09:60", To: "10:00"},
+		{Days: []time.Weekday{7}},
+		{Cron: "* * * * *", From: "09:00", To: "10:00"},
+	} {
+		_, err := parseWindow(bad, time.UTC)
+		require.Equal(t, ErrBadRule, errors.Cause(err), bad)
+	}
+}
+
+// TestZone checks windows follow daylight saving time
+func TestZone(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database: " + err.Error())
+	}
+	w, err := parseWindow(Window{From: "09:00", To: "17:00"}, newYork)
+	require.NoError(t, err)
+	require.True(t, w.contains(at(t, "2024-01-15 14:00", time.UTC)))
+	require.False(t, w.contains(at(t, "2024-07-15 21:30", time.UTC)))
+	require.True(t, w.contains(at(t, "2024-07-15 13:00", time.UTC)))
+	require.False(t, w.contains(at(t, "2024-01-15 13:00", time.UTC)))
+}
+
+// check runs the authfunc at now
+func check(t *testing.T, s *Schedule, now time.Time) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	s.config.Now = func() time.Time { return now }
+	w := httptest.NewRecorder()
+	ret, err := s.Check(w, httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	return ret, w
+}
+
+// TestStandalone locks a staging site on weekends
+func TestStandalone(t *testing.T) {
+	s, err := New(Config{Rules: []Rule{{Deny: []Window{{Days: []time.Weekday{time.Saturday, time.Sunday}}}}}})
+	require.NoError(t, err)
+	ret, _ := check(t, s, at(t, "2024-01-05 12:00", time.UTC))
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	ret, w := check(t, s, at(t, "2024-01-06 12:00", time.UTC))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	_, err = New(Config{})
+	require.Equal(t, ErrBadRule, errors.Cause(err))
+	_, err = New(Config{Rules: []Rule{{Identities: []string{"["}}}})
+	require.Equal(t, ErrBadRule, errors.Cause(err))
+}
+
+// TestDefault checks OIDC-shaped info is matched on the field the rules are written for, and identities matching no rule get Default
+func TestDefault(t *testing.T) {
+	primary := func(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+		return authdoor.AuthFuncReturn{}, nil
+	}
+	_, err := New(Config{Primary: primary, Rules: []Rule{{}}})
+	require.Equal(t, ErrNoIdentity, err)
+
+	info := func(claims string) json.RawMessage { return json.RawMessage(claims) }
+	contractor := info(`{"iss":"https://accounts.example.com","sub":"248289761001","aud":"authdoor","email":"pat@contractors.example.com","email_verified":true}`)
+	staff := info(`{"iss":"https://accounts.example.com","sub":"110169484474","aud":"authdoor","email":"sam@example.com","email_verified":true}`)
+	monday, evening := at(t, "2024-01-01 10:00", time.UTC), at(t, "2024-01-01 20:00", time.UTC)
+
+	rules := []Rule{{Identities: []string{"*@contractors.example.com"}, Allow: []Window{{Cron: "* 9-16 * * mon-fri"}}}}
+	s, err := New(Config{Primary: primary, Identity: Fields("email"), Rules: rules})
+	require.NoError(t, err)
+	identity, ok := s.config.Identity(contractor)
+	require.True(t, ok)
+	require.Equal(t, "pat@contractors.example.com", identity)
+	require.True(t, s.Allowed(identity, monday))
+	require.False(t, s.Allowed(identity, evening))
+	identity, _ = s.config.Identity(staff)
+	require.False(t, s.Allowed(identity, monday))
+	require.False(t, s.Allowed("", monday))
+
+	s, err = New(Config{Primary: primary, Identity: Fields("email"), Rules: rules, Default: Allow})
+	require.NoError(t, err)
+	require.True(t, s.Allowed(identity, evening))
+	identity, _ = s.config.Identity(contractor)
+	require.False(t, s.Allowed(identity, evening))
+}
+
+// TestPrimary lets contractors in during business hours only
+func TestPrimary(t *testing.T) {
+	var primary authdoor.AuthFuncReturn
+	s, err := New(Config{
+		Primary: func(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+			return primary, nil
+		},
+		Identity: Fields("email", "user", "sub"),
+		Rules: []Rule{
+			{Identities: []string{"*@contractors.example.com"}, Allow: []Window{{Cron: "* 9-16 * * mon-fri"}}},
+			{Identities: []string{"oncall"}},
+			{Deny: []Window{{Days: []time.Weekday{time.Sunday}}}},
+		},
+	})
+	require.NoError(t, err)
+	grant := func(info string) {
+		primary = authdoor.AuthFuncReturn{Auth: authdoor.AuthGranted, Resp: authdoor.Ignored, Info: authdoor.InstanceReturnInfo{Info: json.RawMessage(info)}}
+	}
+	monday, sunday := at(t, "2024-01-01 10:00", time.UTC), at(t, "2024-01-07 10:00", time.UTC)
+
+	grant(`{"email":"pat@contractors.example.com"}`)
+	ret, _ := check(t, s, monday)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, "pat@contractors.example.com", info.Identity)
+	require.Equal(t, `{"email":"pat@contractors.example.com"}`, string(info.Primary))
+	ret, w := check(t, s, at(t, "2024-01-01 17:00", time.UTC))
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	// the first matching rule decides, so oncall isn't locked out on Sundays and everyone else is
+	grant(`{"user":"oncall"}`)
+	ret, _ = check(t, s, sunday)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	grant(`{"sub":"staff"}`)
+	ret, _ = check(t, s, monday)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	ret, _ = check(t, s, sunday)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	grant(`{}`)
+	ret, _ = check(t, s, sunday)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	// anything but a grant is passed on untouched
+	primary = authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}
+	ret, _ = check(t, s, sunday)
+	require.Equal(t, primary, ret)
+	require.True(t, s.Allowed("oncall", sunday))
+	require.False(t, s.Allowed("", sunday))
+}
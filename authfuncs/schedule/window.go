@@ -0,0 +1,107 @@
+package schedule
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Window is a span of time that repeats. Either set Cron, or Days and From and To.
+type Window struct {
+	// Days the window starts on, empty is every day
+	Days []time.Weekday
+	// From and To are "15:04" times of day. To may be "24:00", or earlier than From for a window running past midnight. Both empty is the whole day.
+	From string
+	To   string
+	// Cron is a five field cron expression, like "* 9-17 * * mon-fri". Every minute it matches is in the window.
+	Cron string
+	// Location is the time zone the window is in, defaults to Config.Location
+	Location *time.Location
+}
+
+// window is a parsed Window
+type window struct {
+	days     [7]bool
+	from, to int
+	cron     *cron
+	location *time.Location
+}
+
+// parseClock parses a "15:04" time of day into minutes after midnight
+func parseClock(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || len(parts[1]) != 2 {
+		return 0, errors.Wrap(ErrBadRule, "time of day "+s+" should look like 15:04")
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, errors.Wrap(ErrBadRule, "time of day "+s)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, errors.Wrap(ErrBadRule, "time of day "+s)
+	}
+	return hour*60 + minute, nil
+}
+
+// parseWindow checks and parses a Window
+func parseWindow(w Window, location *time.Location) (*window, error) {
+	ret := &window{location: location}
+	if w.Location != nil {
+		ret.location = w.Location
+	}
+	if w.Cron != "" {
+		if len(w.Days) != 0 || w.From != "" || w.To != "" {
+			return nil, errors.Wrap(ErrBadRule, "a window has either Cron or Days, From and To")
+		}
+		c, err := parseCron(w.Cron)
+		if err != nil {
+			return nil, err
+		}
+		ret.cron = c
+		return ret, nil
+	}
+	for _, day := range w.Days {
+		if day < time.Sunday || day > time.Saturday {
+			return nil, errors.Wrap(ErrBadRule, "bad weekday "+strconv.Itoa(int(day)))
+		}
+		ret.days[day] = true
+	}
+	if len(w.Days) == 0 {
+		ret.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	if w.From == "" && w.To == "" {
+		ret.to = 24 * 60
+		return ret, nil
+	}
+	var err error
+	if ret.from, err = parseClock(w.From); err != nil {
+		return nil, err
+	}
+	if ret.to, err = parseClock(w.To); err != nil {
+		return nil, err
+	}
+	if ret.from == ret.to || ret.from == 24*60 {
+		return nil, errors.Wrap(ErrBadRule, "window from "+w.From+" to "+w.To+" is empty")
+	}
+	return ret, nil
+}
+
+// contains reports whether t is in the window. A window running past midnight belongs to the day it starts on.
+func (w *window) contains(t time.Time) bool {
+	t = t.In(w.location)
+	if w.cron != nil {
+		return w.cron.match(t)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.from < w.to {
+		return w.days[day] && w.from <= minute && minute < w.to
+	}
+	if minute >= w.from {
+		return w.days[day]
+	}
+	return minute < w.to && w.days[(day+6)%7]
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ayjayt/authdoor/authfuncs/signedurl"
+)
+
+var file = flag.String("keys", "signedurl-keys.json", "key file")
+
+// usage prints the subcommands
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: signedurl [-keys signedurl-keys.json] genkey ID\n")
+	fmt.Fprintf(os.Stderr, "       signedurl [-keys signedurl-keys.json] sign [-key ID] [-for 24h] [-method GET] [-ip ADDRESS] URL\n")
+	fmt.Fprintf(os.Stderr, "       signedurl [-keys signedurl-keys.json] list\n")
+	os.Exit(2)
+}
+
+// fail prints err and exits
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "signedurl: %v\n", err)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	switch flag.Arg(0) {
+	case "genkey":
+		if flag.NArg() != 2 {
+			usage()
+		}
+		genkey(flag.Arg(1))
+	case "sign":
+		sign(flag.Args()[1:])
+	case "list":
+		keys, err := signedurl.LoadKeys(*file)
+		if err != nil {
+			fail(err)
+		}
+		ids := make([]string, 0, len(keys))
+		for keyID := range keys {
+			ids = append(ids, keyID)
+		}
+		sort.Strings(ids)
+		for _, keyID := range ids {
+			fmt.Println(keyID)
+		}
+	default:
+		usage()
+	}
+}
+
+// genkey adds a new key to the file, creating it if needed
+func genkey(keyID string) {
+	keys, err := signedurl.LoadKeys(*file)
+	if os.IsNotExist(err) {
+		keys, err = make(map[string][]byte), nil
+	}
+	if err != nil {
+		fail(err)
+	}
+	if _, ok := keys[keyID]; ok {
+		fail(fmt.Errorf("key %s already exists", keyID))
+	}
+	keys[keyID] = signedurl.GenerateKey()
+	if err := signedurl.SaveKeys(*file, keys); err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "added key %s to %s\n", keyID, *file)
+}
+
+// sign parses the sign flags and prints the signed URL
+func sign(args []string) {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyID := flags.String("key", "", "key ID to sign with, needed if the file has more than one")
+	lifetime := flags.Duration("for", 24*time.Hour, "how long the link works")
+	method := flags.String("method", "", "only allow this method")
+	ip := flags.String("ip", "", "only allow this client address")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	keys, err := signedurl.LoadKeys(*file)
+	if err != nil {
+		fail(err)
+	}
+	signer, err := signedurl.New(signedurl.Config{Keys: keys, SigningKey: *keyID})
+	if err != nil {
+		fail(err)
+	}
+	signed, err := signer.Sign(flags.Arg(0), *lifetime, *method, *ip)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "expires %s\n", time.Now().Add(*lifetime).UTC().Format(time.RFC3339))
+	fmt.Println(signed)
+}
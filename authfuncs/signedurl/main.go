@@ -0,0 +1,187 @@
+/*
+Package signedurl is an AuthFunc for sharing links. A link carries an HMAC over its path, query and expiry, and optionally the method and client address it's for, so someone without an account can open one URL until it expires. Links are minted with Sign or the signedurl command.
+*/
+package signedurl
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/ipfilter"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+var (
+	// ErrInvalid is returned for links that are malformed, signed with a key we don't have, or altered
+	ErrInvalid = errors.New("invalid signed URL")
+	// ErrExpired is returned for links past their expiry
+	ErrExpired = errors.New("signed URL expired")
+	// ErrTooLong is returned for links expiring further out than Config.MaxLifetime
+	ErrTooLong = errors.New("signed URL lifetime too long")
+	// ErrMethod is returned when a link is used with a method it wasn't signed for
+	ErrMethod = errors.New("signed URL not valid for this method")
+	// ErrIP is returned when a link is used from an address it wasn't signed for
+	ErrIP = errors.New("signed URL not valid from this address")
+)
+
+// Config lists the keys
+type Config struct {
+	// Keys are every key ID links may be signed with. Keep old keys here until their links expire, then remove them.
+	Keys map[string][]byte
+	// SigningKey is the key ID Sign uses, defaults to the only key if there's one
+	SigningKey string
+	// MaxLifetime, if set, refuses links expiring further than this from now, both when signing and checking
+	MaxLifetime time.Duration
+	// Resolver finds the client address for IP-bound links, nil uses RemoteAddr
+	Resolver *ipfilter.Resolver
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	KeyID   string    `json:"key_id"`
+	Expires time.Time `json:"expires"`
+	Method  string    `json:"method,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+}
+
+// SignedURL supplies an authfunc receiver and stores information to be used by that receiver
+type SignedURL struct {
+	config Config
+	now    func() time.Time
+}
+
+// New returns a SignedURL ready to be used as an AuthFunc
+func New(config Config) (*SignedURL, error) {
+	if len(config.Keys) == 0 {
+		return nil, errors.New("at least one key is required")
+	}
+	for keyID, key := range config.Keys {
+		if len(key) < 16 {
+			return nil, errors.New("key " + keyID + " is shorter than 16 bytes")
+		}
+	}
+	if config.SigningKey == "" && len(config.Keys) == 1 {
+		for keyID := range config.Keys {
+			config.SigningKey = keyID
+		}
+	}
+	if _, ok := config.Keys[config.SigningKey]; config.SigningKey != "" && !ok {
+		return nil, errors.New("SigningKey " + config.SigningKey + " isn't in Keys")
+	}
+	if config.Resolver == nil {
+		resolver, err := ipfilter.NewResolver(nil, "")
+		if err != nil {
+			return nil, err
+		}
+		config.Resolver = resolver
+	}
+	return &SignedURL{config: config, now: time.Now}, nil
+}
+
+// Sign signs rawURL with the SigningKey for lifetime
+func (s *SignedURL) Sign(rawURL string, lifetime time.Duration, method, ip string) (string, error) {
+	if s.config.SigningKey == "" {
+		return "", errors.New("no SigningKey configured")
+	}
+	if s.config.MaxLifetime != 0 && lifetime > s.config.MaxLifetime {
+		return "", ErrTooLong
+	}
+	return Sign(rawURL, s.config.SigningKey, s.config.Keys[s.config.SigningKey], Link{
+		Expires: s.now().Add(lifetime),
+		Method:  method,
+		IP:      ip,
+	})
+}
+
+// verify checks the request's signature and what it's bound to
+func (s *SignedURL) verify(r *http.Request) (*Info, error) {
+	query := r.URL.Query()
+	for _, param := range params {
+		if len(query[param]) > 1 {
+			return nil, errors.Wrap(ErrInvalid, "repeated "+param)
+		}
+	}
+	keyID, expires := query.Get(ParamKeyID), query.Get(ParamExpires)
+	method, ip, signature := query.Get(ParamMethod), query.Get(ParamIP), query.Get(ParamSignature)
+	for _, param := range params {
+		query.Del(param)
+	}
+	key, ok := s.config.Keys[keyID]
+	if !ok {
+		return nil, errors.Wrap(ErrInvalid, "unknown key "+keyID)
+	}
+	want := mac(key, canonical(keyID, expires, method, ip, r.URL.EscapedPath(), query))
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(want)) != 1 {
+		return nil, errors.Wrap(ErrInvalid, "signature doesn't match")
+	}
+	// past here everything was signed by someone with the key
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalid, "bad expiry")
+	}
+	info := &Info{KeyID: keyID, Expires: time.Unix(unix, 0).UTC(), Method: method, IP: ip}
+	now := s.now()
+	if !now.Before(info.Expires) {
+		return info, ErrExpired
+	}
+	if s.config.MaxLifetime != 0 && info.Expires.Sub(now) > s.config.MaxLifetime {
+		return info, ErrTooLong
+	}
+	if method != "" && method != r.Method && !(method == "GET" && r.Method == "HEAD") {
+		return info, ErrMethod
+	}
+	if ip != "" {
+		client := s.config.Resolver.ClientIP(r)
+		if client == nil || !client.Equal(net.ParseIP(ip)) {
+			return info, ErrIP
+		}
+	}
+	return info, nil
+}
+
+// Check is an authfunc. Requests without a signature fail quietly so later instances decide, a bad, expired or misused link is answered with 403.
+func (s *SignedURL) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if _, ok := r.URL.Query()[ParamSignature]; !ok {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	info, err := s.verify(r)
+	if err != nil {
+		defaultLogger.Info("signedurl refused " + r.URL.Path + ": " + err.Error())
+		message := "This link is invalid."
+		if err == ErrExpired {
+			message = "This link has expired."
+		}
+		http.Error(w, message, http.StatusForbidden)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: infoJSON},
+	}, nil
+}
@@ -0,0 +1,207 @@
+package signedurl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/ipfilter"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/signedurl/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// check runs the authfunc on a request for target
+func check(t *testing.T, s *SignedURL, method, target, remoteAddr string) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, nil)
+	if remoteAddr != "" {
+		r.RemoteAddr = remoteAddr
+	}
+	ret, err := s.Check(w, r)
+	require.NoError(t, err)
+	return ret, w
+}
+
+// TestCheck signs links and checks what they're good for
+func TestCheck(t *testing.T) {
+	s, err := New(Config{Keys: map[string][]byte{"2024": GenerateKey()}})
+	require.NoError(t, err)
+	signed, err := s.Sign("https://files.example.com/reports/q3.pdf?download=1", time.Hour, "", "")
+	require.NoError(t, err)
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	require.Equal(t, "2024", u.Query().Get(ParamKeyID))
+
+	ret, _ := check(t, s, "GET", u.RequestURI(), "")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, "2024", info.KeyID)
+	require.True(t, info.Expires.Sub(time.Now().Add(time.Hour)) < 2*time.Second)
+
+	ret, _ = check(t, s, "GET", "/reports/q3.pdf", "")
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	// anything changed in the link is refused
+	altered := []string{
+		strings.Replace(u.RequestURI(), "q3.pdf", "q4.pdf", 1),
+		strings.Replace(u.RequestURI(), "download=1", "download=2", 1),
+		u.RequestURI() + "&extra=1",
+		strings.Replace(u.RequestURI(), "download=1&", "", 1),
+		strings.Replace(u.RequestURI(), ParamExpires+"=", ParamExpires+"=9", 1),
+		strings.Replace(u.RequestURI(), ParamKeyID+"=2024", ParamKeyID+"=2023", 1),
+		u.RequestURI() + "&" + ParamSignature + "=x",
+		u.RequestURI() + "&" + ParamMethod + "=GET",
+	}
+	for _, target := range altered {
+		ret, w := check(t, s, "GET", target, "")
+		require.Equal(t, authdoor.AuthDenied, ret.Auth, target)
+		require.Equal(t, authdoor.Answered, ret.Resp, target)
+		require.Equal(t, http.StatusForbidden, w.Code, target)
+	}
+
+	s.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	ret, w := check(t, s, "GET", u.RequestURI(), "")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Contains(t, w.Body.String(), "expired")
+	s.now = time.Now
+
+	_, err = s.Sign(signed, time.Hour, "", "")
+	require.Error(t, err)
+	_, err = Sign("/x", "2024", GenerateKey(), Link{})
+	require.Error(t, err)
+}
+
+// TestBinding checks method and address bound links
+func TestBinding(t *testing.T) {
+	resolver, err := ipfilter.NewResolver([]string{"10.0.0.0/8"}, "")
+	require.NoError(t, err)
+	s, err := New(Config{Keys: map[string][]byte{"a": GenerateKey()}, Resolver: resolver})
+	require.NoError(t, err)
+
+	signed, err := s.Sign("/upload", time.Hour, "put", "")
+	require.NoError(t, err)
+	ret, _ := check(t, s, "PUT", signed, "")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	ret, _ = check(t, s, "GET", signed, "")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	signed, err = s.Sign("/file", time.Hour, "GET", "")
+	require.NoError(t, err)
+	ret, _ = check(t, s, "HEAD", signed, "")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	signed, err = s.Sign("/file", time.Hour, "", "2001:db8::1")
+	require.NoError(t, err)
+	require.Contains(t, signed, ParamIP+"=2001%3Adb8%3A%3A1")
+	ret, _ = check(t, s, "GET", signed, "[2001:db8::1]:1234")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	ret, _ = check(t, s, "GET", signed, "192.0.2.1:1234")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	// behind a trusted proxy the forwarded address is what counts
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", signed, nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("X-Forwarded-For", "2001:db8::1")
+	ret, err = s.Check(w, r)
+	require.NoError(t, err)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	_, err = s.Sign("/file", time.Hour, "", "not an address")
+	require.Error(t, err)
+}
+
+// TestRotation checks links signed with an old key work until the key is removed
+func TestRotation(t *testing.T) {
+	keys := map[string][]byte{"old": GenerateKey(), "new": GenerateKey()}
+	_, err := New(Config{Keys: keys, SigningKey: "missing"})
+	require.Error(t, err)
+	_, err = New(Config{Keys: map[string][]byte{"short": []byte("x")}})
+	require.Error(t, err)
+
+	old, err := New(Config{Keys: keys, SigningKey: "old"})
+	require.NoError(t, err)
+	oldLink, err := old.Sign("/f", time.Hour, "", "")
+	require.NoError(t, err)
+	current, err := New(Config{Keys: keys, SigningKey: "new", MaxLifetime: 24 * time.Hour})
+	require.NoError(t, err)
+	newLink, err := current.Sign("/f", time.Hour, "", "")
+	require.NoError(t, err)
+	require.Contains(t, newLink, ParamKeyID+"=new")
+
+	for _, link := range []string{oldLink, newLink} {
+		ret, _ := check(t, current, "GET", link, "")
+		require.Equal(t, authdoor.AuthGranted, ret.Auth, link)
+	}
+	_, err = current.Sign("/f", 48*time.Hour, "", "")
+	require.Equal(t, ErrTooLong, err)
+	tooLong, err := old.Sign("/f", 48*time.Hour, "", "")
+	require.NoError(t, err)
+	ret, _ := check(t, current, "GET", tooLong, "")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	rotated, err := New(Config{Keys: map[string][]byte{"new": keys["new"]}})
+	require.NoError(t, err)
+	ret, _ = check(t, rotated, "GET", oldLink, "")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	ret, _ = check(t, rotated, "GET", newLink, "")
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+}
+
+// TestKeys saves and loads a key file
+func TestKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signedurl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys.json")
+	keys := map[string][]byte{"a": GenerateKey(), "b": GenerateKey()}
+	require.NoError(t, SaveKeys(file, keys))
+	stat, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	loaded, err := LoadKeys(file)
+	require.NoError(t, err)
+	require.Equal(t, keys, loaded)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"a":"c2hvcnQ="}`), 0600))
+	_, err = LoadKeys(file)
+	require.Error(t, err)
+	_, err = LoadKeys(filepath.Join(dir, "missing.json"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,155 @@
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Query parameters a signed URL carries. Everything else in the query is signed too, so parameters can't be added or changed.
+const (
+	ParamKeyID     = "sig_key"
+	ParamExpires   = "sig_expires"
+	ParamMethod    = "sig_method"
+	ParamIP        = "sig_ip"
+	ParamSignature = "sig"
+)
+
+// params are all of ours
+var params = []string{ParamKeyID, ParamExpires, ParamMethod, ParamIP, ParamSignature}
+
+// Link is what a signed URL is limited to
+type Link struct {
+	Expires time.Time
+	// Method, if set, is the only method allowed. GET also allows HEAD.
+	Method string
+	// IP, if set, is the only client address allowed
+	IP string
+}
+
+// canonical is the string that's MACed
+func canonical(keyID, expires, method, ip, path string, query url.Values) string {
+	return strings.Join([]string{"authdoor-signedurl-v1", keyID, expires, method, ip, path, query.Encode()}, "\n")
+}
+
+// mac returns the base64url HMAC-SHA256 of s
+func mac(key []byte, s string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Sign returns rawURL signed with the key given. The host isn't signed, so a link works on any name the site answers to.
+func Sign(rawURL, keyID string, key []byte, link Link) (string, error) {
+	if keyID == "" || len(key) == 0 {
+		return "", errors.New("a key ID and key are required")
+	}
+	if link.Expires.IsZero() {
+		return "", errors.New("links have to expire")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for _, param := range params {
+		if _, ok := query[param]; ok {
+			return "", errors.New("URL already has " + param)
+		}
+	}
+	method := strings.ToUpper(link.Method)
+	ip := ""
+	if link.IP != "" {
+		parsed := net.ParseIP(link.IP)
+		if parsed == nil {
+			return "", errors.New("bad IP " + link.IP)
+		}
+		ip = parsed.String()
+	}
+	expires := strconv.FormatInt(link.Expires.Unix(), 10)
+	signature := mac(key, canonical(keyID, expires, method, ip, u.EscapedPath(), query))
+	query.Set(ParamKeyID, keyID)
+	query.Set(ParamExpires, expires)
+	if method != "" {
+		query.Set(ParamMethod, method)
+	}
+	if ip != "" {
+		query.Set(ParamIP, ip)
+	}
+	query.Set(ParamSignature, signature)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// GenerateKey returns a new random key
+func GenerateKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// LoadKeys reads a JSON file of key IDs to base64 keys
+func LoadKeys(file string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make(map[string]string)
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+	keys := make(map[string][]byte, len(encoded))
+	for keyID, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) < 16 {
+			return nil, errors.New(file + ": key " + keyID + " isn't at least 16 bytes of base64")
+		}
+		keys[keyID] = key
+	}
+	return keys, nil
+}
+
+// SaveKeys writes keys for LoadKeys, readable only by the owner
+func SaveKeys(file string, keys map[string][]byte) error {
+	encoded := make(map[string]string, len(keys))
+	for keyID, key := range keys {
+		encoded[keyID] = base64.StdEncoding.EncodeToString(key)
+	}
+	data, err := json.MarshalIndent(encoded, "", "  ")
+	if err != nil {
+		return err
+	}
+	// TempFile makes the file 0600, which the rename keeps
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".signedurl-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+/*
+Package totp adds an RFC 6238 second factor to another AuthFunc. It wraps the primary AuthFunc rather than following it in a list, since a list stops at the first grant: once the primary grants, the identity is read from its info and the user has to enter a code (or enroll) before the grant is passed on.
+*/
+package totp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/redirect"
+	"github.com/ayjayt/authdoor/authfuncs/internal/session"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// IdentityFields are tried in order when Config.Identity is nil. They cover the info of the authfuncs in this repo.
+var IdentityFields = []string{"user", "login", "sub", "email", "owner", "id"}
+
+// Config describes the second factor
+type Config struct {
+	// Primary is the first factor, its grants are held back until a code is entered
+	Primary authdoor.AuthFunc
+	Store   Store
+	// Issuer is shown in authenticator apps
+	Issuer string
+	// Identity picks the user out of the primary's info, defaults to the first string in IdentityFields
+	Identity func(info json.RawMessage) (string, bool)
+	// Period and Digits default to 30 seconds and 6
+	Period time.Duration
+	Digits int
+	// Skew is how many periods either side of now are accepted, defaults to 1
+	Skew int
+	// RecoveryCodes is how many are made at enrollment, defaults to 10
+	RecoveryCodes int
+	// DisableEnrollment denies users who haven't enrolled instead of enrolling them
+	DisableEnrollment bool
+	// SessionLength defaults to 6 hours like basicpass
+	SessionLength time.Duration
+	// MaxAttempts is how many wrong codes an identity can enter before it's locked out, defaults to 5
+	MaxAttempts int
+	// LockoutLength is how long a lockout lasts after the last wrong code, defaults to 15 minutes
+	LockoutLength time.Duration
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	Identity string          `json:"identity"`
+	Primary  json.RawMessage `json:"primary,omitempty"`
+}
+
+// TOTP supplies an authfunc receiver and stores information to be used by that receiver
+type TOTP struct {
+	config Config
+	uuid   string
+	// sessions holds the identity that passed the second factor by session id
+	sessions *session.Map
+	// pending holds secrets shown to users who haven't confirmed them yet, by identity
+	pending *session.Map
+	// failures counts codes entered by identity since the last one that worked, until LockoutLength after the last one
+	failures *session.Map
+	mutex    *sync.Mutex
+	now      func() time.Time
+}
+
+// New returns a TOTP ready to be used as an AuthFunc
+func New(config Config) (*TOTP, error) {
+	if config.Primary == nil || config.Store == nil {
+		return nil, errors.New("Primary and Store are required")
+	}
+	if config.Issuer == "" {
+		config.Issuer = "authdoor"
+	}
+	if config.Identity == nil {
+		config.Identity = defaultIdentity
+	}
+	if config.Period == 0 {
+		config.Period = 30 * time.Second
+	}
+	if config.Digits == 0 {
+		config.Digits = 6
+	}
+	if config.Skew == 0 {
+		config.Skew = 1
+	}
+	if config.RecoveryCodes == 0 {
+		config.RecoveryCodes = 10
+	}
+	if config.SessionLength == 0 {
+		config.SessionLength = 6 * time.Hour
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 5
+	}
+	if config.LockoutLength == 0 {
+		config.LockoutLength = 15 * time.Minute
+	}
+	return &TOTP{
+		config:   config,
+		uuid:     uuid.New().String(),
+		sessions: session.New(),
+		pending:  session.New(),
+		failures: session.New(),
+		mutex:    new(sync.Mutex),
+		now:      time.Now,
+	}, nil
+}
+
+// defaultIdentity returns the first non-empty string in IdentityFields
+func defaultIdentity(info json.RawMessage) (string, bool) {
+	fields := map[string]interface{}{}
+	if json.Unmarshal(info, &fields) != nil {
+		return "", false
+	}
+	for _, name := range IdentityFields {
+		if value, ok := fields[name].(string); ok && value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// cookieName is the name of the session cookie
+func (t *TOTP) cookieName() string {
+	return "totp-" + t.uuid
+}
+
+// randomSecret returns n random bytes
+func randomSecret(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// failed is returned whenever a page is shown
+var failed = authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}
+
+// Check is an authfunc that runs the primary and, if it grants, requires the second factor
+func (t *TOTP) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	ret, err := t.config.Primary(w, r)
+	if err != nil || ret.Auth != authdoor.AuthGranted {
+		return ret, err
+	}
+	if ret.Resp == authdoor.Answered {
+		// the primary is finishing its own login, probably with a redirect. The code is asked for on the next request.
+		return failed, nil
+	}
+	identity, ok := t.config.Identity(ret.Info.Info)
+	if !ok {
+		defaultLogger.Error("totp couldn't find an identity in the primary's info")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	if t.hasSession(r, identity) {
+		return t.granted(identity, ret.Info.Info)
+	}
+	_, err = t.config.Store.Get(identity)
+	if errors.Cause(err) == ErrNotEnrolled {
+		return t.enroll(w, r, identity)
+	}
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	if r.Method == "POST" && r.PostFormValue("totp-reference") == t.uuid && r.PostFormValue("totp-action") == "verify" {
+		return t.verify(w, r, identity)
+	}
+	return t.render(w, http.StatusOK, codePage, pageData{Reference: t.uuid})
+}
+
+// hasSession reports whether the request carries a second factor session for identity
+func (t *TOTP) hasSession(r *http.Request, identity string) bool {
+	cookie, err := r.Cookie(t.cookieName())
+	if err != nil {
+		return false
+	}
+	owner, ok := t.sessions.Get(cookie.Value, t.now())
+	if !ok {
+		return false
+	}
+	// a session belongs to whoever passed the primary when it was made
+	return subtle.ConstantTimeCompare([]byte(owner.(string)), []byte(identity)) == 1
+}
+
+// startSession sets the session cookie
+func (t *TOTP) startSession(w http.ResponseWriter, r *http.Request, identity string) {
+	sess := uuid.New().String()
+	now := t.now()
+	t.sessions.Set(sess, identity, now.Add(t.config.SessionLength), now)
+	http.SetCookie(w, &http.Cookie{
+		Name:     t.cookieName(),
+		Value:    sess,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// granted passes the primary's grant on
+func (t *TOTP) granted(identity string, primary json.RawMessage) (authdoor.AuthFuncReturn, error) {
+	info, err := json.Marshal(Info{Identity: identity, Primary: primary})
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	return authdoor.AuthFuncReturn{
+		Auth: authdoor.AuthGranted,
+		Resp: authdoor.Ignored,
+		Info: authdoor.InstanceReturnInfo{Info: info},
+	}, nil
+}
+
+// normalizeCode strips the spaces and dashes people type
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+// verify checks a posted code or recovery code. The grant happens on the request we redirect to, granting here would hand the POST to the base handler.
+func (t *TOTP) verify(w http.ResponseWriter, r *http.Request, identity string) (authdoor.AuthFuncReturn, error) {
+	code := normalizeCode(r.PostFormValue("totp-code"))
+	now := t.now()
+	if !t.attempt(identity, now) {
+		defaultLogger.Info("totp refused a code for " + identity + " who is locked out")
+		t.render(w, http.StatusTooManyRequests, codePage, pageData{Reference: t.uuid, Error: "Too many wrong codes, try again later."})
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	ok := false
+	err := t.config.Store.Update(identity, func(e *Enrollment) bool {
+		if counter, match := matchCode(e.Secret, code, now, t.config.Period, t.config.Digits, t.config.Skew); match {
+			if counter <= e.LastCounter {
+				defaultLogger.Info("totp code replayed for " + identity)
+				return false
+			}
+			e.LastCounter = counter
+			ok = true
+			return true
+		}
+		for i, stored := range e.RecoveryCodes {
+			colon := strings.IndexByte(stored, ':')
+			if colon == -1 {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(hashRecoveryCode(stored[:colon], code)), []byte(stored)) == 1 {
+				e.RecoveryCodes = append(e.RecoveryCodes[:i], e.RecoveryCodes[i+1:]...)
+				defaultLogger.Info("totp recovery code used for " + identity)
+				ok = true
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	if !ok {
+		t.render(w, http.StatusUnauthorized, codePage, pageData{Reference: t.uuid, Error: "That code didn't work."})
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	t.failures.Delete(identity)
+	t.startSession(w, r, identity)
+	http.Redirect(w, r, redirect.Local(r.URL.RequestURI()), http.StatusSeeOther)
+	return failed, nil
+}
+
+// attempt counts a code entered for identity, and reports false if it's locked out. Codes are counted before they're checked so concurrent guesses can't get past MaxAttempts, and the count is cleared when one works.
+func (t *TOTP) attempt(identity string, now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	count := 0
+	if c, ok := t.failures.Get(identity, now); ok {
+		count = c.(int)
+	}
+	if count >= t.config.MaxAttempts {
+		return false
+	}
+	t.failures.Set(identity, count+1, now.Add(t.config.LockoutLength), now)
+	return true
+}
+
+// enroll shows a new secret, and once a code for it is posted, saves it and shows the recovery codes
+func (t *TOTP) enroll(w http.ResponseWriter, r *http.Request, identity string) (authdoor.AuthFuncReturn, error) {
+	if t.config.DisableEnrollment {
+		defaultLogger.Info("totp denied " + identity + " who isn't enrolled")
+		http.Error(w, "a second factor is required, ask an administrator to enroll you", http.StatusForbidden)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	now := t.now()
+	t.mutex.Lock()
+	var secret []byte
+	if pending, ok := t.pending.Get(identity, now); ok {
+		secret = pending.([]byte)
+	} else {
+		secret = randomSecret(20)
+		t.pending.Set(identity, secret, now.Add(10*time.Minute), now)
+	}
+	t.mutex.Unlock()
+
+	data := pageData{
+		Reference: t.uuid,
+		Secret:    secretEncoding.EncodeToString(secret),
+		URI:       ProvisioningURI(t.config.Issuer, identity, secret, t.config.Period, t.config.Digits),
+	}
+	if r.Method != "POST" || r.PostFormValue("totp-reference") != t.uuid || r.PostFormValue("totp-action") != "enroll" {
+		return t.render(w, http.StatusOK, enrollPage, data)
+	}
+	counter, match := matchCode(secret, normalizeCode(r.PostFormValue("totp-code")), now, t.config.Period, t.config.Digits, t.config.Skew)
+	if !match {
+		data.Error = "That code didn't work, check your device's clock."
+		t.render(w, http.StatusUnauthorized, enrollPage, data)
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}, nil
+	}
+	enrollment := &Enrollment{Secret: secret, LastCounter: counter, Created: now.UTC()}
+	for i := 0; i < t.config.RecoveryCodes; i++ {
+		code := strings.ToLower(secretEncoding.EncodeToString(randomSecret(5)))
+		data.RecoveryCodes = append(data.RecoveryCodes, code[:4]+"-"+code[4:])
+		enrollment.RecoveryCodes = append(enrollment.RecoveryCodes, hashRecoveryCode(secretEncoding.EncodeToString(randomSecret(5)), code))
+	}
+	if err := t.config.Store.Put(identity, enrollment); err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	t.pending.Delete(identity)
+	defaultLogger.Info("totp enrolled " + identity)
+	t.startSession(w, r, identity)
+	data.Continue = redirect.Local(r.URL.RequestURI())
+	return t.render(w, http.StatusOK, recoveryPage, data)
+}
+
+// pageData fills the templates
+type pageData struct {
+	Reference     string
+	Error         string
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+	Continue      string
+}
+
+// render writes a page and returns failed, since a page is never a grant
+func (t *TOTP) render(w http.ResponseWriter, status int, page *template.Template, data pageData) (authdoor.AuthFuncReturn, error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := page.Execute(w, data); err != nil {
+		return failed, err
+	}
+	return failed, nil
+}
+
+var (
+	codePage = template.Must(template.New("code").Parse(`<html><body>
+	<form method="POST">
+		<p>Enter the code from your authenticator app, or a recovery code.</p>
+		{{if .Error}}<p>{{.Error}}</p>{{end}}
+		<input name="totp-code" autocomplete="one-time-code" autofocus />
+		<input name="totp-reference" type="hidden" value="{{.Reference}}" />
+		<input name="totp-action" type="hidden" value="verify" />
+		<button type="submit">Submit</button>
+	</form>
+</body></html>
+`))
+	enrollPage = template.Must(template.New("enroll").Parse(`<html><body>
+	<form method="POST">
+		<p>Add this account to your authenticator app by typing the key <code>{{.Secret}}</code>, or pasting <code>{{.URI}}</code> if it takes a URI, then enter the code it shows.</p>
+		{{if .Error}}<p>{{.Error}}</p>{{end}}
+		<input name="totp-code" autocomplete="one-time-code" autofocus />
+		<input name="totp-reference" type="hidden" value="{{.Reference}}" />
+		<input name="totp-action" type="hidden" value="enroll" />
+		<button type="submit">Enroll</button>
+	</form>
+</body></html>
+`))
+	recoveryPage = template.Must(template.New("recovery").Parse(`<html><body>
+	<p>Keep these recovery codes somewhere safe. Each one works once if you lose your device, and they won't be shown again.</p>
+	<ul>{{range .RecoveryCodes}}<li><code>{{.}}</code></li>{{end}}</ul>
+	<a href="{{.Continue}}">Continue</a>
+</body></html>
+`))
+)
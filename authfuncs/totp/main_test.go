@@ -0,0 +1,352 @@
+package totp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/totp/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// TestHOTP checks the SHA1 vectors from RFC 6238 appendix B
+func TestHOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, want := range vectors {
+		require.Equal(t, want, hotp(secret, counterAt(time.Unix(unix, 0), 30*time.Second), 8))
+	}
+	counter, ok := matchCode(secret, "94287082", time.Unix(89, 0), 30*time.Second, 8, 1)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), counter)
+	_, ok = matchCode(secret, "94287082", time.Unix(120, 0), 30*time.Second, 8, 1)
+	require.False(t, ok)
+}
+
+// TestProvisioningURI checks the label and parameters
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(ProvisioningURI("Example Co", "aj@example.com", []byte("12345678901234567890"), 30*time.Second, 6))
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "totp", uri.Host)
+	require.Equal(t, "/Example Co:aj@example.com", uri.Path)
+	require.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	require.Equal(t, "Example Co", uri.Query().Get("issuer"))
+	require.Equal(t, "6", uri.Query().Get("digits"))
+}
+
+// TestFileStore checks secrets are encrypted, survive reopening, and need the right key
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "totp.json")
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	_, err = OpenFileStore(file, []byte("short"))
+	require.Equal(t, ErrKeySize, err)
+
+	store, err := OpenFileStore(file, key)
+	require.NoError(t, err)
+	_, err = store.Get("aj")
+	require.Equal(t, ErrNotEnrolled, err)
+	require.NoError(t, store.Put("aj", &Enrollment{Secret: []byte("a very secret value"), LastCounter: 5}))
+
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "a very secret value")
+
+	reopened, err := OpenFileStore(file, key)
+	require.NoError(t, err)
+	enrollment, err := reopened.Get("aj")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a very secret value"), enrollment.Secret)
+	require.NoError(t, reopened.Update("aj", func(e *Enrollment) bool {
+		e.LastCounter = 6
+		return true
+	}))
+	enrollment, err = reopened.Get("aj")
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), enrollment.LastCounter)
+
+	wrongKey, err := OpenFileStore(file, []byte("fedcba9876543210fedcba9876543210"))
+	require.NoError(t, err)
+	_, err = wrongKey.Get("aj")
+	require.Equal(t, ErrDecrypt, err)
+
+	// a secret moved to another identity doesn't open
+	entries := map[string]json.RawMessage{}
+	require.NoError(t, json.Unmarshal(data, &entries))
+	entries["bob"] = entries["aj"]
+	data, err = json.Marshal(entries)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+	swapped, err := OpenFileStore(file, key)
+	require.NoError(t, err)
+	_, err = swapped.Get("bob")
+	require.Equal(t, ErrDecrypt, err)
+}
+
+// memoryStore is a Store for tests
+type memoryStore map[string]Enrollment
+
+func (m memoryStore) Get(identity string) (*Enrollment, error) {
+	e, ok := m[identity]
+	if !ok {
+		return nil, ErrNotEnrolled
+	}
+	e.RecoveryCodes = append([]string{}, e.RecoveryCodes...)
+	return &e, nil
+}
+
+func (m memoryStore) Put(identity string, enrollment *Enrollment) error {
+	m[identity] = *enrollment
+	return nil
+}
+
+func (m memoryStore) Update(identity string, fn func(*Enrollment) bool) error {
+	e, err := m.Get(identity)
+	if err != nil {
+		return err
+	}
+	if fn(e) {
+		m[identity] = *e
+	}
+	return nil
+}
+
+// primary grants whoever sends X-User
+func primary(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	user := r.Header.Get("X-User")
+	if user == "" {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, nil
+	}
+	info, _ := json.Marshal(map[string]string{"user": user})
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthGranted, Resp: authdoor.Ignored, Info: authdoor.InstanceReturnInfo{Info: info}}, nil
+}
+
+// client keeps cookies between requests to a TOTP
+type client struct {
+	t       *testing.T
+	totp    *TOTP
+	user    string
+	cookies []*http.Cookie
+	// path is requested instead of /page if set
+	path string
+}
+
+// do runs Check with a GET, or a POST of form if it isn't nil
+func (c *client) do(form url.Values) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	path := "https://app.local/page"
+	if c.path != "" {
+		path = "https://app.local" + c.path
+	}
+	req := httptest.NewRequest("GET", path, nil)
+	if form != nil {
+		form.Set("totp-reference", c.totp.uuid)
+		req = httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("X-User", c.user)
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	ret, err := c.totp.Check(recorder, req)
+	require.NoError(c.t, err)
+	c.cookies = append(c.cookies, recorder.Result().Cookies()...)
+	return ret, recorder
+}
+
+var (
+	secretRegexp   = regexp.MustCompile(`secret=([A-Z2-7]+)`)
+	recoveryRegexp = regexp.MustCompile(`<code>([a-z2-7]{4}-[a-z2-7]{4})</code>`)
+)
+
+// TestFlow enrolls a user, logs in, and checks replays, drift and recovery codes
+func TestFlow(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	store := memoryStore{}
+	totp, err := New(Config{Primary: primary, Store: store, Issuer: "test"})
+	require.NoError(t, err)
+	totp.now = func() time.Time { return now }
+
+	// the primary failing passes through
+	anonymous := &client{t: t, totp: totp}
+	ret, _ := anonymous.do(nil)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+
+	// enrollment shows a secret and takes a code for it
+	aj := &client{t: t, totp: totp, user: "aj"}
+	ret, recorder := aj.do(nil)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	match := secretRegexp.FindStringSubmatch(recorder.Body.String())
+	require.NotNil(t, match)
+	secret, err := secretEncoding.DecodeString(match[1])
+	require.NoError(t, err)
+
+	ret, recorder = aj.do(url.Values{"totp-action": {"enroll"}, "totp-code": {"000000"}})
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	ret, recorder = aj.do(url.Values{"totp-action": {"enroll"}, "totp-code": {hotp(secret, counterAt(now, 30*time.Second), 6)}})
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	recovery := recoveryRegexp.FindAllStringSubmatch(recorder.Body.String(), -1)
+	require.Len(t, recovery, 10)
+	require.Len(t, store["aj"].RecoveryCodes, 10)
+
+	// the enrollment started a session
+	ret, _ = aj.do(nil)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, "aj", info.Identity)
+
+	// a session isn't shared with another identity
+	aj.user = "bob"
+	ret, _ = aj.do(nil)
+	require.NotEqual(t, authdoor.AuthGranted, ret.Auth)
+	aj.user = "aj"
+
+	// a fresh browser has to enter a code, and the enrollment code is already used
+	laptop := &client{t: t, totp: totp, user: "aj"}
+	ret, recorder = laptop.do(nil)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Contains(t, recorder.Body.String(), `value="verify"`)
+	ret, _ = laptop.do(url.Values{"totp-action": {"verify"}, "totp-code": {hotp(secret, counterAt(now, 30*time.Second), 6)}})
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	// a code one step ahead is within the skew, and redirects back with a session
+	now = now.Add(5 * time.Second)
+	code := hotp(secret, counterAt(now, 30*time.Second)+1, 6)
+	ret, recorder = laptop.do(url.Values{"totp-action": {"verify"}, "totp-code": {code[:3] + " " + code[3:]}})
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, http.StatusSeeOther, recorder.Code)
+	ret, _ = laptop.do(nil)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+
+	// replaying it fails, as does anything two steps off
+	phone := &client{t: t, totp: totp, user: "aj"}
+	ret, _ = phone.do(url.Values{"totp-action": {"verify"}, "totp-code": {code}})
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	ret, _ = phone.do(url.Values{"totp-action": {"verify"}, "totp-code": {hotp(secret, counterAt(now, 30*time.Second)+3, 6)}})
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	// recovery codes work once, in any case
+	ret, recorder = phone.do(url.Values{"totp-action": {"verify"}, "totp-code": {strings.ToUpper(recovery[0][1])}})
+	require.Equal(t, http.StatusSeeOther, recorder.Code)
+	require.Len(t, store["aj"].RecoveryCodes, 9)
+	tablet := &client{t: t, totp: totp, user: "aj"}
+	ret, _ = tablet.do(url.Values{"totp-action": {"verify"}, "totp-code": {recovery[0][1]}})
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+
+	// sessions expire
+	now = now.Add(7 * time.Hour)
+	ret, _ = laptop.do(nil)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+}
+
+// TestOpenRedirect makes sure passing the second factor at a path another host could be read from doesn't send the user there
+func TestOpenRedirect(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	secret := randomSecret(20)
+	totp, err := New(Config{Primary: primary, Store: memoryStore{"aj": {Secret: secret}}})
+	require.NoError(t, err)
+	totp.now = func() time.Time { return now }
+	ret, recorder := (&client{t: t, totp: totp, user: "aj", path: "//evil.com/x"}).do(url.Values{"totp-action": {"verify"}, "totp-code": {hotp(secret, counterAt(now, 30*time.Second), 6)}})
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, http.StatusSeeOther, recorder.Code)
+	require.Equal(t, "/", recorder.Header().Get("Location"))
+}
+
+// TestLockout locks an identity out after MaxAttempts wrong codes, even from another browser and with the right code
+func TestLockout(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	secret := randomSecret(20)
+	totp, err := New(Config{Primary: primary, Store: memoryStore{"aj": {Secret: secret}, "bob": {Secret: secret}}, MaxAttempts: 3})
+	require.NoError(t, err)
+	totp.now = func() time.Time { return now }
+	right := func() url.Values {
+		return url.Values{"totp-action": {"verify"}, "totp-code": {hotp(secret, counterAt(now, 30*time.Second), 6)}}
+	}
+	wrong := url.Values{"totp-action": {"verify"}, "totp-code": {"000000"}}
+
+	// a right code clears the count
+	for i := 0; i < 2; i++ {
+		_, recorder := (&client{t: t, totp: totp, user: "aj"}).do(wrong)
+		require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	}
+	_, recorder := (&client{t: t, totp: totp, user: "aj"}).do(right())
+	require.Equal(t, http.StatusSeeOther, recorder.Code)
+
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		_, recorder = (&client{t: t, totp: totp, user: "aj"}).do(wrong)
+		require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	}
+	ret, recorder := (&client{t: t, totp: totp, user: "aj"}).do(right())
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Empty(t, recorder.Result().Cookies())
+
+	// other identities aren't affected
+	_, recorder = (&client{t: t, totp: totp, user: "bob"}).do(right())
+	require.Equal(t, http.StatusSeeOther, recorder.Code)
+
+	// the lockout ends LockoutLength after the last wrong code
+	now = now.Add(16 * time.Minute)
+	_, recorder = (&client{t: t, totp: totp, user: "aj"}).do(right())
+	require.Equal(t, http.StatusSeeOther, recorder.Code)
+}
+
+// TestDisableEnrollment denies users who haven't enrolled
+func TestDisableEnrollment(t *testing.T) {
+	totp, err := New(Config{Primary: primary, Store: memoryStore{}, DisableEnrollment: true})
+	require.NoError(t, err)
+	ret, recorder := (&client{t: t, totp: totp, user: "aj"}).do(nil)
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+}
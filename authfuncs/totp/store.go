@@ -0,0 +1,212 @@
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotEnrolled is returned by stores for identities without an enrollment
+	ErrNotEnrolled = errors.New("not enrolled")
+	// ErrKeySize is returned when the store's encryption key isn't 16, 24 or 32 bytes
+	ErrKeySize = errors.New("encryption key must be 16, 24 or 32 bytes")
+	// ErrDecrypt is returned when a stored secret can't be decrypted, usually a wrong key
+	ErrDecrypt = errors.New("couldn't decrypt secret")
+)
+
+// Enrollment is one identity's second factor
+type Enrollment struct {
+	Secret []byte
+	// RecoveryCodes are salted hashes of unused recovery codes
+	RecoveryCodes []string
+	// LastCounter is the last time step accepted, codes for it or earlier are replays
+	LastCounter uint64
+	Created     time.Time
+}
+
+// Store keeps enrollments. Update must be atomic for replay protection to hold.
+type Store interface {
+	// Get returns ErrNotEnrolled for unknown identities
+	Get(identity string) (*Enrollment, error)
+	// Put creates or replaces an enrollment
+	Put(identity string, enrollment *Enrollment) error
+	// Update runs fn on the enrollment and saves it if fn returns true, without anyone else updating it in between
+	Update(identity string, fn func(*Enrollment) bool) error
+}
+
+// storedEnrollment is an Enrollment as written to disk, with the secret sealed by AES-GCM
+type storedEnrollment struct {
+	Secret        string    `json:"secret"`
+	RecoveryCodes []string  `json:"recovery_codes"`
+	LastCounter   uint64    `json:"last_counter"`
+	Created       time.Time `json:"created"`
+}
+
+// FileStore is a Store in a JSON file. Secrets are encrypted with AES-GCM, bound to their identity, so the file is safe to back up.
+type FileStore struct {
+	file    string
+	aead    cipher.AEAD
+	mutex   *sync.Mutex
+	entries map[string]storedEnrollment
+}
+
+// OpenFileStore loads file, a missing file is an empty store. key encrypts the secrets.
+func OpenFileStore(file string, key []byte) (*FileStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrKeySize
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{
+		file:    file,
+		aead:    aead,
+		mutex:   new(sync.Mutex),
+		entries: make(map[string]storedEnrollment),
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+	return s, nil
+}
+
+// encrypt seals secret for identity
+func (s *FileStore) encrypt(identity string, secret []byte) string {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, secret, []byte(identity)))
+}
+
+// decrypt opens a secret sealed for identity
+func (s *FileStore) decrypt(identity string, sealed string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < s.aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	secret, err := s.aead.Open(nil, raw[:s.aead.NonceSize()], raw[s.aead.NonceSize():], []byte(identity))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return secret, nil
+}
+
+// save writes the file through a temporary file and a rename. The caller holds the lock.
+func (s *FileStore) save() error {
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), ".totp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// get decrypts an entry. The caller holds the lock.
+func (s *FileStore) get(identity string) (*Enrollment, error) {
+	stored, ok := s.entries[identity]
+	if !ok {
+		return nil, ErrNotEnrolled
+	}
+	secret, err := s.decrypt(identity, stored.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Enrollment{
+		Secret:        secret,
+		RecoveryCodes: append([]string{}, stored.RecoveryCodes...),
+		LastCounter:   stored.LastCounter,
+		Created:       stored.Created,
+	}, nil
+}
+
+// put encrypts an entry and saves the file. The caller holds the lock.
+func (s *FileStore) put(identity string, enrollment *Enrollment) error {
+	old, existed := s.entries[identity]
+	s.entries[identity] = storedEnrollment{
+		Secret:        s.encrypt(identity, enrollment.Secret),
+		RecoveryCodes: enrollment.RecoveryCodes,
+		LastCounter:   enrollment.LastCounter,
+		Created:       enrollment.Created,
+	}
+	if err := s.save(); err != nil {
+		if existed {
+			s.entries[identity] = old
+		} else {
+			delete(s.entries, identity)
+		}
+		return err
+	}
+	return nil
+}
+
+// Get returns identity's enrollment
+func (s *FileStore) Get(identity string) (*Enrollment, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.get(identity)
+}
+
+// Put saves identity's enrollment
+func (s *FileStore) Put(identity string, enrollment *Enrollment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.put(identity, enrollment)
+}
+
+// Update runs fn under the store's lock and saves the result if fn returns true
+func (s *FileStore) Update(identity string, fn func(*Enrollment) bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	enrollment, err := s.get(identity)
+	if err != nil {
+		return err
+	}
+	if !fn(enrollment) {
+		return nil
+	}
+	return s.put(identity, enrollment)
+}
+
+// hashRecoveryCode is the stored form of a recovery code
+func hashRecoveryCode(salt string, code string) string {
+	sum := sha256.Sum256([]byte(salt + code))
+	return salt + ":" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,69 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// secretEncoding is unpadded base32, which is what authenticator apps expect
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// hotp computes an RFC 4226 code for counter
+func hotp(secret []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	code := strconv.FormatUint(uint64(value%mod), 10)
+	return strings.Repeat("0", digits-len(code)) + code
+}
+
+// counterAt is the RFC 6238 time step for t
+func counterAt(t time.Time, period time.Duration) uint64 {
+	return uint64(t.Unix()) / uint64(period/time.Second)
+}
+
+// matchCode looks for code within skew steps either side of now, returning the step it matched
+func matchCode(secret []byte, code string, now time.Time, period time.Duration, digits int, skew int) (uint64, bool) {
+	if len(code) != digits {
+		return 0, false
+	}
+	current := counterAt(now, period)
+	for i := -skew; i <= skew; i++ {
+		counter := current + uint64(i)
+		if i < 0 && current < uint64(-i) {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, counter, digits)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningURI is the otpauth:// URI authenticator apps read from a QR code
+func ProvisioningURI(issuer, account string, secret []byte, period time.Duration, digits int) string {
+	query := url.Values{
+		"secret":    {secretEncoding.EncodeToString(secret)},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(digits)},
+		"period":    {strconv.Itoa(int(period / time.Second))},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
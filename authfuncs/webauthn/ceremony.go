@@ -0,0 +1,300 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrChallenge is returned when a response's challenge wasn't issued, was already used, or expired
+	ErrChallenge = errors.New("unknown or expired challenge")
+	// ErrClientData is returned when the client data is for another ceremony or origin
+	ErrClientData = errors.New("bad client data")
+	// ErrRelyingParty is returned when authenticator data is for another relying party id
+	ErrRelyingParty = errors.New("wrong relying party")
+	// ErrFlags is returned when the user wasn't present, or wasn't verified and Config.UserVerification is set
+	ErrFlags = errors.New("user presence or verification missing")
+	// ErrAttestation is returned for attestation statements that don't verify or aren't trusted
+	ErrAttestation = errors.New("bad attestation")
+	// ErrUserHandle is returned when an assertion is for a different user than asked for
+	ErrUserHandle = errors.New("credential belongs to another user")
+)
+
+// urlBytes is base64url in JSON, which is how the browser side sends binary
+type urlBytes []byte
+
+// MarshalJSON encodes b as unpadded base64url
+func (b urlBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes base64url with or without padding
+func (b *urlBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// credentialResponse is a PublicKeyCredential as posted by the page, for either ceremony
+type credentialResponse struct {
+	ID       string   `json:"id"`
+	RawID    urlBytes `json:"rawId"`
+	Type     string   `json:"type"`
+	Response struct {
+		ClientDataJSON    urlBytes `json:"clientDataJSON"`
+		AttestationObject urlBytes `json:"attestationObject"`
+		AuthenticatorData urlBytes `json:"authenticatorData"`
+		Signature         urlBytes `json:"signature"`
+		UserHandle        urlBytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+// collectedClientData is what the browser signs over (WebAuthn section 5.8.1)
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// ceremony is an issued challenge waiting for its response. It's sealed into a cookie rather than kept here, so a response only counts from the browser that started it and nothing is held for ceremonies that are never finished.
+type ceremony struct {
+	Challenge []byte    `json:"c"`
+	Register  bool      `json:"r,omitempty"`
+	User      string    `json:"u,omitempty"`
+	Handle    []byte    `json:"h,omitempty"`
+	Expires   time.Time `json:"e"`
+}
+
+// checkResponse does the parts of both ceremonies that are the same: the credential's shape, the client data and the challenge
+func (a *WebAuthn) checkResponse(response *credentialResponse, clientType string, sealed string) (*ceremony, error) {
+	if response.Type != "public-key" || len(response.RawID) == 0 || response.ID != base64.RawURLEncoding.EncodeToString(response.RawID) {
+		return nil, ErrClientData
+	}
+	client := collectedClientData{}
+	if err := json.Unmarshal(response.Response.ClientDataJSON, &client); err != nil {
+		return nil, ErrClientData
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(client.Challenge, "="))
+	if err != nil {
+		return nil, ErrChallenge
+	}
+	// the challenge is used up even if the rest fails, so a bad response can't be retried
+	c, ok := a.takeCeremony(sealed, challenge)
+	if !ok || c.Register != (clientType == "webauthn.create") {
+		return nil, ErrChallenge
+	}
+	if client.Type != clientType || client.CrossOrigin || !a.allowedOrigin(client.Origin) {
+		return nil, ErrClientData
+	}
+	return c, nil
+}
+
+// allowedOrigin reports whether origin is one of Config.Origins
+func (a *WebAuthn) allowedOrigin(origin string) bool {
+	for _, allowed := range a.config.Origins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAuthData checks the relying party and flags every response's authenticator data must have
+func (a *WebAuthn) checkAuthData(data *authData) error {
+	rpIDHash := sha256.Sum256([]byte(a.config.RPID))
+	if !bytes.Equal(data.rpIDHash, rpIDHash[:]) {
+		return ErrRelyingParty
+	}
+	if data.flags&flagUserPresent == 0 || a.config.UserVerification && data.flags&flagUserVerified == 0 {
+		return ErrFlags
+	}
+	return nil
+}
+
+// finishRegistration verifies a registration response and returns the credential to store
+func (a *WebAuthn) finishRegistration(response *credentialResponse, sealed string) (*Credential, error) {
+	c, err := a.checkResponse(response, "webauthn.create", sealed)
+	if err != nil {
+		return nil, err
+	}
+	item, rest, err := decodeCBOR(response.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := item.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, ErrCBOR
+	}
+	format, _ := object["fmt"].(string)
+	statement, okStatement := object["attStmt"].(map[interface{}]interface{})
+	rawAuthData, okAuthData := object["authData"].([]byte)
+	if !okStatement || !okAuthData {
+		return nil, ErrCBOR
+	}
+	data, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkAuthData(data); err != nil {
+		return nil, err
+	}
+	if data.flags&flagAttested == 0 || !bytes.Equal(data.credentialID, response.RawID) {
+		return nil, ErrAuthData
+	}
+	key, err := parseCOSEKey(data.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(response.Response.ClientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	switch format {
+	case "none":
+		if len(statement) != 0 || a.config.AttestationRoots != nil {
+			return nil, ErrAttestation
+		}
+	case "packed":
+		if err := a.verifyPacked(statement, key, data, signed); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Wrap(ErrAttestation, "unsupported format "+format)
+	}
+	return &Credential{
+		ID:         append([]byte{}, data.credentialID...),
+		User:       c.User,
+		UserHandle: c.Handle,
+		PublicKey:  append([]byte{}, data.publicKey...),
+		SignCount:  data.signCount,
+		AAGUID:     append([]byte{}, data.aaguid...),
+		Created:    a.now().UTC(),
+	}, nil
+}
+
+// oidAAGUID is the id-fido-gen-ce-aaguid certificate extension
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// verifyPacked checks a packed attestation statement (WebAuthn section 8.2). Without x5c it's self attestation, signed by the credential itself.
+func (a *WebAuthn) verifyPacked(statement map[interface{}]interface{}, key *coseKey, data *authData, signed []byte) error {
+	alg, okAlg := statement["alg"].(int64)
+	sig, okSig := statement["sig"].([]byte)
+	if !okAlg || !okSig {
+		return ErrAttestation
+	}
+	chain, hasChain := statement["x5c"].([]interface{})
+	if !hasChain {
+		if a.config.AttestationRoots != nil || int(alg) != key.alg {
+			return ErrAttestation
+		}
+		if err := key.verify(signed, sig); err != nil {
+			return ErrAttestation
+		}
+		return nil
+	}
+	certs := make([]*x509.Certificate, 0, len(chain))
+	for _, raw := range chain {
+		der, ok := raw.([]byte)
+		if !ok {
+			return ErrAttestation
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.Wrap(ErrAttestation, err.Error())
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return ErrAttestation
+	}
+	leaf := certs[0]
+	algorithm, err := x509Algorithm(int(alg))
+	if err != nil {
+		return err
+	}
+	if err := leaf.CheckSignature(algorithm, signed, sig); err != nil {
+		return ErrAttestation
+	}
+	// the certificate requirements in section 8.2.1
+	if leaf.Version != 3 || leaf.IsCA || len(leaf.Subject.OrganizationalUnit) != 1 || leaf.Subject.OrganizationalUnit[0] != "Authenticator Attestation" {
+		return errors.Wrap(ErrAttestation, "attestation certificate doesn't meet requirements")
+	}
+	for _, extension := range leaf.Extensions {
+		if !extension.Id.Equal(oidAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(extension.Value, &aaguid); err != nil || extension.Critical || !bytes.Equal(aaguid, data.aaguid) {
+			return errors.Wrap(ErrAttestation, "attestation certificate is for another aaguid")
+		}
+	}
+	if a.config.AttestationRoots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         a.config.AttestationRoots,
+			Intermediates: intermediates,
+			CurrentTime:   a.now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return errors.Wrap(ErrAttestation, err.Error())
+		}
+	}
+	return nil
+}
+
+// finishLogin verifies an assertion and returns the credential it was made with, with its new sign count saved
+func (a *WebAuthn) finishLogin(response *credentialResponse, sealed string) (*Credential, error) {
+	c, err := a.checkResponse(response, "webauthn.get", sealed)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := a.config.Store.Get(response.RawID)
+	if err != nil {
+		return nil, err
+	}
+	if c.User != "" && c.User != credential.User {
+		return nil, ErrUserHandle
+	}
+	if len(response.Response.UserHandle) != 0 && !bytes.Equal(response.Response.UserHandle, credential.UserHandle) {
+		return nil, ErrUserHandle
+	}
+	data, err := parseAuthData(response.Response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkAuthData(data); err != nil {
+		return nil, err
+	}
+	key, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(response.Response.ClientDataJSON)
+	signed := append(append([]byte{}, response.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := key.verify(signed, response.Response.Signature); err != nil {
+		return nil, err
+	}
+	if err := a.config.Store.SetSignCount(credential.ID, data.signCount, a.now().UTC()); err != nil {
+		return nil, err
+	}
+	credential.SignCount = data.signCount
+	return credential, nil
+}
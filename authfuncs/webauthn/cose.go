@@ -0,0 +1,203 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrAlgorithm is returned for COSE keys and attestations using an algorithm we don't support
+	ErrAlgorithm = errors.New("unsupported algorithm")
+	// ErrSignature is returned when a signature doesn't verify
+	ErrSignature = errors.New("bad signature")
+	// ErrAuthData is returned for authenticator data that's too short or inconsistent
+	ErrAuthData = errors.New("bad authenticator data")
+)
+
+// COSE algorithm identifiers we support
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// SupportedAlgorithms are offered to authenticators in order of preference
+var SupportedAlgorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// coseKey is a credential public key
+type coseKey struct {
+	alg int
+	key crypto.PublicKey
+}
+
+// intField reads an integer from a COSE map
+func intField(m map[interface{}]interface{}, label int64) (int64, bool) {
+	v, ok := m[label].(int64)
+	return v, ok
+}
+
+// bytesField reads a byte string from a COSE map
+func bytesField(m map[interface{}]interface{}, label int64) ([]byte, bool) {
+	v, ok := m[label].([]byte)
+	return v, ok
+}
+
+// parseCOSEKey reads a COSE_Key (RFC 8152 section 7) for one of SupportedAlgorithms
+func parseCOSEKey(raw []byte) (*coseKey, error) {
+	item, rest, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, ErrCBOR
+	}
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrCBOR
+	}
+	kty, _ := intField(m, 1)
+	alg, _ := intField(m, 3)
+	crv, _ := intField(m, -1)
+	switch {
+	case alg == AlgES256 && kty == 2 && crv == 1:
+		x, okX := bytesField(m, -2)
+		y, okY := bytesField(m, -3)
+		if !okX || !okY || len(x) != 32 || len(y) != 32 {
+			return nil, ErrAlgorithm
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, ErrAlgorithm
+		}
+		return &coseKey{alg: AlgES256, key: key}, nil
+	case alg == AlgEdDSA && kty == 1 && crv == 6:
+		x, ok := bytesField(m, -2)
+		if !ok || len(x) != ed25519.PublicKeySize {
+			return nil, ErrAlgorithm
+		}
+		return &coseKey{alg: AlgEdDSA, key: ed25519.PublicKey(x)}, nil
+	case alg == AlgRS256 && kty == 3:
+		n, okN := bytesField(m, -1)
+		e, okE := bytesField(m, -2)
+		if !okN || !okE || len(e) == 0 || len(e) > 4 || len(n) < 256 {
+			return nil, ErrAlgorithm
+		}
+		exponent := make([]byte, 4)
+		copy(exponent[4-len(e):], e)
+		return &coseKey{alg: AlgRS256, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(binary.BigEndian.Uint32(exponent))}}, nil
+	}
+	return nil, ErrAlgorithm
+}
+
+// verify checks sig over data. ECDSA signatures are ASN.1 like everywhere else in WebAuthn.
+func (k *coseKey) verify(data, sig []byte) error {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		var parsed struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &parsed); err != nil || len(rest) != 0 {
+			return ErrSignature
+		}
+		sum := sha256.Sum256(data)
+		if parsed.R.Sign() <= 0 || parsed.S.Sign() <= 0 || !ecdsa.Verify(key, sum[:], parsed.R, parsed.S) {
+			return ErrSignature
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, sig) {
+			return ErrSignature
+		}
+		return nil
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(data)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+			return ErrSignature
+		}
+		return nil
+	}
+	return ErrAlgorithm
+}
+
+// x509Algorithm is the certificate signature algorithm for a COSE algorithm, used for packed attestation certificates
+func x509Algorithm(alg int) (x509.SignatureAlgorithm, error) {
+	switch alg {
+	case AlgES256:
+		return x509.ECDSAWithSHA256, nil
+	case AlgEdDSA:
+		return x509.PureEd25519, nil
+	case AlgRS256:
+		return x509.SHA256WithRSA, nil
+	}
+	return x509.UnknownSignatureAlgorithm, ErrAlgorithm
+}
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+	flagExtensions   = 0x80
+)
+
+// authData is parsed authenticator data (WebAuthn section 6.1)
+type authData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// the rest are only set when flagAttested is
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthData splits authenticator data up. The public key is left as raw COSE so it can be stored as is.
+func parseAuthData(raw []byte) (*authData, error) {
+	if len(raw) < 37 {
+		return nil, ErrAuthData
+	}
+	data := &authData{
+		rpIDHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rest := raw[37:]
+	if data.flags&flagAttested != 0 {
+		if len(rest) < 18 {
+			return nil, ErrAuthData
+		}
+		data.aaguid = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+			return nil, ErrAuthData
+		}
+		data.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		data.publicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if data.flags&flagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, ErrAuthData
+	}
+	return data, nil
+}
@@ -0,0 +1,468 @@
+/*
+Package webauthn is an AuthFunc for passkeys and security keys. It serves the registration and login ceremonies itself under Config.Path, answering them with JSON for a small script on the pages it renders, and grants requests that carry the session cookie a login sets.
+*/
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/authdoor/authfuncs/internal/seal"
+	"github.com/ayjayt/authdoor/authfuncs/internal/session"
+	"github.com/ayjayt/ilog"
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// Config describes the relying party
+type Config struct {
+	// RPID is the domain credentials are scoped to, like example.com. It's required.
+	RPID string
+	// RPName is shown by some authenticators, defaults to RPID
+	RPName string
+	// Origins responses may come from, defaults to https:// and RPID
+	Origins []string
+	// Path is where the ceremonies are served, defaults to /.webauthn/
+	Path  string
+	Store Store
+	// UserVerification requires a PIN or biometric, not just a touch
+	UserVerification bool
+	// AttestationRoots, if set, only allows registering authenticators with packed attestation chaining to them
+	AttestationRoots *x509.CertPool
+	// Enroll decides who may register a credential without being logged in, like someone with an invite. Logged in users can always add more.
+	Enroll func(r *http.Request) (user string, ok bool)
+	// Timeout is how long a ceremony has to finish, defaults to 5 minutes
+	Timeout time.Duration
+	// SessionLength defaults to 6 hours like basicpass
+	SessionLength time.Duration
+}
+
+// Info is returned as the instance's info on success
+type Info struct {
+	User       string `json:"user"`
+	UserHandle string `json:"user_handle"`
+	Credential string `json:"credential"`
+}
+
+// WebAuthn supplies an authfunc receiver and stores information to be used by that receiver
+type WebAuthn struct {
+	config Config
+	uuid   string
+	sealer *seal.Sealer
+	// used holds challenges that have had a response until they'd have expired, so each only works once
+	used *session.Map
+	// sessions holds the Info of finished logins by session id
+	sessions *session.Map
+	now      func() time.Time
+}
+
+// New returns a WebAuthn ready to be used as an AuthFunc
+func New(config Config) (*WebAuthn, error) {
+	if config.RPID == "" || config.Store == nil {
+		return nil, errors.New("RPID and Store are required")
+	}
+	if config.RPName == "" {
+		config.RPName = config.RPID
+	}
+	if len(config.Origins) == 0 {
+		config.Origins = []string{"https://" + config.RPID}
+	}
+	if config.Path == "" {
+		config.Path = "/.webauthn/"
+	}
+	if !strings.HasSuffix(config.Path, "/") {
+		config.Path += "/"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Minute
+	}
+	if config.SessionLength == 0 {
+		config.SessionLength = 6 * time.Hour
+	}
+	return &WebAuthn{
+		config:   config,
+		uuid:     uuid.New().String(),
+		sealer:   seal.New(nil),
+		used:     session.New(),
+		sessions: session.New(),
+		now:      time.Now,
+	}, nil
+}
+
+// randomBytes returns n random bytes
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// sessionCookie and ceremonyCookie are the names of our cookies
+func (a *WebAuthn) sessionCookie() string {
+	return "webauthn-" + a.uuid
+}
+
+func (a *WebAuthn) ceremonyCookie() string {
+	return "webauthn-ceremony-" + a.uuid
+}
+
+// startCeremony issues a challenge and gives the ceremony to the browser in a sealed cookie
+func (a *WebAuthn) startCeremony(w http.ResponseWriter, r *http.Request, c *ceremony) ([]byte, error) {
+	now := a.now()
+	c.Challenge = randomBytes(32)
+	c.Expires = now.Add(a.config.Timeout)
+	value, err := a.sealer.Seal(c, c.Expires)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.ceremonyCookie(),
+		Value:    value,
+		Path:     a.config.Path,
+		MaxAge:   int(a.config.Timeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return c.Challenge, nil
+}
+
+// takeCeremony opens the sealed ceremony and returns it if it's for challenge, hasn't expired, and hasn't been taken before
+func (a *WebAuthn) takeCeremony(sealed string, challenge []byte) (*ceremony, bool) {
+	c := &ceremony{}
+	if err := a.sealer.Open(sealed, c); err != nil || !bytes.Equal(c.Challenge, challenge) {
+		return nil, false
+	}
+	now := a.now()
+	if !now.Before(c.Expires) {
+		return nil, false
+	}
+	return c, a.used.Add(base64.RawURLEncoding.EncodeToString(challenge), true, c.Expires, now)
+}
+
+// currentSession returns the request's login, if it has one
+func (a *WebAuthn) currentSession(r *http.Request) (*Info, bool) {
+	cookie, err := r.Cookie(a.sessionCookie())
+	if err != nil {
+		return nil, false
+	}
+	info, ok := a.sessions.Get(cookie.Value, a.now())
+	if !ok {
+		return nil, false
+	}
+	return info.(*Info), true
+}
+
+// registrant is who a registration on r would be for
+func (a *WebAuthn) registrant(r *http.Request) (string, bool) {
+	if info, ok := a.currentSession(r); ok {
+		return info.User, true
+	}
+	if a.config.Enroll != nil {
+		return a.config.Enroll(r)
+	}
+	return "", false
+}
+
+// answered is returned for everything served under Config.Path. A finished login grants on the next request, granting here would hand the POST to the base handler.
+var answered = authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}
+
+// denied is returned for ceremonies that fail
+var denied = authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied, Resp: authdoor.Answered}
+
+// Check is an authfunc. It serves the ceremonies, grants requests with a session, and shows everyone else the login page.
+func (a *WebAuthn) Check(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	if strings.HasPrefix(r.URL.Path, a.config.Path) {
+		return a.serveCeremony(w, r, strings.TrimPrefix(r.URL.Path, a.config.Path))
+	}
+	if info, ok := a.currentSession(r); ok {
+		infoJSON, err := json.Marshal(info)
+		if err != nil {
+			return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+		}
+		return authdoor.AuthFuncReturn{
+			Auth: authdoor.AuthGranted,
+			Resp: authdoor.Ignored,
+			Info: authdoor.InstanceReturnInfo{Info: infoJSON},
+		}, nil
+	}
+	return a.render(w, http.StatusUnauthorized, loginPage)
+}
+
+// serveCeremony routes the requests under Config.Path
+func (a *WebAuthn) serveCeremony(w http.ResponseWriter, r *http.Request, route string) (authdoor.AuthFuncReturn, error) {
+	if route == "register" && r.Method == "GET" {
+		if _, ok := a.registrant(r); !ok {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return denied, nil
+		}
+		return a.render(w, http.StatusOK, registerPage)
+	}
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return answered, nil
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	switch route {
+	case "register/begin":
+		return a.beginRegistration(w, r)
+	case "register/finish":
+		return a.finish(w, r, true)
+	case "login/begin":
+		return a.beginLogin(w, r)
+	case "login/finish":
+		return a.finish(w, r, false)
+	}
+	http.NotFound(w, r)
+	return answered, nil
+}
+
+// descriptor is a PublicKeyCredentialDescriptor
+type descriptor struct {
+	Type string   `json:"type"`
+	ID   urlBytes `json:"id"`
+}
+
+// descriptors lists credentials for allowCredentials or excludeCredentials
+func descriptors(credentials []Credential) []descriptor {
+	list := make([]descriptor, 0, len(credentials))
+	for _, credential := range credentials {
+		list = append(list, descriptor{Type: "public-key", ID: credential.ID})
+	}
+	return list
+}
+
+// beginRegistration answers with PublicKeyCredentialCreationOptions
+func (a *WebAuthn) beginRegistration(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	user, ok := a.registrant(r)
+	if !ok {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "not allowed to register"})
+		return denied, nil
+	}
+	existing, err := a.config.Store.List(user)
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	// a user keeps one handle across their credentials, it's random so it says nothing about them
+	handle := randomBytes(32)
+	if len(existing) > 0 {
+		handle = existing[0].UserHandle
+	}
+	challenge, err := a.startCeremony(w, r, &ceremony{Register: true, User: user, Handle: handle})
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	params := make([]map[string]interface{}, 0, len(SupportedAlgorithms))
+	for _, alg := range SupportedAlgorithms {
+		params = append(params, map[string]interface{}{"type": "public-key", "alg": alg})
+	}
+	attestation := "none"
+	if a.config.AttestationRoots != nil {
+		attestation = "direct"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"publicKey": map[string]interface{}{
+		"rp":                 map[string]string{"id": a.config.RPID, "name": a.config.RPName},
+		"user":               map[string]interface{}{"id": urlBytes(handle), "name": user, "displayName": user},
+		"challenge":          urlBytes(challenge),
+		"pubKeyCredParams":   params,
+		"timeout":            int64(a.config.Timeout / time.Millisecond),
+		"excludeCredentials": descriptors(existing),
+		"authenticatorSelection": map[string]interface{}{
+			"residentKey":      "preferred",
+			"userVerification": a.userVerification(),
+		},
+		"attestation": attestation,
+	}})
+	return answered, nil
+}
+
+// beginLogin answers with PublicKeyCredentialRequestOptions. Without a user name the authenticator picks a discoverable credential.
+func (a *WebAuthn) beginLogin(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	body := struct {
+		User string `json:"user"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad request"})
+		return answered, nil
+	}
+	allowed := []Credential{}
+	if body.User != "" {
+		var err error
+		if allowed, err = a.config.Store.List(body.User); err != nil {
+			return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+		}
+	}
+	challenge, err := a.startCeremony(w, r, &ceremony{User: body.User})
+	if err != nil {
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Ignored}, err
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"publicKey": map[string]interface{}{
+		"challenge":        urlBytes(challenge),
+		"rpId":             a.config.RPID,
+		"timeout":          int64(a.config.Timeout / time.Millisecond),
+		"allowCredentials": descriptors(allowed),
+		"userVerification": a.userVerification(),
+	}})
+	return answered, nil
+}
+
+// userVerification is the option sent to authenticators
+func (a *WebAuthn) userVerification() string {
+	if a.config.UserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+// finish verifies either ceremony's response. Registrations are saved, logins start a session.
+func (a *WebAuthn) finish(w http.ResponseWriter, r *http.Request, register bool) (authdoor.AuthFuncReturn, error) {
+	response := &credentialResponse{}
+	if err := json.NewDecoder(r.Body).Decode(response); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad request"})
+		return denied, nil
+	}
+	sealed := ""
+	if cookie, err := r.Cookie(a.ceremonyCookie()); err == nil {
+		sealed = cookie.Value
+	}
+	var credential *Credential
+	var err error
+	if register {
+		if credential, err = a.finishRegistration(response, sealed); err == nil {
+			err = a.config.Store.Add(credential)
+		}
+	} else {
+		credential, err = a.finishLogin(response, sealed)
+	}
+	if err != nil {
+		defaultLogger.Info("webauthn ceremony failed: " + err.Error())
+		if errors.Cause(err) == ErrSignCount {
+			defaultLogger.Error("webauthn sign count went backwards, the authenticator may be cloned: " + response.ID)
+		}
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return denied, nil
+	}
+	if register {
+		defaultLogger.Info("webauthn registered a credential for " + credential.User)
+	} else {
+		a.startSession(w, r, credential)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"user": credential.User})
+	return answered, nil
+}
+
+// startSession sets the session cookie for a login
+func (a *WebAuthn) startSession(w http.ResponseWriter, r *http.Request, credential *Credential) {
+	sess := uuid.New().String()
+	now := a.now()
+	a.sessions.Set(sess, &Info{
+		User:       credential.User,
+		UserHandle: base64.RawURLEncoding.EncodeToString(credential.UserHandle),
+		Credential: base64.RawURLEncoding.EncodeToString(credential.ID),
+	}, now.Add(a.config.SessionLength), now)
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.sessionCookie(),
+		Value:    sess,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// writeJSON answers with v
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// render writes one of the pages
+func (a *WebAuthn) render(w http.ResponseWriter, status int, page *template.Template) (authdoor.AuthFuncReturn, error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := page.Execute(w, struct{ Path string }{a.config.Path}); err != nil {
+		return answered, err
+	}
+	return answered, nil
+}
+
+// script is shared by the pages. The options come as base64url and go back the same way.
+const script = `{{define "script"}}<script>
+const path = {{.Path}};
+const decode = s => Uint8Array.from(atob(s.replace(/-/g, '+').replace(/_/g, '/')), c => c.charCodeAt(0));
+const encode = b => b ? btoa(String.fromCharCode(...new Uint8Array(b))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '') : '';
+const status = m => document.getElementById('status').textContent = m;
+async function post(route, body) {
+	const r = await fetch(path + route, {method: 'POST', credentials: 'same-origin', headers: {'Content-Type': 'application/json'}, body: JSON.stringify(body)});
+	const j = await r.json();
+	if (!r.ok) throw new Error(j.error);
+	return j;
+}
+async function login() {
+	try {
+		const o = (await post('login/begin', {user: document.getElementById('user').value})).publicKey;
+		o.challenge = decode(o.challenge);
+		o.allowCredentials.forEach(c => c.id = decode(c.id));
+		const c = await navigator.credentials.get({publicKey: o});
+		await post('login/finish', {id: c.id, rawId: encode(c.rawId), type: c.type, response: {
+			clientDataJSON: encode(c.response.clientDataJSON), authenticatorData: encode(c.response.authenticatorData),
+			signature: encode(c.response.signature), userHandle: encode(c.response.userHandle)}});
+		location.reload();
+	} catch (e) { status(e.message); }
+}
+async function register() {
+	try {
+		const o = (await post('register/begin', {})).publicKey;
+		o.challenge = decode(o.challenge);
+		o.user.id = decode(o.user.id);
+		o.excludeCredentials.forEach(c => c.id = decode(c.id));
+		const c = await navigator.credentials.create({publicKey: o});
+		const r = await post('register/finish', {id: c.id, rawId: encode(c.rawId), type: c.type, response: {
+			clientDataJSON: encode(c.response.clientDataJSON), attestationObject: encode(c.response.attestationObject)}});
+		status('Registered a passkey for ' + r.user + '.');
+	} catch (e) { status(e.message); }
+}
+</script>{{end}}`
+
+var (
+	loginPage = template.Must(template.Must(template.New("login").Parse(`<html><body>
+	<p id="status">Sign in with a passkey or security key.</p>
+	<input id="user" placeholder="user name (optional)" autocomplete="username webauthn" />
+	<button onclick="login()">Sign in</button>
+	{{template "script" .}}
+</body></html>
+`)).Parse(script))
+	registerPage = template.Must(template.Must(template.New("register").Parse(`<html><body>
+	<p id="status">Register a passkey or security key.</p>
+	<button onclick="register()">Register</button>
+	{{template "script" .}}
+</body></html>
+`)).Parse(script))
+)
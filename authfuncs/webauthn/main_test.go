@@ -0,0 +1,631 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("authfuncs/webauthn/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// encodeCBOR is just enough of an encoder for the software authenticator
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		default:
+			b := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(b[1:], uint32(n))
+			return b
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := head(5, uint64(len(v)))
+		for key, value := range v {
+			out = append(out, encodeCBOR(key)...)
+			out = append(out, encodeCBOR(value)...)
+		}
+		return out
+	}
+	panic(fmt.Sprintf("can't encode %T", v))
+}
+
+// TestCBOR checks decoding and that malformed input is refused
+func TestCBOR(t *testing.T) {
+	item, rest, err := decodeCBOR(append(encodeCBOR(map[interface{}]interface{}{
+		"fmt": "none",
+		1:     -7,
+		-2:    []byte{1, 2, 3},
+		"arr": []interface{}{1000, 70000, "x"},
+	}), 0xff))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xff}, rest)
+	m := item.(map[interface{}]interface{})
+	require.Equal(t, "none", m["fmt"])
+	require.Equal(t, int64(-7), m[int64(1)])
+	require.Equal(t, []byte{1, 2, 3}, m[int64(-2)])
+	require.Equal(t, []interface{}{int64(1000), int64(70000), "x"}, m["arr"])
+
+	bad := [][]byte{
+		{},
+		{0x5f},                         // indefinite byte string
+		{0x43, 1, 2},                   // truncated
+		{0x9a, 0xff, 0xff, 0xff, 0xff}, // huge array
+		{0xa2, 0x01, 0x01, 0x01, 0x02}, // duplicate key
+		{0xa1, 0x40, 0x01},             // byte string key
+		{0xfb, 0, 0, 0, 0, 0, 0, 0, 0}, // float
+		bytes.Repeat([]byte{0x81}, 100),
+	}
+	for _, data := range bad {
+		_, _, err := decodeCBOR(data)
+		require.Equal(t, ErrCBOR, err, "%x", data)
+	}
+}
+
+// softCredential is a key held by the software authenticator
+type softCredential struct {
+	id     []byte
+	key    crypto.Signer
+	handle []byte
+}
+
+// authenticator is a software authenticator that answers options the way a browser and security key would
+type authenticator struct {
+	t           *testing.T
+	rpID        string
+	origin      string
+	aaguid      []byte
+	counter     uint32
+	flags       byte
+	credentials []*softCredential
+	// attestation is "none", "self" or "x5c"
+	attestation string
+	certKey     crypto.Signer
+	certs       [][]byte
+}
+
+// newAuthenticator makes an authenticator for example.com
+func newAuthenticator(t *testing.T) *authenticator {
+	return &authenticator{
+		t:           t,
+		rpID:        "example.com",
+		origin:      "https://example.com",
+		aaguid:      bytes.Repeat([]byte{0xaa}, 16),
+		flags:       flagUserPresent | flagUserVerified,
+		attestation: "none",
+	}
+}
+
+// coseKey encodes a public key
+func (a *authenticator) coseKey(key crypto.PublicKey) []byte {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		xb, yb := key.X.Bytes(), key.Y.Bytes()
+		copy(x[32-len(xb):], xb)
+		copy(y[32-len(yb):], yb)
+		return encodeCBOR(map[interface{}]interface{}{1: 2, 3: AlgES256, -1: 1, -2: x, -3: y})
+	case ed25519.PublicKey:
+		return encodeCBOR(map[interface{}]interface{}{1: 1, 3: AlgEdDSA, -1: 6, -2: []byte(key)})
+	}
+	panic("unsupported key")
+}
+
+// authData builds authenticator data, with the credential if it's given
+func (a *authenticator) authData(credential *softCredential) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := a.flags
+	if credential != nil {
+		flags |= flagAttested
+	}
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.counter)
+	if credential != nil {
+		data = append(data, a.aaguid...)
+		data = append(data, byte(len(credential.id)>>8), byte(len(credential.id)))
+		data = append(data, credential.id...)
+		data = append(data, a.coseKey(credential.key.Public())...)
+	}
+	return data
+}
+
+// sign signs like a COSE algorithm would
+func sign(key crypto.Signer, data []byte) []byte {
+	var sig []byte
+	var err error
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		sum := sha256.Sum256(data)
+		sig, err = key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// clientData is what the browser would collect
+func (a *authenticator) clientData(typ string, challenge string) []byte {
+	data, _ := json.Marshal(collectedClientData{Type: typ, Challenge: challenge, Origin: a.origin})
+	return data
+}
+
+// options pulls the publicKey options out of a begin response
+func options(t *testing.T, body []byte) map[string]interface{} {
+	o := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(body, &o))
+	return o["publicKey"].(map[string]interface{})
+}
+
+// create answers creation options with a new credential using key
+func (a *authenticator) create(body []byte, key crypto.Signer) map[string]interface{} {
+	o := options(a.t, body)
+	handle, err := base64.RawURLEncoding.DecodeString(o["user"].(map[string]interface{})["id"].(string))
+	require.NoError(a.t, err)
+	credential := &softCredential{id: randomBytes(16), key: key, handle: handle}
+	a.credentials = append(a.credentials, credential)
+
+	clientData := a.clientData("webauthn.create", o["challenge"].(string))
+	authData := a.authData(credential)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	format, statement := "none", map[interface{}]interface{}{}
+	switch a.attestation {
+	case "self":
+		alg := AlgES256
+		if _, ok := key.(ed25519.PrivateKey); ok {
+			alg = AlgEdDSA
+		}
+		format, statement = "packed", map[interface{}]interface{}{"alg": alg, "sig": sign(key, signed)}
+	case "x5c":
+		chain := []interface{}{}
+		for _, cert := range a.certs {
+			chain = append(chain, cert)
+		}
+		format, statement = "packed", map[interface{}]interface{}{"alg": AlgES256, "sig": sign(a.certKey, signed), "x5c": chain}
+	}
+	object := encodeCBOR(map[interface{}]interface{}{"fmt": format, "attStmt": statement, "authData": authData})
+	return map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(credential.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(credential.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(object),
+		},
+	}
+}
+
+// get answers request options with the newest allowed credential, or the newest of all for a discoverable login
+func (a *authenticator) get(body []byte) map[string]interface{} {
+	o := options(a.t, body)
+	var credential *softCredential
+	for _, c := range a.credentials {
+		if len(o["allowCredentials"].([]interface{})) == 0 {
+			credential = c
+		}
+		for _, allowed := range o["allowCredentials"].([]interface{}) {
+			if allowed.(map[string]interface{})["id"] == base64.RawURLEncoding.EncodeToString(c.id) {
+				credential = c
+			}
+		}
+	}
+	require.NotNil(a.t, credential)
+	a.counter++
+	clientData := a.clientData("webauthn.get", o["challenge"].(string))
+	authData := a.authData(nil)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	return map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(credential.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(credential.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(sign(credential.key, signed)),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(credential.handle),
+		},
+	}
+}
+
+// browser keeps cookies between requests to a WebAuthn
+type browser struct {
+	t       *testing.T
+	auth    *WebAuthn
+	cookies map[string]*http.Cookie
+	header  http.Header
+}
+
+func newBrowser(t *testing.T, auth *WebAuthn) *browser {
+	return &browser{t: t, auth: auth, cookies: make(map[string]*http.Cookie), header: http.Header{}}
+}
+
+// do runs Check on a request to path, POSTing body as JSON if it isn't nil
+func (b *browser) do(method, path string, body interface{}) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(b.t, err)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, "https://example.com"+path, reader)
+	for name, values := range b.header {
+		req.Header[name] = values
+	}
+	for _, cookie := range b.cookies {
+		req.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	ret, err := b.auth.Check(recorder, req)
+	require.NoError(b.t, err)
+	for _, cookie := range recorder.Result().Cookies() {
+		b.cookies[cookie.Name] = cookie
+	}
+	return ret, recorder
+}
+
+// register runs a registration ceremony, returning the finish response
+func (b *browser) register(a *authenticator, key crypto.Signer) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	_, recorder := b.do("POST", "/.webauthn/register/begin", map[string]string{})
+	require.Equal(b.t, http.StatusOK, recorder.Code, recorder.Body.String())
+	return b.do("POST", "/.webauthn/register/finish", a.create(recorder.Body.Bytes(), key))
+}
+
+// login runs a login ceremony, returning the finish response
+func (b *browser) login(a *authenticator, user string) (authdoor.AuthFuncReturn, *httptest.ResponseRecorder) {
+	_, recorder := b.do("POST", "/.webauthn/login/begin", map[string]string{"user": user})
+	require.Equal(b.t, http.StatusOK, recorder.Code)
+	return b.do("POST", "/.webauthn/login/finish", a.get(recorder.Body.Bytes()))
+}
+
+// newP256 makes an ES256 key
+func newP256() crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// newTestWebAuthn enrolls anyone sending X-Invite
+func newTestWebAuthn(t *testing.T, config Config) *WebAuthn {
+	config.RPID = "example.com"
+	if config.Store == nil {
+		config.Store = NewMemoryStore()
+	}
+	config.Enroll = func(r *http.Request) (string, bool) {
+		invite := r.Header.Get("X-Invite")
+		return invite, invite != ""
+	}
+	auth, err := New(config)
+	require.NoError(t, err)
+	return auth
+}
+
+// TestRegisterAndLogin runs both ceremonies with "none" attestation and checks sign counts
+func TestRegisterAndLogin(t *testing.T) {
+	auth := newTestWebAuthn(t, Config{})
+	device := newAuthenticator(t)
+
+	// strangers see the login page and can't register
+	stranger := newBrowser(t, auth)
+	ret, recorder := stranger.do("GET", "/admin", nil)
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	require.Contains(t, recorder.Body.String(), "navigator.credentials.get")
+	ret, recorder = stranger.do("GET", "/.webauthn/register", nil)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+	_, recorder = stranger.do("POST", "/.webauthn/register/begin", map[string]string{})
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	invited := newBrowser(t, auth)
+	invited.header.Set("X-Invite", "aj")
+	_, recorder = invited.do("GET", "/.webauthn/register", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	ret, recorder = invited.register(device, newP256())
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	require.Equal(t, authdoor.AuthFailed, ret.Auth)
+	credentials, err := auth.config.Store.List("aj")
+	require.NoError(t, err)
+	require.Len(t, credentials, 1)
+
+	// a discoverable login, then one naming the user
+	laptop := newBrowser(t, auth)
+	ret, recorder = laptop.login(device, "")
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	require.Equal(t, authdoor.Answered, ret.Resp)
+	ret, _ = laptop.do("GET", "/admin", nil)
+	require.Equal(t, authdoor.AuthGranted, ret.Auth)
+	require.Equal(t, authdoor.Ignored, ret.Resp)
+	info := Info{}
+	require.NoError(t, json.Unmarshal(ret.Info.Info, &info))
+	require.Equal(t, "aj", info.User)
+	require.Equal(t, base64.RawURLEncoding.EncodeToString(credentials[0].UserHandle), info.UserHandle)
+	_, recorder = newBrowser(t, auth).login(device, "aj")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	// logged in users can add credentials, which share their handle
+	second := newAuthenticator(t)
+	_, recorder = laptop.register(second, newP256())
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	credentials, err = auth.config.Store.List("aj")
+	require.NoError(t, err)
+	require.Len(t, credentials, 2)
+	require.Equal(t, credentials[0].UserHandle, credentials[1].UserHandle)
+
+	// a cloned authenticator shows up as a sign count that didn't go up
+	clone := *device
+	clone.counter--
+	ret, recorder = newBrowser(t, auth).login(&clone, "aj")
+	require.Equal(t, authdoor.AuthDenied, ret.Auth)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	require.Contains(t, recorder.Body.String(), ErrSignCount.Error())
+
+	// a credential can't log in as someone else
+	_, recorder = newBrowser(t, auth).login(second, "bob")
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+// TestCeremonyChecks feeds responses that should each be refused
+func TestCeremonyChecks(t *testing.T) {
+	auth := newTestWebAuthn(t, Config{UserVerification: true})
+	device := newAuthenticator(t)
+	invited := newBrowser(t, auth)
+	invited.header.Set("X-Invite", "aj")
+	_, recorder := invited.register(device, newP256())
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	refused := func(name string, want error, tamper func(a *authenticator, b *browser, response map[string]interface{})) {
+		a := *device
+		b := newBrowser(t, auth)
+		_, recorder := b.do("POST", "/.webauthn/login/begin", map[string]string{})
+		response := a.get(recorder.Body.Bytes())
+		if tamper != nil {
+			tamper(&a, b, response)
+		}
+		ret, recorder := b.do("POST", "/.webauthn/login/finish", response)
+		require.Equal(t, authdoor.AuthDenied, ret.Auth, name)
+		require.Equal(t, http.StatusUnauthorized, recorder.Code, name)
+		require.Contains(t, recorder.Body.String(), want.Error(), name)
+		device.counter = a.counter
+	}
+	resign := func(a *authenticator, response map[string]interface{}, clientData []byte, authData []byte) {
+		fields := response["response"].(map[string]interface{})
+		clientDataHash := sha256.Sum256(clientData)
+		fields["clientDataJSON"] = base64.RawURLEncoding.EncodeToString(clientData)
+		fields["authenticatorData"] = base64.RawURLEncoding.EncodeToString(authData)
+		fields["signature"] = base64.RawURLEncoding.EncodeToString(sign(a.credentials[0].key, append(append([]byte{}, authData...), clientDataHash[:]...)))
+	}
+	challengeOf := func(response map[string]interface{}) string {
+		raw, _ := base64.RawURLEncoding.DecodeString(response["response"].(map[string]interface{})["clientDataJSON"].(string))
+		client := collectedClientData{}
+		json.Unmarshal(raw, &client)
+		return client.Challenge
+	}
+
+	refused("origin", ErrClientData, func(a *authenticator, b *browser, response map[string]interface{}) {
+		a.origin = "https://evil.example"
+		resign(a, response, a.clientData("webauthn.get", challengeOf(response)), a.authData(nil))
+	})
+	refused("type", ErrClientData, func(a *authenticator, b *browser, response map[string]interface{}) {
+		resign(a, response, a.clientData("webauthn.create", challengeOf(response)), a.authData(nil))
+	})
+	refused("rp id", ErrRelyingParty, func(a *authenticator, b *browser, response map[string]interface{}) {
+		a.rpID = "evil.example"
+		a.counter++
+		resign(a, response, a.clientData("webauthn.get", challengeOf(response)), a.authData(nil))
+	})
+	refused("user verification", ErrFlags, func(a *authenticator, b *browser, response map[string]interface{}) {
+		a.flags = flagUserPresent
+		a.counter++
+		resign(a, response, a.clientData("webauthn.get", challengeOf(response)), a.authData(nil))
+	})
+	refused("unknown challenge", ErrChallenge, func(a *authenticator, b *browser, response map[string]interface{}) {
+		resign(a, response, a.clientData("webauthn.get", base64.RawURLEncoding.EncodeToString(randomBytes(32))), a.authData(nil))
+	})
+	refused("signature", ErrSignature, func(a *authenticator, b *browser, response map[string]interface{}) {
+		response["response"].(map[string]interface{})["signature"] = base64.RawURLEncoding.EncodeToString(sign(newP256(), []byte("x")))
+	})
+	refused("other browser", ErrChallenge, func(a *authenticator, b *browser, response map[string]interface{}) {
+		b.cookies = map[string]*http.Cookie{}
+	})
+	refused("user handle", ErrUserHandle, func(a *authenticator, b *browser, response map[string]interface{}) {
+		response["response"].(map[string]interface{})["userHandle"] = base64.RawURLEncoding.EncodeToString([]byte("someone else"))
+	})
+
+	// a good response only works once
+	b := newBrowser(t, auth)
+	_, recorder = b.do("POST", "/.webauthn/login/begin", map[string]string{})
+	response := device.get(recorder.Body.Bytes())
+	_, recorder = b.do("POST", "/.webauthn/login/finish", response)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	_, recorder = b.do("POST", "/.webauthn/login/finish", response)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// ceremonies nobody finishes leave nothing behind on the server
+	used := auth.used.Len()
+	for i := 0; i < 100; i++ {
+		newBrowser(t, auth).do("POST", "/.webauthn/login/begin", map[string]string{})
+	}
+	require.Equal(t, used, auth.used.Len())
+
+	// challenges expire
+	_, recorder = b.do("POST", "/.webauthn/login/begin", map[string]string{})
+	response = device.get(recorder.Body.Bytes())
+	auth.now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	_, recorder = b.do("POST", "/.webauthn/login/finish", response)
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+// TestAttestation registers with packed self and certificate attestation, with and without trusted roots
+func TestAttestation(t *testing.T) {
+	// an attestation CA and a certificate for the authenticator's model
+	caKey := newP256()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Attestation CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	device := newAuthenticator(t)
+	aaguidExtension, err := asn1.Marshal(device.aaguid)
+	require.NoError(t, err)
+	certKey := newP256()
+	certTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Test Key", Organization: []string{"Test"}, OrganizationalUnit: []string{"Authenticator Attestation"}, Country: []string{"US"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: oidAAGUID, Value: aaguidExtension}},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, certTemplate, ca, certKey.Public(), caKey)
+	require.NoError(t, err)
+	device.certKey = certKey
+	device.certs = [][]byte{certDER}
+
+	registers := func(auth *WebAuthn, attestation string, key crypto.Signer) int {
+		device.attestation = attestation
+		b := newBrowser(t, auth)
+		b.header.Set("X-Invite", "aj")
+		_, recorder := b.register(device, key)
+		return recorder.Code
+	}
+
+	open := newTestWebAuthn(t, Config{})
+	require.Equal(t, http.StatusOK, registers(open, "self", newP256()))
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, registers(open, "self", ed25519Key))
+	require.Equal(t, http.StatusOK, registers(open, "x5c", newP256()))
+
+	// the Ed25519 credential logs in too
+	device.credentials = device.credentials[1:2]
+	_, recorder := newBrowser(t, open).login(device, "aj")
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	trusting := newTestWebAuthn(t, Config{AttestationRoots: roots})
+	require.Equal(t, http.StatusUnauthorized, registers(trusting, "none", newP256()))
+	require.Equal(t, http.StatusUnauthorized, registers(trusting, "self", newP256()))
+	require.Equal(t, http.StatusOK, registers(trusting, "x5c", newP256()))
+
+	// a certificate for another model is refused
+	device.aaguid = bytes.Repeat([]byte{0xbb}, 16)
+	require.Equal(t, http.StatusUnauthorized, registers(open, "x5c", newP256()))
+}
+
+// TestFileStore checks credentials and sign counts persist
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webauthn")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "credentials.json")
+
+	store, err := OpenFileStore(file)
+	require.NoError(t, err)
+	credential := &Credential{ID: []byte{1, 2, 3}, User: "aj", UserHandle: []byte{4}, PublicKey: []byte{5}, SignCount: 1}
+	require.NoError(t, store.Add(credential))
+	require.Equal(t, ErrDuplicateCredential, store.Add(credential))
+	require.NoError(t, store.SetSignCount([]byte{1, 2, 3}, 5, time.Now()))
+	require.Equal(t, ErrSignCount, store.SetSignCount([]byte{1, 2, 3}, 5, time.Now()))
+	_, err = store.Get([]byte{9})
+	require.Equal(t, ErrUnknownCredential, err)
+
+	reopened, err := OpenFileStore(file)
+	require.NoError(t, err)
+	loaded, err := reopened.Get([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), loaded.SignCount)
+	list, err := reopened.List("aj")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	// authenticators that don't count always send zero
+	require.NoError(t, reopened.Add(&Credential{ID: []byte{7}, User: "aj"}))
+	require.NoError(t, reopened.SetSignCount([]byte{7}, 0, time.Now()))
+	require.NoError(t, reopened.SetSignCount([]byte{7}, 0, time.Now()))
+}
@@ -0,0 +1,241 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUnknownCredential is returned by stores for credential ids they don't have
+	ErrUnknownCredential = errors.New("unknown credential")
+	// ErrDuplicateCredential is returned when a credential id is registered twice
+	ErrDuplicateCredential = errors.New("credential already registered")
+	// ErrSignCount is returned when a sign count doesn't go up, which means the authenticator may have been cloned
+	ErrSignCount = errors.New("sign count didn't increase")
+)
+
+// Credential is a registered public key
+type Credential struct {
+	ID []byte `json:"id"`
+	// User is the name the credential was registered for, UserHandle is the opaque id given to the authenticator
+	User       string `json:"user"`
+	UserHandle []byte `json:"user_handle"`
+	// PublicKey is the COSE key from registration
+	PublicKey []byte    `json:"public_key"`
+	SignCount uint32    `json:"sign_count"`
+	AAGUID    []byte    `json:"aaguid"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last_used,omitempty"`
+}
+
+// Store keeps credentials
+type Store interface {
+	// Get returns ErrUnknownCredential for ids it doesn't have
+	Get(id []byte) (*Credential, error)
+	// List returns a user's credentials
+	List(user string) ([]Credential, error)
+	// Add returns ErrDuplicateCredential if the id is taken
+	Add(credential *Credential) error
+	// SetSignCount saves a login's sign count, and must return ErrSignCount without saving unless it's greater than the stored one. Authenticators that always send zero don't count and are let through.
+	SetSignCount(id []byte, count uint32, used time.Time) error
+}
+
+// MemoryStore is a Store that forgets everything on restart
+type MemoryStore struct {
+	mutex       *sync.Mutex
+	credentials map[string]*Credential
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{mutex: new(sync.Mutex), credentials: make(map[string]*Credential)}
+}
+
+// Get returns a copy of the credential with id
+func (s *MemoryStore) Get(id []byte) (*Credential, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	credential, ok := s.credentials[string(id)]
+	if !ok {
+		return nil, ErrUnknownCredential
+	}
+	c := *credential
+	return &c, nil
+}
+
+// List returns a user's credentials
+func (s *MemoryStore) List(user string) ([]Credential, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return listCredentials(s.credentials, user), nil
+}
+
+// Add saves a new credential
+func (s *MemoryStore) Add(credential *Credential) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.credentials[string(credential.ID)]; ok {
+		return ErrDuplicateCredential
+	}
+	c := *credential
+	s.credentials[string(credential.ID)] = &c
+	return nil
+}
+
+// SetSignCount saves a login's sign count
+func (s *MemoryStore) SetSignCount(id []byte, count uint32, used time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	credential, ok := s.credentials[string(id)]
+	if !ok {
+		return ErrUnknownCredential
+	}
+	return advance(credential, count, used)
+}
+
+// advance moves a credential's sign count forward
+func advance(credential *Credential, count uint32, used time.Time) error {
+	if (count != 0 || credential.SignCount != 0) && count <= credential.SignCount {
+		return ErrSignCount
+	}
+	credential.SignCount = count
+	credential.LastUsed = used
+	return nil
+}
+
+// listCredentials copies out a user's credentials, oldest first
+func listCredentials(credentials map[string]*Credential, user string) []Credential {
+	list := []Credential{}
+	for _, credential := range credentials {
+		if credential.User == user {
+			list = append(list, *credential)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return bytes.Compare(list[i].ID, list[j].ID) < 0
+	})
+	return list
+}
+
+// FileStore is a Store in a JSON file, keyed by base64url credential id. Only public keys are kept so the file isn't secret, but it should only be writable by us.
+type FileStore struct {
+	file        string
+	mutex       *sync.Mutex
+	credentials map[string]*Credential
+}
+
+// OpenFileStore loads file, a missing file is an empty store
+func OpenFileStore(file string) (*FileStore, error) {
+	s := &FileStore{file: file, mutex: new(sync.Mutex), credentials: make(map[string]*Credential)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]*Credential)
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+	for _, credential := range stored {
+		s.credentials[string(credential.ID)] = credential
+	}
+	return s, nil
+}
+
+// save writes the file through a temporary file and a rename. The caller holds the lock.
+func (s *FileStore) save() error {
+	stored := make(map[string]*Credential, len(s.credentials))
+	for _, credential := range s.credentials {
+		stored[base64.RawURLEncoding.EncodeToString(credential.ID)] = credential
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), ".webauthn-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Get returns a copy of the credential with id
+func (s *FileStore) Get(id []byte) (*Credential, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	credential, ok := s.credentials[string(id)]
+	if !ok {
+		return nil, ErrUnknownCredential
+	}
+	c := *credential
+	return &c, nil
+}
+
+// List returns a user's credentials
+func (s *FileStore) List(user string) ([]Credential, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return listCredentials(s.credentials, user), nil
+}
+
+// Add saves a new credential
+func (s *FileStore) Add(credential *Credential) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.credentials[string(credential.ID)]; ok {
+		return ErrDuplicateCredential
+	}
+	c := *credential
+	s.credentials[string(credential.ID)] = &c
+	if err := s.save(); err != nil {
+		delete(s.credentials, string(credential.ID))
+		return err
+	}
+	return nil
+}
+
+// SetSignCount saves a login's sign count
+func (s *FileStore) SetSignCount(id []byte, count uint32, used time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	credential, ok := s.credentials[string(id)]
+	if !ok {
+		return ErrUnknownCredential
+	}
+	old := *credential
+	if err := advance(credential, count, used); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		*credential = old
+		return err
+	}
+	return nil
+}
@@ -81,6 +81,11 @@ type InstanceReturnInfo struct {
 	Info json.RawMessage
 }
 
+// Name returns the name of the instance that supplied this info
+func (i InstanceReturnInfo) Name() string {
+	return i.name
+}
+
 // IsAnswered is a simple helper to check if the ResponseWriter was written to
 func (r *AuthFuncReturn) IsAnswered() bool {
 	return r.Resp == Answered
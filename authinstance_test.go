@@ -133,6 +133,7 @@ func TestAuthFuncInstanceCall(t *testing.T) {
 		require.Equal(t, allReturnCombos[i].expRet.Auth, info.Auth)
 		require.Equal(t, allReturnCombos[i].expRet.Resp, info.Resp)
 		require.Equal(t, allReturnCombos[i].name, info.Info.name)
+		require.Equal(t, allReturnCombos[i].name, info.Info.Name())
 	}
 }
 
@@ -134,9 +134,8 @@ func (h *AuthHandler) UpdateHandler(completionNotifier chan int) error {
 	return nil
 }
 
-// ServeHTTP is the handler function that wraps the base ServeHTTP, while calling the authorization functions.
-func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// TODO: Set CORS here or force it elsewhere?
+// callActive runs CallAll on whichever of the double-buffered lists is current. The boolean is false if UpdateHandler hasn't built a list yet, in which case nothing was called.
+func (h *AuthHandler) callActive(w http.ResponseWriter, r *http.Request) (AuthFuncReturn, bool, error) {
 	currentList := -1
 	for currentList != h.currentList {
 		currentList := h.currentList
@@ -146,26 +145,30 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			currentList = -1
 			continue
 		}
+		defer h.activeMutex.RUnlock()
 		if h.activeLists[currentList] != nil { // TODO: empty lists forced returns instead of calling, we didn't test of this, why?
-			defer h.activeMutex.RUnlock()
 			ret, err := h.activeLists[currentList].CallAll(w, r)
-			if err != nil {
-				// TODO: log
-				return
-			}
-			if (ret.Auth == AuthGranted) || (ret.Resp == Ignored) {
-				// Set contex here.
-				if h.base != nil {
-					h.base.ServeHTTP(w, r)
-				}
-			}
-			return
+			return ret, true, err
+		}
+		return AuthFuncReturn{Auth: AuthFailed, Resp: Ignored}, false, nil
+	}
+	return AuthFuncReturn{Auth: AuthFailed, Resp: Ignored}, false, nil
+}
+
+// ServeHTTP is the handler function that wraps the base ServeHTTP, while calling the authorization functions.
+func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// TODO: Set CORS here or force it elsewhere?
+	ret, ok, err := h.callActive(w, r)
+	if err != nil {
+		// TODO: log
+		return
+	}
+	if !ok || (ret.Auth == AuthGranted) || (ret.Resp == Ignored) {
+		if ret.Auth == AuthGranted && r != nil {
+			r = r.WithContext(NewContext(r.Context(), ret.Info))
 		}
-		h.activeMutex.RUnlock()
 		if h.base != nil {
 			h.base.ServeHTTP(w, r)
 		}
-		return
 	}
-	return
 }
@@ -20,6 +20,11 @@ func (l *AuthFuncListTemplate) Init(name string, instances ...AuthFuncInstance)
 	return l.AuthFuncListSafe.Init(instances...)
 }
 
+// Name returns the name the template was initialized with.
+func (l *AuthFuncListTemplate) Name() string {
+	return l.name
+}
+
 // AddHandler will add a pointer to the list of handlers.
 func (l *AuthFuncListTemplate) AddHandler(handler *AuthHandler) {
 	l.handlerMutex.Lock()
@@ -16,6 +16,7 @@ func TestAuthFuncListTemplateInit(t *testing.T) {
 	require.Equal(t, len(sortableInstances), len(list.funcMap))
 	require.NotNil(t, list.handlerMutex)
 	require.Equal(t, list.name, "test")
+	require.Equal(t, "test", list.Name())
 	ordered, errorList := checkOrder(&list.AuthFuncListSafe.AuthFuncList)
 	require.True(t, ordered, "list value returned: %v", errorList)
 	for i := range list.funcList {
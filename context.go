@@ -0,0 +1,19 @@
+package authdoor
+
+import (
+	"context"
+)
+
+// contextKey is unexported so only this package can set the info in a context
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the InstanceReturnInfo of the instance that granted access
+func NewContext(ctx context.Context, info InstanceReturnInfo) context.Context {
+	return context.WithValue(ctx, contextKey{}, info)
+}
+
+// InfoFromContext returns the InstanceReturnInfo stored by NewContext, if there is one
+func InfoFromContext(ctx context.Context) (InstanceReturnInfo, bool) {
+	info, ok := ctx.Value(contextKey{}).(InstanceReturnInfo)
+	return info, ok
+}
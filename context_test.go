@@ -0,0 +1,20 @@
+package authdoor
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestContext makes sure info survives a round trip through a context
+func TestContext(t *testing.T) {
+	_, ok := InfoFromContext(context.Background())
+	require.False(t, ok)
+	info := InstanceReturnInfo{name: "test", Info: json.RawMessage(`{}`)}
+	ret, ok := InfoFromContext(NewContext(context.Background(), info))
+	require.True(t, ok)
+	require.Equal(t, info, ret)
+	require.Equal(t, "test", ret.Name())
+}
@@ -0,0 +1,17 @@
+module github.com/ayjayt/authdoor/extauthz
+
+go 1.13
+
+require (
+	github.com/ayjayt/authdoor v0.0.0-20261019060117-4f0c0aadbb1a
+	github.com/ayjayt/ilog v0.0.0-20190723193223-ae1d18ab078a
+	github.com/envoyproxy/go-control-plane v0.9.9
+	github.com/pkg/errors v0.9.1
+	github.com/stretchr/testify v1.5.1
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.36.0
+	google.golang.org/protobuf v1.25.0
+)
+
+// Builds against the checkout it sits in; drop it to use the version required above.
+replace github.com/ayjayt/authdoor => ../
@@ -0,0 +1,246 @@
+/*
+Package extauthz implements Envoy's external authorization (ext_authz) Check API on top of an authdoor.AuthFuncListTemplate, so the same lists that protect an AuthHandler can protect services in an Envoy mesh.
+
+It's a module of its own so only those using it pull in Envoy's and gRPC's dependencies.
+*/
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/pkg/errors"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+var (
+	// ErrNoHTTPAttributes is returned when a CheckRequest doesn't describe an HTTP request
+	ErrNoHTTPAttributes = errors.New("check request has no http attributes")
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// Server is an authv3.AuthorizationServer backed by an AuthFuncListTemplate. Changes to the template are seen by the next Check.
+type Server struct {
+	list *authdoor.AuthFuncListTemplate
+}
+
+// New returns a Server that authorizes with list
+func New(list *authdoor.AuthFuncListTemplate) *Server {
+	defaultLogger.Info("Creating ext_authz server")
+	return &Server{list: list}
+}
+
+// Register registers the Server as the Authorization service on a grpc.Server
+func (s *Server) Register(grpcServer *grpc.Server) {
+	authv3.RegisterAuthorizationServer(grpcServer, s)
+}
+
+// Check runs the list's CallAll on the request Envoy describes. AuthGranted becomes an OK response that sets the identity headers upstream, anything an AuthFunc Answered is sent back to the client, and everything else is denied with 403 (AuthDenied) or 401 (AuthFailed).
+func (s *Server) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	r, err := checkToRequest(ctx, req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	w := newResponseRecorder()
+	ret, err := s.list.CallAll(w, r)
+	if err != nil {
+		defaultLogger.Error("AuthFuncList returned error: " + err.Error())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return returnToCheck(ret, w), nil
+}
+
+// checkToRequest rebuilds an *http.Request from the CheckRequest's attributes
+func checkToRequest(ctx context.Context, req *authv3.CheckRequest) (*http.Request, error) {
+	attrs := req.GetAttributes()
+	httpAttrs := attrs.GetRequest().GetHttp()
+	if httpAttrs == nil {
+		return nil, ErrNoHTTPAttributes
+	}
+	scheme := httpAttrs.GetScheme()
+	if scheme == "" {
+		scheme = "http"
+	}
+	target, err := url.ParseRequestURI(httpAttrs.GetPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "bad path")
+	}
+	target.Scheme = scheme
+	target.Host = httpAttrs.GetHost()
+	body := httpAttrs.GetRawBody()
+	if len(body) == 0 && httpAttrs.GetBody() != "" {
+		body = []byte(httpAttrs.GetBody())
+	}
+	r, err := http.NewRequest(httpAttrs.GetMethod(), target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(ctx)
+	r.RequestURI = target.RequestURI()
+	r.Proto = httpAttrs.GetProtocol()
+	for k, v := range httpAttrs.GetHeaders() {
+		if strings.HasPrefix(k, ":") { // pseudo headers are already in the attributes
+			continue
+		}
+		r.Header.Set(k, v)
+	}
+	if address := attrs.GetSource().GetAddress().GetSocketAddress(); address != nil {
+		r.RemoteAddr = net.JoinHostPort(address.GetAddress(), strconv.FormatUint(uint64(address.GetPortValue()), 10))
+	}
+	if certs := parseCertificates(attrs.GetSource().GetCertificate()); len(certs) != 0 {
+		r.TLS = &tls.ConnectionState{HandshakeComplete: true, PeerCertificates: certs}
+	}
+	return r, nil
+}
+
+// parseCertificates decodes the URL-encoded PEM Envoy sends for the downstream client certificate
+func parseCertificates(encoded string) []*x509.Certificate {
+	if encoded == "" {
+		return nil
+	}
+	rawPEM, err := url.QueryUnescape(encoded)
+	if err != nil {
+		return nil
+	}
+	var ret []*x509.Certificate
+	rest := []byte(rawPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return ret
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return ret
+		}
+		ret = append(ret, cert)
+	}
+}
+
+// returnToCheck translates an AuthFuncReturn (and whatever the AuthFuncs wrote) into a CheckResponse
+func returnToCheck(ret authdoor.AuthFuncReturn, w *responseRecorder) *authv3.CheckResponse {
+	if ret.IsAnswered() {
+		code := w.status
+		if code == 0 {
+			code = http.StatusOK
+			if ret.Auth != authdoor.AuthGranted {
+				code = http.StatusUnauthorized
+			}
+		}
+		return deniedResponse(codes.Unauthenticated, code, w.header, w.body.String())
+	}
+	switch ret.Auth {
+	case authdoor.AuthGranted:
+		info := []byte("null")
+		if len(ret.Info.Info) != 0 {
+			compacted := new(bytes.Buffer)
+			if err := json.Compact(compacted, ret.Info.Info); err == nil {
+				info = compacted.Bytes()
+			}
+		}
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{
+					Headers: []*corev3.HeaderValueOption{
+						overwriteHeader(authdoor.ForwardAuthInstanceHeader, ret.Info.Name()),
+						overwriteHeader(authdoor.ForwardAuthInfoHeader, string(info)),
+					},
+				},
+			},
+		}
+	case authdoor.AuthDenied:
+		return deniedResponse(codes.PermissionDenied, http.StatusForbidden, nil, http.StatusText(http.StatusForbidden))
+	}
+	return deniedResponse(codes.Unauthenticated, http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized))
+}
+
+// deniedResponse builds a response Envoy sends straight back to the client
+func deniedResponse(code codes.Code, httpCode int, header http.Header, body string) *authv3.CheckResponse {
+	headers := make([]*corev3.HeaderValueOption, 0, len(header))
+	for k, values := range header {
+		for _, v := range values {
+			headers = append(headers, &corev3.HeaderValueOption{Header: &corev3.HeaderValue{Key: k, Value: v}})
+		}
+	}
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(httpCode)},
+				Headers: headers,
+				Body:    body,
+			},
+		},
+	}
+}
+
+// overwriteHeader makes a header option that replaces anything the client sent under the same name, so identity headers can't be spoofed
+func overwriteHeader(key, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{Key: key, Value: value},
+		Append: &wrapperspb.BoolValue{Value: false},
+	}
+}
+
+// responseRecorder is the http.ResponseWriter AuthFuncs write to, since there's no real connection to write to
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// newResponseRecorder returns an empty responseRecorder
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header)}
+}
+
+// Header returns the recorded headers
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+// WriteHeader records the first status written
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// Write records the body
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
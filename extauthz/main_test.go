@@ -0,0 +1,162 @@
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("extauthz/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// pathAuthFunc grants /open, denies /closed, serves a login page on /login and fails everything else.
+func pathAuthFunc(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	switch r.URL.Path {
+	case "/open":
+		if r.Header.Get("X-Test") != "yes" || r.URL.Query().Get("q") != "1" {
+			return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied}, nil
+		}
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthGranted, Info: authdoor.InstanceReturnInfo{Info: json.RawMessage(`{"user": "aj"}`)}}, nil
+	case "/closed":
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied}, nil
+	case "/login":
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<form></form>"))
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed, Resp: authdoor.Answered}, nil
+	}
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed}, nil
+}
+
+// newClient starts a Server on an in-memory listener and returns a client connected to it
+func newClient(t *testing.T) (authv3.AuthorizationClient, func()) {
+	instance := new(authdoor.AuthFuncInstance)
+	instance.Init("path", pathAuthFunc, 0, nil)
+	list := new(authdoor.AuthFuncListTemplate)
+	require.NoError(t, list.Init("extauthz", *instance))
+
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	New(list).Register(grpcServer)
+	go grpcServer.Serve(listener)
+
+	dialer := func(context.Context, string) (net.Conn, error) {
+		return listener.Dial()
+	}
+	conn, err := grpc.DialContext(context.Background(), "bufnet", grpc.WithContextDialer(dialer), grpc.WithInsecure())
+	require.NoError(t, err)
+	return authv3.NewAuthorizationClient(conn), func() {
+		conn.Close()
+		grpcServer.Stop()
+	}
+}
+
+// checkRequest builds the CheckRequest Envoy would send for path
+func checkRequest(path string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{
+				Address: &corev3.Address{
+					Address: &corev3.Address_SocketAddress{
+						SocketAddress: &corev3.SocketAddress{
+							Address:       "10.0.0.1",
+							PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 5555},
+						},
+					},
+				},
+			},
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  "GET",
+					Path:    path,
+					Host:    "ajpikul.com",
+					Scheme:  "https",
+					Headers: map[string]string{":authority": "ajpikul.com", "x-test": "yes"},
+				},
+			},
+		},
+	}
+}
+
+// TestCheckToRequest makes sure the attributes end up where AuthFuncs expect them
+func TestCheckToRequest(t *testing.T) {
+	r, err := checkToRequest(context.Background(), checkRequest("/a/b?q=1"))
+	require.NoError(t, err)
+	require.Equal(t, "GET", r.Method)
+	require.Equal(t, "https://ajpikul.com/a/b?q=1", r.URL.String())
+	require.Equal(t, "ajpikul.com", r.Host)
+	require.Equal(t, "yes", r.Header.Get("X-Test"))
+	require.Equal(t, "", r.Header.Get(":authority"))
+	require.Equal(t, "10.0.0.1:5555", r.RemoteAddr)
+	require.Nil(t, r.TLS)
+
+	_, err = checkToRequest(context.Background(), &authv3.CheckRequest{})
+	require.Equal(t, ErrNoHTTPAttributes, err)
+}
+
+// TestCheck runs every kind of AuthFuncReturn through a real gRPC client
+func TestCheck(t *testing.T) {
+	client, closer := newClient(t)
+	defer closer()
+
+	resp, err := client.Check(context.Background(), checkRequest("/open?q=1"))
+	require.NoError(t, err)
+	require.Equal(t, int32(codes.OK), resp.GetStatus().GetCode())
+	headers := resp.GetOkResponse().GetHeaders()
+	require.Equal(t, 2, len(headers))
+	require.Equal(t, authdoor.ForwardAuthInstanceHeader, headers[0].GetHeader().GetKey())
+	require.Equal(t, "path", headers[0].GetHeader().GetValue())
+	require.Equal(t, `{"user":"aj"}`, headers[1].GetHeader().GetValue())
+	require.False(t, headers[1].GetAppend().GetValue())
+
+	resp, err = client.Check(context.Background(), checkRequest("/closed"))
+	require.NoError(t, err)
+	require.Equal(t, int32(codes.PermissionDenied), resp.GetStatus().GetCode())
+	require.Equal(t, int32(http.StatusForbidden), int32(resp.GetDeniedResponse().GetStatus().GetCode()))
+
+	resp, err = client.Check(context.Background(), checkRequest("/other"))
+	require.NoError(t, err)
+	require.Equal(t, int32(codes.Unauthenticated), resp.GetStatus().GetCode())
+	require.Equal(t, int32(http.StatusUnauthorized), int32(resp.GetDeniedResponse().GetStatus().GetCode()))
+
+	resp, err = client.Check(context.Background(), checkRequest("/login"))
+	require.NoError(t, err)
+	require.Equal(t, int32(http.StatusUnauthorized), int32(resp.GetDeniedResponse().GetStatus().GetCode()))
+	require.Equal(t, "<form></form>", resp.GetDeniedResponse().GetBody())
+	require.Equal(t, "Content-Type", resp.GetDeniedResponse().GetHeaders()[0].GetHeader().GetKey())
+
+	_, err = client.Check(context.Background(), checkRequest("not a path"))
+	require.Error(t, err)
+}
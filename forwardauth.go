@@ -0,0 +1,154 @@
+package authdoor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// ForwardAuthInstanceHeader is set on a granted forward-auth reply to the name of the instance that granted access
+	ForwardAuthInstanceHeader = "X-Authdoor-Instance"
+	// ForwardAuthInfoHeader is set on a granted forward-auth reply to the compacted JSON Info of the granting instance
+	ForwardAuthInfoHeader = "X-Authdoor-Info"
+)
+
+// ForwardAuthHandler is an AuthHandler for deployments where nginx (auth_request) or Traefik (ForwardAuth) sits in front of the service instead of authdoor's own proxy.
+// It never calls a base handler. It rebuilds the original request from the proxy's headers, runs the lists on it, and replies 200 with identity headers on AuthGranted, 403 on AuthDenied and 401 when nothing could identify the user.
+// If an instance Answered (a login page, say) its reply is passed through, but if it didn't grant a 2xx status is replaced with 401, or 403 when denied.
+// Lists, instances and hot updates work exactly as they do on AuthHandler.
+type ForwardAuthHandler struct {
+	AuthHandler
+}
+
+// Init initializes the underlying AuthHandler without a base handler.
+func (h *ForwardAuthHandler) Init() error {
+	return h.AuthHandler.Init(nil)
+}
+
+// ServeHTTP reconstructs the original request, calls the authorization functions, and converts the result into a reply the proxy understands.
+func (h *ForwardAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	original, err := forwardedRequest(r)
+	if err != nil {
+		h.logger.Error("Couldn't reconstruct forwarded request: " + err.Error())
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	recorder := &forwardAuthWriter{ResponseWriter: w}
+	ret, ok, err := h.callActive(recorder, original)
+	if err != nil {
+		h.logger.Error("Forward auth failed with error: " + err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		ret = AuthFuncReturn{Auth: AuthFailed, Resp: Ignored}
+	}
+	if ret.IsAnswered() {
+		recorder.flush(ret.Auth)
+		return
+	}
+	switch ret.Auth {
+	case AuthGranted:
+		w.Header().Set(ForwardAuthInstanceHeader, ret.Info.name)
+		if len(ret.Info.Info) != 0 {
+			info := new(bytes.Buffer)
+			if err := json.Compact(info, ret.Info.Info); err == nil {
+				w.Header().Set(ForwardAuthInfoHeader, info.String())
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	case AuthDenied:
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	default:
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+}
+
+// forwardedRequest builds a copy of the request the proxy is asking about. nginx sends X-Original-URI/X-Original-Method (or X-Original-URL) by convention, Traefik sends X-Forwarded-Uri/X-Forwarded-Method.
+func forwardedRequest(r *http.Request) (*http.Request, error) {
+	ret := r.Clone(r.Context())
+	if method := firstHeader(r, "X-Original-Method", "X-Forwarded-Method"); method != "" {
+		ret.Method = method
+	}
+	target := &url.URL{}
+	if rawURL := r.Header.Get("X-Original-URL"); rawURL != "" {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		target = parsed
+	} else {
+		uri := firstHeader(r, "X-Original-URI", "X-Forwarded-Uri")
+		if uri == "" {
+			uri = r.URL.RequestURI()
+		}
+		parsed, err := url.ParseRequestURI(uri)
+		if err != nil {
+			return nil, err
+		}
+		target.Path, target.RawPath, target.RawQuery = parsed.Path, parsed.RawPath, parsed.RawQuery
+		target.Host = firstHeader(r, "X-Forwarded-Host")
+		if target.Host == "" {
+			target.Host = r.Host
+		}
+		target.Scheme = strings.ToLower(firstHeader(r, "X-Forwarded-Proto"))
+		if target.Scheme == "" {
+			target.Scheme = "http"
+			if r.TLS != nil {
+				target.Scheme = "https"
+			}
+		}
+	}
+	ret.URL = target
+	ret.Host = target.Host
+	ret.RequestURI = target.RequestURI()
+	return ret, nil
+}
+
+// firstHeader returns the first non-empty value of the named headers. Comma separated lists (added by chained proxies) are trimmed to their first element.
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := r.Header.Get(name); value != "" {
+			return strings.TrimSpace(strings.SplitN(value, ",", 2)[0])
+		}
+	}
+	return ""
+}
+
+// forwardAuthWriter holds back anything an AuthFunc writes so the status can be fixed up once we know the AuthFuncReturn.
+type forwardAuthWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status instead of sending it.
+func (f *forwardAuthWriter) WriteHeader(status int) {
+	if f.status == 0 {
+		f.status = status
+	}
+}
+
+// Write buffers the body.
+func (f *forwardAuthWriter) Write(b []byte) (int, error) {
+	return f.body.Write(b)
+}
+
+// flush sends the buffered answer. Proxies read any 2xx as success, so an answer that didn't grant never goes out as one: it becomes a 403 if denied and a 401 otherwise. Other statuses, like a redirect to a login page, pass through.
+func (f *forwardAuthWriter) flush(auth AuthStatus) {
+	status := f.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if auth != AuthGranted && status >= 200 && status < 300 {
+		status = http.StatusUnauthorized
+		if auth == AuthDenied {
+			status = http.StatusForbidden
+		}
+	}
+	f.ResponseWriter.WriteHeader(status)
+	f.ResponseWriter.Write(f.body.Bytes())
+}
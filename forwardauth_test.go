@@ -0,0 +1,139 @@
+package authdoor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newForwardAuthHandler builds a ForwardAuthHandler with a single instance and updates it so it's ready to serve.
+func newForwardAuthHandler(t *testing.T, authFunc AuthFunc) *ForwardAuthHandler {
+	handler := new(ForwardAuthHandler)
+	require.NoError(t, handler.Init())
+	instance := new(AuthFuncInstance)
+	instance.Init("forward", authFunc, 0, nil)
+	require.NoError(t, handler.AddInstances(*instance))
+	require.NoError(t, handler.UpdateHandler(nil))
+	return handler
+}
+
+// TestForwardedRequest makes sure both the nginx and Traefik header conventions rebuild the original request.
+func TestForwardedRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://auth.internal/check", nil)
+	req.Header.Set("X-Original-URI", "/private/file?x=1")
+	req.Header.Set("X-Original-Method", "POST")
+	req.Header.Set("X-Forwarded-Host", "ajpikul.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	original, err := forwardedRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, "POST", original.Method)
+	require.Equal(t, "https://ajpikul.com/private/file?x=1", original.URL.String())
+	require.Equal(t, "ajpikul.com", original.Host)
+	require.Equal(t, "GET", req.Method) // the original is untouched
+
+	req = httptest.NewRequest("GET", "http://auth.internal/check", nil)
+	req.Header.Set("X-Forwarded-Uri", "/traefik")
+	req.Header.Set("X-Forwarded-Method", "PUT")
+	req.Header.Set("X-Forwarded-Host", "a.com, b.com")
+	original, err = forwardedRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, "PUT", original.Method)
+	require.Equal(t, "http://a.com/traefik", original.URL.String())
+
+	req = httptest.NewRequest("GET", "http://auth.internal/check", nil)
+	req.Header.Set("X-Original-URL", "https://ajpikul.com/full?y=2")
+	original, err = forwardedRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, "/full?y=2", original.RequestURI)
+	require.Equal(t, "ajpikul.com", original.Host)
+}
+
+// TestForwardAuthHandlerServeHTTP tests the status codes and headers for each kind of AuthFuncReturn.
+func TestForwardAuthHandlerServeHTTP(t *testing.T) {
+	var seenPath string
+	granted := func(w http.ResponseWriter, r *http.Request) (AuthFuncReturn, error) {
+		seenPath = r.URL.Path
+		return AuthFuncReturn{Auth: AuthGranted, Resp: Ignored, Info: InstanceReturnInfo{Info: json.RawMessage(`{ "user": "aj" }`)}}, nil
+	}
+	handler := newForwardAuthHandler(t, granted)
+	req := httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("X-Original-URI", "/secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "/secret", seenPath)
+	require.Equal(t, "forward", recorder.Header().Get(ForwardAuthInstanceHeader))
+	require.Equal(t, `{"user":"aj"}`, recorder.Header().Get(ForwardAuthInfoHeader))
+
+	denied := func(w http.ResponseWriter, r *http.Request) (AuthFuncReturn, error) {
+		return AuthFuncReturn{Auth: AuthDenied, Resp: Ignored}, nil
+	}
+	recorder = httptest.NewRecorder()
+	newForwardAuthHandler(t, denied).ServeHTTP(recorder, httptest.NewRequest("GET", "/auth", nil))
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+	require.Equal(t, "", recorder.Header().Get(ForwardAuthInstanceHeader))
+
+	failed := func(w http.ResponseWriter, r *http.Request) (AuthFuncReturn, error) {
+		return AuthFuncReturn{Auth: AuthFailed, Resp: Ignored}, nil
+	}
+	recorder = httptest.NewRecorder()
+	newForwardAuthHandler(t, failed).ServeHTTP(recorder, httptest.NewRequest("GET", "/auth", nil))
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+// TestForwardAuthHandlerAnswered makes sure login pages pass through, and that an implicit 200 from a failed AuthFunc isn't read as a grant.
+func TestForwardAuthHandlerAnswered(t *testing.T) {
+	loginPage := func(w http.ResponseWriter, r *http.Request) (AuthFuncReturn, error) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<form></form>"))
+		return AuthFuncReturn{Auth: AuthFailed, Resp: Answered}, nil
+	}
+	recorder := httptest.NewRecorder()
+	newForwardAuthHandler(t, loginPage).ServeHTTP(recorder, httptest.NewRequest("GET", "/auth", nil))
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	require.Equal(t, "<form></form>", recorder.Body.String())
+	require.Equal(t, "text/html", recorder.Header().Get("Content-Type"))
+
+	redirect := func(w http.ResponseWriter, r *http.Request) (AuthFuncReturn, error) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return AuthFuncReturn{Auth: AuthFailed, Resp: Answered}, nil
+	}
+	recorder = httptest.NewRecorder()
+	newForwardAuthHandler(t, redirect).ServeHTTP(recorder, httptest.NewRequest("GET", "/auth", nil))
+	require.Equal(t, http.StatusFound, recorder.Code)
+	require.Equal(t, "/login", recorder.Header().Get("Location"))
+
+	// an explicit 2xx without a grant mustn't let the proxy through
+	for auth, status := range map[AuthStatus]int{AuthFailed: http.StatusUnauthorized, AuthDenied: http.StatusForbidden} {
+		auth := auth
+		explicit := func(w http.ResponseWriter, r *http.Request) (AuthFuncReturn, error) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("not you"))
+			return AuthFuncReturn{Auth: auth, Resp: Answered}, nil
+		}
+		recorder = httptest.NewRecorder()
+		newForwardAuthHandler(t, explicit).ServeHTTP(recorder, httptest.NewRequest("GET", "/auth", nil))
+		require.Equal(t, status, recorder.Code)
+		require.Equal(t, "not you", recorder.Body.String())
+	}
+
+	granted := func(w http.ResponseWriter, r *http.Request) (AuthFuncReturn, error) {
+		w.WriteHeader(http.StatusNoContent)
+		return AuthFuncReturn{Auth: AuthGranted, Resp: Answered}, nil
+	}
+	recorder = httptest.NewRecorder()
+	newForwardAuthHandler(t, granted).ServeHTTP(recorder, httptest.NewRequest("GET", "/auth", nil))
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+}
+
+// TestForwardAuthHandlerNotUpdated makes sure a handler with no active list doesn't let anyone through.
+func TestForwardAuthHandlerNotUpdated(t *testing.T) {
+	handler := new(ForwardAuthHandler)
+	require.NoError(t, handler.Init())
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/auth", nil))
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
@@ -11,4 +11,5 @@ require (
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.4.0
 	go.uber.org/zap v1.16.0 // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
@@ -0,0 +1,207 @@
+/*
+Package grpcauth provides grpc.ServerInterceptors that authorize RPCs with the same AuthFuncListTemplates used by authdoor's http handlers.
+
+AuthFuncs see each RPC as an HTTP/2 POST to its full method name (/package.Service/Method) with the incoming metadata as headers and the peer's address and TLS state filled in.
+
+It's a module of its own so only those using it pull in gRPC's dependencies.
+*/
+package grpcauth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+var (
+	// ErrNameTaken is returned when a list is added twice
+	ErrNameTaken = errors.New("tried to add a list with the same name as an existing list")
+	// ErrNotFound is returned when a route points to a list that wasn't added
+	ErrNotFound = errors.New("list name wasn't found")
+)
+
+var defaultLogger ilog.LoggerInterface
+
+func init() {
+	if defaultLogger == nil {
+		defaultLogger = new(ilog.EmptyLogger)
+	}
+}
+
+// SetDefaultLogger allows you set a logger like github.com/go-logr/zapr
+func SetDefaultLogger(newLogger ilog.LoggerInterface) {
+	defaultLogger = newLogger
+	defaultLogger.Info("Default logger set")
+}
+
+// Authorizer holds named AuthFuncListTemplates and routes each RPC to one of them by method prefix. RPCs that match no route use the default list.
+type Authorizer struct {
+	mutex       *sync.RWMutex
+	lists       map[string]*authdoor.AuthFuncListTemplate
+	routes      map[string]string // method prefix -> list name
+	defaultList string
+}
+
+// New returns an Authorizer which uses defaultList for any RPC without a route
+func New(defaultList *authdoor.AuthFuncListTemplate) *Authorizer {
+	defaultLogger.Info("Creating grpc authorizer with default list \"" + defaultList.Name() + "\"")
+	return &Authorizer{
+		mutex:       new(sync.RWMutex),
+		lists:       map[string]*authdoor.AuthFuncListTemplate{defaultList.Name(): defaultList},
+		routes:      make(map[string]string),
+		defaultList: defaultList.Name(),
+	}
+}
+
+// AddLists makes lists available to Route by their names
+func (a *Authorizer) AddLists(lists ...*authdoor.AuthFuncListTemplate) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, list := range lists {
+		if _, ok := a.lists[list.Name()]; ok {
+			return errors.Wrap(ErrNameTaken, list.Name())
+		}
+		a.lists[list.Name()] = list
+	}
+	return nil
+}
+
+// Route sends every RPC whose full method starts with prefix (e.g. "/pkg.Service/" or "/pkg.Service/Method") to the named list. The longest matching prefix wins.
+func (a *Authorizer) Route(prefix string, listName string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.lists[listName]; !ok {
+		return errors.Wrap(ErrNotFound, listName)
+	}
+	a.routes[prefix] = listName
+	return nil
+}
+
+// listFor returns the list routed for fullMethod
+func (a *Authorizer) listFor(fullMethod string) *authdoor.AuthFuncListTemplate {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	name, matched := a.defaultList, ""
+	for prefix, listName := range a.routes {
+		if len(prefix) > len(matched) && strings.HasPrefix(fullMethod, prefix) {
+			name, matched = listName, prefix
+		}
+	}
+	return a.lists[name]
+}
+
+// authorize runs the list for fullMethod and returns a context carrying the granting instance's info, or a status error
+func (a *Authorizer) authorize(ctx context.Context, fullMethod string) (context.Context, error) {
+	r := requestFromContext(ctx, fullMethod)
+	ret, err := a.listFor(fullMethod).CallAll(discardWriter{}, r)
+	if err != nil {
+		defaultLogger.Error("AuthFuncList returned error for " + fullMethod + ": " + err.Error())
+		return nil, status.Error(codes.Internal, "authorization error")
+	}
+	switch ret.Auth {
+	case authdoor.AuthGranted:
+		return authdoor.NewContext(ctx, ret.Info), nil
+	case authdoor.AuthDenied:
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+	return nil, status.Error(codes.Unauthenticated, "unauthenticated")
+}
+
+// UnaryServerInterceptor returns an interceptor which authorizes each unary RPC before calling its handler
+func (a *Authorizer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		newCtx, err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(newCtx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor which authorizes each stream before calling its handler
+func (a *Authorizer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		newCtx, err := a.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: newCtx})
+	}
+}
+
+// requestFromContext builds the *http.Request AuthFuncs inspect out of the RPC's metadata and peer
+func requestFromContext(ctx context.Context, fullMethod string) *http.Request {
+	r := &http.Request{
+		Method:     "POST",
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		RequestURI: fullMethod,
+		URL:        &url.URL{Scheme: "http", Path: fullMethod},
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, values := range md {
+			if k == ":authority" && len(values) != 0 {
+				r.Host = values[0]
+				continue
+			}
+			if strings.HasPrefix(k, ":") {
+				continue
+			}
+			r.Header[http.CanonicalHeaderKey(k)] = values
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			r.RemoteAddr = p.Addr.String()
+		}
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := tlsInfo.State
+			r.TLS = &state
+			r.URL.Scheme = "https"
+		}
+	}
+	r.URL.Host = r.Host
+	return r.WithContext(ctx)
+}
+
+// serverStream replaces the context of a grpc.ServerStream
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the authorized context
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// discardWriter is handed to AuthFuncs since there is no HTTP response to write to. Anything they write is dropped.
+type discardWriter struct{}
+
+// Header returns a throwaway header map
+func (discardWriter) Header() http.Header {
+	return make(http.Header)
+}
+
+// Write discards b
+func (discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// WriteHeader does nothing
+func (discardWriter) WriteHeader(int) {}
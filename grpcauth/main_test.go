@@ -0,0 +1,169 @@
+package grpcauth
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/ayjayt/authdoor"
+	"github.com/ayjayt/ilog"
+)
+
+// TsstMain runs first just to see if we should turn on verbose logging during testing
+func TestMain(t *testing.T) {
+	if testing.Verbose() {
+		fmt.Printf("Verbose...\n")
+		newLogger := new(ilog.ZapWrap)
+		err := newLogger.Init()
+		if err != nil {
+			panic(err)
+		}
+		SetDefaultLogger(newLogger)
+		defaultLogger.Info("grpcauth/main_test.go set logger")
+	}
+}
+
+// TestSetDefaultLogger ensures set logger works by verifying init() ran correctly
+func TestSetDefaultLogger(t *testing.T) {
+	if testing.Verbose() {
+		require.IsType(t, &ilog.ZapWrap{}, defaultLogger)
+	} else {
+		require.IsType(t, &ilog.EmptyLogger{}, defaultLogger)
+	}
+}
+
+// tokenAuthFunc grants the "good" token, denies the "bad" one and fails otherwise
+func tokenAuthFunc(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	switch r.Header.Get("Authorization") {
+	case "good":
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthGranted, Info: authdoor.InstanceReturnInfo{Info: json.RawMessage(`"aj"`)}}, nil
+	case "bad":
+		return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied}, nil
+	}
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthFailed}, nil
+}
+
+// denyAuthFunc denies everything
+func denyAuthFunc(w http.ResponseWriter, r *http.Request) (authdoor.AuthFuncReturn, error) {
+	return authdoor.AuthFuncReturn{Auth: authdoor.AuthDenied}, nil
+}
+
+// newList makes a single instance template
+func newList(t *testing.T, name string, authFunc authdoor.AuthFunc) *authdoor.AuthFuncListTemplate {
+	instance := new(authdoor.AuthFuncInstance)
+	instance.Init(name, authFunc, 0, nil)
+	list := new(authdoor.AuthFuncListTemplate)
+	require.NoError(t, list.Init(name, *instance))
+	return list
+}
+
+// incoming returns a context as a grpc server would build it
+func incoming(token string) context.Context {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token, ":authority", "svc.local"))
+	return peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4000}})
+}
+
+// TestRequestFromContext checks the request view AuthFuncs get
+func TestRequestFromContext(t *testing.T) {
+	r := requestFromContext(incoming("good"), "/pkg.Service/Method")
+	require.Equal(t, "POST", r.Method)
+	require.Equal(t, "/pkg.Service/Method", r.URL.Path)
+	require.Equal(t, "svc.local", r.Host)
+	require.Equal(t, "good", r.Header.Get("Authorization"))
+	require.Equal(t, "10.0.0.2:4000", r.RemoteAddr)
+	require.Nil(t, r.TLS)
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{ServerName: "svc"}}})
+	r = requestFromContext(ctx, "/pkg.Service/Method")
+	require.NotNil(t, r.TLS)
+	require.Equal(t, "svc", r.TLS.ServerName)
+	require.Equal(t, "https", r.URL.Scheme)
+}
+
+// TestUnaryServerInterceptor checks status codes and the context passed to the handler
+func TestUnaryServerInterceptor(t *testing.T) {
+	authorizer := New(newList(t, "tokens", tokenAuthFunc))
+	interceptor := authorizer.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		ret, ok := authdoor.InfoFromContext(ctx)
+		require.True(t, ok)
+		return ret, nil
+	}
+
+	resp, err := interceptor(incoming("good"), nil, info, handler)
+	require.NoError(t, err)
+	require.Equal(t, "tokens", resp.(authdoor.InstanceReturnInfo).Name())
+	require.Equal(t, json.RawMessage(`"aj"`), resp.(authdoor.InstanceReturnInfo).Info)
+
+	_, err = interceptor(incoming("bad"), nil, info, handler)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = interceptor(context.Background(), nil, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// TestRoute makes sure the longest prefix picks the list
+func TestRoute(t *testing.T) {
+	authorizer := New(newList(t, "tokens", tokenAuthFunc))
+	require.NoError(t, authorizer.AddLists(newList(t, "deny", denyAuthFunc)))
+	require.Equal(t, ErrNameTaken, errors.Cause(authorizer.AddLists(newList(t, "deny", denyAuthFunc))))
+	require.Equal(t, ErrNotFound, errors.Cause(authorizer.Route("/pkg.Admin/", "missing")))
+	require.NoError(t, authorizer.Route("/pkg.Admin/", "deny"))
+	require.NoError(t, authorizer.Route("/pkg.Admin/Health", "tokens"))
+	interceptor := authorizer.UnaryServerInterceptor()
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+
+	_, err := interceptor(incoming("good"), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Admin/Delete"}, handler)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = interceptor(incoming("good"), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Admin/Health"}, handler)
+	require.NoError(t, err)
+	_, err = interceptor(incoming("good"), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}, handler)
+	require.NoError(t, err)
+}
+
+// fakeStream is a grpc.ServerStream with nothing but a context
+type fakeStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the stream's context
+func (f *fakeStream) Context() context.Context {
+	return f.ctx
+}
+
+// TestStreamServerInterceptor checks the stream's context is replaced and errors are returned
+func TestStreamServerInterceptor(t *testing.T) {
+	interceptor := New(newList(t, "tokens", tokenAuthFunc)).StreamServerInterceptor()
+	info := &grpc.StreamServerInfo{FullMethod: "/pkg.Service/Stream"}
+	called := false
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		_, ok := authdoor.InfoFromContext(stream.Context())
+		require.True(t, ok)
+		called = true
+		return nil
+	}
+	require.NoError(t, interceptor(nil, &fakeStream{ctx: incoming("good")}, info, handler))
+	require.True(t, called)
+
+	called = false
+	err := interceptor(nil, &fakeStream{ctx: incoming("bad")}, info, handler)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.False(t, called)
+}
@@ -0,0 +1,62 @@
+package authdoor
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Middleware returns a conventional func(http.Handler) http.Handler built from lists, for use in middleware chains and routers that take that signature.
+// Every handler it wraps gets its own AuthHandler subscribed to the lists, so calling UpdateHandlers on a list after changing it updates every wrapped handler.
+// Granted requests carry the instance's info in their context (see InfoFromContext). The lists are checked up front so a bad combination is an error here rather than at request time.
+func Middleware(lists ...*AuthFuncListTemplate) (func(http.Handler) http.Handler, error) {
+	defaultLogger.Info("Creating middleware")
+	probe, err := newMiddlewareHandler(nil, lists)
+	if err != nil {
+		return nil, err
+	}
+	probe.removeAllLists()
+	return func(next http.Handler) http.Handler {
+		handler, err := newMiddlewareHandler(next, lists)
+		if err != nil {
+			// The lists changed since Middleware was called- fail closed.
+			defaultLogger.Error("Couldn't build middleware: " + err.Error())
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			})
+		}
+		return handler
+	}, nil
+}
+
+// newMiddlewareHandler builds an AuthHandler around next with lists added and an active list built
+func newMiddlewareHandler(next http.Handler, lists []*AuthFuncListTemplate) (*AuthHandler, error) {
+	handler := new(AuthHandler)
+	if err := handler.Init(next); err != nil {
+		return nil, err
+	}
+	for _, list := range lists {
+		if err := handler.AddLists(list); err != nil {
+			handler.removeAllLists()
+			return nil, err
+		}
+	}
+	if err := handler.UpdateHandler(nil); err != nil {
+		handler.removeAllLists()
+		return nil, errors.Wrap(err, "couldn't combine lists")
+	}
+	return handler, nil
+}
+
+// removeAllLists unsubscribes the handler from every list added with AddLists
+func (h *AuthHandler) removeAllLists() {
+	names := make([]string, 0, len(h.componentsList))
+	h.componentMutex.Lock()
+	for name := range h.componentsList {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	h.componentMutex.Unlock()
+	h.RemoveLists(names...)
+}
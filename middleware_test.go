@@ -0,0 +1,75 @@
+package authdoor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// statusAuthFunc returns an AuthFunc that always returns auth, writing a 403 itself when it denies
+func statusAuthFunc(auth AuthStatus) AuthFunc {
+	return func(w http.ResponseWriter, r *http.Request) (AuthFuncReturn, error) {
+		if auth == AuthDenied {
+			w.WriteHeader(http.StatusForbidden)
+			return AuthFuncReturn{Auth: auth, Resp: Answered}, nil
+		}
+		return AuthFuncReturn{Auth: auth, Resp: Ignored}, nil
+	}
+}
+
+// newTemplate builds a one instance AuthFuncListTemplate
+func newTemplate(t *testing.T, name string, auth AuthStatus, priority int) *AuthFuncListTemplate {
+	instance := new(AuthFuncInstance)
+	instance.Init(name, statusAuthFunc(auth), priority, nil)
+	template := new(AuthFuncListTemplate)
+	require.NoError(t, template.Init(name, *instance))
+	return template
+}
+
+// TestMiddleware wraps a handler and makes sure the lists decide whether it's called, including after a hot update
+func TestMiddleware(t *testing.T) {
+	var info InstanceReturnInfo
+	var called bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		info, _ = InfoFromContext(r.Context())
+	})
+	deny := newTemplate(t, "deny", AuthDenied, 0)
+	middleware, err := Middleware(newTemplate(t, "grant", AuthGranted, 1), deny)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(deny.handlers)) // the probe unsubscribed
+	handler := middleware(next)
+	require.Equal(t, 1, len(deny.handlers))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	require.False(t, called)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	deny.RemoveInstances("deny")
+	deny.BlockForUpdate(deny.UpdateHandlers())
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	require.True(t, called)
+	require.Equal(t, "grant", info.Name())
+}
+
+// TestMiddlewareErrors makes sure bad list combinations are caught when the middleware is made
+func TestMiddlewareErrors(t *testing.T) {
+	first := newTemplate(t, "same", AuthGranted, 0)
+	_, err := Middleware(first, newTemplate(t, "same", AuthGranted, 0))
+	require.Equal(t, ErrNameTaken, errors.Cause(err))
+	require.Equal(t, 0, len(first.handlers))
+
+	instance := new(AuthFuncInstance)
+	instance.Init("same", statusAuthFunc(AuthGranted), 0, nil)
+	other := new(AuthFuncListTemplate)
+	require.NoError(t, other.Init("other", *instance))
+	_, err = Middleware(first, other)
+	require.Equal(t, ErrNameTaken, errors.Cause(err))
+	require.Equal(t, 0, len(first.handlers))
+	require.Equal(t, 0, len(other.handlers))
+}